@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyPrefix starts every API key so authMiddleware can tell keys from JWTs
+const apiKeyPrefix = "glbk_"
+
+// apiKeyTouchInterval limits how often last_used_at is written for a busy key
+const apiKeyTouchInterval = time.Minute
+
+var (
+	errAPIKeyRevoked = errors.New("api key revoked")
+	errAPIKeyExpired = errors.New("api key expired")
+)
+
+// APIKey is a long-lived credential a user creates for scripts. It acts as
+// its owner but only with the permissions in Scopes that the owner's role
+// still grants, and, when ArchiveID is set, only on models of that archive.
+type APIKey struct {
+	ID     uint   `json:"id"`
+	UserID uint   `json:"user_id"`
+	Name   string `json:"name"`
+	// Key is the plaintext secret. It is only filled in the response that
+	// creates the key; the store keeps KeyHash.
+	Key        string       `json:"key,omitempty"`
+	KeyHash    string       `json:"-"`
+	Hint       string       `json:"key_hint"` // last characters of the secret, for recognising it
+	Scopes     []Permission `json:"scopes"`
+	ArchiveID  uint         `json:"archive_id,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  *time.Time   `json:"expires_at"`
+	LastUsedAt *time.Time   `json:"last_used_at"`
+	RevokedAt  *time.Time   `json:"revoked_at"`
+}
+
+// usable reports why k can no longer authenticate, or nil
+func (k *APIKey) usable(now time.Time) error {
+	if k.RevokedAt != nil {
+		return errAPIKeyRevoked
+	}
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return errAPIKeyExpired
+	}
+	return nil
+}
+
+// allows reports whether p is one of the key's scopes
+func (k *APIKey) allows(p Permission) bool {
+	for _, s := range k.Scopes {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyArchive returns the archive the API key of the request is limited
+// to, or 0 when there is no key or it is not limited
+func apiKeyArchive(c *gin.Context) uint {
+	if v, ok := c.Get("api_key"); ok {
+		return v.(*APIKey).ArchiveID
+	}
+	return 0
+}
+
+// authenticateAPIKey resolves an API key to its owner and stamps its last use
+func (s *Server) authenticateAPIKey(secret string) (*User, *APIKey, error) {
+	key, err := s.store.GetAPIKeyByHash(hashToken(secret))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	if err := key.usable(now); err != nil {
+		return nil, nil, err
+	}
+	user, err := s.store.GetUserByID(key.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		if err := s.store.TouchAPIKey(key.ID, now); err != nil {
+			log.Printf("authenticateAPIKey: touch %d: %v", key.ID, err)
+		}
+	}
+	return user, key, nil
+}
+
+// requireSession rejects requests authenticated with an API key, for
+// endpoints that manage the account itself
+func (s *Server) requireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key"); ok {
+			c.JSON(403, gin.H{"error": "API keys cannot be used here"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ============ API KEY HANDLERS ============
+func (s *Server) listAPIKeysHandler(c *gin.Context) {
+	keys, err := s.store.ListAPIKeys(c.GetUint("user_id"))
+	if err != nil {
+		log.Printf("listAPIKeysHandler: list: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to list API keys"})
+		return
+	}
+	if keys == nil {
+		keys = []*APIKey{}
+	}
+
+	c.JSON(200, gin.H{"message": "API keys retrieved", "data": keys})
+}
+
+// createAPIKeyHandler issues a key for the caller. Scopes must be granted by
+// the caller's role; the secret is returned only in this response.
+func (s *Server) createAPIKeyHandler(c *gin.Context) {
+	var req struct {
+		Name      string       `json:"name" binding:"required"`
+		Scopes    []Permission `json:"scopes" binding:"required,min=1"`
+		ArchiveID uint         `json:"archive_id"`
+		ExpiresAt string       `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request; name and at least one scope are required"})
+		return
+	}
+	role := c.GetString("role")
+	for _, p := range req.Scopes {
+		if !hasPermission(role, p) {
+			c.JSON(400, ErrorResponse{Error: "Your role does not grant scope: " + string(p)})
+			return
+		}
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid expires_at; use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	if req.ArchiveID != 0 {
+		if _, err := s.store.GetArchiveByID(req.ArchiveID); err != nil {
+			c.JSON(404, ErrorResponse{Error: "Archive not found"})
+			return
+		}
+		if !hasPermission(role, PermArchivesManage) {
+			assigned, err := s.store.IsArchiveEditor(req.ArchiveID, c.GetUint("user_id"))
+			if err != nil {
+				log.Printf("createAPIKeyHandler: check editor: %v", err)
+				c.JSON(500, ErrorResponse{Error: "Failed to create API key"})
+				return
+			}
+			if !assigned {
+				c.JSON(403, ErrorResponse{Error: "You are not assigned to this archive"})
+				return
+			}
+		}
+	}
+
+	secret, err := generateRandomToken(24)
+	if err != nil {
+		c.JSON(500, ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+	secret = apiKeyPrefix + secret
+	key := &APIKey{
+		UserID:    c.GetUint("user_id"),
+		Name:      strings.TrimSpace(req.Name),
+		Key:       secret,
+		KeyHash:   hashToken(secret),
+		Hint:      tokenHint(secret),
+		Scopes:    req.Scopes,
+		ArchiveID: req.ArchiveID,
+		ExpiresAt: expiresAt,
+	}
+	if err := s.store.CreateAPIKey(key); err != nil {
+		log.Printf("createAPIKeyHandler: create: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to create API key"})
+		return
+	}
+
+	c.JSON(201, gin.H{"message": "API key created; copy it now, it is not shown again", "data": key})
+}
+
+// revokeAPIKeyHandler revokes one of the caller's keys; user managers may
+// revoke anyone's
+func (s *Server) revokeAPIKeyHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	key, err := s.store.GetAPIKey(req.ID)
+	if err != nil || (key.UserID != c.GetUint("user_id") && !can(c, PermUsersManage)) {
+		c.JSON(404, ErrorResponse{Error: "API key not found"})
+		return
+	}
+
+	if err := s.store.RevokeAPIKey(key.ID); err != nil {
+		log.Printf("revokeAPIKeyHandler: revoke %d: %v", key.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to revoke API key"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "API key revoked"})
+}
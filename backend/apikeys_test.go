@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// createAPIKey creates a key through the API and returns it with its secret
+func (ts *testServer) createAPIKey(token string, req gin.H) APIKey {
+	ts.t.Helper()
+	w := ts.do("POST", "/api/keys", token, req)
+	expectStatus(ts.t, w, 201)
+	var resp struct {
+		Data APIKey `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	key := ts.createAPIKey(admin, gin.H{"name": "ci", "scopes": []string{"models:upload"}})
+	if !strings.HasPrefix(key.Key, apiKeyPrefix) || key.Hint != tokenHint(key.Key) {
+		t.Fatalf("created key %+v", key)
+	}
+	stored, err := ts.store.GetAPIKey(key.ID)
+	if err != nil || stored.KeyHash != hashToken(key.Key) {
+		t.Fatalf("stored key %+v: %v", stored, err)
+	}
+
+	expectStatus(t, ts.do("GET", "/api/user/profile", key.Key, nil), 200)
+	// keys cannot manage keys or sessions
+	expectStatus(t, ts.do("GET", "/api/keys", key.Key, nil), 403)
+	expectStatus(t, ts.do("POST", "/api/auth/logout", key.Key, nil), 403)
+
+	w := ts.do("GET", "/api/keys", admin, nil)
+	var list struct {
+		Data []APIKey `json:"data"`
+	}
+	decodeJSON(t, w, &list)
+	if len(list.Data) != 1 || list.Data[0].Key != "" {
+		t.Fatalf("listed keys %+v", list.Data)
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/keys", admin, gin.H{"id": key.ID}), 200)
+	expectStatus(t, ts.do("GET", "/api/user/profile", key.Key, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/user/profile", apiKeyPrefix+"unknown", nil), 401)
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	editor := ts.userToken("editor@test.com", RoleEditor)
+	glb := testGLB(t, testCube())
+
+	// a key cannot hold more than its owner's role grants
+	expectStatus(t, ts.do("POST", "/api/keys", editor, gin.H{"name": "x", "scopes": []string{"models:delete"}}), 400)
+	expectStatus(t, ts.do("POST", "/api/keys", admin, gin.H{"name": "x", "scopes": []string{}}), 400)
+
+	key := ts.createAPIKey(admin, gin.H{"name": "ci", "scopes": []string{"models:upload"}})
+	id := ts.uploadModel(key.Key, "cube.glb", glb, nil)
+	if m, _ := ts.store.GetModelByID(id); m.UploadedBy == 0 {
+		t.Fatalf("model uploaded by %d", m.UploadedBy)
+	}
+	expectStatus(t, ts.do("DELETE", "/api/models", key.Key, gin.H{"id": id}), 403)
+	expectStatus(t, ts.do("GET", "/api/users", key.Key, nil), 403)
+
+	// a key loses what its owner's role loses
+	u, _ := ts.store.GetUserByEmail("admin@test.com")
+	ts.addUser("other@test.com", "secret123", RoleAdmin)
+	ts.store.UpdateUserRole(u.ID, RoleUser)
+	expectStatus(t, ts.upload(key.Key, map[string]string{"name": "cube"}, testFile{"file", "cube.glb", glb}), 403)
+}
+
+func TestAPIKeyLimitedToArchive(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	own, _ := ts.createArchive(admin, "ARSIP_001")
+	other, _ := ts.createArchive(admin, "ARSIP_002")
+	glb := testGLB(t, testCube())
+	inOwn := ts.uploadModel(admin, "own.glb", glb, map[string]string{"archive_id": fmt.Sprint(own)})
+	inOther := ts.uploadModel(admin, "other.glb", glb, map[string]string{"archive_id": fmt.Sprint(other)})
+	loose := ts.uploadModel(admin, "loose.glb", glb, nil)
+
+	key := ts.createAPIKey(admin, gin.H{"name": "ci", "scopes": []string{"models:upload", "models:delete"}, "archive_id": own})
+
+	// uploads default to the key's archive and go nowhere else
+	id := ts.uploadModel(key.Key, "new.glb", glb, nil)
+	if m, _ := ts.store.GetModelByID(id); m.ArchiveID != own {
+		t.Fatalf("key upload landed in archive %d", m.ArchiveID)
+	}
+	w := ts.upload(key.Key, map[string]string{"name": "x", "archive_id": fmt.Sprint(other)}, testFile{"file", "x.glb", glb})
+	expectStatus(t, w, 403)
+
+	for _, tc := range []struct {
+		model uint
+		want  int
+	}{{inOwn, 0}, {inOther, 403}, {loose, 403}} {
+		for _, r := range []struct{ method, target string }{
+			{"POST", "/api/models/thumbnail"},
+			{"POST", "/api/models/lods"},
+			{"POST", "/api/models/optimize"},
+			{"GET", fmt.Sprintf("/api/models/jobs?id=%d", tc.model)},
+		} {
+			var body interface{}
+			if r.method == "POST" {
+				body = gin.H{"id": tc.model}
+			}
+			w := ts.do(r.method, r.target, key.Key, body)
+			if tc.want == 0 && w.Code >= 300 || tc.want != 0 && w.Code != tc.want {
+				t.Errorf("%s %s on model %d: %d %s", r.method, r.target, tc.model, w.Code, w.Body)
+			}
+		}
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/models", key.Key, gin.H{"id": inOther}), 403)
+	expectStatus(t, ts.do("DELETE", "/api/models", key.Key, gin.H{"id": loose}), 403)
+	expectStatus(t, ts.do("DELETE", "/api/models", key.Key, gin.H{"id": inOwn}), 200)
+}
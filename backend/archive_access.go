@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	errArchiveTokenRotated = errors.New("archive token was rotated")
+	errArchiveTokenExpired = errors.New("archive token expired")
+	errArchiveTokenRevoked = errors.New("archive token revoked")
+)
+
+// ArchiveToken is one named access secret of an archive. Each client gets
+// its own token so access can be tracked and cut off individually. Only the
+// hash of the secret is stored; the plaintext is handed out once, in the
+// response that created or rotated it.
+type ArchiveToken struct {
+	ID         uint       `json:"id"`
+	ArchiveID  uint       `json:"archive_id"`
+	Name       string     `json:"name"` // e.g. "Client A reviewer"
+	Token      string     `json:"token,omitempty"`
+	TokenHash  string     `json:"-"`
+	Hint       string     `json:"token_hint"` // last characters of the secret, to tell tokens apart
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	MaxLogins  int        `json:"max_logins"` // 0 = unlimited
+	LoginCount int        `json:"login_count"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	Version    int        `json:"-"` // bumped on rotation; archive JWTs carry it
+}
+
+// tokenHint returns the part of a secret that may be shown after creation
+func tokenHint(secret string) string {
+	if len(secret) <= 4 {
+		return ""
+	}
+	return secret[len(secret)-4:]
+}
+
+// setSecret sets the plaintext secret together with its hash and hint
+func (t *ArchiveToken) setSecret(secret string) {
+	t.Token = secret
+	t.TokenHash = hashToken(secret)
+	t.Hint = tokenHint(secret)
+}
+
+// ArchiveClaims are carried by the JWTs issued by archive login. They use
+// their own audience so they can never pass for a user token.
+type ArchiveClaims struct {
+	ArchiveID   uint   `json:"archive_id"`
+	ArchiveName string `json:"archive_name"`
+	// TokenID and TokenVersion identify the archive token (and its rotation)
+	// the JWT was issued from
+	TokenID      uint `json:"atid"`
+	TokenVersion int  `json:"tv"`
+	jwt.RegisteredClaims
+}
+
+// usable reports why the token cannot be used at t, or nil if it can
+func (t *ArchiveToken) usable(now time.Time) error {
+	if t.RevokedAt != nil {
+		return errArchiveTokenRevoked
+	}
+	if t.ExpiresAt != nil && !now.Before(*t.ExpiresAt) {
+		return errArchiveTokenExpired
+	}
+	return nil
+}
+
+// parseExpiry accepts RFC3339 or a plain date; a plain date means access
+// ends after that whole day (UTC). An empty string means no expiry.
+func parseExpiry(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	d, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	end := d.Add(24 * time.Hour)
+	return &end, nil
+}
+
+// generateArchiveToken issues the JWT handed out by archive login. It never
+// outlives the archive token itself and records which token was used, at
+// which version, so revoking or rotating that token invalidates it.
+func (s *Server) generateArchiveToken(arch *Archive, tok *ArchiveToken) (string, error) {
+	exp := time.Now().Add(s.cfg.ArchiveTTL.Duration)
+	if tok.ExpiresAt != nil && tok.ExpiresAt.Before(exp) {
+		exp = *tok.ExpiresAt
+	}
+	return s.signClaims(ArchiveClaims{
+		ArchiveID:    arch.ID,
+		ArchiveName:  arch.Name,
+		TokenID:      tok.ID,
+		TokenVersion: tok.Version,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audienceArchive},
+			Subject:   "archive:" + strconv.FormatUint(uint64(arch.ID), 10),
+			ExpiresAt: jwt.NewNumericDate(exp),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+}
+
+// verifyArchiveToken accepts only JWTs issued by archive login
+func (s *Server) verifyArchiveToken(tokenString string) (*ArchiveClaims, error) {
+	claims := &ArchiveClaims{}
+	if err := s.parseClaims(tokenString, claims, audienceArchive); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// findArchiveToken returns the archive token whose secret is secret. This
+// stands in for a constant-time compare: only the SHA-256 of the secret is
+// ever compared, in the store's index lookup, so how long that takes can
+// reveal something about the hash but nothing about a secret that gives it.
+func (s *Server) findArchiveToken(secret string) (*ArchiveToken, error) {
+	return s.store.GetArchiveTokenByHash(hashToken(secret))
+}
+
+// currentArchive loads the archive an archive JWT was issued for and checks
+// the token it was issued from is still current
+func (s *Server) currentArchive(claims *ArchiveClaims) (*Archive, *ArchiveToken, error) {
+	tok, err := s.store.GetArchiveToken(claims.TokenID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok.ArchiveID != claims.ArchiveID || tok.Version != claims.TokenVersion {
+		return nil, nil, errArchiveTokenRotated
+	}
+	if err := tok.usable(time.Now()); err != nil {
+		return nil, nil, err
+	}
+	arch, err := s.store.GetArchiveByID(tok.ArchiveID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return arch, tok, nil
+}
+
+// importLegacyArchiveToken moves a plaintext token.txt left in an archive
+// folder into the store as a hashed token and deletes the file. The file is
+// kept if the import fails so the next start can retry.
+func importLegacyArchiveToken(store Store, arch *Archive, dir string) {
+	path := filepath.Join(dir, "token.txt")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: read %s: %v", path, err)
+		}
+		return
+	}
+
+	if secret := strings.TrimSpace(string(b)); secret != "" {
+		existing, err := store.GetArchiveTokenByHash(hashToken(secret))
+		switch {
+		case err == nil && existing.ArchiveID != arch.ID:
+			log.Printf("Warning: %s holds a token of another archive; leaving it in place", path)
+			return
+		case err == nil:
+			// already imported, e.g. by the hash migration
+		case errors.Is(err, ErrNotFound):
+			tok := &ArchiveToken{ArchiveID: arch.ID, Name: "Default"}
+			tok.setSecret(secret)
+			if err := store.CreateArchiveToken(tok); err != nil {
+				log.Printf("Warning: import %s: %v", path, err)
+				return
+			}
+		default:
+			log.Printf("Warning: import %s: %v", path, err)
+			return
+		}
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Printf("Warning: remove %s: %v", path, err)
+		return
+	}
+	log.Printf("Imported legacy token.txt of archive %s; the plaintext file was removed", arch.Name)
+}
+
+// ============ ARCHIVE TOKEN HANDLERS ============
+func (s *Server) listArchiveTokensHandler(c *gin.Context) {
+	archiveID, err := strconv.ParseUint(c.Query("archive_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid archive_id"})
+		return
+	}
+	tokens, err := s.store.ListArchiveTokens(uint(archiveID))
+	if err != nil {
+		log.Printf("listArchiveTokensHandler: list %d: %v", archiveID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to list tokens"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Archive tokens retrieved", "data": tokens})
+}
+
+func (s *Server) createArchiveTokenHandler(c *gin.Context) {
+	var req struct {
+		ArchiveID uint   `json:"archive_id" binding:"required"`
+		Name      string `json:"name" binding:"required"`
+		ExpiresAt string `json:"expires_at"`
+		MaxLogins int    `json:"max_logins" binding:"min=0"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid expires_at; use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	if _, err := s.store.GetArchiveByID(req.ArchiveID); err != nil {
+		c.JSON(404, ErrorResponse{Error: "Archive not found"})
+		return
+	}
+
+	secret, err := generateRandomToken(16)
+	if err != nil {
+		c.JSON(500, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+	tok := &ArchiveToken{
+		ArchiveID: req.ArchiveID,
+		Name:      req.Name,
+		ExpiresAt: expiresAt,
+		MaxLogins: req.MaxLogins,
+	}
+	tok.setSecret(secret)
+	if err := s.store.CreateArchiveToken(tok); err != nil {
+		log.Printf("createArchiveTokenHandler: create: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to create token"})
+		return
+	}
+
+	// the only time the secret is returned
+	c.JSON(201, gin.H{"message": "Archive token created", "data": tok})
+}
+
+// updateArchiveTokenHandler replaces the access policy of a token.
+// Omitting expires_at removes the expiry, omitting max_logins removes the cap.
+func (s *Server) updateArchiveTokenHandler(c *gin.Context) {
+	var req struct {
+		ID        uint   `json:"id" binding:"required"`
+		ExpiresAt string `json:"expires_at"`
+		MaxLogins int    `json:"max_logins" binding:"min=0"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	expiresAt, err := parseExpiry(req.ExpiresAt)
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid expires_at; use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+
+	tok, err := s.store.UpdateArchiveTokenAccess(req.ID, expiresAt, req.MaxLogins)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(404, ErrorResponse{Error: "Token not found"})
+			return
+		}
+		log.Printf("updateArchiveTokenHandler: update %d: %v", req.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to update token"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Archive token updated", "data": tok})
+}
+
+func (s *Server) rotateArchiveTokenHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	secret, err := generateRandomToken(16)
+	if err != nil {
+		c.JSON(500, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+	tok, err := s.store.RotateArchiveToken(req.ID, hashToken(secret), tokenHint(secret))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(404, ErrorResponse{Error: "Token not found"})
+			return
+		}
+		log.Printf("rotateArchiveTokenHandler: rotate %d: %v", req.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to rotate token"})
+		return
+	}
+
+	tok.Token = secret // shown once
+	c.JSON(200, gin.H{"message": "Archive token rotated", "data": tok})
+}
+
+func (s *Server) revokeArchiveTokenHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	if err := s.store.RevokeArchiveToken(req.ID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(404, ErrorResponse{Error: "Token not found"})
+			return
+		}
+		log.Printf("revokeArchiveTokenHandler: revoke %d: %v", req.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to revoke token"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Archive token revoked"})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// archiveTokens lists the tokens of an archive through the API
+func (ts *testServer) archiveTokens(adminToken string, archiveID uint) []ArchiveToken {
+	ts.t.Helper()
+	w := ts.do("GET", fmt.Sprintf("/api/archives/tokens?archive_id=%d", archiveID), adminToken, nil)
+	expectStatus(ts.t, w, 200)
+	var resp struct {
+		Data []ArchiveToken `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data
+}
+
+func archiveLoginStatus(ts *testServer, secret string) int {
+	return ts.do("POST", "/api/archives/login", "", gin.H{"token": secret}).Code
+}
+
+func TestArchiveTokenRotation(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	session := ts.archiveLogin(secret)
+	tok := ts.archiveTokens(admin, archID)[0]
+
+	w := ts.do("POST", "/api/archives/tokens/rotate", admin, gin.H{"id": tok.ID})
+	expectStatus(t, w, 200)
+	var resp struct {
+		Data ArchiveToken `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	if resp.Data.Token == "" || resp.Data.Token == secret || resp.Data.Hint != tokenHint(resp.Data.Token) {
+		t.Fatalf("rotated token %+v", resp.Data)
+	}
+
+	if code := archiveLoginStatus(ts, secret); code != 401 {
+		t.Fatalf("login with the old secret: %d", code)
+	}
+	// sessions opened with the old secret end with the rotation
+	expectStatus(t, ts.do("GET", "/api/models", session, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/models", ts.archiveLogin(resp.Data.Token), nil), 200)
+	expectStatus(t, ts.do("POST", "/api/archives/tokens/rotate", admin, gin.H{"id": tok.ID + 100}), 404)
+}
+
+func TestArchiveTokenExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	session := ts.archiveLogin(secret)
+	tok := ts.archiveTokens(admin, archID)[0]
+
+	expectStatus(t, ts.do("PUT", "/api/archives/tokens", admin, gin.H{"id": tok.ID, "expires_at": "not a date"}), 400)
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	expectStatus(t, ts.do("PUT", "/api/archives/tokens", admin, gin.H{"id": tok.ID, "expires_at": past}), 200)
+
+	w := ts.do("POST", "/api/archives/login", "", gin.H{"token": secret})
+	expectStatus(t, w, 401)
+	if msg := errorOf(t, w); msg != "Token expired" {
+		t.Fatalf("expired login answered %q", msg)
+	}
+	expectStatus(t, ts.do("GET", "/api/models", session, nil), 401)
+
+	// omitting expires_at lifts the expiry again
+	expectStatus(t, ts.do("PUT", "/api/archives/tokens", admin, gin.H{"id": tok.ID}), 200)
+	if code := archiveLoginStatus(ts, secret); code != 200 {
+		t.Fatalf("login after lifting the expiry: %d", code)
+	}
+}
+
+func TestArchiveTokenMaxLogins(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	tok := ts.archiveTokens(admin, archID)[0]
+	expectStatus(t, ts.do("PUT", "/api/archives/tokens", admin, gin.H{"id": tok.ID, "max_logins": 2}), 200)
+
+	for i := 0; i < 2; i++ {
+		if code := archiveLoginStatus(ts, secret); code != 200 {
+			t.Fatalf("login %d: %d", i+1, code)
+		}
+	}
+	if code := archiveLoginStatus(ts, secret); code != 403 {
+		t.Fatalf("login past the cap: %d", code)
+	}
+	if got := ts.archiveTokens(admin, archID)[0]; got.LoginCount != 2 || got.LastUsedAt == nil {
+		t.Fatalf("token after logins %+v", got)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	if e, err := parseExpiry(""); e != nil || err != nil {
+		t.Fatalf("empty: %v %v", e, err)
+	}
+	e, err := parseExpiry("2030-01-02")
+	if err != nil || !e.Equal(time.Date(2030, 1, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("plain date: %v %v", e, err)
+	}
+	if _, err := parseExpiry("tomorrow"); err == nil {
+		t.Fatal("bad expiry accepted")
+	}
+}
+
+func TestArchiveNamedTokens(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, defaultSecret := ts.createArchive(admin, "ARSIP_001")
+
+	expectStatus(t, ts.do("POST", "/api/archives/tokens", admin, gin.H{"archive_id": archID + 100, "name": "Client A"}), 404)
+	expectStatus(t, ts.do("POST", "/api/archives/tokens", admin, gin.H{"archive_id": archID}), 400)
+	w := ts.do("POST", "/api/archives/tokens", admin, gin.H{"archive_id": archID, "name": "Client A"})
+	expectStatus(t, w, 201)
+	var resp struct {
+		Data ArchiveToken `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	clientSecret := resp.Data.Token
+	if clientSecret == "" || clientSecret == defaultSecret {
+		t.Fatalf("created token %+v", resp.Data)
+	}
+
+	tokens := ts.archiveTokens(admin, archID)
+	if len(tokens) != 2 {
+		t.Fatalf("%d tokens", len(tokens))
+	}
+	for _, tok := range tokens {
+		if tok.Token != "" {
+			t.Fatalf("listing shows the secret of %q", tok.Name)
+		}
+	}
+
+	clientSession := ts.archiveLogin(clientSecret)
+	defaultSession := ts.archiveLogin(defaultSecret)
+	w = ts.do("POST", "/api/archives/login", "", gin.H{"token": clientSecret})
+	var login struct {
+		TokenName string `json:"token_name"`
+	}
+	decodeJSON(t, w, &login)
+	if login.TokenName != "Client A" {
+		t.Fatalf("login names token %q", login.TokenName)
+	}
+
+	// revoking one token leaves the others working
+	expectStatus(t, ts.do("DELETE", "/api/archives/tokens", admin, gin.H{"id": resp.Data.ID}), 200)
+	if code := archiveLoginStatus(ts, clientSecret); code != 401 {
+		t.Fatalf("login with revoked token: %d", code)
+	}
+	expectStatus(t, ts.do("GET", "/api/models", clientSession, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/models", defaultSession, nil), 200)
+	expectStatus(t, ts.do("DELETE", "/api/archives/tokens", admin, gin.H{"id": resp.Data.ID + 100}), 404)
+}
+
+func TestArchiveTokenManagementNeedsPermission(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	user := ts.userToken("user@test.com", RoleUser)
+	archID, _ := ts.createArchive(admin, "ARSIP_001")
+	expectStatus(t, ts.do("GET", fmt.Sprintf("/api/archives/tokens?archive_id=%d", archID), user, nil), 403)
+	expectStatus(t, ts.do("POST", "/api/archives/tokens", user, gin.H{"archive_id": archID, "name": "x"}), 403)
+}
+
+func TestArchiveTokensStoredHashed(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	tokens, err := ts.store.ListArchiveTokens(archID)
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("tokens: %v %d", err, len(tokens))
+	}
+	if tok := tokens[0]; tok.Token != "" || tok.TokenHash != hashToken(secret) || tok.Hint != tokenHint(secret) {
+		t.Fatalf("stored token %+v", tok)
+	}
+	if _, err := os.Stat(filepath.Join(ts.cfg.ArchiveRoot, "ARSIP_001", "token.txt")); !os.IsNotExist(err) {
+		t.Fatalf("token.txt written: %v", err)
+	}
+}
+
+func TestImportLegacyArchiveToken(t *testing.T) {
+	store := NewMemoryStore()
+	arch := &Archive{Name: "ARSIP_001"}
+	other := &Archive{Name: "ARSIP_002"}
+	store.CreateArchive(arch)
+	store.CreateArchive(other)
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "token.txt", []byte("legacy-secret\n"))
+
+	importLegacyArchiveToken(store, arch, dir)
+	tok, err := store.GetArchiveTokenByHash(hashToken("legacy-secret"))
+	if err != nil || tok.ArchiveID != arch.ID {
+		t.Fatalf("imported token: %v %+v", err, tok)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("token.txt kept: %v", err)
+	}
+
+	// a file holding another archive's secret is left alone
+	writeTestFile(t, dir, "token.txt", []byte("legacy-secret"))
+	importLegacyArchiveToken(store, other, dir)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("foreign token.txt removed: %v", err)
+	}
+	if tokens, _ := store.ListArchiveTokens(other.ID); len(tokens) != 0 {
+		t.Fatalf("foreign secret imported into %s", other.Name)
+	}
+}
+
+func TestArchiveAndUserTokensDoNotMix(t *testing.T) {
+	ts := newTestServer(t)
+	// user 1 and archive 1 share an id, as they did when archive tokens
+	// reused Claims.UserID
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	if archID != 1 {
+		t.Fatalf("archive id %d", archID)
+	}
+	archive := ts.archiveLogin(secret)
+
+	claims, err := ts.verifyArchiveToken(archive)
+	if err != nil || claims.ArchiveID != archID || claims.ArchiveName != "ARSIP_001" {
+		t.Fatalf("archive claims %+v: %v", claims, err)
+	}
+	if _, err := ts.verifyToken(archive); err == nil {
+		t.Fatal("archive token verified as a user token")
+	}
+	if _, err := ts.verifyArchiveToken(admin); err == nil {
+		t.Fatal("user token verified as an archive token")
+	}
+	expectStatus(t, ts.do("GET", "/api/user/profile", archive, nil), 403)
+	expectStatus(t, ts.upload(archive, map[string]string{"name": "x"}, testFile{"file", "x.glb", testGLB(t, testCube())}), 403)
+
+	// a token without an audience is neither
+	bare, _ := ts.signClaims(jwt.MapClaims{"user_id": 1, "role": RoleAdmin, "exp": time.Now().Add(time.Hour).Unix()})
+	expectStatus(t, ts.do("GET", "/api/user/profile", bare, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/models", bare, nil), 200) // public listing, unfiltered
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultJWTSecret is the placeholder secret shipped with the repo. The server
+// refuses to start with it unless running in development mode.
+const DefaultJWTSecret = "your-super-secret-key-change-in-production"
+
+// Config holds every runtime setting of the server. Values are resolved in
+// order: built-in defaults, then the JSON config file, then environment
+// variables.
+type Config struct {
+	Env           string   `json:"env"` // "development" or "production"
+	ListenAddr    string   `json:"listen_addr"`
+	JWTSecret     string   `json:"jwt_secret"`
+	TokenTTL      Duration `json:"token_ttl"` // access token lifetime
+	RefreshTTL    Duration `json:"refresh_token_ttl"`
+	ArchiveTTL    Duration `json:"archive_session_ttl"` // lifetime of JWTs issued by archive login
+	UploadDir     string   `json:"upload_dir"`
+	ArchiveRoot   string   `json:"archive_root"`
+	CORSOrigins   []string `json:"cors_origins"`
+	MaxUploadSize int64    `json:"max_upload_size"` // bytes
+	DBPath        string   `json:"db_path"`
+	StoreBackend  string   `json:"store_backend"` // "sqlite" or "memory"
+
+	// Resumable uploads are staged in UploadStagingDir until completed;
+	// an upload untouched for UploadExpiry is discarded
+	UploadStagingDir       string   `json:"upload_staging_dir"`
+	UploadExpiry           Duration `json:"upload_expiry"`
+	MaxResumableUploadSize int64    `json:"max_resumable_upload_size"` // bytes
+	// ThumbnailSize is the width and height in pixels of rendered previews
+	ThumbnailSize int `json:"thumbnail_size"`
+
+	// Post-upload processing runs as jobs on JobWorkers workers; a failed
+	// job is retried after JobRetryDelay, doubling each time, until it has
+	// run JobMaxAttempts times
+	JobWorkers     int      `json:"job_workers"`
+	JobMaxAttempts int      `json:"job_max_attempts"`
+	JobRetryDelay  Duration `json:"job_retry_delay"`
+	// OptimizeModels queues an optimized variant of every new model
+	OptimizeModels bool `json:"optimize_models"`
+	// Models with at least LODMinTriangles triangles get a simplified
+	// version for each of LODRatios, the share of triangles kept, from most
+	// to least detailed; no ratios turns LODs off
+	LODRatios       []float64 `json:"lod_ratios"`
+	LODMinTriangles int       `json:"lod_min_triangles"`
+	// Textures of optimized variants and LODs are scaled down to at most
+	// TextureMaxSize pixels on their longest edge (0 keeps the size).
+	// TextureFormat "jpeg" re-encodes opaque textures as JPEG at
+	// TextureJPEGQuality; "original" keeps each texture's format. WebP and
+	// KTX2 output waits for an encoder the build can carry, so those values
+	// are rejected rather than ignored.
+	TextureMaxSize     int    `json:"texture_max_size"`
+	TextureFormat      string `json:"texture_format"`
+	TextureJPEGQuality int    `json:"texture_jpeg_quality"`
+
+	// BootstrapAdminEmail names the account made admin on a start with no
+	// enabled admin. The password comes only from the environment; when it
+	// is not set a random one is generated and logged once.
+	BootstrapAdminEmail    string `json:"bootstrap_admin_email"`
+	BootstrapAdminPassword string `json:"-"`
+	// SeedTestUsers creates the well-known test accounts (admin@test.com
+	// and friends) on start; development only
+	SeedTestUsers bool `json:"seed_test_users"`
+
+	// AppURL is where the frontend is served; links in mails point there
+	AppURL           string   `json:"app_url"`
+	PasswordResetTTL Duration `json:"password_reset_ttl"`
+	MailBackend      string   `json:"mail_backend"` // "file" or "smtp"
+	MailDir          string   `json:"mail_dir"`     // outbox of the file mailer
+	MailFrom         string   `json:"mail_from"`
+	SMTPAddr         string   `json:"smtp_addr"` // host:port
+	SMTPUsername     string   `json:"smtp_username"`
+	SMTPPassword     string   `json:"-"`
+
+	// Failed logins allowed per account and per client IP before each
+	// further failure locks it, starting at LoginLockout and doubling up to
+	// LoginLockoutMax
+	LoginMaxFailures   int      `json:"login_max_failures"`
+	LoginIPMaxFailures int      `json:"login_ip_max_failures"`
+	LoginLockout       Duration `json:"login_lockout"`
+	LoginLockoutMax    Duration `json:"login_lockout_max"`
+	// TrustedProxies may set X-Forwarded-For; without any, the client IP
+	// is the address of the connection
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// OpenID Connect login is enabled when OIDCIssuer is set. OIDCRoleMap
+	// maps IdP groups to roles; users in no mapped group get
+	// OIDCDefaultRole, or are refused if it is empty.
+	OIDCIssuer       string            `json:"oidc_issuer"`
+	OIDCClientID     string            `json:"oidc_client_id"`
+	OIDCClientSecret string            `json:"-"`
+	OIDCRedirectURL  string            `json:"oidc_redirect_url"` // this server's /api/auth/oidc/callback
+	OIDCScopes       []string          `json:"oidc_scopes"`
+	OIDCGroupsClaim  string            `json:"oidc_groups_claim"`
+	OIDCRoleMap      map[string]string `json:"oidc_role_map"`
+	OIDCDefaultRole  string            `json:"oidc_default_role"`
+}
+
+// Duration is a time.Duration that reads from JSON as a string like "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// DefaultConfig returns the built-in settings used for anything not configured
+func DefaultConfig() Config {
+	return Config{
+		Env:           "development",
+		ListenAddr:    ":8080",
+		JWTSecret:     DefaultJWTSecret,
+		TokenTTL:      Duration{15 * time.Minute},
+		RefreshTTL:    Duration{30 * 24 * time.Hour},
+		ArchiveTTL:    Duration{24 * time.Hour},
+		UploadDir:     "uploads",
+		ArchiveRoot:   "model_archives",
+		CORSOrigins:   []string{"*"},
+		MaxUploadSize: 100 << 20, // 100MB
+		DBPath:        "./3d_db.db",
+		StoreBackend:  "sqlite",
+
+		UploadStagingDir:       "upload_staging",
+		UploadExpiry:           Duration{24 * time.Hour},
+		MaxResumableUploadSize: 4 << 30, // 4GB
+		ThumbnailSize:          256,
+		JobWorkers:             2,
+		JobMaxAttempts:         5,
+		JobRetryDelay:          Duration{30 * time.Second},
+		LODRatios:              []float64{0.5, 0.1},
+		LODMinTriangles:        100000,
+		TextureMaxSize:         2048,
+		TextureFormat:          "original",
+		TextureJPEGQuality:     85,
+
+		AppURL:           "http://localhost:5173",
+		PasswordResetTTL: Duration{time.Hour},
+		MailBackend:      "file",
+		MailDir:          "mail_outbox",
+		MailFrom:         "no-reply@localhost",
+
+		LoginMaxFailures:   5,
+		LoginIPMaxFailures: 20,
+		LoginLockout:       Duration{time.Minute},
+		LoginLockoutMax:    Duration{time.Hour},
+
+		OIDCRedirectURL: "http://localhost:8080/api/auth/oidc/callback",
+		OIDCScopes:      []string{"openid", "email", "profile"},
+		OIDCGroupsClaim: "groups",
+		OIDCDefaultRole: RoleUser,
+	}
+}
+
+// IsDev reports whether the server runs in development mode
+func (c Config) IsDev() bool {
+	return c.Env == "development"
+}
+
+// LoadConfig builds the configuration from the file at path (skipped when
+// path is empty or, for the default path, missing) and the environment.
+func LoadConfig(path string, explicit bool) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(b, &cfg); err != nil {
+				return cfg, fmt.Errorf("parse %s: %w", path, err)
+			}
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+			// optional default config file
+		default:
+			return cfg, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides settings from environment variables
+func (c *Config) applyEnv() error {
+	str := map[string]*string{
+		"BACKEND_ENV":    &c.Env,
+		"LISTEN_ADDR":    &c.ListenAddr,
+		"JWT_SECRET":     &c.JWTSecret,
+		"UPLOAD_DIR":     &c.UploadDir,
+		"ARCHIVE_DIR":    &c.ArchiveRoot,
+		"SQLITE_DB_PATH": &c.DBPath,
+		"STORE_BACKEND":  &c.StoreBackend,
+
+		"UPLOAD_STAGING_DIR": &c.UploadStagingDir,
+		"TEXTURE_FORMAT":     &c.TextureFormat,
+
+		"BOOTSTRAP_ADMIN_EMAIL":    &c.BootstrapAdminEmail,
+		"BOOTSTRAP_ADMIN_PASSWORD": &c.BootstrapAdminPassword,
+
+		"APP_URL":       &c.AppURL,
+		"MAIL_BACKEND":  &c.MailBackend,
+		"MAIL_DIR":      &c.MailDir,
+		"MAIL_FROM":     &c.MailFrom,
+		"SMTP_ADDR":     &c.SMTPAddr,
+		"SMTP_USERNAME": &c.SMTPUsername,
+		"SMTP_PASSWORD": &c.SMTPPassword,
+
+		"OIDC_ISSUER":        &c.OIDCIssuer,
+		"OIDC_CLIENT_ID":     &c.OIDCClientID,
+		"OIDC_CLIENT_SECRET": &c.OIDCClientSecret,
+		"OIDC_REDIRECT_URL":  &c.OIDCRedirectURL,
+		"OIDC_GROUPS_CLAIM":  &c.OIDCGroupsClaim,
+		"OIDC_DEFAULT_ROLE":  &c.OIDCDefaultRole,
+	}
+	for key, dst := range str {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = strings.TrimSpace(v)
+		}
+	}
+
+	durations := map[string]*Duration{
+		"JWT_EXPIRY":             &c.TokenTTL,
+		"REFRESH_TOKEN_EXPIRY":   &c.RefreshTTL,
+		"ARCHIVE_SESSION_EXPIRY": &c.ArchiveTTL,
+		"PASSWORD_RESET_EXPIRY":  &c.PasswordResetTTL,
+		"LOGIN_LOCKOUT":          &c.LoginLockout,
+		"LOGIN_LOCKOUT_MAX":      &c.LoginLockoutMax,
+		"UPLOAD_EXPIRY":          &c.UploadExpiry,
+		"JOB_RETRY_DELAY":        &c.JobRetryDelay,
+	}
+	for key, dst := range durations {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			dst.Duration = d
+		}
+	}
+	sizes := map[string]*int64{
+		"MAX_UPLOAD_SIZE":           &c.MaxUploadSize,
+		"MAX_RESUMABLE_UPLOAD_SIZE": &c.MaxResumableUploadSize,
+	}
+	for key, dst := range sizes {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = n
+		}
+	}
+	ints := map[string]*int{
+		"LOGIN_MAX_FAILURES":    &c.LoginMaxFailures,
+		"LOGIN_IP_MAX_FAILURES": &c.LoginIPMaxFailures,
+		"THUMBNAIL_SIZE":        &c.ThumbnailSize,
+		"JOB_WORKERS":           &c.JobWorkers,
+		"JOB_MAX_ATTEMPTS":      &c.JobMaxAttempts,
+		"LOD_MIN_TRIANGLES":     &c.LODMinTriangles,
+		"TEXTURE_MAX_SIZE":      &c.TextureMaxSize,
+		"TEXTURE_JPEG_QUALITY":  &c.TextureJPEGQuality,
+	}
+	for key, dst := range ints {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = n
+		}
+	}
+	bools := map[string]*bool{
+		"OPTIMIZE_MODELS": &c.OptimizeModels,
+		"SEED_TEST_USERS": &c.SeedTestUsers,
+	}
+	for key, dst := range bools {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = b
+		}
+	}
+	lists := map[string]*[]string{
+		"CORS_ALLOWED_ORIGINS": &c.CORSOrigins,
+		"TRUSTED_PROXIES":      &c.TrustedProxies,
+		"OIDC_SCOPES":          &c.OIDCScopes,
+	}
+	for key, dst := range lists {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = nil
+			for _, o := range strings.Split(v, ",") {
+				if o = strings.TrimSpace(o); o != "" {
+					*dst = append(*dst, o)
+				}
+			}
+		}
+	}
+	// LOD_RATIOS=0.5,0.1
+	if v, ok := os.LookupEnv("LOD_RATIOS"); ok {
+		c.LODRatios = []float64{}
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			r, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return fmt.Errorf("LOD_RATIOS: %w", err)
+			}
+			c.LODRatios = append(c.LODRatios, r)
+		}
+	}
+	// OIDC_ROLE_MAP=group=role,group2=role2
+	if v, ok := os.LookupEnv("OIDC_ROLE_MAP"); ok {
+		c.OIDCRoleMap = map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			group, role, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("OIDC_ROLE_MAP: %q is not group=role", pair)
+			}
+			c.OIDCRoleMap[strings.TrimSpace(group)] = strings.TrimSpace(role)
+		}
+	}
+	return nil
+}
+
+// OIDCEnabled reports whether OpenID Connect login is configured
+func (c Config) OIDCEnabled() bool {
+	return c.OIDCIssuer != ""
+}
+
+// Validate reports every invalid setting at once
+func (c Config) Validate() error {
+	var problems []string
+	switch c.Env {
+	case "development", "production":
+	default:
+		problems = append(problems, fmt.Sprintf("env must be \"development\" or \"production\", got %q", c.Env))
+	}
+	if c.ListenAddr == "" {
+		problems = append(problems, "listen_addr is required")
+	}
+	if c.JWTSecret == "" {
+		problems = append(problems, "jwt_secret is required")
+	} else if !c.IsDev() {
+		if c.JWTSecret == DefaultJWTSecret {
+			problems = append(problems, "jwt_secret is still the default placeholder; set JWT_SECRET")
+		} else if len(c.JWTSecret) < 32 {
+			problems = append(problems, "jwt_secret must be at least 32 characters outside development")
+		}
+	}
+	if c.TokenTTL.Duration <= 0 {
+		problems = append(problems, "token_ttl must be positive")
+	}
+	if c.RefreshTTL.Duration < c.TokenTTL.Duration {
+		problems = append(problems, "refresh_token_ttl must not be shorter than token_ttl")
+	}
+	if c.ArchiveTTL.Duration <= 0 {
+		problems = append(problems, "archive_session_ttl must be positive")
+	}
+	if c.UploadDir == "" {
+		problems = append(problems, "upload_dir is required")
+	}
+	if c.ArchiveRoot == "" {
+		problems = append(problems, "archive_root is required")
+	}
+	if len(c.CORSOrigins) == 0 {
+		problems = append(problems, "cors_origins must list at least one origin (or \"*\")")
+	}
+	if c.MaxUploadSize <= 0 {
+		problems = append(problems, "max_upload_size must be positive")
+	}
+	if c.UploadStagingDir == "" {
+		problems = append(problems, "upload_staging_dir is required")
+	}
+	if c.UploadExpiry.Duration <= 0 {
+		problems = append(problems, "upload_expiry must be positive")
+	}
+	if c.MaxResumableUploadSize <= 0 {
+		problems = append(problems, "max_resumable_upload_size must be positive")
+	}
+	if c.ThumbnailSize < 16 || c.ThumbnailSize > 2048 {
+		problems = append(problems, "thumbnail_size must be between 16 and 2048")
+	}
+	if c.JobWorkers < 1 {
+		problems = append(problems, "job_workers must be at least 1")
+	}
+	if c.JobMaxAttempts < 1 {
+		problems = append(problems, "job_max_attempts must be at least 1")
+	}
+	if c.JobRetryDelay.Duration <= 0 {
+		problems = append(problems, "job_retry_delay must be positive")
+	}
+	for i, r := range c.LODRatios {
+		if !(r > 0 && r < 1) || i > 0 && r >= c.LODRatios[i-1] {
+			problems = append(problems, "lod_ratios must be between 0 and 1 and decreasing, like [0.5, 0.1]")
+			break
+		}
+	}
+	if c.LODMinTriangles < 0 {
+		problems = append(problems, "lod_min_triangles must not be negative")
+	}
+	if c.TextureMaxSize < 0 {
+		problems = append(problems, "texture_max_size must not be negative")
+	}
+	switch c.TextureFormat {
+	case "original", "jpeg":
+	case "webp", "ktx2":
+		problems = append(problems, fmt.Sprintf("texture_format %q is not supported: the server has no %s encoder; use \"jpeg\" or \"original\"", c.TextureFormat, strings.ToUpper(c.TextureFormat)))
+	default:
+		problems = append(problems, fmt.Sprintf("texture_format must be \"original\" or \"jpeg\", got %q", c.TextureFormat))
+	}
+	if c.TextureJPEGQuality < 1 || c.TextureJPEGQuality > 100 {
+		problems = append(problems, "texture_jpeg_quality must be between 1 and 100")
+	}
+	switch c.StoreBackend {
+	case "sqlite":
+		if c.DBPath == "" {
+			problems = append(problems, "db_path is required for the sqlite store")
+		}
+	case "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("store_backend must be \"sqlite\" or \"memory\", got %q", c.StoreBackend))
+	}
+	if c.AppURL == "" {
+		problems = append(problems, "app_url is required")
+	}
+	if c.PasswordResetTTL.Duration <= 0 {
+		problems = append(problems, "password_reset_ttl must be positive")
+	}
+	if c.MailFrom == "" {
+		problems = append(problems, "mail_from is required")
+	}
+	switch c.MailBackend {
+	case "file":
+		if c.MailDir == "" {
+			problems = append(problems, "mail_dir is required for the file mailer")
+		}
+	case "smtp":
+		if c.SMTPAddr == "" {
+			problems = append(problems, "smtp_addr is required for the smtp mailer")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("mail_backend must be \"file\" or \"smtp\", got %q", c.MailBackend))
+	}
+	if c.LoginMaxFailures < 1 || c.LoginIPMaxFailures < 1 {
+		problems = append(problems, "login_max_failures and login_ip_max_failures must be at least 1")
+	}
+	if c.LoginLockout.Duration <= 0 || c.LoginLockoutMax.Duration < c.LoginLockout.Duration {
+		problems = append(problems, "login_lockout must be positive and login_lockout_max not shorter than it")
+	}
+	if c.OIDCEnabled() {
+		if c.OIDCClientID == "" || c.OIDCRedirectURL == "" {
+			problems = append(problems, "oidc_client_id and oidc_redirect_url are required when oidc_issuer is set")
+		}
+		if c.OIDCDefaultRole != "" && !validRole(c.OIDCDefaultRole) {
+			problems = append(problems, fmt.Sprintf("oidc_default_role %q is not a known role", c.OIDCDefaultRole))
+		}
+		for group, role := range c.OIDCRoleMap {
+			if !validRole(role) {
+				problems = append(problems, fmt.Sprintf("oidc_role_map maps %q to unknown role %q", group, role))
+			}
+		}
+	}
+	if c.SeedTestUsers && !c.IsDev() {
+		problems = append(problems, "seed_test_users creates accounts with published passwords and is only allowed in development")
+	}
+	if c.BootstrapAdminPassword != "" && len(c.BootstrapAdminPassword) < 8 {
+		problems = append(problems, "BOOTSTRAP_ADMIN_PASSWORD must be at least 8 characters")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(problems, "\n  - "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFileThenEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{"listen_addr": ":9000", "upload_dir": "from-file", "token_ttl": "5m", "cors_origins": ["http://a"]}`), 0644)
+	t.Setenv("UPLOAD_DIR", "from-env")
+	t.Setenv("JWT_EXPIRY", "10m")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "http://b, http://c")
+
+	cfg, err := LoadConfig(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":9000" {
+		t.Errorf("listen_addr %q, want the file value", cfg.ListenAddr)
+	}
+	if cfg.UploadDir != "from-env" || cfg.TokenTTL.Duration != 10*time.Minute {
+		t.Errorf("env did not win over the file: %q %v", cfg.UploadDir, cfg.TokenTTL)
+	}
+	if strings.Join(cfg.CORSOrigins, " ") != "http://b http://c" {
+		t.Errorf("cors origins %q", cfg.CORSOrigins)
+	}
+	if cfg.RefreshTTL != DefaultConfig().RefreshTTL {
+		t.Errorf("unset refresh ttl %v, want the default", cfg.RefreshTTL)
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.json")
+	if _, err := LoadConfig(path, false); err != nil {
+		t.Fatalf("optional default file: %v", err)
+	}
+	if _, err := LoadConfig(path, true); err == nil {
+		t.Fatal("explicit missing file was accepted")
+	}
+}
+
+func TestLoadConfigRejectsBadEnv(t *testing.T) {
+	t.Setenv("JWT_EXPIRY", "soon")
+	if _, err := LoadConfig("", false); err == nil || !strings.Contains(err.Error(), "JWT_EXPIRY") {
+		t.Fatalf("bad duration: %v", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Env = "staging"
+	cfg.ListenAddr = ""
+	cfg.MaxUploadSize = 0
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("invalid config accepted")
+	}
+	for _, want := range []string{"env must be", "listen_addr", "max_upload_size"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from %v", want, err)
+		}
+	}
+}
+
+func TestValidateProductionSecret(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Env = "production"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "jwt_secret") {
+		t.Fatalf("default secret in production: %v", err)
+	}
+	cfg.JWTSecret = "short"
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("short secret in production accepted")
+	}
+	cfg.JWTSecret = strings.Repeat("s", 32)
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigLODRatios(t *testing.T) {
+	t.Setenv("LOD_RATIOS", "0.4, 0.05")
+	cfg, err := LoadConfig("", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.LODRatios) != 2 || cfg.LODRatios[0] != 0.4 || cfg.LODRatios[1] != 0.05 {
+		t.Fatalf("lod ratios %v", cfg.LODRatios)
+	}
+	t.Setenv("LOD_RATIOS", "")
+	if cfg, err := LoadConfig("", false); err != nil || len(cfg.LODRatios) != 0 {
+		t.Fatalf("empty LOD_RATIOS: %v %v", cfg.LODRatios, err)
+	}
+
+	for _, v := range []string{"half", "0.1,0.5", "1.5", "0"} {
+		t.Setenv("LOD_RATIOS", v)
+		if _, err := LoadConfig("", false); err == nil || !strings.Contains(err.Error(), "LOD_RATIOS") && !strings.Contains(err.Error(), "lod_ratios") {
+			t.Errorf("LOD_RATIOS=%s: %v", v, err)
+		}
+	}
+}
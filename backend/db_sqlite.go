@@ -2,71 +2,1089 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
-var DB *sql.DB
+// SQLiteStore is the Store backed by a SQLite database file
+type SQLiteStore struct {
+	db *sql.DB
+}
 
-// InitDB opens the SQLite database at path (creates file if not exists)
-func InitDB(path string) error {
+// NewSQLiteStore opens the SQLite database at path (creates file if not exists)
+// and applies any pending schema migrations
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
 	dsn := fmt.Sprintf("%s?_foreign_keys=on", path)
 	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// verify
 	if err := db.Ping(); err != nil {
 		db.Close()
-		return err
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
 	}
-	DB = db
 	log.Printf("SQLite DB opened: %s", path)
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close closes the underlying database handle
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// translateErr maps driver errors onto the package sentinel errors
+func translateErr(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.ExtendedCode {
+		case sqlite3.ErrConstraintUnique:
+			return ErrConflict
+		case sqlite3.ErrConstraintForeignKey:
+			// the referenced row does not exist
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+// nullID stores a zero id as NULL so optional foreign keys stay valid
+func nullID(id uint) sql.NullInt64 {
+	if id == 0 {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(id), Valid: true}
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ============ USERS ============
+const userColumns = `id, email, password_hash, role, disabled_at, created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	var disabledAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Email, &u.PasswordHash, &u.Role, &disabledAt, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	if disabledAt.Valid {
+		u.DisabledAt = &disabledAt.Time
+	}
+	return &u, nil
+}
+
+// CreateUser inserts u and fills in its ID and timestamps
+func (s *SQLiteStore) CreateUser(u *User) error {
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO users (email, password_hash, role, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`,
+		u.Email, u.PasswordHash, u.Role, now, now)
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	u.ID = uint(id)
+	u.CreatedAt = now
+	u.UpdatedAt = now
 	return nil
 }
 
-// InsertModel inserts a model row and returns the inserted id
-func InsertModel(name, description, fileName, fileURL string, fileSize int64, archiveID, uploadedBy *int64) (int64, error) {
-	res, err := DB.Exec(`INSERT INTO models (name, description, file_name, file_url, file_size, archive_id, uploaded_by, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, name, description, fileName, fileURL, fileSize, archiveID, uploadedBy)
+// GetUserByID fetches a user by primary key
+func (s *SQLiteStore) GetUserByID(id uint) (*User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+// GetUserByEmail fetches a user by (unique) email
+func (s *SQLiteStore) GetUserByEmail(email string) (*User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+}
+
+// ListUsers returns all users ordered by id
+func (s *SQLiteStore) ListUsers() ([]*User, error) {
+	rows, err := s.db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY id`)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// UpdateUserRole changes the role of a user
+func (s *SQLiteStore) UpdateUserRole(id uint, role string) (*User, error) {
+	res, err := s.db.Exec(`UPDATE users SET role = ?, updated_at = ? WHERE id = ?`, role, time.Now().UTC(), id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetUserByID(id)
+}
+
+// SetUserDisabled disables (stamping disabled_at once) or re-enables a user
+func (s *SQLiteStore) SetUserDisabled(id uint, disabled bool) (*User, error) {
+	now := time.Now().UTC()
+	var disabledAt interface{}
+	if disabled {
+		disabledAt = now
+	}
+	res, err := s.db.Exec(`UPDATE users SET disabled_at = CASE WHEN ? THEN COALESCE(disabled_at, ?) END, updated_at = ? WHERE id = ?`,
+		disabled, disabledAt, now, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetUserByID(id)
+}
+
+// DeleteUser removes a user; sessions, API keys, pending uploads and archive
+// assignments go by cascade, uploaded models lose their uploader
+func (s *SQLiteStore) DeleteUser(id uint) error {
+	res, err := s.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CountEnabledUsers counts users with role that are not disabled
+func (s *SQLiteStore) CountEnabledUsers(role string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE role = ? AND disabled_at IS NULL`, role).Scan(&n)
+	return n, err
+}
+
+// UpdateUserPassword replaces the password hash of a user
+func (s *SQLiteStore) UpdateUserPassword(id uint, passwordHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, passwordHash, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetUserByIdentity fetches the user linked to an external login
+func (s *SQLiteStore) GetUserByIdentity(issuer, subject string) (*User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users
+		WHERE id = (SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?)`, issuer, subject))
+}
+
+// LinkUserIdentity records that an external login belongs to userID
+func (s *SQLiteStore) LinkUserIdentity(userID uint, issuer, subject string) error {
+	_, err := s.db.Exec(`INSERT INTO user_identities (issuer, subject, user_id, created_at) VALUES (?, ?, ?, ?)`,
+		issuer, subject, userID, time.Now().UTC())
+	return translateErr(err)
+}
+
+// ============ PASSWORD RESETS ============
+const passwordResetColumns = `token_hash, user_id, created_at, expires_at, used_at`
+
+func scanPasswordReset(row rowScanner) (*PasswordReset, error) {
+	var r PasswordReset
+	var usedAt sql.NullTime
+	if err := row.Scan(&r.TokenHash, &r.UserID, &r.CreatedAt, &r.ExpiresAt, &usedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	if usedAt.Valid {
+		r.UsedAt = &usedAt.Time
+	}
+	return &r, nil
+}
+
+// CreatePasswordReset inserts r and fills in its creation time
+func (s *SQLiteStore) CreatePasswordReset(r *PasswordReset) error {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		r.TokenHash, r.UserID, now, r.ExpiresAt.UTC()); err != nil {
+		return translateErr(err)
+	}
+	r.CreatedAt = now
+	return nil
+}
+
+// GetPasswordReset fetches a reset token by hash
+func (s *SQLiteStore) GetPasswordReset(hash string) (*PasswordReset, error) {
+	return scanPasswordReset(s.db.QueryRow(`SELECT `+passwordResetColumns+` FROM password_resets WHERE token_hash = ?`, hash))
+}
+
+// ConsumePasswordReset marks the token and the user's other pending tokens used
+func (s *SQLiteStore) ConsumePasswordReset(hash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	res, err := tx.Exec(`UPDATE password_resets SET used_at = ? WHERE token_hash = ? AND used_at IS NULL`, now, hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrConflict
+	}
+	if _, err := tx.Exec(`UPDATE password_resets SET used_at = ?
+		WHERE used_at IS NULL AND user_id = (SELECT user_id FROM password_resets WHERE token_hash = ?)`, now, hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ============ ARCHIVES ============
+const archiveColumns = `id, name, created_at`
+
+func scanArchive(row rowScanner) (*Archive, error) {
+	var a Archive
+	if err := row.Scan(&a.ID, &a.Name, &a.CreatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	return &a, nil
+}
+
+// nullTime stores a nil time as NULL
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// CreateArchive inserts a and fills in its ID and creation time
+func (s *SQLiteStore) CreateArchive(a *Archive) error {
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO archives (name, created_at) VALUES (?, ?)`, a.Name, now)
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	a.ID = uint(id)
+	a.CreatedAt = now
+	return nil
+}
+
+// GetArchiveByID fetches an archive by primary key
+func (s *SQLiteStore) GetArchiveByID(id uint) (*Archive, error) {
+	return scanArchive(s.db.QueryRow(`SELECT `+archiveColumns+` FROM archives WHERE id = ?`, id))
+}
+
+// GetArchiveByName fetches an archive by its folder name
+func (s *SQLiteStore) GetArchiveByName(name string) (*Archive, error) {
+	return scanArchive(s.db.QueryRow(`SELECT `+archiveColumns+` FROM archives WHERE name = ?`, name))
+}
+
+// ListArchives returns all archives ordered by id
+func (s *SQLiteStore) ListArchives() ([]*Archive, error) {
+	rows, err := s.db.Query(`SELECT ` + archiveColumns + ` FROM archives ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Archive
+	for rows.Next() {
+		a, err := scanArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// DeleteArchive removes an archive row; its models are removed by cascade
+func (s *SQLiteStore) DeleteArchive(id uint) error {
+	res, err := s.db.Exec(`DELETE FROM archives WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ============ ARCHIVE TOKENS ============
+const archiveTokenColumns = `id, archive_id, name, token_hash, token_hint, created_at, expires_at, max_logins, login_count, last_used_at, revoked_at, version`
+
+func scanArchiveToken(row rowScanner) (*ArchiveToken, error) {
+	var t ArchiveToken
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.ArchiveID, &t.Name, &t.TokenHash, &t.Hint, &t.CreatedAt, &expiresAt,
+		&t.MaxLogins, &t.LoginCount, &lastUsedAt, &revokedAt, &t.Version); err != nil {
+		return nil, translateErr(err)
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+	return &t, nil
+}
+
+// CreateArchiveToken inserts t and fills in its ID, creation time and version
+func (s *SQLiteStore) CreateArchiveToken(t *ArchiveToken) error {
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO archive_tokens (archive_id, name, token_hash, token_hint, created_at, expires_at, max_logins) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		t.ArchiveID, t.Name, t.TokenHash, t.Hint, now, nullTime(t.ExpiresAt), t.MaxLogins)
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	t.ID = uint(id)
+	t.CreatedAt = now
+	t.LoginCount = 0
+	t.Version = 1
+	return nil
+}
+
+// GetArchiveToken fetches an archive token by primary key
+func (s *SQLiteStore) GetArchiveToken(id uint) (*ArchiveToken, error) {
+	return scanArchiveToken(s.db.QueryRow(`SELECT `+archiveTokenColumns+` FROM archive_tokens WHERE id = ?`, id))
+}
+
+// GetArchiveTokenByHash fetches the archive token whose secret hashes to tokenHash
+func (s *SQLiteStore) GetArchiveTokenByHash(tokenHash string) (*ArchiveToken, error) {
+	return scanArchiveToken(s.db.QueryRow(`SELECT `+archiveTokenColumns+` FROM archive_tokens WHERE token_hash = ?`, tokenHash))
+}
+
+// ListArchiveTokens returns the tokens of an archive ordered by id
+func (s *SQLiteStore) ListArchiveTokens(archiveID uint) ([]*ArchiveToken, error) {
+	rows, err := s.db.Query(`SELECT `+archiveTokenColumns+` FROM archive_tokens WHERE archive_id = ? ORDER BY id`, archiveID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*ArchiveToken
+	for rows.Next() {
+		t, err := scanArchiveToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// RotateArchiveToken replaces the secret hash, bumps the version and resets the login count
+func (s *SQLiteStore) RotateArchiveToken(id uint, tokenHash, hint string) (*ArchiveToken, error) {
+	res, err := s.db.Exec(`UPDATE archive_tokens SET token_hash = ?, token_hint = ?, version = version + 1, login_count = 0 WHERE id = ?`,
+		tokenHash, hint, id)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetArchiveToken(id)
+}
+
+// UpdateArchiveTokenAccess sets the expiry (nil = never) and login cap (0 = unlimited)
+func (s *SQLiteStore) UpdateArchiveTokenAccess(id uint, expiresAt *time.Time, maxLogins int) (*ArchiveToken, error) {
+	res, err := s.db.Exec(`UPDATE archive_tokens SET expires_at = ?, max_logins = ? WHERE id = ?`, nullTime(expiresAt), maxLogins, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrNotFound
+	}
+	return s.GetArchiveToken(id)
+}
+
+// RevokeArchiveToken marks a token revoked; revoking twice is a no-op
+func (s *SQLiteStore) RevokeArchiveToken(id uint) error {
+	res, err := s.db.Exec(`UPDATE archive_tokens SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordArchiveTokenLogin counts a login and stamps last use, unless the cap is reached
+func (s *SQLiteStore) RecordArchiveTokenLogin(id uint) error {
+	res, err := s.db.Exec(`UPDATE archive_tokens SET login_count = login_count + 1, last_used_at = ?
+		WHERE id = ? AND (max_logins = 0 OR login_count < max_logins)`, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := s.GetArchiveToken(id); err != nil {
+			return err
+		}
+		return ErrLimitReached
+	}
+	return nil
+}
+
+// ============ ARCHIVE EDITORS ============
+// AssignArchiveEditor records that userID may upload into archiveID
+func (s *SQLiteStore) AssignArchiveEditor(archiveID, userID uint) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO archive_editors (archive_id, user_id, created_at) VALUES (?, ?, ?)`,
+		archiveID, userID, time.Now().UTC())
+	return translateErr(err)
+}
+
+// UnassignArchiveEditor removes an assignment
+func (s *SQLiteStore) UnassignArchiveEditor(archiveID, userID uint) error {
+	res, err := s.db.Exec(`DELETE FROM archive_editors WHERE archive_id = ? AND user_id = ?`, archiveID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListArchiveEditors returns the users assigned to an archive ordered by id
+func (s *SQLiteStore) ListArchiveEditors(archiveID uint) ([]*User, error) {
+	rows, err := s.db.Query(`SELECT `+userColumns+` FROM users
+		WHERE id IN (SELECT user_id FROM archive_editors WHERE archive_id = ?) ORDER BY id`, archiveID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// ListEditorArchives returns the archives a user is assigned to ordered by id
+func (s *SQLiteStore) ListEditorArchives(userID uint) ([]*Archive, error) {
+	rows, err := s.db.Query(`SELECT `+archiveColumns+` FROM archives
+		WHERE id IN (SELECT archive_id FROM archive_editors WHERE user_id = ?) ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Archive
+	for rows.Next() {
+		a, err := scanArchive(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// IsArchiveEditor reports whether userID is assigned to archiveID
+func (s *SQLiteStore) IsArchiveEditor(archiveID, userID uint) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM archive_editors WHERE archive_id = ? AND user_id = ?`, archiveID, userID).Scan(&n)
+	return n > 0, err
+}
+
+// ============ MODELS ============
+const modelColumns = `id, name, description, file_name, file_url, file_size, archive_id, uploaded_by, metadata, thumbnail_url, processing_status, optimized_url, optimized_size, lods, source_url, source_format, created_at, updated_at`
+
+func scanModel(row rowScanner) (*GLBModel, error) {
+	var m GLBModel
+	var archiveID, uploadedBy sql.NullInt64
+	var metadata sql.NullString
+	var lods string
+	if err := row.Scan(&m.ID, &m.Name, &m.Description, &m.FileName, &m.FileURL, &m.FileSize,
+		&archiveID, &uploadedBy, &metadata, &m.ThumbnailURL, &m.ProcessingStatus, &m.OptimizedURL, &m.OptimizedSize, &lods, &m.SourceURL, &m.SourceFormat, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	m.ArchiveID = uint(archiveID.Int64)
+	m.UploadedBy = uint(uploadedBy.Int64)
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &m.Metadata); err != nil {
+			log.Printf("scanModel: metadata of model %d: %v", m.ID, err)
+		}
+	}
+	if err := json.Unmarshal([]byte(lods), &m.LODs); err != nil {
+		log.Printf("scanModel: lods of model %d: %v", m.ID, err)
+	}
+	return &m, nil
+}
+
+// metadataJSON encodes model metadata for the metadata column; nil stays NULL
+func metadataJSON(md *ModelMetadata) (interface{}, error) {
+	if md == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// lodsJSON encodes LODs for the lods column, which is never NULL
+func lodsJSON(lods []ModelLOD) (string, error) {
+	if lods == nil {
+		lods = []ModelLOD{}
+	}
+	b, err := json.Marshal(lods)
+	return string(b), err
+}
+
+// CreateModel inserts m and fills in its ID and timestamps
+func (s *SQLiteStore) CreateModel(m *GLBModel) error {
+	metadata, err := metadataJSON(m.Metadata)
+	if err != nil {
+		return err
+	}
+	lods, err := lodsJSON(m.LODs)
+	if err != nil {
+		return err
+	}
+	if m.ProcessingStatus == "" {
+		m.ProcessingStatus = ProcessingReady
+	}
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO models (name, description, file_name, file_url, file_size, archive_id, uploaded_by, metadata, thumbnail_url, processing_status, optimized_url, optimized_size, lods, source_url, source_format, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Name, m.Description, m.FileName, m.FileURL, m.FileSize, nullID(m.ArchiveID), nullID(m.UploadedBy), metadata, m.ThumbnailURL, m.ProcessingStatus,
+		m.OptimizedURL, m.OptimizedSize, lods, m.SourceURL, m.SourceFormat, now, now)
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	m.ID = uint(id)
+	m.CreatedAt = now
+	m.UpdatedAt = now
+	return nil
+}
+
+// GetModelByID fetches a model by primary key
+func (s *SQLiteStore) GetModelByID(id uint) (*GLBModel, error) {
+	return scanModel(s.db.QueryRow(`SELECT `+modelColumns+` FROM models WHERE id = ?`, id))
+}
+
+// GetModelByFile fetches the model stored as fileName in the given archive
+// (archiveID 0 means the public uploads directory)
+func (s *SQLiteStore) GetModelByFile(fileName string, archiveID uint) (*GLBModel, error) {
+	return scanModel(s.db.QueryRow(`SELECT `+modelColumns+` FROM models WHERE file_name = ? AND archive_id IS ?`,
+		fileName, nullID(archiveID)))
+}
+
+// ListModels returns models ordered by id; archiveID 0 returns every model
+func (s *SQLiteStore) ListModels(archiveID uint) ([]*GLBModel, error) {
+	query := `SELECT ` + modelColumns + ` FROM models`
+	var args []interface{}
+	if archiveID != 0 {
+		query += ` WHERE archive_id = ?`
+		args = append(args, archiveID)
+	}
+	rows, err := s.db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*GLBModel
+	for rows.Next() {
+		m, err := scanModel(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// CountModels returns the number of models stored in an archive
+func (s *SQLiteStore) CountModels(archiveID uint) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM models WHERE archive_id = ?`, archiveID).Scan(&n)
+	return n, err
+}
+
+// DeleteModel removes a model row
+func (s *SQLiteStore) DeleteModel(id uint) error {
+	res, err := s.db.Exec(`DELETE FROM models WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetModelMetadata stores the metadata read from the model file
+func (s *SQLiteStore) SetModelMetadata(id uint, md *ModelMetadata) error {
+	metadata, err := metadataJSON(md)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`UPDATE models SET metadata = ?, updated_at = ? WHERE id = ?`, metadata, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetModelThumbnail records where the rendered preview of a model is served
+func (s *SQLiteStore) SetModelThumbnail(id uint, url string) error {
+	res, err := s.db.Exec(`UPDATE models SET thumbnail_url = ?, updated_at = ? WHERE id = ?`, url, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetModelProcessingStatus records how far the jobs of a model have come
+func (s *SQLiteStore) SetModelProcessingStatus(id uint, status string) error {
+	res, err := s.db.Exec(`UPDATE models SET processing_status = ?, updated_at = ? WHERE id = ?`, status, time.Now().UTC(), id)
+	if err != nil {
+		return err
 	}
-	return res.LastInsertId()
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetModelOptimized records where the optimized variant of a model is served
+func (s *SQLiteStore) SetModelOptimized(id uint, url string, size int64) error {
+	res, err := s.db.Exec(`UPDATE models SET optimized_url = ?, optimized_size = ?, updated_at = ? WHERE id = ?`, url, size, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-// GetModelRow fetches file_name, file_url and archive_id for a model id
-func GetModelRow(id int64) (fileName string, fileURL string, archiveID sql.NullInt64, err error) {
-	row := DB.QueryRow(`SELECT file_name, file_url, archive_id FROM models WHERE id = ?`, id)
-	var arch sql.NullInt64
-	if err = row.Scan(&fileName, &fileURL, &arch); err != nil {
-		return
+// SetModelLODs replaces the simplified versions of a model
+func (s *SQLiteStore) SetModelLODs(id uint, lods []ModelLOD) error {
+	data, err := lodsJSON(lods)
+	if err != nil {
+		return err
 	}
-	archiveID = arch
-	return
+	res, err := s.db.Exec(`UPDATE models SET lods = ?, updated_at = ? WHERE id = ?`, data, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
 }
 
-// DeleteModelByID deletes a model row and returns its file_name and archive_id (if any)
-func DeleteModelByID(id int64) (fileName string, archiveID sql.NullInt64, err error) {
-	// fetch first
-	row := DB.QueryRow(`SELECT file_name, archive_id FROM models WHERE id = ?`, id)
-	var arch sql.NullInt64
-	if err = row.Scan(&fileName, &arch); err != nil {
-		return
+// ============ SESSIONS ============
+const sessionColumns = `id, user_id, created_at, expires_at, revoked_at`
+
+func scanSession(row rowScanner) (*Session, error) {
+	var sess Session
+	var revokedAt sql.NullTime
+	if err := row.Scan(&sess.ID, &sess.UserID, &sess.CreatedAt, &sess.ExpiresAt, &revokedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	if revokedAt.Valid {
+		sess.RevokedAt = &revokedAt.Time
 	}
-	// delete
-	if _, err = DB.Exec(`DELETE FROM models WHERE id = ?`, id); err != nil {
-		return
+	return &sess, nil
+}
+
+// CreateSession inserts sess and fills in its creation time
+func (s *SQLiteStore) CreateSession(sess *Session) error {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`INSERT INTO sessions (id, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		sess.ID, sess.UserID, now, sess.ExpiresAt.UTC()); err != nil {
+		return translateErr(err)
 	}
-	archiveID = arch
-	return
+	sess.CreatedAt = now
+	return nil
 }
 
-// GetArchiveNameByID returns archive name for given id
-func GetArchiveNameByID(id int64) (string, error) {
-	var name string
-	err := DB.QueryRow(`SELECT name FROM archives WHERE id = ?`, id).Scan(&name)
-	return name, err
+// GetSession fetches a session by id
+func (s *SQLiteStore) GetSession(id string) (*Session, error) {
+	return scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+
+// ExtendSession moves the expiry of a session
+func (s *SQLiteStore) ExtendSession(id string, expiresAt time.Time) error {
+	res, err := s.db.Exec(`UPDATE sessions SET expires_at = ? WHERE id = ?`, expiresAt.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RevokeSession marks a session revoked; revoking twice is a no-op
+func (s *SQLiteStore) RevokeSession(id string) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now().UTC(), id)
+	return err
+}
+
+// RevokeUserSessions revokes every active session of a user
+func (s *SQLiteStore) RevokeUserSessions(userID uint) error {
+	_, err := s.db.Exec(`UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL`, time.Now().UTC(), userID)
+	return err
+}
+
+// CreateRefreshToken stores the hash of a newly issued refresh token
+func (s *SQLiteStore) CreateRefreshToken(t *RefreshToken) error {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)`,
+		t.TokenHash, t.SessionID, now); err != nil {
+		return translateErr(err)
+	}
+	t.CreatedAt = now
+	return nil
+}
+
+// GetRefreshToken fetches a refresh token by its hash
+func (s *SQLiteStore) GetRefreshToken(hash string) (*RefreshToken, error) {
+	var t RefreshToken
+	var usedAt sql.NullTime
+	err := s.db.QueryRow(`SELECT token_hash, session_id, created_at, used_at FROM refresh_tokens WHERE token_hash = ?`, hash).
+		Scan(&t.TokenHash, &t.SessionID, &t.CreatedAt, &usedAt)
+	if err != nil {
+		return nil, translateErr(err)
+	}
+	if usedAt.Valid {
+		t.UsedAt = &usedAt.Time
+	}
+	return &t, nil
+}
+
+// ConsumeRefreshToken marks a refresh token used, failing if it already was
+func (s *SQLiteStore) ConsumeRefreshToken(hash string) error {
+	res, err := s.db.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ? AND used_at IS NULL`, time.Now().UTC(), hash)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+// ============ API KEYS ============
+const apiKeyColumns = `id, user_id, name, key_hash, key_hint, scopes, archive_id, created_at, expires_at, last_used_at, revoked_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	var k APIKey
+	var scopes string
+	var archiveID sql.NullInt64
+	var expiresAt, lastUsedAt, revokedAt sql.NullTime
+	if err := row.Scan(&k.ID, &k.UserID, &k.Name, &k.KeyHash, &k.Hint, &scopes, &archiveID, &k.CreatedAt,
+		&expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	for _, p := range strings.Split(scopes, ",") {
+		if p != "" {
+			k.Scopes = append(k.Scopes, Permission(p))
+		}
+	}
+	k.ArchiveID = uint(archiveID.Int64)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return &k, nil
+}
+
+// CreateAPIKey inserts k and fills in its ID and creation time
+func (s *SQLiteStore) CreateAPIKey(k *APIKey) error {
+	scopes := make([]string, len(k.Scopes))
+	for i, p := range k.Scopes {
+		scopes[i] = string(p)
+	}
+	archiveID := sql.NullInt64{Int64: int64(k.ArchiveID), Valid: k.ArchiveID != 0}
+	now := time.Now().UTC()
+	res, err := s.db.Exec(`INSERT INTO api_keys (user_id, name, key_hash, key_hint, scopes, archive_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.UserID, k.Name, k.KeyHash, k.Hint, strings.Join(scopes, ","), archiveID, now, nullTime(k.ExpiresAt))
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	k.ID = uint(id)
+	k.CreatedAt = now
+	return nil
+}
+
+// GetAPIKey fetches an API key by primary key
+func (s *SQLiteStore) GetAPIKey(id uint) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+// GetAPIKeyByHash fetches the API key whose secret hashes to keyHash
+func (s *SQLiteStore) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	return scanAPIKey(s.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+}
+
+// ListAPIKeys returns the keys of a user ordered by id
+func (s *SQLiteStore) ListAPIKeys(userID uint) ([]*APIKey, error) {
+	rows, err := s.db.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+// RevokeAPIKey marks a key revoked; revoking twice is a no-op
+func (s *SQLiteStore) RevokeAPIKey(id uint) error {
+	res, err := s.db.Exec(`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?) WHERE id = ?`, time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TouchAPIKey records the last use of a key
+func (s *SQLiteStore) TouchAPIKey(id uint, at time.Time) error {
+	_, err := s.db.Exec(`UPDATE api_keys SET last_used_at = ? WHERE id = ?`, at.UTC(), id)
+	return err
+}
+
+// ============ UPLOADS ============
+const uploadColumns = `id, user_id, name, description, archive_id, file_name, size, sha256, upload_offset, created_at, expires_at`
+
+func scanUpload(row rowScanner) (*Upload, error) {
+	var u Upload
+	var archiveID sql.NullInt64
+	if err := row.Scan(&u.ID, &u.UserID, &u.Name, &u.Description, &archiveID, &u.FileName, &u.Size, &u.SHA256,
+		&u.Offset, &u.CreatedAt, &u.ExpiresAt); err != nil {
+		return nil, translateErr(err)
+	}
+	u.ArchiveID = uint(archiveID.Int64)
+	return &u, nil
+}
+
+// CreateUpload inserts u and fills in its creation time
+func (s *SQLiteStore) CreateUpload(u *Upload) error {
+	archiveID := sql.NullInt64{Int64: int64(u.ArchiveID), Valid: u.ArchiveID != 0}
+	now := time.Now().UTC()
+	_, err := s.db.Exec(`INSERT INTO uploads (`+uploadColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.ID, u.UserID, u.Name, u.Description, archiveID, u.FileName, u.Size, u.SHA256, u.Offset, now, u.ExpiresAt.UTC())
+	if err != nil {
+		return translateErr(err)
+	}
+	u.CreatedAt = now
+	return nil
+}
+
+// GetUpload fetches a pending upload by id
+func (s *SQLiteStore) GetUpload(id string) (*Upload, error) {
+	return scanUpload(s.db.QueryRow(`SELECT `+uploadColumns+` FROM uploads WHERE id = ?`, id))
+}
+
+// SetUploadOffset records the staged size of an upload and its new expiry
+func (s *SQLiteStore) SetUploadOffset(id string, offset int64, expiresAt time.Time) error {
+	res, err := s.db.Exec(`UPDATE uploads SET upload_offset = ?, expires_at = ? WHERE id = ?`, offset, expiresAt.UTC(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUpload removes a pending upload
+func (s *SQLiteStore) DeleteUpload(id string) error {
+	res, err := s.db.Exec(`DELETE FROM uploads WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListExpiredUploads returns the uploads that expired before now
+func (s *SQLiteStore) ListExpiredUploads(now time.Time) ([]*Upload, error) {
+	rows, err := s.db.Query(`SELECT `+uploadColumns+` FROM uploads WHERE expires_at < ? ORDER BY expires_at`, now.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Upload
+	for rows.Next() {
+		u, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// ============ JOBS ============
+const jobColumns = `id, model_id, kind, status, attempts, max_attempts, last_error, run_at, created_at, updated_at`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	if err := row.Scan(&j.ID, &j.ModelID, &j.Kind, &j.Status, &j.Attempts, &j.MaxAttempts, &j.LastError,
+		&j.RunAt, &j.CreatedAt, &j.UpdatedAt); err != nil {
+		return nil, translateErr(err)
+	}
+	return &j, nil
+}
+
+// CreateJob inserts j as queued and fills in its ID and timestamps
+func (s *SQLiteStore) CreateJob(j *Job) error {
+	now := time.Now().UTC()
+	if j.RunAt.IsZero() {
+		j.RunAt = now
+	}
+	res, err := s.db.Exec(`INSERT INTO jobs (model_id, kind, status, attempts, max_attempts, last_error, run_at, created_at, updated_at)
+		VALUES (?, ?, ?, 0, ?, '', ?, ?, ?)`, j.ModelID, j.Kind, JobQueued, j.MaxAttempts, j.RunAt.UTC(), now, now)
+	if err != nil {
+		return translateErr(err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	j.ID = uint(id)
+	j.Status = JobQueued
+	j.Attempts = 0
+	j.LastError = ""
+	j.CreatedAt = now
+	j.UpdatedAt = now
+	return nil
+}
+
+// GetJob fetches a job by primary key
+func (s *SQLiteStore) GetJob(id uint) (*Job, error) {
+	return scanJob(s.db.QueryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+}
+
+// ListModelJobs returns the jobs of a model ordered by id
+func (s *SQLiteStore) ListModelJobs(modelID uint) ([]*Job, error) {
+	rows, err := s.db.Query(`SELECT `+jobColumns+` FROM jobs WHERE model_id = ? ORDER BY id`, modelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []*Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// ClaimJob marks the queued job due first as running in a single statement,
+// so concurrent workers never claim the same job
+func (s *SQLiteStore) ClaimJob(now time.Time) (*Job, error) {
+	now = now.UTC()
+	return scanJob(s.db.QueryRow(`UPDATE jobs SET status = ?, attempts = attempts + 1, updated_at = ?
+		WHERE id = (SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, id LIMIT 1)
+		RETURNING `+jobColumns, JobRunning, now, JobQueued, now))
+}
+
+// FinishJob records the outcome of a running job
+func (s *SQLiteStore) FinishJob(id uint, status, lastError string, runAt time.Time) error {
+	res, err := s.db.Exec(`UPDATE jobs SET status = ?, last_error = ?, run_at = ?, updated_at = ? WHERE id = ?`,
+		status, lastError, runAt.UTC(), time.Now().UTC(), id)
+	if err != nil {
+		return translateErr(err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RequeueRunningJobs puts every running job back in the queue. A job with a
+// newer queued or running job of the same kind is dropped instead.
+func (s *SQLiteStore) RequeueRunningJobs() (int, error) {
+	now := time.Now().UTC()
+	if _, err := s.db.Exec(`UPDATE jobs SET status = ?, last_error = 'superseded by a newer job', updated_at = ?
+		WHERE status = ? AND EXISTS (SELECT 1 FROM jobs q WHERE q.model_id = jobs.model_id AND q.kind = jobs.kind
+			AND (q.status = ? OR (q.status = ? AND q.id > jobs.id)))`,
+		JobFailed, now, JobRunning, JobQueued, JobRunning); err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`UPDATE jobs SET status = ?, run_at = ?, updated_at = ? WHERE status = ?`, JobQueued, now, now, JobRunning)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
 }
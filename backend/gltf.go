@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// GLB container constants from the glTF 2.0 spec
+const (
+	glbMagic     = 0x46546C67 // "glTF"
+	glbChunkJSON = 0x4E4F534A // "JSON"
+	glbChunkBIN  = 0x004E4942 // "BIN\0"
+	glbHeaderLen = 12
+)
+
+// accessor component types
+const (
+	gltfByte          = 5120
+	gltfUnsignedByte  = 5121
+	gltfShort         = 5122
+	gltfUnsignedShort = 5123
+	gltfUnsignedInt   = 5125
+	gltfFloat         = 5126
+)
+
+// GLTF is the JSON part of a glTF 2.0 asset. Extensions and extras are
+// carried through untouched. Required indices that are missing decode as -1
+// so validation can tell them from index 0.
+type GLTF struct {
+	Asset              GLTFAsset                  `json:"asset"`
+	ExtensionsUsed     []string                   `json:"extensionsUsed,omitempty"`
+	ExtensionsRequired []string                   `json:"extensionsRequired,omitempty"`
+	Scene              *int                       `json:"scene,omitempty"`
+	Scenes             []GLTFScene                `json:"scenes,omitempty"`
+	Nodes              []GLTFNode                 `json:"nodes,omitempty"`
+	Meshes             []GLTFMesh                 `json:"meshes,omitempty"`
+	Accessors          []GLTFAccessor             `json:"accessors,omitempty"`
+	BufferViews        []GLTFBufferView           `json:"bufferViews,omitempty"`
+	Buffers            []GLTFBuffer               `json:"buffers,omitempty"`
+	Materials          []GLTFMaterial             `json:"materials,omitempty"`
+	Textures           []GLTFTexture              `json:"textures,omitempty"`
+	Images             []GLTFImage                `json:"images,omitempty"`
+	Samplers           []GLTFSampler              `json:"samplers,omitempty"`
+	Skins              []GLTFSkin                 `json:"skins,omitempty"`
+	Animations         []GLTFAnimation            `json:"animations,omitempty"`
+	Cameras            []GLTFCamera               `json:"cameras,omitempty"`
+	Extensions         map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras             json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFAsset struct {
+	Version    string                     `json:"version"`
+	MinVersion string                     `json:"minVersion,omitempty"`
+	Generator  string                     `json:"generator,omitempty"`
+	Copyright  string                     `json:"copyright,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFScene struct {
+	Name       string                     `json:"name,omitempty"`
+	Nodes      []int                      `json:"nodes,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFNode struct {
+	Name        string                     `json:"name,omitempty"`
+	Children    []int                      `json:"children,omitempty"`
+	Mesh        *int                       `json:"mesh,omitempty"`
+	Camera      *int                       `json:"camera,omitempty"`
+	Skin        *int                       `json:"skin,omitempty"`
+	Matrix      []float64                  `json:"matrix,omitempty"`
+	Translation []float64                  `json:"translation,omitempty"`
+	Rotation    []float64                  `json:"rotation,omitempty"`
+	Scale       []float64                  `json:"scale,omitempty"`
+	Weights     []float64                  `json:"weights,omitempty"`
+	Extensions  map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras      json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFMesh struct {
+	Name       string                     `json:"name,omitempty"`
+	Primitives []GLTFPrimitive            `json:"primitives"`
+	Weights    []float64                  `json:"weights,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFPrimitive struct {
+	Attributes map[string]int             `json:"attributes"`
+	Indices    *int                       `json:"indices,omitempty"`
+	Material   *int                       `json:"material,omitempty"`
+	Mode       *int                       `json:"mode,omitempty"` // 4 (triangles) when absent
+	Targets    []map[string]int           `json:"targets,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFAccessor struct {
+	Name          string                     `json:"name,omitempty"`
+	BufferView    *int                       `json:"bufferView,omitempty"`
+	ByteOffset    int                        `json:"byteOffset,omitempty"`
+	ComponentType int                        `json:"componentType"`
+	Normalized    bool                       `json:"normalized,omitempty"`
+	Count         int                        `json:"count"`
+	Type          string                     `json:"type"`
+	Min           []float64                  `json:"min,omitempty"`
+	Max           []float64                  `json:"max,omitempty"`
+	Sparse        *GLTFSparse                `json:"sparse,omitempty"`
+	Extensions    map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras        json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFSparse struct {
+	Count   int `json:"count"`
+	Indices struct {
+		BufferView    int `json:"bufferView"`
+		ByteOffset    int `json:"byteOffset,omitempty"`
+		ComponentType int `json:"componentType"`
+	} `json:"indices"`
+	Values struct {
+		BufferView int `json:"bufferView"`
+		ByteOffset int `json:"byteOffset,omitempty"`
+	} `json:"values"`
+}
+
+func (s *GLTFSparse) UnmarshalJSON(b []byte) error {
+	type plain GLTFSparse
+	p := plain{}
+	p.Indices.BufferView, p.Values.BufferView = -1, -1
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*s = GLTFSparse(p)
+	return nil
+}
+
+type GLTFBufferView struct {
+	Name       string                     `json:"name,omitempty"`
+	Buffer     int                        `json:"buffer"`
+	ByteOffset int                        `json:"byteOffset,omitempty"`
+	ByteLength int                        `json:"byteLength"`
+	ByteStride int                        `json:"byteStride,omitempty"`
+	Target     int                        `json:"target,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+func (v *GLTFBufferView) UnmarshalJSON(b []byte) error {
+	type plain GLTFBufferView
+	p := plain{Buffer: -1}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*v = GLTFBufferView(p)
+	return nil
+}
+
+type GLTFBuffer struct {
+	Name       string                     `json:"name,omitempty"`
+	URI        string                     `json:"uri,omitempty"`
+	ByteLength int                        `json:"byteLength"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFMaterial struct {
+	Name                 string                     `json:"name,omitempty"`
+	PBRMetallicRoughness *GLTFPBR                   `json:"pbrMetallicRoughness,omitempty"`
+	NormalTexture        *GLTFTextureInfo           `json:"normalTexture,omitempty"`
+	OcclusionTexture     *GLTFTextureInfo           `json:"occlusionTexture,omitempty"`
+	EmissiveTexture      *GLTFTextureInfo           `json:"emissiveTexture,omitempty"`
+	EmissiveFactor       []float64                  `json:"emissiveFactor,omitempty"`
+	AlphaMode            string                     `json:"alphaMode,omitempty"`
+	AlphaCutoff          *float64                   `json:"alphaCutoff,omitempty"`
+	DoubleSided          bool                       `json:"doubleSided,omitempty"`
+	Extensions           map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras               json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFPBR struct {
+	BaseColorFactor          []float64                  `json:"baseColorFactor,omitempty"`
+	BaseColorTexture         *GLTFTextureInfo           `json:"baseColorTexture,omitempty"`
+	MetallicFactor           *float64                   `json:"metallicFactor,omitempty"`
+	RoughnessFactor          *float64                   `json:"roughnessFactor,omitempty"`
+	MetallicRoughnessTexture *GLTFTextureInfo           `json:"metallicRoughnessTexture,omitempty"`
+	Extensions               map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras                   json.RawMessage            `json:"extras,omitempty"`
+}
+
+// GLTFTextureInfo references a texture from a material; Scale only applies
+// to normal textures and Strength to occlusion textures
+type GLTFTextureInfo struct {
+	Index      int                        `json:"index"`
+	TexCoord   int                        `json:"texCoord,omitempty"`
+	Scale      *float64                   `json:"scale,omitempty"`
+	Strength   *float64                   `json:"strength,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+func (t *GLTFTextureInfo) UnmarshalJSON(b []byte) error {
+	type plain GLTFTextureInfo
+	p := plain{Index: -1}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*t = GLTFTextureInfo(p)
+	return nil
+}
+
+type GLTFTexture struct {
+	Name       string                     `json:"name,omitempty"`
+	Sampler    *int                       `json:"sampler,omitempty"`
+	Source     *int                       `json:"source,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFImage struct {
+	Name       string                     `json:"name,omitempty"`
+	URI        string                     `json:"uri,omitempty"`
+	MimeType   string                     `json:"mimeType,omitempty"`
+	BufferView *int                       `json:"bufferView,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFSampler struct {
+	Name       string                     `json:"name,omitempty"`
+	MagFilter  int                        `json:"magFilter,omitempty"`
+	MinFilter  int                        `json:"minFilter,omitempty"`
+	WrapS      int                        `json:"wrapS,omitempty"`
+	WrapT      int                        `json:"wrapT,omitempty"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFSkin struct {
+	Name                string                     `json:"name,omitempty"`
+	InverseBindMatrices *int                       `json:"inverseBindMatrices,omitempty"`
+	Skeleton            *int                       `json:"skeleton,omitempty"`
+	Joints              []int                      `json:"joints"`
+	Extensions          map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras              json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFAnimation struct {
+	Name       string                     `json:"name,omitempty"`
+	Channels   []GLTFChannel              `json:"channels"`
+	Samplers   []GLTFAnimationSampler     `json:"samplers"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+type GLTFChannel struct {
+	Sampler int `json:"sampler"`
+	Target  struct {
+		Node *int   `json:"node,omitempty"`
+		Path string `json:"path"`
+	} `json:"target"`
+	Extensions map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras     json.RawMessage            `json:"extras,omitempty"`
+}
+
+func (ch *GLTFChannel) UnmarshalJSON(b []byte) error {
+	type plain GLTFChannel
+	p := plain{Sampler: -1}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*ch = GLTFChannel(p)
+	return nil
+}
+
+type GLTFAnimationSampler struct {
+	Input         int                        `json:"input"`
+	Output        int                        `json:"output"`
+	Interpolation string                     `json:"interpolation,omitempty"` // LINEAR when absent
+	Extensions    map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras        json.RawMessage            `json:"extras,omitempty"`
+}
+
+func (s *GLTFAnimationSampler) UnmarshalJSON(b []byte) error {
+	type plain GLTFAnimationSampler
+	p := plain{Input: -1, Output: -1}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*s = GLTFAnimationSampler(p)
+	return nil
+}
+
+type GLTFCamera struct {
+	Name         string                     `json:"name,omitempty"`
+	Type         string                     `json:"type"`
+	Perspective  json.RawMessage            `json:"perspective,omitempty"`
+	Orthographic json.RawMessage            `json:"orthographic,omitempty"`
+	Extensions   map[string]json.RawMessage `json:"extensions,omitempty"`
+	Extras       json.RawMessage            `json:"extras,omitempty"`
+}
+
+// gltfAsset is a parsed .glb or .gltf file together with the bytes of each
+// buffer that could be resolved; Data[i] is nil for a buffer whose bytes are
+// not available. URIErrs[i] says why external buffer i could not be opened.
+type gltfAsset struct {
+	Doc     *GLTF
+	Data    []io.ReaderAt
+	URIErrs []error
+	resolve gltfResolver
+}
+
+// componentSize returns the byte size of an accessor component type, or 0
+func componentSize(componentType int) int {
+	switch componentType {
+	case gltfByte, gltfUnsignedByte:
+		return 1
+	case gltfShort, gltfUnsignedShort:
+		return 2
+	case gltfUnsignedInt, gltfFloat:
+		return 4
+	}
+	return 0
+}
+
+// componentCount returns the number of components of an accessor type, or 0
+func componentCount(typ string) int {
+	switch typ {
+	case "SCALAR":
+		return 1
+	case "VEC2":
+		return 2
+	case "VEC3":
+		return 3
+	case "VEC4", "MAT2":
+		return 4
+	case "MAT3":
+		return 9
+	case "MAT4":
+		return 16
+	}
+	return 0
+}
+
+// elementSize is the byte size of one accessor element. Matrix columns
+// start on 4-byte boundaries, which pads MAT2/MAT3 of small components.
+func elementSize(componentType int, typ string) int {
+	size := componentSize(componentType)
+	switch {
+	case typ == "MAT2" && size == 1:
+		return 8
+	case typ == "MAT3" && size == 1:
+		return 12
+	case typ == "MAT3" && size == 2:
+		return 24
+	}
+	return size * componentCount(typ)
+}
+
+// decodeDataURI decodes a base64 data: URI, returning its media type
+func decodeDataURI(uri string) ([]byte, string, error) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return nil, "", errors.New("not a data URI")
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok || !strings.HasSuffix(meta, ";base64") {
+		return nil, "", errors.New("only base64 data URIs are supported")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid base64: %w", err)
+	}
+	return data, strings.TrimSuffix(meta, ";base64"), nil
+}
+
+// parseGLB splits a GLB container into its JSON chunk and the section of r
+// holding the BIN chunk, if any
+func parseGLB(r io.ReaderAt, size int64) ([]byte, *io.SectionReader, []GLTFError) {
+	var header [glbHeaderLen]byte
+	if size < glbHeaderLen {
+		return nil, nil, []GLTFError{{Message: "file is too short to be a GLB"}}
+	}
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return nil, nil, []GLTFError{{Message: "cannot read GLB header"}}
+	}
+	if binary.LittleEndian.Uint32(header[0:]) != glbMagic {
+		return nil, nil, []GLTFError{{Message: "missing GLB magic \"glTF\"; the file is not a binary glTF"}}
+	}
+	if v := binary.LittleEndian.Uint32(header[4:]); v != 2 {
+		return nil, nil, []GLTFError{{Message: fmt.Sprintf("GLB version %d is not supported; only version 2 is", v)}}
+	}
+	if length := int64(binary.LittleEndian.Uint32(header[8:])); length != size {
+		return nil, nil, []GLTFError{{Message: fmt.Sprintf("GLB header declares %d bytes but the file has %d; it may be truncated", length, size)}}
+	}
+
+	var jsonChunk []byte
+	var bin *io.SectionReader
+	var errs []GLTFError
+	for offset, n := int64(glbHeaderLen), 0; offset < size; n++ {
+		var chunk [8]byte
+		if size-offset < 8 {
+			errs = append(errs, GLTFError{Message: fmt.Sprintf("trailing %d bytes after the last chunk", size-offset)})
+			break
+		}
+		if _, err := r.ReadAt(chunk[:], offset); err != nil {
+			errs = append(errs, GLTFError{Message: "cannot read chunk header"})
+			break
+		}
+		length := int64(binary.LittleEndian.Uint32(chunk[0:]))
+		typ := binary.LittleEndian.Uint32(chunk[4:])
+		start := offset + 8
+		if length > size-start {
+			errs = append(errs, GLTFError{Message: fmt.Sprintf("chunk %d declares %d bytes but only %d remain; the file may be truncated", n, length, size-start)})
+			break
+		}
+		if length%4 != 0 {
+			errs = append(errs, GLTFError{Message: fmt.Sprintf("chunk %d length %d is not a multiple of 4", n, length)})
+		}
+		switch {
+		case n == 0 && typ != glbChunkJSON:
+			return nil, nil, append(errs, GLTFError{Message: "first GLB chunk is not JSON"})
+		case n == 0:
+			jsonChunk = make([]byte, length)
+			if _, err := r.ReadAt(jsonChunk, start); err != nil {
+				return nil, nil, append(errs, GLTFError{Message: "cannot read JSON chunk"})
+			}
+		case typ == glbChunkBIN && n == 1:
+			bin = io.NewSectionReader(r, start, length)
+		case typ == glbChunkBIN:
+			errs = append(errs, GLTFError{Message: "a BIN chunk may only follow the JSON chunk"})
+		}
+		offset = start + length
+	}
+	if jsonChunk == nil && len(errs) == 0 {
+		errs = append(errs, GLTFError{Message: "GLB has no JSON chunk"})
+	}
+	return jsonChunk, bin, errs
+}
+
+// encodeGLB writes doc and its BIN chunk as a GLB container
+func encodeGLB(doc *GLTF, bin []byte) ([]byte, error) {
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	for len(js)%4 != 0 {
+		js = append(js, ' ')
+	}
+	for len(bin)%4 != 0 {
+		bin = append(bin, 0)
+	}
+	total := glbHeaderLen + 8 + len(js)
+	if len(bin) > 0 {
+		total += 8 + len(bin)
+	}
+	out := make([]byte, 0, total)
+	out = binary.LittleEndian.AppendUint32(out, glbMagic)
+	out = binary.LittleEndian.AppendUint32(out, 2)
+	out = binary.LittleEndian.AppendUint32(out, uint32(total))
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(js)))
+	out = binary.LittleEndian.AppendUint32(out, glbChunkJSON)
+	out = append(out, js...)
+	if len(bin) > 0 {
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(bin)))
+		out = binary.LittleEndian.AppendUint32(out, glbChunkBIN)
+		out = append(out, bin...)
+	}
+	return out, nil
+}
+
+// decodeGLTFJSON parses the glTF JSON, describing a failure as a GLTFError
+func decodeGLTFJSON(data []byte) (*GLTF, []GLTFError) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // tolerate a BOM
+	var doc GLTF
+	if err := json.Unmarshal(data, &doc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &typeErr):
+			return nil, []GLTFError{{
+				Pointer: "/" + strings.ReplaceAll(typeErr.Field, ".", "/"),
+				Message: fmt.Sprintf("expected %s, got JSON %s", typeErr.Type, typeErr.Value),
+			}}
+		case errors.As(err, &syntaxErr):
+			return nil, []GLTFError{{Message: fmt.Sprintf("invalid JSON at byte %d: %v", syntaxErr.Offset, err)}}
+		}
+		return nil, []GLTFError{{Message: "invalid JSON: " + err.Error()}}
+	}
+	return &doc, nil
+}
+
+// openGLTF parses a .glb or .gltf file of size bytes read from r. Buffers
+// stored in the GLB BIN chunk or in data URIs are resolved, external ones
+// through resolve when it is not nil, and EXT_meshopt_compression fallback
+// buffers are decoded on first read; others are left nil. It only fails
+// for files that cannot be parsed at all; use validateGLTF to check the
+// content.
+func openGLTF(r io.ReaderAt, size int64, ext string, resolve gltfResolver) (*gltfAsset, []GLTFError) {
+	var jsonData []byte
+	var bin *io.SectionReader
+	if ext == ".glb" {
+		var errs []GLTFError
+		jsonData, bin, errs = parseGLB(r, size)
+		if len(errs) > 0 {
+			return nil, errs
+		}
+	} else {
+		jsonData = make([]byte, size)
+		if _, err := r.ReadAt(jsonData, 0); err != nil && !errors.Is(err, io.EOF) {
+			return nil, []GLTFError{{Message: "cannot read file"}}
+		}
+	}
+
+	doc, errs := decodeGLTFJSON(jsonData)
+	if doc == nil {
+		return nil, errs
+	}
+	asset := &gltfAsset{
+		Doc:     doc,
+		Data:    make([]io.ReaderAt, len(doc.Buffers)),
+		URIErrs: make([]error, len(doc.Buffers)),
+		resolve: resolve,
+	}
+	for i, b := range doc.Buffers {
+		switch {
+		case b.URI == "" && i == 0 && bin != nil:
+			asset.Data[i] = bin
+		case strings.HasPrefix(b.URI, "data:"):
+			if data, _, err := decodeDataURI(b.URI); err == nil {
+				asset.Data[i] = bytes.NewReader(data)
+			}
+		case b.URI != "" && resolve != nil:
+			if f, err := resolve(b.URI); err != nil {
+				asset.URIErrs[i] = err
+			} else {
+				asset.Data[i] = f
+			}
+		}
+	}
+	asset.attachMeshopt()
+	return asset, nil
+}
+
+// imageKind sniffs the image formats glTF allows: "png", "jpeg", "webp"
+// (EXT_texture_webp) and "ktx2" (KHR_texture_basisu). It returns "" for
+// anything else.
+func imageKind(r io.ReaderAt) string {
+	head := make([]byte, 12)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return "jpeg"
+	case len(head) == 12 && string(head[:4]) == "RIFF" && string(head[8:]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(head, []byte("\xABKTX 20\xBB\r\n\x1a\n")):
+		return "ktx2"
+	}
+	return ""
+}
+
+// dataSize returns the number of bytes available for buffer i, or -1 if its
+// bytes are not resolved
+func (a *gltfAsset) dataSize(i int) int64 {
+	switch d := a.Data[i].(type) {
+	case *io.SectionReader:
+		return d.Size()
+	case *bytes.Reader:
+		return d.Size()
+	case *meshoptBuffer:
+		return d.size
+	case nil:
+		return -1
+	}
+	return -1
+}
+
+// spanFits reports whether count elements of elemSize bytes, stride bytes
+// apart and starting at offset, end within limit bytes. Counts and offsets
+// come from the file, so it divides instead of multiplying to stay clear of
+// overflow.
+func spanFits(offset, count, elemSize, stride int, limit int64) bool {
+	if offset < 0 || count < 0 || elemSize < 1 || stride < 1 {
+		return false
+	}
+	if count == 0 {
+		return int64(offset) <= limit
+	}
+	room := limit - int64(offset) - int64(elemSize)
+	return room >= 0 && int64(count-1) <= room/int64(stride)
+}
+
+// accessorBytes reads the elements of a plain accessor, elemSize bytes
+// each, with the stride of its buffer view. The elements must lie within
+// the buffer view and the bytes of its buffer, so a file that was never
+// validated cannot ask for more memory than it holds.
+func (a *gltfAsset) accessorBytes(acc GLTFAccessor, elemSize int) ([]byte, int, error) {
+	if acc.BufferView == nil || acc.Sparse != nil {
+		return nil, 0, errors.New("accessor has no plain buffer view")
+	}
+	if *acc.BufferView < 0 || *acc.BufferView >= len(a.Doc.BufferViews) {
+		return nil, 0, errors.New("accessor buffer view does not exist")
+	}
+	bv := a.Doc.BufferViews[*acc.BufferView]
+	if bv.Buffer < 0 || bv.Buffer >= len(a.Data) || a.Data[bv.Buffer] == nil {
+		return nil, 0, errors.New("buffer bytes are not available")
+	}
+	stride := bv.ByteStride
+	if stride == 0 {
+		stride = elemSize
+	}
+	if !spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, a.dataSize(bv.Buffer)) ||
+		!spanFits(acc.ByteOffset, acc.Count, elemSize, stride, int64(bv.ByteLength)) {
+		return nil, 0, errors.New("accessor lies outside its buffer")
+	}
+	if acc.Count == 0 {
+		return nil, stride, nil
+	}
+	raw := make([]byte, stride*(acc.Count-1)+elemSize)
+	if _, err := a.Data[bv.Buffer].ReadAt(raw, int64(bv.ByteOffset+acc.ByteOffset)); err != nil {
+		return nil, 0, err
+	}
+	return raw, stride, nil
+}
+
+// readIndices returns the values of a scalar unsigned integer accessor that
+// is backed by a buffer view
+func (a *gltfAsset) readIndices(i int) ([]uint32, error) {
+	acc := a.Doc.Accessors[i]
+	size := componentSize(acc.ComponentType)
+	if size == 0 {
+		return nil, errors.New("accessor is not an unsigned integer type")
+	}
+	raw, stride, err := a.accessorBytes(acc, size)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]uint32, acc.Count)
+	for n := range out {
+		p := raw[n*stride:]
+		switch acc.ComponentType {
+		case gltfUnsignedByte:
+			out[n] = uint32(p[0])
+		case gltfUnsignedShort:
+			out[n] = uint32(binary.LittleEndian.Uint16(p))
+		case gltfUnsignedInt:
+			out[n] = binary.LittleEndian.Uint32(p)
+		default:
+			return nil, errors.New("accessor is not an unsigned integer type")
+		}
+	}
+	return out, nil
+}
+
+// readFloats returns the components of an accessor that is backed by a
+// buffer view as floats, componentCount(acc.Type) per element. Integers
+// that are not normalized keep their value, as KHR_mesh_quantization
+// allows. Matrix padding and sparse substitution are not supported.
+func (a *gltfAsset) readFloats(i int) ([]float64, error) {
+	acc := a.Doc.Accessors[i]
+	if strings.HasPrefix(acc.Type, "MAT") {
+		return nil, errors.New("matrix accessors are not supported")
+	}
+	n := componentCount(acc.Type)
+	size := componentSize(acc.ComponentType)
+	if n == 0 || size == 0 {
+		return nil, errors.New("unsupported accessor type")
+	}
+	raw, stride, err := a.accessorBytes(acc, size*n)
+	if err != nil || acc.Count == 0 {
+		return nil, err
+	}
+	out := make([]float64, acc.Count*n)
+	for e := 0; e < acc.Count; e++ {
+		for c := 0; c < n; c++ {
+			p := raw[e*stride+c*size:]
+			var v float64
+			// normalized integers map to [0,1] or [-1,1]
+			switch {
+			case acc.ComponentType == gltfFloat:
+				v = float64(math.Float32frombits(binary.LittleEndian.Uint32(p)))
+			case !acc.Normalized && acc.ComponentType == gltfByte:
+				v = float64(int8(p[0]))
+			case !acc.Normalized && acc.ComponentType == gltfUnsignedByte:
+				v = float64(p[0])
+			case !acc.Normalized && acc.ComponentType == gltfShort:
+				v = float64(int16(binary.LittleEndian.Uint16(p)))
+			case !acc.Normalized && acc.ComponentType == gltfUnsignedShort:
+				v = float64(binary.LittleEndian.Uint16(p))
+			case acc.ComponentType == gltfByte:
+				v = math.Max(float64(int8(p[0]))/127, -1)
+			case acc.ComponentType == gltfUnsignedByte:
+				v = float64(p[0]) / 255
+			case acc.ComponentType == gltfShort:
+				v = math.Max(float64(int16(binary.LittleEndian.Uint16(p)))/32767, -1)
+			case acc.ComponentType == gltfUnsignedShort:
+				v = float64(binary.LittleEndian.Uint16(p)) / 65535
+			default:
+				return nil, errors.New("unsupported component type")
+			}
+			out[e*n+c] = v
+		}
+	}
+	return out, nil
+}
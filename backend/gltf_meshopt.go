@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// ============ EXT_meshopt_compression ============
+
+// The vertex codec (version 0) and index sequence codec (version 1) of
+// meshoptimizer, which EXT_meshopt_compression stores buffer views with.
+// Loaders decode them with the meshoptimizer decoder; three.js ships it as
+// MeshoptDecoder.
+
+const meshoptExtension = "EXT_meshopt_compression"
+
+const (
+	meshoptVertexHeader   = 0xa0 // vertex codec, version 0
+	meshoptSequenceHeader = 0xd0 // index sequence codec; the low bits are the version
+	meshoptTailSize       = 32   // minimum tail of a vertex stream
+	meshoptGroupSize      = 16   // bytes packed together in a vertex stream
+	meshoptMaxRatio       = 64   // most vertex bytes one compressed byte can hold
+)
+
+// meshoptView is the EXT_meshopt_compression object of a buffer view: where
+// its compressed bytes are and how to decode them into the view
+type meshoptView struct {
+	Buffer     int    `json:"buffer"`
+	ByteOffset int    `json:"byteOffset,omitempty"`
+	ByteLength int    `json:"byteLength"`
+	ByteStride int    `json:"byteStride"`
+	Count      int    `json:"count"`
+	Mode       string `json:"mode"`
+	Filter     string `json:"filter,omitempty"`
+}
+
+// meshoptViewOf returns the EXT_meshopt_compression object of bv, or nil
+// if it has none. A missing buffer decodes as -1.
+func meshoptViewOf(bv GLTFBufferView) (*meshoptView, error) {
+	raw, ok := bv.Extensions[meshoptExtension]
+	if !ok {
+		return nil, nil
+	}
+	m := meshoptView{Buffer: -1}
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// isMeshoptFallback reports whether buffer b only stands in for the
+// decoded bytes of compressed buffer views
+func isMeshoptFallback(b GLTFBuffer) bool {
+	var ext struct {
+		Fallback bool `json:"fallback"`
+	}
+	raw, ok := b.Extensions[meshoptExtension]
+	return ok && json.Unmarshal(raw, &ext) == nil && ext.Fallback
+}
+
+// meshoptProblem checks the EXT_meshopt_compression object m of buffer view
+// bv and describes the first problem, or returns ""
+func (a *gltfAsset) meshoptProblem(bv GLTFBufferView, m *meshoptView) string {
+	bufs := a.Doc.Buffers
+	switch {
+	case m.Buffer < 0 || m.Buffer >= len(bufs):
+		return fmt.Sprintf("buffer %d does not exist", m.Buffer)
+	case isMeshoptFallback(bufs[m.Buffer]):
+		return fmt.Sprintf("buffer %d is a fallback buffer and holds no compressed data", m.Buffer)
+	case m.ByteLength < 1 || !spanFits(m.ByteOffset, m.ByteLength, 1, 1, int64(bufs[m.Buffer].ByteLength)):
+		return fmt.Sprintf("%d compressed bytes at offset %d lie outside buffer %d of %d bytes", m.ByteLength, m.ByteOffset, m.Buffer, bufs[m.Buffer].ByteLength)
+	case m.Count < 1:
+		return "count must be at least 1"
+	}
+	switch m.Mode {
+	case "ATTRIBUTES":
+		if m.ByteStride < 4 || m.ByteStride > 256 || m.ByteStride%4 != 0 {
+			return fmt.Sprintf("byteStride %d must be a multiple of 4 up to 256", m.ByteStride)
+		}
+		if bv.ByteStride != 0 && bv.ByteStride != m.ByteStride {
+			return fmt.Sprintf("byteStride %d differs from the byteStride %d of the buffer view", m.ByteStride, bv.ByteStride)
+		}
+	case "TRIANGLES", "INDICES":
+		if m.ByteStride != 2 && m.ByteStride != 4 {
+			return fmt.Sprintf("byteStride %d must be 2 or 4 for %s", m.ByteStride, m.Mode)
+		}
+		if m.Mode == "TRIANGLES" && m.Count%3 != 0 {
+			return fmt.Sprintf("count %d is not a multiple of 3", m.Count)
+		}
+	default:
+		return fmt.Sprintf("mode %q is not ATTRIBUTES, TRIANGLES or INDICES", m.Mode)
+	}
+	switch m.Filter {
+	case "", "NONE":
+	case "OCTAHEDRAL", "QUATERNION", "EXPONENTIAL":
+		if m.Mode != "ATTRIBUTES" {
+			return fmt.Sprintf("filter %s needs mode ATTRIBUTES", m.Filter)
+		}
+	default:
+		return fmt.Sprintf("filter %q is not NONE, OCTAHEDRAL, QUATERNION or EXPONENTIAL", m.Filter)
+	}
+	if !spanFits(0, m.Count, m.ByteStride, m.ByteStride, int64(bv.ByteLength)) || m.Count*m.ByteStride != bv.ByteLength {
+		return fmt.Sprintf("%d elements of %d bytes do not fill the %d bytes of the buffer view", m.Count, m.ByteStride, bv.ByteLength)
+	}
+	return ""
+}
+
+// meshoptDecodable reports whether the codecs here read m: the triangle
+// codec and the filters are left to loaders
+func meshoptDecodable(m *meshoptView) bool {
+	return (m.Mode == "ATTRIBUTES" || m.Mode == "INDICES") && (m.Filter == "" || m.Filter == "NONE")
+}
+
+// meshoptBuffer holds the bytes of a fallback buffer, decoded from the
+// compressed buffer views that point into it on the first read, so opening
+// a file to read its JSON costs nothing
+type meshoptBuffer struct {
+	asset *gltfAsset
+	index int
+	size  int64
+
+	once sync.Once
+	data *bytes.Reader
+	err  error
+}
+
+// attachMeshopt gives every fallback buffer without bytes of its own a
+// meshoptBuffer, when the codecs here can decode all views into it
+func (a *gltfAsset) attachMeshopt() {
+	for i, b := range a.Doc.Buffers {
+		if a.Data[i] != nil || !isMeshoptFallback(b) {
+			continue
+		}
+		var size int64
+		decodable := true
+		for _, bv := range a.Doc.BufferViews {
+			m, err := meshoptViewOf(bv)
+			if bv.Buffer != i || m == nil && err == nil {
+				continue
+			}
+			if err != nil || !meshoptDecodable(m) {
+				decodable = false
+				break
+			}
+			if bv.ByteOffset >= 0 && bv.ByteLength >= 0 {
+				size = max(size, int64(bv.ByteOffset)+int64(bv.ByteLength))
+			}
+		}
+		if decodable {
+			a.Data[i] = &meshoptBuffer{asset: a, index: i, size: size}
+		}
+	}
+}
+
+func (b *meshoptBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if err := b.decode(); err != nil {
+		return 0, err
+	}
+	return b.data.ReadAt(p, off)
+}
+
+// decode fills the buffer from its compressed views once. The decoded size
+// is limited to what the compressed bytes at hand can hold, so a crafted
+// file cannot ask for more memory than that.
+func (b *meshoptBuffer) decode() error {
+	b.once.Do(func() {
+		a := b.asset
+		var source int64
+		sources := make(map[int]bool)
+		for _, bv := range a.Doc.BufferViews {
+			if m, _ := meshoptViewOf(bv); bv.Buffer == b.index && m != nil && m.Buffer >= 0 && m.Buffer < len(a.Data) && !sources[m.Buffer] {
+				sources[m.Buffer] = true
+				source += max(a.dataSize(m.Buffer), 0)
+			}
+		}
+		if b.size > source*meshoptMaxRatio {
+			b.err = fmt.Errorf("%d decoded bytes cannot come from %d compressed bytes", b.size, source)
+			return
+		}
+		data := make([]byte, b.size)
+		for v, bv := range a.Doc.BufferViews {
+			if bv.Buffer != b.index {
+				continue
+			}
+			if err := a.decodeMeshoptView(bv, data); err != nil {
+				b.err = fmt.Errorf("buffer view %d: %w", v, err)
+				return
+			}
+		}
+		b.data = bytes.NewReader(data)
+	})
+	return b.err
+}
+
+// decodeMeshoptView decodes compressed buffer view bv into its place in the
+// bytes of its fallback buffer
+func (a *gltfAsset) decodeMeshoptView(bv GLTFBufferView, buffer []byte) error {
+	m, err := meshoptViewOf(bv)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return errors.New("buffer view of a fallback buffer is not compressed")
+	}
+	if problem := a.meshoptProblem(bv, m); problem != "" {
+		return errors.New(problem)
+	}
+	if !spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, int64(len(buffer))) {
+		return errors.New("buffer view lies outside its buffer")
+	}
+	src := a.Data[m.Buffer]
+	if src == nil || !spanFits(m.ByteOffset, m.ByteLength, 1, 1, a.dataSize(m.Buffer)) {
+		return errors.New("compressed bytes are not available")
+	}
+	if int64(bv.ByteLength) > int64(m.ByteLength)*meshoptMaxRatio {
+		return fmt.Errorf("%d bytes cannot come from %d compressed bytes", bv.ByteLength, m.ByteLength)
+	}
+	enc := make([]byte, m.ByteLength)
+	if _, err := src.ReadAt(enc, int64(m.ByteOffset)); err != nil {
+		return err
+	}
+	dst := buffer[bv.ByteOffset : bv.ByteOffset+bv.ByteLength]
+	if m.Mode == "ATTRIBUTES" {
+		return decodeMeshoptVertices(dst, enc, m.ByteStride)
+	}
+	return decodeMeshoptIndices(dst, enc, m.ByteStride)
+}
+
+// meshoptBlockSize returns the number of vertices of stride bytes the
+// vertex codec encodes together
+func meshoptBlockSize(stride int) int {
+	return min((8192/stride)&^(meshoptGroupSize-1), 256)
+}
+
+// encodeMeshoptVertices compresses count vertices of stride bytes, a
+// multiple of 4 up to 256. Each byte of a vertex is stored as the
+// difference to the same byte of the previous vertex, in blocks of
+// vertices byte by byte.
+func encodeMeshoptVertices(data []byte, stride int) []byte {
+	count := len(data) / stride
+	out := []byte{meshoptVertexHeader}
+	last := append([]byte(nil), data[:stride]...)
+	buf := make([]byte, 256)
+	block := meshoptBlockSize(stride)
+	for first := 0; first < count; first += block {
+		n := min(block, count-first)
+		for k := 0; k < stride; k++ {
+			clear(buf)
+			p := last[k]
+			for i := 0; i < n; i++ {
+				v := data[(first+i)*stride+k]
+				d := v - p
+				buf[i] = d<<1 ^ byte(int8(d)>>7) // zigzag
+				p = v
+			}
+			out = encodeMeshoptBytes(out, buf[:(n+meshoptGroupSize-1)&^(meshoptGroupSize-1)])
+		}
+		copy(last, data[(first+n-1)*stride:])
+	}
+	// the first vertex closes the stream, which decoders start from
+	if stride < meshoptTailSize {
+		out = append(out, make([]byte, meshoptTailSize-stride)...)
+	}
+	return append(out, data[:stride]...)
+}
+
+// encodeMeshoptBytes appends buf in groups of 16 bytes, each stored with as
+// few bits as it needs: none when it is all zeros, 2, 4 or all 8. A 2-bit
+// code per group says which, in header bytes ahead of the groups.
+func encodeMeshoptBytes(out, buf []byte) []byte {
+	groups := len(buf) / meshoptGroupSize
+	header := len(out)
+	out = append(out, make([]byte, (groups+3)/4)...)
+	for g := 0; g < groups; g++ {
+		group := buf[g*meshoptGroupSize : (g+1)*meshoptGroupSize]
+		code, bits, size := 3, 8, meshoptGroupSize
+		for c, b := range []int{0, 2, 4} {
+			if s := meshoptGroupBytes(group, b); s < size {
+				code, bits, size = c, b, s
+			}
+		}
+		out[header+g/4] |= byte(code << (g % 4 * 2))
+		out = packMeshoptGroup(out, group, bits)
+	}
+	return out
+}
+
+// meshoptGroupBytes returns the bytes group takes with values of bits
+// bits; values that do not fit follow as whole bytes
+func meshoptGroupBytes(group []byte, bits int) int {
+	if bits == 0 {
+		for _, v := range group {
+			if v != 0 {
+				return meshoptGroupSize + 1
+			}
+		}
+		return 0
+	}
+	size := meshoptGroupSize * bits / 8
+	sentinel := byte(1)<<bits - 1
+	for _, v := range group {
+		if v >= sentinel {
+			size++
+		}
+	}
+	return size
+}
+
+func packMeshoptGroup(out, group []byte, bits int) []byte {
+	switch bits {
+	case 0:
+		return out
+	case 8:
+		return append(out, group...)
+	}
+	sentinel := byte(1)<<bits - 1
+	per := 8 / bits
+	for i := 0; i < meshoptGroupSize; i += per {
+		var b byte
+		for _, v := range group[i : i+per] {
+			b = b<<bits | min(v, sentinel)
+		}
+		out = append(out, b)
+	}
+	for _, v := range group {
+		if v >= sentinel {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// decodeMeshoptVertices decodes a vertex stream of vertices of stride bytes
+// into dst, which it must fill exactly
+func decodeMeshoptVertices(dst, src []byte, stride int) error {
+	if stride < 4 || stride > 256 || stride%4 != 0 || len(dst)%stride != 0 {
+		return fmt.Errorf("vertex size %d is not a multiple of 4 up to 256", stride)
+	}
+	tail := max(meshoptTailSize, stride)
+	if len(src) < 1+tail || src[0] != meshoptVertexHeader {
+		return errors.New("not a version 0 vertex stream")
+	}
+	last := append([]byte(nil), src[len(src)-stride:]...)
+	data := src[1 : len(src)-tail]
+	buf := make([]byte, 256)
+	block := meshoptBlockSize(stride)
+	count := len(dst) / stride
+	for first := 0; first < count; first += block {
+		n := min(block, count-first)
+		for k := 0; k < stride; k++ {
+			var err error
+			if data, err = decodeMeshoptBytes(buf[:(n+meshoptGroupSize-1)&^(meshoptGroupSize-1)], data); err != nil {
+				return err
+			}
+			p := last[k]
+			for i := 0; i < n; i++ {
+				v := buf[i]
+				p += -(v & 1) ^ v>>1
+				dst[(first+i)*stride+k] = p
+			}
+			last[k] = p
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("vertex stream has %d bytes left over", len(data))
+	}
+	return nil
+}
+
+// decodeMeshoptBytes fills buf from the groups at the start of data and
+// returns the rest of data
+func decodeMeshoptBytes(buf, data []byte) ([]byte, error) {
+	groups := len(buf) / meshoptGroupSize
+	headerSize := (groups + 3) / 4
+	if len(data) < headerSize {
+		return nil, errors.New("vertex stream is truncated")
+	}
+	header, data := data[:headerSize], data[headerSize:]
+	for g := 0; g < groups; g++ {
+		group := buf[g*meshoptGroupSize : (g+1)*meshoptGroupSize]
+		bits := [4]int{0, 2, 4, 8}[header[g/4]>>(g%4*2)&3]
+		switch bits {
+		case 0:
+			clear(group)
+			continue
+		case 8:
+			if len(data) < meshoptGroupSize {
+				return nil, errors.New("vertex stream is truncated")
+			}
+			data = data[copy(group, data):]
+			continue
+		}
+		packed := meshoptGroupSize * bits / 8
+		if len(data) < packed {
+			return nil, errors.New("vertex stream is truncated")
+		}
+		sentinel := byte(1)<<bits - 1
+		per := 8 / bits
+		extra := data[packed:]
+		for i := range group {
+			v := data[i/per] >> (8 - bits*(i%per+1)) & sentinel
+			if v == sentinel {
+				if len(extra) == 0 {
+					return nil, errors.New("vertex stream is truncated")
+				}
+				v, extra = extra[0], extra[1:]
+			}
+			group[i] = v
+		}
+		data = extra
+	}
+	return data, nil
+}
+
+// encodeMeshoptIndices compresses an index sequence. Each index is stored
+// as a variable length difference to one of the last two indices, so runs
+// going back and forth stay small. It returns nil for indices of 2^30 and
+// up, which the codec cannot hold.
+func encodeMeshoptIndices(indices []uint32) []byte {
+	out := []byte{meshoptSequenceHeader | 1}
+	var last [2]uint32
+	current := uint32(0)
+	for _, index := range indices {
+		if index >= 1<<30 {
+			return nil
+		}
+		if cd := int32(index - last[current]); cd >= 30 || cd <= -30 {
+			current ^= 1
+		}
+		d := index - last[current]
+		v := d<<1 ^ uint32(int32(d)>>31)
+		out = binary.AppendUvarint(out, uint64(v<<1|current))
+		last[current] = index
+	}
+	return append(out, 0, 0, 0, 0)
+}
+
+// decodeMeshoptIndices decodes an index sequence into dst as indices of
+// size bytes, 2 or 4, which it must fill exactly
+func decodeMeshoptIndices(dst, src []byte, size int) error {
+	if (size != 2 && size != 4) || len(dst)%size != 0 {
+		return fmt.Errorf("index size %d is not 2 or 4", size)
+	}
+	count := len(dst) / size
+	if len(src) < 1+count+4 || src[0]&0xf0 != meshoptSequenceHeader || src[0]&0x0f > 1 {
+		return errors.New("not an index sequence")
+	}
+	data := src[1 : len(src)-4]
+	var last [2]uint32
+	for i := 0; i < count; i++ {
+		v, n := binary.Uvarint(data)
+		if n <= 0 || v > math.MaxUint32 {
+			return errors.New("index sequence is truncated")
+		}
+		data = data[n:]
+		current := v & 1
+		v >>= 1
+		index := last[current] + (uint32(v>>1) ^ -uint32(v&1))
+		last[current] = index
+		if size == 2 {
+			binary.LittleEndian.PutUint16(dst[i*2:], uint16(index))
+		} else {
+			binary.LittleEndian.PutUint32(dst[i*4:], index)
+		}
+	}
+	if len(data) != 0 {
+		return fmt.Errorf("index sequence has %d bytes left over", len(data))
+	}
+	return nil
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxGLTFErrors caps how many problems are reported for one file
+const maxGLTFErrors = 100
+
+// GLTFError is one problem found in a glTF asset. Pointer is a JSON pointer
+// into the glTF JSON ("/accessors/3/count"), empty for container problems.
+type GLTFError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// gltfValidator collects the problems of one asset
+type gltfValidator struct {
+	asset   *gltfAsset
+	doc     *GLTF
+	parents []int // parent node of each node, -1 for roots; nil if unknown
+	errs    []GLTFError
+}
+
+func (v *gltfValidator) addf(pointer, format string, args ...interface{}) {
+	v.errs = append(v.errs, GLTFError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// ref checks that index i points into a list of n items
+func (v *gltfValidator) ref(pointer string, i, n int, what string) bool {
+	if i < 0 || i >= n {
+		if i == -1 {
+			v.addf(pointer, "required reference to %s is missing", what)
+		} else {
+			v.addf(pointer, "%s %d does not exist (%d defined)", what, i, n)
+		}
+		return false
+	}
+	return true
+}
+
+func (v *gltfValidator) optRef(pointer string, i *int, n int, what string) bool {
+	return i != nil && v.ref(pointer, *i, n, what)
+}
+
+func ptr(parts ...interface{}) string {
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString("/")
+		b.WriteString(fmt.Sprint(p))
+	}
+	return b.String()
+}
+
+// validateGLTF parses a .glb or .gltf file and checks it against the glTF
+// 2.0 spec: the GLB container, required properties, references between
+// objects, buffer view and accessor bounds, and index values where the
+// buffer bytes are at hand. External URIs are opened through resolve; with
+// a nil resolve they are reported as missing. It returns nil for a valid
+// file.
+func validateGLTF(r io.ReaderAt, size int64, ext string, resolve gltfResolver) []GLTFError {
+	asset, errs := openGLTF(r, size, ext, resolve)
+	if asset == nil {
+		return errs
+	}
+	v := &gltfValidator{asset: asset, doc: asset.Doc}
+	v.validate(ext)
+	if len(v.errs) > maxGLTFErrors {
+		v.errs = append(v.errs[:maxGLTFErrors], GLTFError{Message: fmt.Sprintf("%d more problems not listed", len(v.errs)-maxGLTFErrors)})
+	}
+	return v.errs
+}
+
+func (v *gltfValidator) validate(ext string) {
+	doc := v.doc
+	v.validateAsset()
+	for _, e := range doc.ExtensionsRequired {
+		if !containsString(doc.ExtensionsUsed, e) {
+			v.addf("/extensionsRequired", "%s is required but not listed in extensionsUsed", e)
+		}
+	}
+	v.validateBuffers(ext)
+	v.validateBufferViews()
+	v.validateMeshopt()
+	v.validateAccessors()
+	v.validateMeshes()
+	v.validateNodes()
+	v.validateScenes()
+	v.validateMaterials()
+	v.validateTextures()
+	v.validateSkins()
+	v.validateAnimations()
+	v.validateCameras()
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *gltfValidator) validateAsset() {
+	a := v.doc.Asset
+	if a.Version == "" {
+		v.addf("/asset/version", "asset.version is required")
+		return
+	}
+	if major, _, _ := strings.Cut(a.Version, "."); major != "2" {
+		v.addf("/asset/version", "glTF version %s is not supported; only 2.x is", a.Version)
+	}
+	if a.MinVersion != "" && a.MinVersion != "2.0" {
+		v.addf("/asset/minVersion", "minVersion %s is newer than the supported 2.0", a.MinVersion)
+	}
+}
+
+func (v *gltfValidator) validateBuffers(ext string) {
+	for i, b := range v.doc.Buffers {
+		p := ptr("buffers", i)
+		if b.ByteLength < 1 {
+			v.addf(p+"/byteLength", "byteLength must be at least 1")
+			continue
+		}
+		if b.URI == "" && isMeshoptFallback(b) {
+			continue // decoded from compressed views; see validateMeshopt
+		}
+		switch {
+		case b.URI == "" && !(ext == ".glb" && i == 0):
+			v.addf(p+"/uri", "uri is required; only the first buffer of a GLB may use the BIN chunk")
+			continue
+		case b.URI != "" && !strings.HasPrefix(b.URI, "data:"):
+			if v.asset.resolve == nil {
+				v.addf(p+"/uri", "external buffer %q is not part of the upload; upload it along with the .gltf or as a zip", b.URI)
+				continue
+			}
+			if err := v.asset.URIErrs[i]; err != nil {
+				v.addf(p+"/uri", "buffer %v", err)
+				continue
+			}
+		case strings.HasPrefix(b.URI, "data:"):
+			if _, _, err := decodeDataURI(b.URI); err != nil {
+				v.addf(p+"/uri", "invalid data URI: %v", err)
+				continue
+			}
+		}
+		if n := v.asset.dataSize(i); n == -1 {
+			v.addf(p, "buffer 0 uses the GLB BIN chunk, but the file has none")
+		} else if n < int64(b.ByteLength) {
+			v.addf(p+"/byteLength", "byteLength is %d but only %d bytes are present", b.ByteLength, n)
+		} else if b.URI == "" && n > int64(b.ByteLength)+3 {
+			v.addf(p+"/byteLength", "BIN chunk has %d bytes, more than byteLength %d plus padding", n, b.ByteLength)
+		}
+	}
+}
+
+func (v *gltfValidator) validateBufferViews() {
+	for i, bv := range v.doc.BufferViews {
+		p := ptr("bufferViews", i)
+		if !v.ref(p+"/buffer", bv.Buffer, len(v.doc.Buffers), "buffer") {
+			continue
+		}
+		if bv.ByteLength < 1 {
+			v.addf(p+"/byteLength", "byteLength must be at least 1")
+		}
+		if bv.ByteOffset < 0 {
+			v.addf(p+"/byteOffset", "byteOffset must not be negative")
+		}
+		if bv.ByteStride != 0 && (bv.ByteStride < 4 || bv.ByteStride > 252 || bv.ByteStride%4 != 0) {
+			v.addf(p+"/byteStride", "byteStride %d must be a multiple of 4 between 4 and 252", bv.ByteStride)
+		}
+		if bv.Target != 0 && bv.Target != 34962 && bv.Target != 34963 {
+			v.addf(p+"/target", "target %d is not ARRAY_BUFFER (34962) or ELEMENT_ARRAY_BUFFER (34963)", bv.Target)
+		}
+		if size := v.doc.Buffers[bv.Buffer].ByteLength; bv.ByteOffset >= 0 && !spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, int64(size)) {
+			v.addf(p, "%d bytes at offset %d lie outside buffer %d of %d bytes", bv.ByteLength, bv.ByteOffset, bv.Buffer, size)
+		}
+	}
+}
+
+// validateMeshopt checks the EXT_meshopt_compression objects of the buffer
+// views and decodes the fallback buffers they fill. A buffer that cannot be
+// decoded is reported and treated as unavailable from then on, so its
+// accessors are not read.
+func (v *gltfValidator) validateMeshopt() {
+	broken := make(map[int]bool)
+	for i, bv := range v.doc.BufferViews {
+		p := ptr("bufferViews", i, "extensions", meshoptExtension)
+		m, err := meshoptViewOf(bv)
+		bad := err != nil
+		if bad {
+			v.addf(p, "invalid %s: %v", meshoptExtension, err)
+		} else if m != nil {
+			if problem := v.asset.meshoptProblem(bv, m); problem != "" {
+				v.addf(p, "%s", problem)
+				bad = true
+			} else if !containsString(v.doc.ExtensionsUsed, meshoptExtension) {
+				v.addf(p, "%s is not listed in extensionsUsed", meshoptExtension)
+			}
+		}
+		if bad && bv.Buffer >= 0 && bv.Buffer < len(v.doc.Buffers) {
+			broken[bv.Buffer] = true
+		}
+	}
+	for i, d := range v.asset.Data {
+		mb, ok := d.(*meshoptBuffer)
+		if !ok {
+			continue
+		}
+		if broken[i] {
+			v.asset.Data[i] = nil
+		} else if err := mb.decode(); err != nil {
+			v.addf(ptr("buffers", i), "cannot decode compressed data: %v", err)
+			v.asset.Data[i] = nil
+		}
+	}
+}
+
+// viewFits checks that count elements of elemSize bytes starting at offset,
+// stride bytes apart, lie within buffer view bvIndex
+func (v *gltfValidator) viewFits(p string, bvIndex, offset, count, elemSize, stride int) {
+	bv := v.doc.BufferViews[bvIndex]
+	if stride == 0 {
+		stride = elemSize
+	}
+	if !spanFits(offset, count, elemSize, stride, int64(bv.ByteLength)) {
+		v.addf(p, "%d elements of %d bytes, %d apart from offset %d, do not fit in the %d bytes of buffer view %d", count, elemSize, stride, offset, bv.ByteLength, bvIndex)
+	}
+}
+
+func (v *gltfValidator) validateAccessors() {
+	for i, a := range v.doc.Accessors {
+		p := ptr("accessors", i)
+		size := componentSize(a.ComponentType)
+		comps := componentCount(a.Type)
+		if size == 0 {
+			v.addf(p+"/componentType", "componentType %d is not one of 5120, 5121, 5122, 5123, 5125, 5126", a.ComponentType)
+		}
+		if comps == 0 {
+			v.addf(p+"/type", "type %q is not one of SCALAR, VEC2, VEC3, VEC4, MAT2, MAT3, MAT4", a.Type)
+		}
+		if a.Count < 1 {
+			v.addf(p+"/count", "count must be at least 1")
+		}
+		if a.Normalized && (a.ComponentType == gltfFloat || a.ComponentType == gltfUnsignedInt) {
+			v.addf(p+"/normalized", "normalized is not allowed for componentType %d", a.ComponentType)
+		}
+		if a.Min != nil && len(a.Min) != comps && comps != 0 {
+			v.addf(p+"/min", "min has %d values, %s needs %d", len(a.Min), a.Type, comps)
+		}
+		if a.Max != nil && len(a.Max) != comps && comps != 0 {
+			v.addf(p+"/max", "max has %d values, %s needs %d", len(a.Max), a.Type, comps)
+		}
+		if size == 0 || comps == 0 || a.Count < 1 {
+			continue
+		}
+		if a.ByteOffset < 0 || a.ByteOffset%size != 0 {
+			v.addf(p+"/byteOffset", "byteOffset %d must be a non-negative multiple of the component size %d", a.ByteOffset, size)
+			continue
+		}
+		if v.optRef(p+"/bufferView", a.BufferView, len(v.doc.BufferViews), "buffer view") {
+			bv := v.doc.BufferViews[*a.BufferView]
+			if (bv.ByteOffset+a.ByteOffset)%size != 0 {
+				v.addf(p+"/byteOffset", "data does not start on a %d-byte boundary in its buffer", size)
+			}
+			elem := elementSize(a.ComponentType, a.Type)
+			if bv.ByteStride != 0 && bv.ByteStride < elem {
+				v.addf(p, "element of %d bytes does not fit in byteStride %d of buffer view %d", elem, bv.ByteStride, *a.BufferView)
+			}
+			v.viewFits(p, *a.BufferView, a.ByteOffset, a.Count, elem, bv.ByteStride)
+		} else if a.ByteOffset != 0 {
+			v.addf(p+"/byteOffset", "byteOffset needs a bufferView")
+		}
+		if a.Sparse != nil {
+			v.validateSparse(p+"/sparse", a)
+		}
+	}
+}
+
+func (v *gltfValidator) validateSparse(p string, a GLTFAccessor) {
+	s := a.Sparse
+	if s.Count < 1 || s.Count > a.Count {
+		v.addf(p+"/count", "count must be between 1 and the accessor count %d", a.Count)
+		return
+	}
+	isize := componentSize(s.Indices.ComponentType)
+	if s.Indices.ComponentType != gltfUnsignedByte && s.Indices.ComponentType != gltfUnsignedShort && s.Indices.ComponentType != gltfUnsignedInt {
+		v.addf(p+"/indices/componentType", "componentType must be 5121, 5123 or 5125")
+	} else if v.ref(p+"/indices/bufferView", s.Indices.BufferView, len(v.doc.BufferViews), "buffer view") {
+		v.viewFits(p+"/indices", s.Indices.BufferView, s.Indices.ByteOffset, s.Count, isize, 0)
+	}
+	if v.ref(p+"/values/bufferView", s.Values.BufferView, len(v.doc.BufferViews), "buffer view") {
+		v.viewFits(p+"/values", s.Values.BufferView, s.Values.ByteOffset, s.Count, elementSize(a.ComponentType, a.Type), 0)
+	}
+}
+
+// accessorOK reports whether accessor i exists and passed its own checks
+// far enough to be read
+func (v *gltfValidator) accessorOK(i int) bool {
+	if i < 0 || i >= len(v.doc.Accessors) {
+		return false
+	}
+	a := v.doc.Accessors[i]
+	return componentSize(a.ComponentType) != 0 && componentCount(a.Type) != 0 && a.Count >= 1
+}
+
+func (v *gltfValidator) validateMeshes() {
+	for i, m := range v.doc.Meshes {
+		p := ptr("meshes", i)
+		if len(m.Primitives) == 0 {
+			v.addf(p+"/primitives", "a mesh needs at least one primitive")
+		}
+		for j, prim := range m.Primitives {
+			v.validatePrimitive(ptr("meshes", i, "primitives", j), prim)
+		}
+	}
+}
+
+func (v *gltfValidator) validatePrimitive(p string, prim GLTFPrimitive) {
+	if len(prim.Attributes) == 0 {
+		v.addf(p+"/attributes", "a primitive needs at least one attribute")
+	}
+	names := make([]string, 0, len(prim.Attributes))
+	for name := range prim.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	count := -1
+	for _, name := range names {
+		idx := prim.Attributes[name]
+		ap := p + "/attributes/" + name
+		if !v.ref(ap, idx, len(v.doc.Accessors), "accessor") || !v.accessorOK(idx) {
+			continue
+		}
+		a := v.doc.Accessors[idx]
+		if count != -1 && a.Count != count {
+			v.addf(ap, "attribute has %d elements but others of the primitive have %d", a.Count, count)
+		}
+		count = a.Count
+		if name == "POSITION" {
+			quantized := containsString(v.doc.ExtensionsUsed, "KHR_mesh_quantization")
+			if a.Type != "VEC3" || (a.ComponentType != gltfFloat && !quantized) {
+				v.addf(ap, "POSITION must be a float VEC3 accessor")
+			}
+			if a.Min == nil || a.Max == nil {
+				v.addf(ap, "POSITION accessor %d must define min and max", idx)
+			}
+		}
+	}
+	if prim.Mode != nil && (*prim.Mode < 0 || *prim.Mode > 6) {
+		v.addf(p+"/mode", "mode %d is not between 0 and 6", *prim.Mode)
+	}
+	v.optRef(p+"/material", prim.Material, len(v.doc.Materials), "material")
+	for t, target := range prim.Targets {
+		for name, idx := range target {
+			v.ref(p+ptr("targets", t, name), idx, len(v.doc.Accessors), "accessor")
+		}
+	}
+
+	if !v.optRef(p+"/indices", prim.Indices, len(v.doc.Accessors), "accessor") || !v.accessorOK(*prim.Indices) {
+		return
+	}
+	a := v.doc.Accessors[*prim.Indices]
+	if a.Type != "SCALAR" || (a.ComponentType != gltfUnsignedByte && a.ComponentType != gltfUnsignedShort && a.ComponentType != gltfUnsignedInt) {
+		v.addf(p+"/indices", "indices must be a SCALAR accessor of unsigned bytes, shorts or ints")
+		return
+	}
+	if count > 0 {
+		v.checkIndexValues(p+"/indices", *prim.Indices, count)
+	}
+}
+
+// checkIndexValues reads an index accessor, when its bytes are available,
+// and reports the first index that is past the vertex count
+func (v *gltfValidator) checkIndexValues(p string, i, vertexCount int) {
+	a := v.doc.Accessors[i]
+	if a.BufferView == nil || a.Sparse != nil || *a.BufferView < 0 || *a.BufferView >= len(v.doc.BufferViews) {
+		return
+	}
+	bv := v.doc.BufferViews[*a.BufferView]
+	if bv.Buffer < 0 || bv.Buffer >= len(v.doc.Buffers) || v.asset.Data[bv.Buffer] == nil {
+		return
+	}
+	stride := bv.ByteStride
+	if stride == 0 {
+		stride = componentSize(a.ComponentType)
+	}
+	if !spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, v.asset.dataSize(bv.Buffer)) ||
+		!spanFits(a.ByteOffset, a.Count, componentSize(a.ComponentType), stride, int64(bv.ByteLength)) {
+		return // already reported as out of bounds
+	}
+	indices, err := v.asset.readIndices(i)
+	if err != nil {
+		v.addf(p, "cannot read indices: %v", err)
+		return
+	}
+	restart := uint32(1)<<(8*componentSize(a.ComponentType)) - 1
+	for n, idx := range indices {
+		if int64(idx) >= int64(vertexCount) {
+			v.addf(p, "index %d at position %d is out of range for %d vertices", idx, n, vertexCount)
+			return
+		}
+		if idx == restart {
+			v.addf(p, "index at position %d is the primitive restart value %d, which glTF does not allow", n, idx)
+			return
+		}
+	}
+}
+
+func (v *gltfValidator) validateNodes() {
+	nodes := v.doc.Nodes
+	parent := make([]int, len(nodes))
+	for i := range parent {
+		parent[i] = -1
+	}
+	for i, n := range nodes {
+		p := ptr("nodes", i)
+		v.optRef(p+"/mesh", n.Mesh, len(v.doc.Meshes), "mesh")
+		v.optRef(p+"/camera", n.Camera, len(v.doc.Cameras), "camera")
+		v.optRef(p+"/skin", n.Skin, len(v.doc.Skins), "skin")
+		if n.Matrix != nil && (n.Translation != nil || n.Rotation != nil || n.Scale != nil) {
+			v.addf(p+"/matrix", "a node cannot have both matrix and translation/rotation/scale")
+		}
+		for _, f := range []struct {
+			name string
+			got  []float64
+			want int
+		}{{"matrix", n.Matrix, 16}, {"translation", n.Translation, 3}, {"rotation", n.Rotation, 4}, {"scale", n.Scale, 3}} {
+			if f.got != nil && len(f.got) != f.want {
+				v.addf(p+"/"+f.name, "%s needs %d numbers, has %d", f.name, f.want, len(f.got))
+			}
+		}
+		for j, c := range n.Children {
+			cp := ptr("nodes", i, "children", j)
+			if !v.ref(cp, c, len(nodes), "node") {
+				continue
+			}
+			if c == i {
+				v.addf(cp, "node %d is its own child", i)
+			} else if parent[c] != -1 {
+				v.addf(cp, "node %d already is a child of node %d; a node can have only one parent", c, parent[c])
+			} else {
+				parent[c] = i
+			}
+		}
+	}
+	// with at most one parent each, a cycle shows up as a walk upwards that
+	// never ends
+	for i := range nodes {
+		steps := 0
+		for n := parent[i]; n != -1; n = parent[n] {
+			if steps++; steps > len(nodes) {
+				v.addf(ptr("nodes", i), "node hierarchy contains a cycle")
+				return
+			}
+		}
+	}
+	v.parents = parent
+}
+
+func (v *gltfValidator) validateScenes() {
+	if v.doc.Scene != nil {
+		v.ref("/scene", *v.doc.Scene, len(v.doc.Scenes), "scene")
+	}
+	for i, s := range v.doc.Scenes {
+		for j, n := range s.Nodes {
+			p := ptr("scenes", i, "nodes", j)
+			if v.ref(p, n, len(v.doc.Nodes), "node") && v.parents != nil && v.parents[n] != -1 {
+				v.addf(p, "node %d is a child of node %d; scenes may only list root nodes", n, v.parents[n])
+			}
+		}
+	}
+}
+
+func (v *gltfValidator) validateMaterials() {
+	for i, m := range v.doc.Materials {
+		p := ptr("materials", i)
+		check := func(name string, t *GLTFTextureInfo) {
+			if t != nil {
+				v.ref(p+"/"+name+"/index", t.Index, len(v.doc.Textures), "texture")
+			}
+		}
+		if pbr := m.PBRMetallicRoughness; pbr != nil {
+			check("pbrMetallicRoughness/baseColorTexture", pbr.BaseColorTexture)
+			check("pbrMetallicRoughness/metallicRoughnessTexture", pbr.MetallicRoughnessTexture)
+			if pbr.BaseColorFactor != nil && len(pbr.BaseColorFactor) != 4 {
+				v.addf(p+"/pbrMetallicRoughness/baseColorFactor", "baseColorFactor needs 4 numbers")
+			}
+		}
+		check("normalTexture", m.NormalTexture)
+		check("occlusionTexture", m.OcclusionTexture)
+		check("emissiveTexture", m.EmissiveTexture)
+		if m.EmissiveFactor != nil && len(m.EmissiveFactor) != 3 {
+			v.addf(p+"/emissiveFactor", "emissiveFactor needs 3 numbers")
+		}
+		switch m.AlphaMode {
+		case "", "OPAQUE", "MASK", "BLEND":
+		default:
+			v.addf(p+"/alphaMode", "alphaMode %q is not OPAQUE, MASK or BLEND", m.AlphaMode)
+		}
+	}
+}
+
+func (v *gltfValidator) validateTextures() {
+	for i, t := range v.doc.Textures {
+		p := ptr("textures", i)
+		v.optRef(p+"/sampler", t.Sampler, len(v.doc.Samplers), "sampler")
+		v.optRef(p+"/source", t.Source, len(v.doc.Images), "image")
+	}
+	for i, img := range v.doc.Images {
+		p := ptr("images", i)
+		switch {
+		case img.URI != "" && img.BufferView != nil:
+			v.addf(p, "an image has either uri or bufferView, not both")
+		case img.BufferView != nil:
+			if v.ref(p+"/bufferView", *img.BufferView, len(v.doc.BufferViews), "buffer view") {
+				bv := v.doc.BufferViews[*img.BufferView]
+				if bv.Buffer >= 0 && bv.Buffer < len(v.asset.Data) && v.asset.Data[bv.Buffer] != nil &&
+					imageKind(io.NewSectionReader(v.asset.Data[bv.Buffer], int64(bv.ByteOffset), int64(bv.ByteLength))) == "" {
+					v.addf(p+"/bufferView", "the image bytes are not a PNG, JPEG, WebP or KTX2 image")
+				}
+			}
+			if img.MimeType == "" {
+				v.addf(p+"/mimeType", "mimeType is required with bufferView")
+			}
+		case strings.HasPrefix(img.URI, "data:"):
+			if _, _, err := decodeDataURI(img.URI); err != nil {
+				v.addf(p+"/uri", "invalid data URI: %v", err)
+			}
+		case img.URI != "" && v.asset.resolve == nil:
+			v.addf(p+"/uri", "external image %q is not part of the upload; upload it along with the .gltf or as a zip", img.URI)
+		case img.URI != "":
+			f, err := v.asset.resolve(img.URI)
+			if err != nil {
+				v.addf(p+"/uri", "image %v", err)
+			} else if kind := imageKind(f); kind == "" {
+				v.addf(p+"/uri", "%s is not a PNG, JPEG, WebP or KTX2 image", img.URI)
+			}
+		default:
+			v.addf(p, "an image needs a uri or a bufferView")
+		}
+	}
+}
+
+func (v *gltfValidator) validateSkins() {
+	for i, s := range v.doc.Skins {
+		p := ptr("skins", i)
+		if len(s.Joints) == 0 {
+			v.addf(p+"/joints", "a skin needs at least one joint")
+		}
+		for j, n := range s.Joints {
+			v.ref(ptr("skins", i, "joints", j), n, len(v.doc.Nodes), "node")
+		}
+		v.optRef(p+"/skeleton", s.Skeleton, len(v.doc.Nodes), "node")
+		if v.optRef(p+"/inverseBindMatrices", s.InverseBindMatrices, len(v.doc.Accessors), "accessor") {
+			a := v.doc.Accessors[*s.InverseBindMatrices]
+			if a.Type != "MAT4" || a.Count < len(s.Joints) {
+				v.addf(p+"/inverseBindMatrices", "inverseBindMatrices must be a MAT4 accessor with one matrix per joint")
+			}
+		}
+	}
+}
+
+func (v *gltfValidator) validateAnimations() {
+	for i, an := range v.doc.Animations {
+		p := ptr("animations", i)
+		if len(an.Channels) == 0 {
+			v.addf(p+"/channels", "an animation needs at least one channel")
+		}
+		if len(an.Samplers) == 0 {
+			v.addf(p+"/samplers", "an animation needs at least one sampler")
+		}
+		for j, ch := range an.Channels {
+			cp := ptr("animations", i, "channels", j)
+			v.ref(cp+"/sampler", ch.Sampler, len(an.Samplers), "animation sampler")
+			v.optRef(cp+"/target/node", ch.Target.Node, len(v.doc.Nodes), "node")
+			switch ch.Target.Path {
+			case "translation", "rotation", "scale", "weights":
+			default:
+				v.addf(cp+"/target/path", "path %q is not translation, rotation, scale or weights", ch.Target.Path)
+			}
+		}
+		for j, s := range an.Samplers {
+			sp := ptr("animations", i, "samplers", j)
+			if v.ref(sp+"/input", s.Input, len(v.doc.Accessors), "accessor") {
+				if a := v.doc.Accessors[s.Input]; a.Type != "SCALAR" || a.ComponentType != gltfFloat {
+					v.addf(sp+"/input", "input must be a float SCALAR accessor of key times")
+				}
+			}
+			v.ref(sp+"/output", s.Output, len(v.doc.Accessors), "accessor")
+			switch s.Interpolation {
+			case "", "LINEAR", "STEP", "CUBICSPLINE":
+			default:
+				v.addf(sp+"/interpolation", "interpolation %q is not LINEAR, STEP or CUBICSPLINE", s.Interpolation)
+			}
+		}
+	}
+}
+
+func (v *gltfValidator) validateCameras() {
+	for i, c := range v.doc.Cameras {
+		p := ptr("cameras", i)
+		switch {
+		case c.Type == "perspective" && c.Perspective == nil:
+			v.addf(p+"/perspective", "perspective is required for a perspective camera")
+		case c.Type == "orthographic" && c.Orthographic == nil:
+			v.addf(p+"/orthographic", "orthographic is required for an orthographic camera")
+		case c.Type != "perspective" && c.Type != "orthographic":
+			v.addf(p+"/type", "type %q is not perspective or orthographic", c.Type)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// cubeWith returns the GLB of testCube after mutate changed its document.
+// The position accessor is 0 and the index accessor 1, each in the buffer
+// view of the same number.
+func cubeWith(t *testing.T, mutate func(doc *GLTF)) []byte {
+	t.Helper()
+	doc, bin := testDoc(testCube())
+	mutate(doc)
+	data, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// hasError reports whether errs holds a problem at pointer
+func hasError(errs []GLTFError, pointer string) bool {
+	for _, e := range errs {
+		if e.Pointer == pointer {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateGLTFAcceptsValidFiles(t *testing.T) {
+	glb := testGLB(t, testCube())
+	if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); errs != nil {
+		t.Fatalf("valid GLB: %+v", errs)
+	}
+	gltf := []byte(`{"asset":{"version":"2.0"},"scenes":[{"nodes":[0]}],"nodes":[{}]}`)
+	if errs := validateGLTF(bytes.NewReader(gltf), int64(len(gltf)), ".gltf", nil); errs != nil {
+		t.Fatalf("valid glTF: %+v", errs)
+	}
+}
+
+func TestValidateGLTFContainer(t *testing.T) {
+	glb := testGLB(t, testCube())
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, make([]byte, 64)...)
+	for name, data := range map[string][]byte{
+		"renamed JPEG": jpeg,
+		"truncated":    glb[:len(glb)-10],
+		"empty":        {},
+	} {
+		if errs := validateGLTF(bytes.NewReader(data), int64(len(data)), ".glb", nil); len(errs) == 0 {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	if errs := validateGLTF(strings.NewReader(`{"asset":`), 9, ".gltf", nil); len(errs) == 0 {
+		t.Error("broken JSON accepted")
+	}
+}
+
+func TestValidateGLTFReportsProblems(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mutate  func(doc *GLTF)
+		pointer string
+	}{
+		{"no version", func(doc *GLTF) { doc.Asset.Version = "" }, "/asset/version"},
+		{"missing accessor", func(doc *GLTF) { doc.Meshes[0].Primitives[0].Attributes["NORMAL"] = 9 }, "/meshes/0/primitives/0/attributes/NORMAL"},
+		{"view past its buffer", func(doc *GLTF) { doc.BufferViews[1].ByteLength += 4 }, "/bufferViews/1"},
+		{"accessor past its view", func(doc *GLTF) { doc.Accessors[1].Count++ }, "/accessors/1"},
+		{"bad component type", func(doc *GLTF) { doc.Accessors[0].ComponentType = 5130 }, "/accessors/0/componentType"},
+		{"bad stride", func(doc *GLTF) { doc.BufferViews[0].ByteStride = 6 }, "/bufferViews/0/byteStride"},
+		{"required but unused", func(doc *GLTF) { doc.ExtensionsRequired = []string{"KHR_x"} }, "/extensionsRequired"},
+	} {
+		glb := cubeWith(t, tc.mutate)
+		if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); !hasError(errs, tc.pointer) {
+			t.Errorf("%s: want a problem at %s, got %+v", tc.name, tc.pointer, errs)
+		}
+	}
+}
+
+func TestValidateGLTFIndexValues(t *testing.T) {
+	cube := testCube()
+	cube.indices[4] = 8
+	glb := testGLB(t, cube)
+	errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+	if !hasError(errs, "/meshes/0/primitives/0/indices") || !strings.Contains(errs[0].Message, "out of range for 8 vertices") {
+		t.Fatalf("index past the vertices: %+v", errs)
+	}
+}
+
+// A broken bufferView of an index accessor is reported once, and its
+// values are not read
+func TestValidateGLTFNegativeIndexView(t *testing.T) {
+	glb := cubeWith(t, func(doc *GLTF) {
+		bad := -1
+		doc.Accessors[1].BufferView = &bad
+	})
+	errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+	if !hasError(errs, "/accessors/1/bufferView") {
+		t.Fatalf("negative index buffer view: %+v", errs)
+	}
+}
+
+// Counts and offsets near the int64 limit must be reported, not wrap
+// around the bounds checks into a huge allocation.
+func TestValidateGLTFHugeCounts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mutate  func(doc *GLTF)
+		pointer string
+	}{
+		{"index count", func(doc *GLTF) { doc.Accessors[1].Count = 1 << 62 }, "/accessors/1"},
+		{"strided index count", func(doc *GLTF) {
+			doc.BufferViews[1].ByteStride = 8
+			doc.Accessors[1].Count = 1<<62 + 1
+		}, "/accessors/1"},
+		{"position count", func(doc *GLTF) { doc.Accessors[0].Count = 1<<61 + 1 }, "/accessors/0"},
+		{"view offset", func(doc *GLTF) {
+			doc.BufferViews[1].ByteOffset = 1 << 62
+			doc.BufferViews[1].ByteLength = 1 << 62
+		}, "/bufferViews/1"},
+		{"accessor offset", func(doc *GLTF) { doc.Accessors[1].ByteOffset = 1<<63 - 4 }, "/accessors/1"},
+	} {
+		glb := cubeWith(t, tc.mutate)
+		if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); !hasError(errs, tc.pointer) {
+			t.Errorf("%s: want a problem at %s, got %+v", tc.name, tc.pointer, errs)
+		}
+	}
+}
+
+// Files on disk that were never validated reach the readers directly
+func TestReadAccessorsOfHostileFiles(t *testing.T) {
+	open := func(mutate func(doc *GLTF)) *gltfAsset {
+		glb := cubeWith(t, mutate)
+		asset, errs := openGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+		if asset == nil {
+			t.Fatalf("open: %+v", errs)
+		}
+		return asset
+	}
+
+	// an empty accessor in a strided view reads as nothing
+	asset := open(func(doc *GLTF) {
+		doc.BufferViews[1].ByteStride = 8
+		doc.Accessors[1].Count = 0
+	})
+	if idx, err := asset.readIndices(1); err != nil || len(idx) != 0 {
+		t.Fatalf("empty indices: %v %v", idx, err)
+	}
+
+	for name, mutate := range map[string]func(doc *GLTF){
+		"huge count":       func(doc *GLTF) { doc.Accessors[1].Count = 1 << 62; doc.Accessors[0].Count = 1 << 62 },
+		"huge stride":      func(doc *GLTF) { doc.BufferViews[1].ByteStride = 1 << 40; doc.BufferViews[0].ByteStride = 1 << 40 },
+		"negative count":   func(doc *GLTF) { doc.Accessors[1].Count = -5; doc.Accessors[0].Count = -5 },
+		"view past buffer": func(doc *GLTF) { doc.BufferViews[1].ByteLength = 1 << 40; doc.BufferViews[0].ByteLength = 1 << 40 },
+		"missing view":     func(doc *GLTF) { *doc.Accessors[1].BufferView = 7; *doc.Accessors[0].BufferView = 7 },
+	} {
+		asset := open(mutate)
+		if _, err := asset.readIndices(1); err == nil {
+			t.Errorf("%s: indices read", name)
+		}
+		if _, err := asset.readFloats(0); err == nil {
+			t.Errorf("%s: positions read", name)
+		}
+		if _, err := asset.rawElements(asset.Doc.Accessors[0]); err == nil {
+			t.Errorf("%s: raw positions read", name)
+		}
+	}
+}
+
+func TestUploadRejectsInvalidModel(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+
+	w := ts.upload(token, map[string]string{"name": "photo"}, testFile{"file", "photo.glb", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0, 0, 0}})
+	expectStatus(t, w, 422)
+
+	glb := cubeWith(t, func(doc *GLTF) { doc.Accessors[1].Count = 1 << 62 })
+	w = ts.upload(token, map[string]string{"name": "crafted"}, testFile{"file", "crafted.glb", glb})
+	expectStatus(t, w, 422)
+	var resp struct {
+		Errors []GLTFError `json:"validation_errors"`
+	}
+	decodeJSON(t, w, &resp)
+	if !hasError(resp.Errors, "/accessors/1") {
+		t.Fatalf("validation errors %+v", resp.Errors)
+	}
+	glb = cubeWith(t, func(doc *GLTF) {
+		bad := -1
+		doc.Accessors[1].BufferView = &bad
+	})
+	expectStatus(t, ts.upload(token, map[string]string{"name": "negative"}, testFile{"file", "negative.glb", glb}), 422)
+	if models, _ := ts.store.ListModels(0); len(models) != 0 {
+		t.Fatalf("invalid models stored: %+v", models)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Job kinds, the post-upload processing steps of a model
+const (
+	JobMetadata  = "metadata"
+	JobThumbnail = "thumbnail"
+	JobOptimize  = "optimize"
+	JobLOD       = "lod"
+)
+
+// Job statuses
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Processing statuses of a model, summarizing the latest job of each kind
+const (
+	ProcessingPending    = "pending" // jobs queued, none started yet
+	ProcessingProcessing = "processing"
+	ProcessingReady      = "ready"
+	ProcessingFailed     = "failed" // a job gave up; see its last_error
+)
+
+const (
+	// jobPollInterval is how often idle workers look for retries that
+	// came due; new jobs wake a worker right away
+	jobPollInterval = 5 * time.Second
+	// jobMaxRetryDelay caps the doubling delay between attempts
+	jobMaxRetryDelay = time.Hour
+)
+
+// Job is one processing step of a model, run by a worker in the background
+// and kept in the store so it survives restarts. A failed run is queued
+// again at RunAt until MaxAttempts runs have been made.
+type Job struct {
+	ID          uint      `json:"id"`
+	ModelID     uint      `json:"model_id"`
+	Kind        string    `json:"kind"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"max_attempts"`
+	LastError   string    `json:"last_error"`
+	RunAt       time.Time `json:"run_at"` // when a queued job runs next
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// jobRunners does the work of each job kind for a model
+var jobRunners = map[string]func(s *Server, modelID uint) error{
+	JobMetadata:  (*Server).extractModelMetadata,
+	JobThumbnail: (*Server).thumbnailJob,
+	JobOptimize:  (*Server).optimizeModelJob,
+	JobLOD:       (*Server).lodJob,
+}
+
+// uploadJobs returns the jobs queued for every new model, in order
+func (s *Server) uploadJobs() []string {
+	kinds := []string{JobMetadata, JobThumbnail}
+	if s.cfg.OptimizeModels {
+		kinds = append(kinds, JobOptimize)
+	}
+	if len(s.cfg.LODRatios) > 0 {
+		kinds = append(kinds, JobLOD)
+	}
+	return kinds
+}
+
+// errPermanent marks job errors a retry cannot fix
+var errPermanent = errors.New("permanent failure")
+
+// enqueueJob queues a job of kind for a model and wakes a worker. If one is
+// already queued, that job is returned instead.
+func (s *Server) enqueueJob(modelID uint, kind string) (*Job, error) {
+	j := &Job{ModelID: modelID, Kind: kind, MaxAttempts: s.cfg.JobMaxAttempts}
+	err := s.store.CreateJob(j)
+	if errors.Is(err, ErrConflict) {
+		jobs, lerr := s.store.ListModelJobs(modelID)
+		if lerr != nil {
+			return nil, lerr
+		}
+		for _, q := range jobs {
+			if q.Kind == kind && q.Status == JobQueued {
+				j, err = q, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.refreshProcessingStatus(modelID)
+	select {
+	case s.jobWake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// queueUploadJobs queues the processing of a new model
+func (s *Server) queueUploadJobs(modelID uint) {
+	for _, kind := range s.uploadJobs() {
+		if _, err := s.enqueueJob(modelID, kind); err != nil {
+			log.Printf("queueUploadJobs: model %d: queue %s: %v", modelID, kind, err)
+		}
+	}
+}
+
+// queueMissingJobs queues the processing that models stored by older
+// versions or copied into the upload directories never had
+func (s *Server) queueMissingJobs() {
+	models, err := s.store.ListModels(0)
+	if err != nil {
+		log.Printf("queueMissingJobs: list models: %v", err)
+		return
+	}
+	for _, m := range models {
+		jobs, err := s.store.ListModelJobs(m.ID)
+		if err != nil {
+			log.Printf("queueMissingJobs: list jobs of model %d: %v", m.ID, err)
+			continue
+		}
+		had := make(map[string]bool)
+		for _, j := range jobs {
+			had[j.Kind] = true
+		}
+		missing := map[string]bool{
+			JobMetadata:  m.Metadata == nil,
+			JobThumbnail: m.ThumbnailURL == "",
+			JobOptimize:  m.OptimizedURL == "",
+			JobLOD:       len(m.LODs) == 0,
+		}
+		for _, kind := range s.uploadJobs() {
+			if missing[kind] && !had[kind] {
+				if _, err := s.enqueueJob(m.ID, kind); err != nil {
+					log.Printf("queueMissingJobs: model %d: queue %s: %v", m.ID, kind, err)
+				}
+			}
+		}
+	}
+}
+
+// startJobWorkers requeues the jobs a previous run left running and starts
+// the workers. Processing is CPU bound, so a few workers keep uploads
+// responsive.
+func (s *Server) startJobWorkers() {
+	n, err := s.store.RequeueRunningJobs()
+	if err != nil {
+		log.Printf("startJobWorkers: requeue running jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("Requeued %d interrupted job(s)", n)
+	}
+	for i := 0; i < s.cfg.JobWorkers; i++ {
+		go s.jobWorker()
+	}
+}
+
+func (s *Server) jobWorker() {
+	for {
+		j, err := s.store.ClaimJob(time.Now())
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) {
+				log.Printf("jobWorker: claim job: %v", err)
+			}
+			select {
+			case <-s.jobWake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		s.processJob(j)
+	}
+}
+
+// processJob runs a claimed job and records the outcome, scheduling a retry
+// with a doubling delay while attempts are left
+func (s *Server) processJob(j *Job) {
+	s.refreshProcessingStatus(j.ModelID)
+	start := time.Now()
+	err := runJob(s, j)
+
+	status, lastError, runAt := JobDone, "", time.Now()
+	if err != nil {
+		status, lastError = JobFailed, err.Error()
+		if j.Attempts < j.MaxAttempts && !errors.Is(err, errPermanent) {
+			status = JobQueued
+			runAt = runAt.Add(s.jobRetryDelay(j.Attempts))
+		}
+		log.Printf("jobWorker: %s job %d of model %d, attempt %d/%d: %v", j.Kind, j.ID, j.ModelID, j.Attempts, j.MaxAttempts, err)
+	} else {
+		log.Printf("jobWorker: %s job %d of model %d done in %v", j.Kind, j.ID, j.ModelID, time.Since(start).Round(time.Millisecond))
+	}
+
+	err = s.store.FinishJob(j.ID, status, lastError, runAt)
+	if errors.Is(err, ErrConflict) {
+		// a newer job of the same kind is queued and takes over the retry
+		err = s.store.FinishJob(j.ID, JobFailed, lastError, runAt)
+	}
+	if errors.Is(err, ErrNotFound) {
+		// the model was deleted meanwhile
+		return
+	}
+	if err != nil {
+		log.Printf("jobWorker: record job %d: %v", j.ID, err)
+	}
+	s.refreshProcessingStatus(j.ModelID)
+}
+
+// runJob calls the runner of the job kind; a panic fails the job for good
+// instead of taking the server down
+func runJob(s *Server, j *Job) (err error) {
+	run, ok := jobRunners[j.Kind]
+	if !ok {
+		return fmt.Errorf("%w: unknown job kind %q", errPermanent, j.Kind)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: panic: %v", errPermanent, r)
+		}
+	}()
+	return run(s, j.ModelID)
+}
+
+// jobRetryDelay returns how long to wait after the given failed attempt
+func (s *Server) jobRetryDelay(attempt int) time.Duration {
+	d := s.cfg.JobRetryDelay.Duration
+	for i := 1; i < attempt && d < jobMaxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > jobMaxRetryDelay {
+		d = jobMaxRetryDelay
+	}
+	return d
+}
+
+// refreshProcessingStatus recomputes the processing status of a model from
+// its jobs. The lock keeps workers finishing at the same time from storing
+// the status in the wrong order.
+func (s *Server) refreshProcessingStatus(modelID uint) {
+	s.jobStatusMu.Lock()
+	defer s.jobStatusMu.Unlock()
+	jobs, err := s.store.ListModelJobs(modelID)
+	if err != nil {
+		log.Printf("refreshProcessingStatus: list jobs of model %d: %v", modelID, err)
+		return
+	}
+	if err := s.store.SetModelProcessingStatus(modelID, processingStatus(jobs)); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("refreshProcessingStatus: model %d: %v", modelID, err)
+	}
+}
+
+// processingStatus summarizes jobs, oldest first; only the latest job of
+// each kind counts, so a successful rerun clears an earlier failure
+func processingStatus(jobs []*Job) string {
+	latest := make(map[string]*Job)
+	for _, j := range jobs {
+		latest[j.Kind] = j
+	}
+	active, started, failed := false, false, false
+	for _, j := range latest {
+		switch j.Status {
+		case JobQueued:
+			active = true
+			started = started || j.Attempts > 0
+		case JobRunning:
+			active, started = true, true
+		case JobDone:
+			started = true
+		case JobFailed:
+			failed = true
+		}
+	}
+	switch {
+	case active && started:
+		return ProcessingProcessing
+	case active:
+		return ProcessingPending
+	case failed:
+		return ProcessingFailed
+	}
+	return ProcessingReady
+}
+
+// extractModelMetadata reads and stores the metadata of a model
+func (s *Server) extractModelMetadata(modelID uint) error {
+	m, err := s.store.GetModelByID(modelID)
+	if err != nil {
+		return err
+	}
+	md, err := readModelMetadata(filepath.Join(modelBaseDir(s.cfg, s.store, m), filepath.FromSlash(m.FileName)))
+	if err != nil {
+		return err
+	}
+	return s.store.SetModelMetadata(modelID, md)
+}
+
+// thumbnailJob renders the preview of a model; a model without anything to
+// draw, such as a point cloud, simply keeps no thumbnail
+func (s *Server) thumbnailJob(modelID uint) error {
+	err := s.renderModelThumbnail(modelID)
+	if errors.Is(err, errNothingToRender) {
+		log.Printf("thumbnailJob: model %d has nothing to render", modelID)
+		return nil
+	}
+	return err
+}
+
+// checkModelAccess reports whether the caller may change a model: managers
+// any, editors those in archives assigned to them, and an API key limited to
+// an archive only the models in it. It answers the request itself when not.
+func (s *Server) checkModelAccess(c *gin.Context, m *GLBModel) bool {
+	if keyArchive := apiKeyArchive(c); keyArchive != 0 && m.ArchiveID != keyArchive {
+		c.JSON(403, gin.H{"error": "This API key can only change models in its own archive"})
+		return false
+	}
+	if hasPermission(c.GetString("role"), PermArchivesManage) {
+		return true
+	}
+	assigned := false
+	if m.ArchiveID != 0 {
+		var err error
+		if assigned, err = s.store.IsArchiveEditor(m.ArchiveID, c.GetUint("user_id")); err != nil {
+			log.Printf("checkModelAccess: check editor: %v", err)
+			c.JSON(500, gin.H{"error": "Error checking archive access"})
+			return false
+		}
+	}
+	if !assigned {
+		c.JSON(403, gin.H{"error": "You are not assigned to this archive"})
+		return false
+	}
+	return true
+}
+
+// modelJobsHandler reports the processing status of a model and its jobs
+func (s *Server) modelJobsHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid model id"})
+		return
+	}
+	m, err := s.store.GetModelByID(uint(id))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Model not found"})
+		return
+	}
+	if !s.checkModelAccess(c, m) {
+		return
+	}
+	jobs, err := s.store.ListModelJobs(m.ID)
+	if err != nil {
+		log.Printf("modelJobsHandler: list jobs: %v", err)
+		c.JSON(500, gin.H{"error": "Error retrieving jobs"})
+		return
+	}
+	if jobs == nil {
+		jobs = []*Job{}
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(200, gin.H{
+		"message": "Jobs retrieved successfully",
+		"data": gin.H{
+			"model_id":          m.ID,
+			"processing_status": m.ProcessingStatus,
+			"jobs":              jobs,
+		},
+	})
+}
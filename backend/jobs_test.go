@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStoreJobs(t *testing.T) {
+	storeContract(t, func(t *testing.T, s Store) {
+		m := &GLBModel{Name: "cube", FileName: "cube.glb"}
+		if err := s.CreateModel(m); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		meta := &Job{ModelID: m.ID, Kind: JobMetadata, MaxAttempts: 3}
+		thumb := &Job{ModelID: m.ID, Kind: JobThumbnail, MaxAttempts: 3, RunAt: now.Add(time.Second)}
+		for _, j := range []*Job{meta, thumb} {
+			if err := s.CreateJob(j); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.CreateJob(&Job{ModelID: m.ID, Kind: JobMetadata, MaxAttempts: 3}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("second queued job of a kind: %v", err)
+		}
+		if err := s.CreateJob(&Job{ModelID: m.ID + 1, Kind: JobMetadata, MaxAttempts: 3}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("job of a missing model: %v", err)
+		}
+
+		// jobs are claimed once they are due, the earliest first
+		j, err := s.ClaimJob(now.Add(time.Minute))
+		if err != nil || j.ID != meta.ID || j.Status != JobRunning || j.Attempts != 1 {
+			t.Fatalf("claimed %+v: %v", j, err)
+		}
+		if _, err := s.ClaimJob(now); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("claimed a job before it is due: %v", err)
+		}
+		// a running job does not block a new one of its kind
+		if err := s.CreateJob(&Job{ModelID: m.ID, Kind: JobMetadata, MaxAttempts: 3}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.FinishJob(meta.ID, JobQueued, "boom", now.Add(time.Hour)); !errors.Is(err, ErrConflict) {
+			t.Fatalf("retry next to a queued job of its kind: %v", err)
+		}
+		if err := s.FinishJob(thumb.ID, JobDone, "", now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.FinishJob(meta.ID, JobFailed, "boom", now); err != nil {
+			t.Fatal(err)
+		}
+		if j, err := s.GetJob(meta.ID); err != nil || j.Status != JobFailed || j.LastError != "boom" {
+			t.Fatalf("finished %+v: %v", j, err)
+		}
+		jobs, _ := s.ListModelJobs(m.ID)
+		if len(jobs) != 3 || jobs[0].ID != meta.ID || jobs[2].Status != JobQueued {
+			t.Fatalf("jobs %+v", jobs)
+		}
+
+		// a restart puts interrupted jobs back in the queue
+		if _, err := s.ClaimJob(now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := s.RequeueRunningJobs(); err != nil || n != 1 {
+			t.Fatalf("requeued %d: %v", n, err)
+		}
+		if _, err := s.ClaimJob(now.Add(time.Minute)); err != nil {
+			t.Fatalf("requeued job not claimable: %v", err)
+		}
+
+		if err := s.DeleteModel(m.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetJob(meta.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("job outlived its model: %v", err)
+		}
+	})
+}
+
+func TestProcessingStatus(t *testing.T) {
+	job := func(kind, status string, attempts int) *Job {
+		return &Job{Kind: kind, Status: status, Attempts: attempts}
+	}
+	for _, tc := range []struct {
+		jobs []*Job
+		want string
+	}{
+		{nil, ProcessingReady},
+		{[]*Job{job(JobMetadata, JobQueued, 0), job(JobThumbnail, JobQueued, 0)}, ProcessingPending},
+		{[]*Job{job(JobMetadata, JobDone, 1), job(JobThumbnail, JobQueued, 0)}, ProcessingProcessing},
+		{[]*Job{job(JobMetadata, JobQueued, 2)}, ProcessingProcessing},
+		{[]*Job{job(JobMetadata, JobRunning, 1), job(JobThumbnail, JobFailed, 5)}, ProcessingProcessing},
+		{[]*Job{job(JobMetadata, JobDone, 1), job(JobThumbnail, JobFailed, 5)}, ProcessingFailed},
+		// a successful rerun clears the failure
+		{[]*Job{job(JobThumbnail, JobFailed, 5), job(JobThumbnail, JobDone, 1)}, ProcessingReady},
+	} {
+		if got := processingStatus(tc.jobs); got != tc.want {
+			t.Errorf("%d jobs: %s, want %s", len(tc.jobs), got, tc.want)
+		}
+	}
+}
+
+func TestJobRetryDelay(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.JobRetryDelay = Duration{20 * time.Minute} })
+	for attempt, want := range map[int]time.Duration{1: 20 * time.Minute, 2: 40 * time.Minute, 3: time.Hour, 10: time.Hour} {
+		if got := ts.jobRetryDelay(attempt); got != want {
+			t.Errorf("attempt %d: %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+// testJobKind registers a job kind that runs fn for the length of the test
+func testJobKind(t *testing.T, fn func(s *Server, modelID uint) error) string {
+	kind := "test-" + strings.ToLower(t.Name())
+	jobRunners[kind] = fn
+	t.Cleanup(func() { delete(jobRunners, kind) })
+	return kind
+}
+
+func TestJobRetriesUntilMaxAttempts(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.JobMaxAttempts = 3 })
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	ts.runJobs()
+	runs := 0
+	kind := testJobKind(t, func(s *Server, modelID uint) error {
+		runs++
+		return fmt.Errorf("attempt %d failed", runs)
+	})
+	job, err := ts.enqueueJob(id, kind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		// retries wait, so claim as if the delay had passed
+		j, err := ts.store.ClaimJob(time.Now().Add(24 * time.Hour))
+		if err != nil {
+			t.Fatalf("attempt %d not claimable: %v", attempt, err)
+		}
+		ts.processJob(j)
+		j, _ = ts.store.GetJob(job.ID)
+		want := JobQueued
+		if attempt == 3 {
+			want = JobFailed
+		}
+		if j.Status != want || j.Attempts != attempt || j.LastError != fmt.Sprintf("attempt %d failed", attempt) {
+			t.Fatalf("after attempt %d: %+v", attempt, j)
+		}
+		if want == JobQueued && !j.RunAt.After(time.Now()) {
+			t.Fatalf("retry not delayed: %v", j.RunAt)
+		}
+	}
+	if m, _ := ts.store.GetModelByID(id); m.ProcessingStatus != ProcessingFailed {
+		t.Fatalf("processing status %q", m.ProcessingStatus)
+	}
+
+	// a rerun that succeeds makes the model ready again
+	jobRunners[kind] = func(s *Server, modelID uint) error { return nil }
+	ts.enqueueJob(id, kind)
+	ts.runJobs()
+	if m, _ := ts.store.GetModelByID(id); m.ProcessingStatus != ProcessingReady {
+		t.Fatalf("processing status after rerun %q", m.ProcessingStatus)
+	}
+}
+
+func TestJobPermanentFailures(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	ts.runJobs()
+
+	for name, fn := range map[string]func(s *Server, modelID uint) error{
+		"permanent": func(s *Server, modelID uint) error { return fmt.Errorf("%w: unreadable", errPermanent) },
+		"panic":     func(s *Server, modelID uint) error { panic("bad model") },
+	} {
+		kind := testJobKind(t, fn)
+		job, _ := ts.enqueueJob(id, kind)
+		ts.runJobs()
+		if j, _ := ts.store.GetJob(job.ID); j.Status != JobFailed || j.Attempts != 1 {
+			t.Errorf("%s: %+v", name, j)
+		}
+		delete(jobRunners, kind)
+	}
+}
+
+func TestModelJobsHandler(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+
+	get := func() (status string, jobs []*Job) {
+		t.Helper()
+		w := ts.do("GET", fmt.Sprintf("/api/models/jobs?id=%d", id), admin, nil)
+		expectStatus(t, w, 200)
+		var resp struct {
+			Data struct {
+				Status string `json:"processing_status"`
+				Jobs   []*Job `json:"jobs"`
+			} `json:"data"`
+		}
+		decodeJSON(t, w, &resp)
+		return resp.Data.Status, resp.Data.Jobs
+	}
+	status, jobs := get()
+	if status != ProcessingPending || len(jobs) != len(ts.uploadJobs()) {
+		t.Fatalf("queued: %s %d jobs", status, len(jobs))
+	}
+	for i, kind := range ts.uploadJobs() {
+		if jobs[i].Kind != kind || jobs[i].Status != JobQueued {
+			t.Fatalf("job %d: %+v", i, jobs[i])
+		}
+	}
+	ts.runJobs()
+	status, jobs = get()
+	if status != ProcessingReady {
+		t.Fatalf("processed: %s", status)
+	}
+	for _, j := range jobs {
+		if j.Status != JobDone {
+			t.Fatalf("job %+v", j)
+		}
+	}
+
+	expectStatus(t, ts.do("GET", "/api/models/jobs?id=x", admin, nil), 400)
+	expectStatus(t, ts.do("GET", fmt.Sprintf("/api/models/jobs?id=%d", id+1), admin, nil), 404)
+	viewer := ts.userToken("viewer@test.com", RoleUser)
+	expectStatus(t, ts.do("GET", fmt.Sprintf("/api/models/jobs?id=%d", id), viewer, nil), 403)
+}
+
+func TestUploadJobsFollowConfig(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.OptimizeModels = true
+		c.LODRatios = []float64{0.5}
+	})
+	want := []string{JobMetadata, JobThumbnail, JobOptimize, JobLOD}
+	if got := ts.uploadJobs(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("upload jobs %v", got)
+	}
+}
+
+func TestQueueMissingJobs(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	done := ts.uploadModel(admin, "done.glb", testGLB(t, testCube()), nil)
+	ts.runJobs()
+	// a model copied in by hand, as the startup scan registers it
+	writeTestFile(t, ts.cfg.UploadDir, "copied.glb", testGLB(t, testCube()))
+	registerOrphanModel(ts.store, "copied.glb", "/uploads/copied.glb", 0, 0)
+	copied, err := ts.store.GetModelByFile("copied.glb", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.queueMissingJobs()
+	ts.queueMissingJobs()
+	n := len(ts.uploadJobs())
+	if jobs, _ := ts.store.ListModelJobs(copied.ID); len(jobs) != n {
+		t.Fatalf("copied model has %d jobs, want %d", len(jobs), n)
+	}
+	if jobs, _ := ts.store.ListModelJobs(done); len(jobs) != n {
+		t.Fatalf("processed model queued again: %d jobs", len(jobs))
+	}
+	ts.runJobs()
+	if m, _ := ts.store.GetModelByID(copied.ID); m.Metadata == nil || m.ThumbnailURL == "" {
+		t.Fatalf("copied model not processed: %+v", m)
+	}
+}
+
+func TestJobRunsForDeletedModel(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	j, err := ts.store.ClaimJob(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": id}), 200)
+	// the worker finishing a job of a deleted model must not fail loudly
+	ts.processJob(j)
+	if _, err := ts.store.GetJob(j.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("job of a deleted model: %v", err)
+	}
+}
+
+func TestMigrateProcessingJobs(t *testing.T) {
+	db := openTestDB(t)
+	migrateTo(t, db, 15)
+	if _, err := db.Exec(`INSERT INTO models (name, file_name, file_url, created_at, updated_at)
+		VALUES ('old', 'old.glb', '/uploads/old.glb', datetime('now'), datetime('now'))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	s := &SQLiteStore{db: db}
+	models, err := s.ListModels(0)
+	if err != nil || len(models) != 1 || models[0].ProcessingStatus != ProcessingReady {
+		t.Fatalf("model from before jobs %+v: %v", models, err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLoginEntries bounds how many IPs/accounts are tracked before stale
+// entries are swept
+const maxLoginEntries = 10000
+
+// loginAttempts counts the recent failed logins of one IP or account
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Lockout is a locked IP or account as shown to admins
+type Lockout struct {
+	Kind        string    `json:"kind"` // "account" or "ip"
+	Subject     string    `json:"subject"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	RetryAfter  int       `json:"retry_after"` // seconds
+}
+
+// loginLimiter tracks failed logins per client IP and per account. Once a
+// key reaches its failure threshold every further failure locks it for
+// twice as long as the previous one, up to LoginLockoutMax. Failures are
+// forgotten LoginLockoutMax after the last one. State is kept in memory and
+// starts empty on every restart.
+type loginLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*loginAttempts
+
+	accountMax int
+	ipMax      int
+	base       time.Duration
+	max        time.Duration
+}
+
+func newLoginLimiter(cfg Config) *loginLimiter {
+	return &loginLimiter{
+		entries:    make(map[string]*loginAttempts),
+		accountMax: cfg.LoginMaxFailures,
+		ipMax:      cfg.LoginIPMaxFailures,
+		base:       cfg.LoginLockout.Duration,
+		max:        cfg.LoginLockoutMax.Duration,
+	}
+}
+
+func ipKey(ip string) string { return "ip:" + ip }
+
+func accountKey(email string) string { return "account:" + strings.ToLower(strings.TrimSpace(email)) }
+
+// retryAfter returns how long the longest lock among keys still lasts, or 0
+// if none is locked
+func (l *loginLimiter) retryAfter(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		if a, ok := l.entries[k]; ok {
+			if d := a.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	return wait
+}
+
+// fail records a failed login for each key
+func (l *loginLimiter) fail(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if len(l.entries) >= maxLoginEntries {
+		l.sweep(now)
+	}
+	for _, k := range keys {
+		a, ok := l.entries[k]
+		if !ok || now.Sub(a.lastFailure) > l.max {
+			a = &loginAttempts{}
+			l.entries[k] = a
+		}
+		a.failures++
+		a.lastFailure = now
+
+		over := a.failures - l.threshold(k)
+		if over < 0 {
+			continue
+		}
+		d := l.max
+		if over < 32 && l.base<<over < l.max {
+			d = l.base << over
+		}
+		a.lockedUntil = now.Add(d)
+		log.Printf("Login locked for %s after %d failed attempts; retry in %s", k, a.failures, d)
+	}
+}
+
+// reset forgets the failures of key, after a successful login or when an
+// admin unlocks it. It reports whether key was tracked.
+func (l *loginLimiter) reset(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.entries[key]
+	delete(l.entries, key)
+	return ok
+}
+
+// locked lists the keys that are currently locked, longest lock first
+func (l *loginLimiter) locked() []Lockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	out := []Lockout{}
+	for k, a := range l.entries {
+		if !a.lockedUntil.After(now) {
+			continue
+		}
+		kind, subject, _ := strings.Cut(k, ":")
+		out = append(out, Lockout{
+			Kind:        kind,
+			Subject:     subject,
+			Failures:    a.failures,
+			LockedUntil: a.lockedUntil,
+			RetryAfter:  retrySeconds(a.lockedUntil.Sub(now)),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LockedUntil.After(out[j].LockedUntil) })
+	return out
+}
+
+func (l *loginLimiter) threshold(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return l.ipMax
+	}
+	return l.accountMax
+}
+
+// sweep drops entries that are neither locked nor recent. Callers hold mu.
+func (l *loginLimiter) sweep(now time.Time) {
+	for k, a := range l.entries {
+		if !a.lockedUntil.After(now) && now.Sub(a.lastFailure) > l.max {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// retrySeconds rounds d up to whole seconds for Retry-After
+func retrySeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// tooManyAttempts answers a login made while its IP or account is locked
+func tooManyAttempts(c *gin.Context, wait time.Duration) {
+	secs := retrySeconds(wait)
+	c.Header("Retry-After", fmt.Sprint(secs))
+	c.JSON(429, gin.H{"error": "Too many failed login attempts; try again later", "retry_after": secs})
+}
+
+// ============ LOCKOUT HANDLERS ============
+func (s *Server) listLockoutsHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"message": "Locked logins retrieved", "data": s.limiter.locked()})
+}
+
+// unlockHandler clears the failed attempts of an account or IP
+func (s *Server) unlockHandler(c *gin.Context) {
+	var req struct {
+		Kind    string `json:"kind" binding:"required,oneof=account ip"`
+		Subject string `json:"subject" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request; kind must be \"account\" or \"ip\""})
+		return
+	}
+
+	key := ipKey(req.Subject)
+	if req.Kind == "account" {
+		key = accountKey(req.Subject)
+	}
+	if !s.limiter.reset(key) {
+		c.JSON(404, ErrorResponse{Error: "No failed attempts recorded"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Unlocked"})
+}
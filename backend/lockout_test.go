@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testLimiter() *loginLimiter {
+	cfg := DefaultConfig()
+	cfg.LoginMaxFailures = 3
+	cfg.LoginIPMaxFailures = 5
+	cfg.LoginLockout = Duration{time.Minute}
+	cfg.LoginLockoutMax = Duration{4 * time.Minute}
+	return newLoginLimiter(cfg)
+}
+
+func TestLoginLimiterDoublesLock(t *testing.T) {
+	l := testLimiter()
+	key := accountKey(" A@Test.com ")
+	if key != accountKey("a@test.com") {
+		t.Fatalf("account keys differ by case: %q", key)
+	}
+	for i := 0; i < 2; i++ {
+		l.fail(key)
+	}
+	if wait := l.retryAfter(key); wait != 0 {
+		t.Fatalf("locked below the threshold for %v", wait)
+	}
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		l.fail(key)
+		if wait := l.retryAfter(key); wait <= want-time.Second || wait > want {
+			t.Fatalf("locked for %v, want %v", wait, want)
+		}
+	}
+	if got := l.locked(); len(got) != 1 || got[0].Kind != "account" || got[0].Subject != "a@test.com" || got[0].Failures != 6 {
+		t.Fatalf("locked %+v", got)
+	}
+	if !l.reset(key) || l.retryAfter(key) != 0 || l.reset(key) {
+		t.Fatal("reset")
+	}
+}
+
+func TestLoginLimiterIPThreshold(t *testing.T) {
+	l := testLimiter()
+	ip := ipKey("192.0.2.1")
+	for i := 0; i < 4; i++ {
+		l.fail(ip)
+	}
+	if l.retryAfter(ip) != 0 {
+		t.Fatal("IP locked at the account threshold")
+	}
+	l.fail(ip)
+	if l.retryAfter(ip) == 0 {
+		t.Fatal("IP not locked at its threshold")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.LoginMaxFailures = 3 })
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	bad := gin.H{"email": "a@test.com", "password": "wrong"}
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, ts.do("POST", "/api/auth/login", "", bad), 401)
+	}
+	w := ts.do("POST", "/api/auth/login", "", gin.H{"email": "a@test.com", "password": "secret123"})
+	expectStatus(t, w, 429)
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After")
+	}
+	// other accounts from the same IP are not affected
+	ts.login("admin@test.com", "secret123")
+
+	w = ts.do("GET", "/api/users/lockouts", admin, nil)
+	var list struct {
+		Data []Lockout `json:"data"`
+	}
+	decodeJSON(t, w, &list)
+	if len(list.Data) != 1 || list.Data[0].Subject != "a@test.com" {
+		t.Fatalf("lockouts %+v", list.Data)
+	}
+	expectStatus(t, ts.do("DELETE", "/api/users/lockouts", admin, gin.H{"kind": "account", "subject": "a@test.com"}), 200)
+	expectStatus(t, ts.do("DELETE", "/api/users/lockouts", admin, gin.H{"kind": "account", "subject": "a@test.com"}), 404)
+	expectStatus(t, ts.do("DELETE", "/api/users/lockouts", admin, gin.H{"kind": "user", "subject": "a@test.com"}), 400)
+	ts.login("a@test.com", "secret123")
+}
+
+func TestLoginSuccessResetsFailures(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.LoginMaxFailures = 3 })
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	bad := gin.H{"email": "a@test.com", "password": "wrong"}
+	for i := 0; i < 2; i++ {
+		expectStatus(t, ts.do("POST", "/api/auth/login", "", bad), 401)
+	}
+	ts.login("a@test.com", "secret123")
+	for i := 0; i < 2; i++ {
+		expectStatus(t, ts.do("POST", "/api/auth/login", "", bad), 401)
+	}
+	ts.login("a@test.com", "secret123")
+}
+
+func TestLoginLockoutByIP(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.LoginIPMaxFailures = 3 })
+	for _, email := range []string{"a@test.com", "b@test.com", "c@test.com"} {
+		expectStatus(t, ts.do("POST", "/api/auth/login", "", gin.H{"email": email, "password": "x"}), 401)
+	}
+	expectStatus(t, ts.do("POST", "/api/auth/login", "", gin.H{"email": "d@test.com", "password": "x"}), 429)
+	// archive logins share the IP lock
+	expectStatus(t, ts.do("POST", "/api/archives/login", "", gin.H{"token": "guess"}), 429)
+}
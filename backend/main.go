@@ -2,10 +2,13 @@ package main
 
 import (
 	"crypto/rand"
-	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -15,48 +18,53 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// ============ IN-MEMORY STORAGE ============
-var (
-	users                 = make(map[uint]*User)
-	models                = make(map[uint]*GLBModel)
-	archives              = make(map[uint]*Archive)
-	userIDCounter    uint = 1
-	modelIDCounter   uint = 1
-	archiveIDCounter uint = 1
-	mu               sync.RWMutex
-)
-
 // ============ MODELS ============
 type User struct {
-	ID           uint      `json:"id"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"`
-	Role         string    `json:"role"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           uint       `json:"id"`
+	Email        string     `json:"email"`
+	PasswordHash string     `json:"-"`
+	Role         string     `json:"role"`
+	DisabledAt   *time.Time `json:"disabled_at"` // disabled accounts cannot log in
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
 }
 
 type GLBModel struct {
-	ID          uint      `json:"id"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	FileURL     string    `json:"file_url"`
-	FileName    string    `json:"file_name"`
-	ArchiveID   uint      `json:"archive_id"`
-	UploadedBy  uint      `json:"uploaded_by"`
-	FileSize    int64     `json:"file_size"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	FileURL     string `json:"file_url"`
+	FileName    string `json:"file_name"`
+	ArchiveID   uint   `json:"archive_id"`
+	UploadedBy  uint   `json:"uploaded_by"`
+	FileSize    int64  `json:"file_size"`
+	// Metadata is read from the file on upload; nil until it could be
+	Metadata *ModelMetadata `json:"metadata"`
+	// ThumbnailURL points to a rendered PNG preview; empty until rendered
+	ThumbnailURL string `json:"thumbnail_url"`
+	// ProcessingStatus tells how far the post-upload jobs have come
+	ProcessingStatus string `json:"processing_status"`
+	// OptimizedURL points to a smaller GLB of the same model; empty when
+	// there is none
+	OptimizedURL  string `json:"optimized_url"`
+	OptimizedSize int64  `json:"optimized_size"`
+	// LODs are simplified versions of a heavy model, most detailed first
+	LODs []ModelLOD `json:"lods"`
+	// SourceURL points to the uploaded file a converted model was made
+	// from, in SourceFormat ("obj", "stl", "ply" or "fbx"); both are empty
+	// for models uploaded as glTF
+	SourceURL    string    `json:"source_url"`
+	SourceFormat string    `json:"source_format"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type Archive struct {
 	ID        uint      `json:"id"`
 	Name      string    `json:"name"` // folder name (e.g., ARSIP_001)
-	Token     string    `json:"token"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -72,9 +80,12 @@ type LoginRequest struct {
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
-	Role  string `json:"role"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refresh_token"`
+	ExpiresIn    int64        `json:"expires_in"` // access token lifetime in seconds
+	User         User         `json:"user"`
+	Role         string       `json:"role"`
+	Permissions  []Permission `json:"permissions"`
 }
 
 type ErrorResponse struct {
@@ -87,47 +98,68 @@ type SuccessResponse struct {
 }
 
 // ============ JWT HELPERS ============
-const JWTSecret = "your-super-secret-key-change-in-production"
+// JWT audiences. User and archive tokens are signed with the same secret, so
+// the audience is what keeps one kind from being accepted as the other.
+const (
+	audienceUser    = "glb-user"
+	audienceArchive = "glb-archive"
+)
 
+// Claims are carried by the access tokens of registered users
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Email  string `json:"email"`
-	Role   string `json:"role"`
+	UserID    uint   `json:"user_id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func generateToken(userID uint, email string, role string) (string, error) {
+func (s *Server) generateToken(userID uint, email string, role string, sessionID string) (string, error) {
 	claims := Claims{
-		UserID: userID,
-		Email:  email,
-		Role:   role,
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			Audience:  jwt.ClaimStrings{audienceUser},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(s.cfg.TokenTTL.Duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
+	return s.signClaims(claims)
+}
 
+func (s *Server) signClaims(claims jwt.Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(JWTSecret))
+	return token.SignedString([]byte(s.cfg.JWTSecret))
 }
 
-func verifyToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+// parseClaims verifies tokenString and that it was issued for audience,
+// filling in claims
+func (s *Server) parseClaims(tokenString string, claims jwt.Claims, audience string) error {
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(JWTSecret), nil
-	})
+		return []byte(s.cfg.JWTSecret), nil
+	}, jwt.WithAudience(audience))
 
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	if !token.Valid {
+		return fmt.Errorf("invalid token")
 	}
+	return nil
+}
 
-	return nil, fmt.Errorf("invalid token")
+// verifyToken accepts only user access tokens
+func (s *Server) verifyToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	if err := s.parseClaims(tokenString, claims, audienceUser); err != nil {
+		return nil, err
+	}
+	return claims, nil
 }
 
 // generateRandomToken returns a hex encoded random string of length 2*n
@@ -139,8 +171,34 @@ func generateRandomToken(n int) (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
+// ============ SERVER ============
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+	cfg     Config
+	store   Store
+	mailer  Mailer
+	limiter *loginLimiter
+	oidc    *oidcProvider // nil unless OIDC login is configured
+	uploads *uploadLocks
+	// jobWake nudges an idle job worker when a job is queued
+	jobWake     chan struct{}
+	jobStatusMu sync.Mutex
+}
+
+func NewServer(cfg Config, store Store, mailer Mailer) *Server {
+	return &Server{
+		cfg:     cfg,
+		store:   store,
+		mailer:  mailer,
+		limiter: newLoginLimiter(cfg),
+		oidc:    newOIDCProvider(cfg),
+		uploads: newUploadLocks(),
+		jobWake: make(chan struct{}, 1),
+	}
+}
+
 // ============ MIDDLEWARE ============
-func authMiddleware() gin.HandlerFunc {
+func (s *Server) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -157,26 +215,89 @@ func authMiddleware() gin.HandlerFunc {
 		}
 
 		token := parts[1]
-		claims, err := verifyToken(token)
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			user, key, err := s.authenticateAPIKey(token)
+			if err != nil {
+				c.JSON(401, gin.H{"error": "Invalid, expired or revoked API key"})
+				c.Abort()
+				return
+			}
+			if user.DisabledAt != nil {
+				c.JSON(401, gin.H{"error": "Account disabled or removed"})
+				c.Abort()
+				return
+			}
+			c.Set("user_id", user.ID)
+			c.Set("email", user.Email)
+			c.Set("role", user.Role)
+			c.Set("api_key", key)
+			c.Next()
+			return
+		}
+
+		claims, err := s.verifyToken(token)
 		if err != nil {
+			if _, aerr := s.verifyArchiveToken(token); aerr == nil {
+				c.JSON(403, gin.H{"error": "Archive tokens cannot be used here"})
+			} else {
+				c.JSON(401, gin.H{"error": "Invalid or expired token"})
+			}
+			c.Abort()
+			return
+		}
+
+		// every user token belongs to a server-side session that may have been revoked
+		if claims.SessionID == "" {
 			c.JSON(401, gin.H{"error": "Invalid or expired token"})
 			c.Abort()
 			return
 		}
+		sess, err := s.store.GetSession(claims.SessionID)
+		if err != nil || !sess.Active(time.Now()) || sess.UserID != claims.UserID {
+			c.JSON(401, gin.H{"error": "Session expired or revoked"})
+			c.Abort()
+			return
+		}
+		// the account is re-read so disabling it or changing its role takes
+		// effect before the access token expires
+		user, err := s.store.GetUserByID(claims.UserID)
+		if err != nil || user.DisabledAt != nil {
+			c.JSON(401, gin.H{"error": "Account disabled or removed"})
+			c.Abort()
+			return
+		}
 
-		c.Set("user_id", claims.UserID)
-		c.Set("email", claims.Email)
-		c.Set("role", claims.Role)
+		c.Set("user_id", user.ID)
+		c.Set("email", user.Email)
+		c.Set("role", user.Role)
+		c.Set("session_id", claims.SessionID)
 		c.Next()
 	}
 }
 
-func corsMiddleware() gin.HandlerFunc {
+// corsMiddleware allows the configured origins; "*" allows any origin
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	allowAll := false
+	allowed := make(map[string]bool)
+	for _, o := range origins {
+		if o == "*" {
+			allowAll = true
+		}
+		allowed[o] = true
+	}
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		if allowAll {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Add("Vary", "Origin")
+			if origin := c.GetHeader("Origin"); allowed[origin] {
+				c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+		}
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, Upload-Offset")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "Retry-After, Upload-Offset, Location, Content-Disposition")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -188,7 +309,7 @@ func corsMiddleware() gin.HandlerFunc {
 }
 
 // ============ AUTH HANDLERS ============
-func registerHandler(c *gin.Context) {
+func (s *Server) registerHandler(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request"})
@@ -201,26 +322,20 @@ func registerHandler(c *gin.Context) {
 		return
 	}
 
-	mu.Lock()
-	for _, u := range users {
-		if u.Email == req.Email {
-			mu.Unlock()
-			c.JSON(409, gin.H{"error": "Email already exists"})
-			return
-		}
-	}
-
 	user := &User{
-		ID:           userIDCounter,
 		Email:        req.Email,
 		PasswordHash: string(hashedPassword),
-		Role:         "user",
-		CreatedAt:    time.Now(),
-		UpdatedAt:    time.Now(),
+		Role:         RoleUser,
+	}
+	if err := s.store.CreateUser(user); err != nil {
+		if errors.Is(err, ErrConflict) {
+			c.JSON(409, gin.H{"error": "Email already exists"})
+			return
+		}
+		log.Printf("registerHandler: create user: %v", err)
+		c.JSON(500, gin.H{"error": "Error creating user"})
+		return
 	}
-	users[userIDCounter] = user
-	userIDCounter++
-	mu.Unlock()
 
 	c.JSON(201, gin.H{
 		"message": "User registered successfully",
@@ -232,62 +347,59 @@ func registerHandler(c *gin.Context) {
 	})
 }
 
-func loginHandler(c *gin.Context) {
+func (s *Server) loginHandler(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "Invalid request"})
 		return
 	}
-
-	mu.RLock()
-	var user *User
-	for _, u := range users {
-		if u.Email == req.Email {
-			user = u
-			break
-		}
+	ip, account := ipKey(c.ClientIP()), accountKey(req.Email)
+	if wait := s.limiter.retryAfter(ip, account); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
 	}
-	mu.RUnlock()
 
-	if user == nil {
+	user, err := s.store.GetUserByEmail(req.Email)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("loginHandler: lookup user: %v", err)
+		} else {
+			s.limiter.fail(ip, account)
+		}
 		c.JSON(401, gin.H{"error": "Invalid email or password"})
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		s.limiter.fail(ip, account)
 		c.JSON(401, gin.H{"error": "Invalid email or password"})
 		return
 	}
+	s.limiter.reset(account)
+	if user.DisabledAt != nil {
+		c.JSON(403, gin.H{"error": "Account disabled"})
+		return
+	}
 
-	token, err := generateToken(user.ID, user.Email, user.Role)
+	resp, err := s.startSession(user)
 	if err != nil {
+		log.Printf("loginHandler: start session: %v", err)
 		c.JSON(500, gin.H{"error": "Error generating token"})
 		return
 	}
 
-	c.JSON(200, AuthResponse{
-		Token: token,
-		User: User{
-			ID:    user.ID,
-			Email: user.Email,
-			Role:  user.Role,
-		},
-		Role: user.Role,
-	})
+	c.JSON(200, resp)
 }
 
-func getUserProfileHandler(c *gin.Context) {
+func (s *Server) getUserProfileHandler(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
 		c.JSON(401, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	mu.RLock()
-	user, ok := users[userID.(uint)]
-	mu.RUnlock()
-
-	if !ok {
+	user, err := s.store.GetUserByID(userID.(uint))
+	if err != nil {
 		c.JSON(404, gin.H{"error": "User not found"})
 		return
 	}
@@ -295,32 +407,46 @@ func getUserProfileHandler(c *gin.Context) {
 	c.JSON(200, gin.H{
 		"message": "User profile",
 		"data": gin.H{
-			"id":    user.ID,
-			"email": user.Email,
-			"role":  user.Role,
+			"id":          user.ID,
+			"email":       user.Email,
+			"role":        user.Role,
+			"permissions": permissionsOf(user.Role),
 		},
 	})
 }
 
 // ============ MODEL HANDLERS ============
-func uploadModelHandler(c *gin.Context) {
-	role, exists := c.Get("role")
-	if !exists || role != "admin" {
-		c.JSON(403, gin.H{"error": "Only admin can upload models"})
-		return
-	}
-
-	userID, _ := c.Get("user_id")
-
+func (s *Server) uploadModelHandler(c *gin.Context) {
+	// cap the request body; allow some slack for the other form fields
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.cfg.MaxUploadSize+1<<20)
 	file, err := c.FormFile("file")
 	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			c.JSON(413, gin.H{"error": fmt.Sprintf("File exceeds the maximum upload size of %d bytes", s.cfg.MaxUploadSize)})
+			return
+		}
 		c.JSON(400, gin.H{"error": "No file uploaded"})
 		return
 	}
+	if file.Size > s.cfg.MaxUploadSize {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File exceeds the maximum upload size of %d bytes", s.cfg.MaxUploadSize)})
+		return
+	}
 
-	fileExt := filepath.Ext(file.Filename)
-	if fileExt != ".glb" && fileExt != ".gltf" {
-		c.JSON(400, gin.H{"error": "Only .glb and .gltf files are allowed"})
+	fileExt := strings.ToLower(filepath.Ext(file.Filename))
+	if !modelExtension(fileExt) && fileExt != ".zip" {
+		c.JSON(400, gin.H{"error": uploadExtensionError})
+		return
+	}
+	// buffers, materials and images a .gltf, .obj, .ply or .fbx refers to
+	// come along as "resources"
+	var resources []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil {
+		resources = form.File["resources"]
+	}
+	if len(resources) > 0 && (fileExt == ".glb" || fileExt == ".zip" || importFormat(fileExt) == "stl") {
+		c.JSON(400, gin.H{"error": "Resource files can only accompany a .gltf, .obj, .ply or .fbx file"})
 		return
 	}
 
@@ -333,34 +459,38 @@ func uploadModelHandler(c *gin.Context) {
 		return
 	}
 
-	// determine destination: default uploads/ unless archive specified
-	var destDir string = "uploads"
-	var archiveID uint = 0
-	var fileURL string
-	if archiveIDStr != "" {
-		// parse archive id
-		var aid uint64
-		var err error
-		if aid, err = strconv.ParseUint(archiveIDStr, 10, 64); err == nil {
-			mu.RLock()
-			arch, ok := archives[uint(aid)]
-			mu.RUnlock()
-			if ok {
-				destDir = filepath.Join("model_archives", arch.Name)
-				archiveID = uint(aid)
-			} else {
-				c.JSON(400, gin.H{"error": "Archive not found"})
-				return
+	destDir, arch, ok := s.uploadTarget(c, archiveIDStr)
+	if !ok {
+		return
+	}
+
+	// converted formats are stored like a multi-file model, with the GLB
+	// beside the uploaded files
+	if fileExt == ".zip" || len(resources) > 0 || importFormat(fileExt) != "" {
+		stored, ok := s.storeModelFiles(c, destDir, fileExt != ".zip", func(dir string) (string, error) {
+			if fileExt != ".zip" {
+				return stageMultipart(dir, file, resources)
 			}
-		} else {
-			c.JSON(400, gin.H{"error": "Invalid archive_id"})
-			return
+			src, err := file.Open()
+			if err != nil {
+				return "", err
+			}
+			defer src.Close()
+			return extractZip(src, file.Size, dir, s.cfg.MaxResumableUploadSize)
+		})
+		if ok {
+			s.createUploadedModel(c, name, description, destDir, stored, arch)
 		}
+		return
 	}
 
-	// ensure dest dir exists
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		c.JSON(500, gin.H{"error": "Error creating destination directory"})
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error reading file"})
+		return
+	}
+	defer src.Close()
+	if !checkModelFile(c, src, file.Size, fileExt, nil) {
 		return
 	}
 
@@ -372,73 +502,123 @@ func uploadModelHandler(c *gin.Context) {
 		return
 	}
 
-	if archiveID != 0 {
-		// File served via secure archive route
-		mu.RLock()
-		arch := archives[archiveID]
-		mu.RUnlock()
-		fileURL = fmt.Sprintf("/api/archives/%s/files/%s", arch.Name, fileName)
-	} else {
-		fileURL = fmt.Sprintf("/uploads/%s", fileName)
+	s.createUploadedModel(c, name, description, destDir, storedModel{fileName: fileName, size: file.Size}, arch)
+}
+
+// uploadExtensionError answers an upload of a file that is not a model
+const uploadExtensionError = "Only .glb, .gltf, .obj, .stl, .ply, .fbx and .zip files are allowed"
+
+// checkModelFile validates the content of an uploaded model, answering 422
+// with the list of problems if it is not a valid glTF 2.0 asset. External
+// URIs are opened through resolve, or reported missing when it is nil.
+func checkModelFile(c *gin.Context, r io.ReaderAt, size int64, ext string, resolve gltfResolver) bool {
+	if errs := validateGLTF(r, size, ext, resolve); len(errs) > 0 {
+		c.JSON(422, gin.H{"error": "File is not a valid glTF 2.0 model", "validation_errors": errs})
+		return false
 	}
+	return true
+}
 
-	// insert into SQLite (if available)
-	var dbID int64 = 0
-	if DB != nil {
-		var aid *int64
-		var ub *int64
-		if archiveID != 0 {
-			a := int64(archiveID)
-			aid = &a
-		}
-		if userID != nil {
-			if uid, ok := userID.(uint); ok {
-				u := int64(uid)
-				ub = &u
-			}
+// uploadTarget resolves the directory an upload is stored in: the upload dir,
+// or the archive named by archiveIDStr once the caller is allowed to upload
+// there. It answers the request itself when ok is false.
+func (s *Server) uploadTarget(c *gin.Context, archiveIDStr string) (destDir string, arch *Archive, ok bool) {
+	// an API key limited to one archive uploads there by default and nowhere else
+	keyArchive := apiKeyArchive(c)
+	if keyArchive != 0 && archiveIDStr == "" {
+		archiveIDStr = strconv.FormatUint(uint64(keyArchive), 10)
+	}
+
+	// editors may only upload into archives they are assigned to; this
+	// follows the role, whatever the scopes of an API key
+	manager := hasPermission(c.GetString("role"), PermArchivesManage)
+	if !manager && archiveIDStr == "" {
+		c.JSON(403, gin.H{"error": "Editors must upload into an assigned archive"})
+		return "", nil, false
+	}
+
+	// determine destination: default uploads/ unless archive specified
+	destDir = s.cfg.UploadDir
+	if archiveIDStr != "" {
+		aid, err := strconv.ParseUint(archiveIDStr, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{"error": "Invalid archive_id"})
+			return "", nil, false
 		}
-		id, err := InsertModel(name, description, fileName, fileURL, int64(file.Size), aid, ub)
+		arch, err = s.store.GetArchiveByID(uint(aid))
 		if err != nil {
-			log.Printf("Warning: failed insert model to sqlite: %v", err)
-		} else {
-			dbID = id
+			c.JSON(400, gin.H{"error": "Archive not found"})
+			return "", nil, false
+		}
+		if keyArchive != 0 && arch.ID != keyArchive {
+			c.JSON(403, gin.H{"error": "This API key can only upload into its own archive"})
+			return "", nil, false
 		}
+		if !manager {
+			assigned, err := s.store.IsArchiveEditor(arch.ID, c.GetUint("user_id"))
+			if err != nil {
+				log.Printf("uploadTarget: check editor: %v", err)
+				c.JSON(500, gin.H{"error": "Error checking archive access"})
+				return "", nil, false
+			}
+			if !assigned {
+				c.JSON(403, gin.H{"error": "You are not assigned to this archive"})
+				return "", nil, false
+			}
+		}
+		destDir = filepath.Join(s.cfg.ArchiveRoot, arch.Name)
 	}
 
-	// also keep in-memory for compatibility
-	mu.Lock()
-	assignedID := modelIDCounter
-	if dbID > 0 {
-		// keep counters in sync
-		if uint(dbID) >= modelIDCounter {
-			assignedID = uint(dbID)
-			modelIDCounter = uint(dbID + 1)
-		}
+	// ensure dest dir exists
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		c.JSON(500, gin.H{"error": "Error creating destination directory"})
+		return "", nil, false
 	}
+	return destDir, arch, true
+}
+
+// createUploadedModel records the model stored in destDir as a model of
+// the caller, queues its processing and answers the upload. The files are
+// removed if that fails.
+func (s *Server) createUploadedModel(c *gin.Context, name, description, destDir string, stored storedModel, arch *Archive) {
+	fileName := stored.fileName
+	filePath := filepath.Join(destDir, filepath.FromSlash(fileName))
 	model := &GLBModel{
-		ID:          assignedID,
-		Name:        name,
-		Description: description,
-		FileName:    fileName,
-		FileURL:     fileURL,
-		ArchiveID:   archiveID,
-		UploadedBy: func() uint {
-			if userID != nil {
-				if uid, ok := userID.(uint); ok {
-					return uid
-				}
-			}
-			return 0
-		}(),
-		FileSize:  file.Size,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		Name:             name,
+		Description:      description,
+		FileName:         fileName,
+		FileSize:         stored.size,
+		UploadedBy:       c.GetUint("user_id"),
+		ProcessingStatus: ProcessingPending,
+		SourceFormat:     stored.sourceFormat,
+	}
+	if arch != nil {
+		// File served via secure archive route
+		model.ArchiveID = arch.ID
+		model.FileURL = fmt.Sprintf("/api/archives/%s/files/%s", arch.Name, fileName)
+		if stored.sourceFileName != "" {
+			model.SourceURL = fmt.Sprintf("/api/archives/%s/files/%s", arch.Name, stored.sourceFileName)
+		}
+	} else {
+		model.FileURL = fmt.Sprintf("/uploads/%s", fileName)
+		if stored.sourceFileName != "" {
+			model.SourceURL = fmt.Sprintf("/uploads/%s", stored.sourceFileName)
+		}
 	}
-	models[assignedID] = model
-	if assignedID >= modelIDCounter {
-		modelIDCounter = assignedID + 1
+
+	if err := s.store.CreateModel(model); err != nil {
+		log.Printf("createUploadedModel: create model: %v", err)
+		if err := removeModelFiles(destDir, fileName); err != nil {
+			log.Printf("Warning: failed to remove file %s: %v", filePath, err)
+		}
+		c.JSON(500, gin.H{"error": "Error saving model"})
+		return
+	}
+	s.queueUploadJobs(model.ID)
+	warnings := stored.warnings
+	if warnings == nil {
+		warnings = []string{}
 	}
-	mu.Unlock()
 
 	c.JSON(201, gin.H{
 		"message": "Model uploaded successfully",
@@ -450,22 +630,30 @@ func uploadModelHandler(c *gin.Context) {
 			"file_name":   model.FileName,
 			"file_size":   model.FileSize,
 			"archive_id":  model.ArchiveID,
+			// metadata and thumbnail follow once the jobs are done
+			"processing_status": model.ProcessingStatus,
+			"source_url":        model.SourceURL,
+			"source_format":     model.SourceFormat,
+			// what a conversion had to leave out
+			"warnings": warnings,
 		},
 	})
 }
 
-func getModelsHandler(c *gin.Context) {
-	// Allow optional filtering by archive. If caller is an archive_user, only return their archive.
+func (s *Server) getModelsHandler(c *gin.Context) {
+	// Allow optional filtering by archive. If caller holds an archive token, only return their archive.
 	var archiveFilter uint = 0
 	// check Authorization header for archive user token
 	authHeader := c.GetHeader("Authorization")
 	if authHeader != "" {
 		parts := strings.Split(authHeader, " ")
 		if len(parts) == 2 && parts[0] == "Bearer" {
-			if claims, err := verifyToken(parts[1]); err == nil {
-				if claims.Role == "archive_user" {
-					archiveFilter = claims.UserID
+			if claims, err := s.verifyArchiveToken(parts[1]); err == nil {
+				if _, _, err := s.currentArchive(claims); err != nil {
+					c.JSON(401, gin.H{"error": "Archive token revoked or expired"})
+					return
 				}
+				archiveFilter = claims.ArchiveID
 			}
 		}
 	}
@@ -479,29 +667,46 @@ func getModelsHandler(c *gin.Context) {
 		}
 	}
 
-	mu.RLock()
-	defer mu.RUnlock()
+	models, err := s.store.ListModels(archiveFilter)
+	if err != nil {
+		log.Printf("getModelsHandler: list models: %v", err)
+		c.JSON(500, gin.H{"error": "Error retrieving models"})
+		return
+	}
 
+	uploaders := make(map[uint]string)
 	var response []interface{}
 	for _, model := range models {
-		if archiveFilter != 0 && model.ArchiveID != archiveFilter {
-			continue
+		lods := model.LODs
+		if lods == nil {
+			lods = []ModelLOD{}
 		}
-		var uploaderEmail string
-		if user, ok := users[model.UploadedBy]; ok {
-			uploaderEmail = user.Email
+		uploaderEmail, seen := uploaders[model.UploadedBy]
+		if !seen && model.UploadedBy != 0 {
+			if user, err := s.store.GetUserByID(model.UploadedBy); err == nil {
+				uploaderEmail = user.Email
+			}
+			uploaders[model.UploadedBy] = uploaderEmail
 		}
 
 		response = append(response, gin.H{
-			"id":          model.ID,
-			"name":        model.Name,
-			"description": model.Description,
-			"file_url":    model.FileURL,
-			"file_name":   model.FileName,
-			"file_size":   model.FileSize,
-			"uploaded_by": uploaderEmail,
-			"archive_id":  model.ArchiveID,
-			"created_at":  model.CreatedAt.Format("2006-01-02 15:04:05"),
+			"id":                model.ID,
+			"name":              model.Name,
+			"description":       model.Description,
+			"file_url":          model.FileURL,
+			"file_name":         model.FileName,
+			"file_size":         model.FileSize,
+			"uploaded_by":       uploaderEmail,
+			"archive_id":        model.ArchiveID,
+			"metadata":          model.Metadata,
+			"thumbnail_url":     model.ThumbnailURL,
+			"processing_status": model.ProcessingStatus,
+			"optimized_url":     model.OptimizedURL,
+			"optimized_size":    model.OptimizedSize,
+			"lods":              lods,
+			"source_url":        model.SourceURL,
+			"source_format":     model.SourceFormat,
+			"created_at":        model.CreatedAt.Format("2006-01-02 15:04:05"),
 		})
 	}
 
@@ -512,14 +717,7 @@ func getModelsHandler(c *gin.Context) {
 }
 
 // ============ ARCHIVE HANDLERS & MIDDLEWARE ============
-func createArchiveHandler(c *gin.Context) {
-	// only admin
-	role, exists := c.Get("role")
-	if !exists || role != "admin" {
-		c.JSON(403, ErrorResponse{Error: "Only admins can create archives"})
-		return
-	}
-
+func (s *Server) createArchiveHandler(c *gin.Context) {
 	// optional custom name
 	name := c.PostForm("name")
 	if name == "" {
@@ -529,79 +727,119 @@ func createArchiveHandler(c *gin.Context) {
 	name = strings.TrimSpace(name)
 	name = strings.ReplaceAll(name, " ", "_")
 
+	// optional access policy
+	expiresAt, err := parseExpiry(c.PostForm("expires_at"))
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid expires_at; use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	maxLogins := 0
+	if v := c.PostForm("max_logins"); v != "" {
+		if maxLogins, err = strconv.Atoi(v); err != nil || maxLogins < 0 {
+			c.JSON(400, ErrorResponse{Error: "Invalid max_logins"})
+			return
+		}
+	}
+
+	tokenName := c.PostForm("token_name")
+	if tokenName == "" {
+		tokenName = "Default"
+	}
+
 	token, err := generateRandomToken(16)
 	if err != nil {
 		c.JSON(500, ErrorResponse{Error: "Failed to generate token"})
 		return
 	}
 
+	arch := &Archive{Name: name}
+	if err := s.store.CreateArchive(arch); err != nil {
+		if errors.Is(err, ErrConflict) {
+			c.JSON(409, ErrorResponse{Error: "Archive already exists"})
+			return
+		}
+		log.Printf("createArchiveHandler: create archive: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to create archive"})
+		return
+	}
+
 	// create folder
-	dir := filepath.Join("model_archives", name)
+	dir := filepath.Join(s.cfg.ArchiveRoot, name)
 	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.store.DeleteArchive(arch.ID)
 		c.JSON(500, ErrorResponse{Error: "Failed to create archive folder"})
 		return
 	}
 
-	// write token.txt
-	if err := os.WriteFile(filepath.Join(dir, "token.txt"), []byte(token), 0644); err != nil {
-		c.JSON(500, ErrorResponse{Error: "Failed to write token file"})
-		return
+	// first access token
+	tok := &ArchiveToken{
+		ArchiveID: arch.ID,
+		Name:      tokenName,
+		ExpiresAt: expiresAt,
+		MaxLogins: maxLogins,
 	}
-
-	mu.Lock()
-	arch := &Archive{
-		ID:        archiveIDCounter,
-		Name:      name,
-		Token:     token,
-		CreatedAt: time.Now(),
+	tok.setSecret(token)
+	if err := s.store.CreateArchiveToken(tok); err != nil {
+		s.store.DeleteArchive(arch.ID)
+		log.Printf("createArchiveHandler: create token: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to create archive token"})
+		return
 	}
-	archives[archiveIDCounter] = arch
-	archiveIDCounter++
-	mu.Unlock()
 
-	c.JSON(201, gin.H{"message": "Archive created", "data": arch})
+	// the secret is only returned here; the store keeps its hash
+	c.JSON(201, gin.H{"message": "Archive created", "data": gin.H{
+		"id":         arch.ID,
+		"name":       arch.Name,
+		"created_at": arch.CreatedAt,
+		"token":      tok.Token,
+		"tokens":     []*ArchiveToken{tok},
+	}})
 }
 
-func listArchivesHandler(c *gin.Context) {
-	// only admin
-	role, exists := c.Get("role")
-	if !exists || role != "admin" {
-		c.JSON(403, ErrorResponse{Error: "Only admins can list archives"})
+// listArchivesHandler returns every archive with its tokens to managers and
+// only the assigned archives, without tokens, to editors
+func (s *Server) listArchivesHandler(c *gin.Context) {
+	manage := can(c, PermArchivesManage)
+	var archives []*Archive
+	var err error
+	if manage {
+		archives, err = s.store.ListArchives()
+	} else {
+		archives, err = s.store.ListEditorArchives(c.GetUint("user_id"))
+	}
+	if err != nil {
+		log.Printf("listArchivesHandler: list archives: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to list archives"})
 		return
 	}
 
-	mu.RLock()
-	defer mu.RUnlock()
-
 	var resp []interface{}
 	for _, a := range archives {
 		// count models in archive
-		count := 0
-		for _, m := range models {
-			if m.ArchiveID == a.ID {
-				count++
-			}
+		count, err := s.store.CountModels(a.ID)
+		if err != nil {
+			log.Printf("listArchivesHandler: count models in %s: %v", a.Name, err)
 		}
-		resp = append(resp, gin.H{
+		item := gin.H{
 			"id":         a.ID,
 			"name":       a.Name,
-			"token":      a.Token,
 			"count":      count,
 			"created_at": a.CreatedAt.Format("2006-01-02 15:04:05"),
-		})
+		}
+		if manage {
+			tokens, err := s.store.ListArchiveTokens(a.ID)
+			if err != nil {
+				log.Printf("listArchivesHandler: list tokens of %s: %v", a.Name, err)
+			}
+			item["tokens"] = tokens
+		}
+		resp = append(resp, item)
 	}
 
 	c.JSON(200, gin.H{"message": "Archives retrieved", "data": resp})
 }
 
-func deleteArchiveHandler(c *gin.Context) {
-	// only admin
-	role, exists := c.Get("role")
-	if !exists || role != "admin" {
-		c.JSON(403, ErrorResponse{Error: "Only admins can delete archives"})
-		return
-	}
-
+func (s *Server) deleteArchiveHandler(c *gin.Context) {
 	var req struct {
 		ID uint `json:"id" binding:"required"`
 	}
@@ -610,39 +848,29 @@ func deleteArchiveHandler(c *gin.Context) {
 		return
 	}
 
-	mu.Lock()
-	arch, ok := archives[req.ID]
-	if !ok {
-		mu.Unlock()
+	arch, err := s.store.GetArchiveByID(req.ID)
+	if err != nil {
 		c.JSON(404, ErrorResponse{Error: "Archive not found"})
 		return
 	}
 
-	// delete models in archive
-	for id, m := range models {
-		if m.ArchiveID == req.ID {
-			// remove file
-			p := filepath.Join("model_archives", arch.Name, m.FileName)
-			if err := os.Remove(p); err != nil {
-				log.Printf("Warning: failed to remove file %s: %v", p, err)
-			}
-			delete(models, id)
-		}
+	// delete archive row; its models are removed by cascade
+	if err := s.store.DeleteArchive(arch.ID); err != nil {
+		log.Printf("deleteArchiveHandler: delete archive %d: %v", arch.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to delete archive"})
+		return
 	}
 
-	// delete folder
-	dir := filepath.Join("model_archives", arch.Name)
+	// delete folder (and the model files inside it)
+	dir := filepath.Join(s.cfg.ArchiveRoot, arch.Name)
 	if err := os.RemoveAll(dir); err != nil {
 		log.Printf("Warning: failed to remove archive folder %s: %v", dir, err)
 	}
 
-	delete(archives, req.ID)
-	mu.Unlock()
-
 	c.JSON(200, gin.H{"message": "Archive deleted"})
 }
 
-func archiveLoginHandler(c *gin.Context) {
+func (s *Server) archiveLoginHandler(c *gin.Context) {
 	var req struct {
 		Token string `json:"token" binding:"required"`
 	}
@@ -650,68 +878,106 @@ func archiveLoginHandler(c *gin.Context) {
 		c.JSON(400, ErrorResponse{Error: "Invalid request"})
 		return
 	}
+	// archive tokens are guessed without knowing the archive, so only the
+	// client IP is tracked
+	ip := ipKey(c.ClientIP())
+	if wait := s.limiter.retryAfter(ip); wait > 0 {
+		tooManyAttempts(c, wait)
+		return
+	}
 
-	mu.RLock()
-	var found *Archive
-	for _, a := range archives {
-		if a.Token == req.Token {
-			found = a
-			break
+	tok, err := s.findArchiveToken(req.Token)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			s.limiter.fail(ip)
 		}
+		c.JSON(401, ErrorResponse{Error: "Invalid token"})
+		return
 	}
-	mu.RUnlock()
-
-	if found == nil {
+	if err := tok.usable(time.Now()); err != nil {
+		if errors.Is(err, errArchiveTokenExpired) {
+			c.JSON(401, ErrorResponse{Error: "Token expired"})
+		} else {
+			c.JSON(401, ErrorResponse{Error: "Invalid token"})
+		}
+		return
+	}
+	found, err := s.store.GetArchiveByID(tok.ArchiveID)
+	if err != nil {
 		c.JSON(401, ErrorResponse{Error: "Invalid token"})
 		return
 	}
+	if err := s.store.RecordArchiveTokenLogin(tok.ID); err != nil {
+		if errors.Is(err, ErrLimitReached) {
+			c.JSON(403, ErrorResponse{Error: "Token login limit reached"})
+			return
+		}
+		log.Printf("archiveLoginHandler: record login: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+	log.Printf("archiveLoginHandler: archive %s opened with token %d (%s)", found.Name, tok.ID, tok.Name)
 
-	// create JWT for archive user; reuse Claims.UserID to store archive ID
-	tokenStr, err := generateToken(found.ID, found.Name, "archive_user")
+	tokenStr, err := s.generateArchiveToken(found, tok)
 	if err != nil {
 		c.JSON(500, ErrorResponse{Error: "Failed to generate token"})
 		return
 	}
 
-	c.JSON(200, gin.H{"message": "Login successful", "token": tokenStr, "archive": found})
+	c.JSON(200, gin.H{"message": "Login successful", "token": tokenStr, "archive": found, "token_name": tok.Name})
 }
 
-func archiveAuthMiddleware() gin.HandlerFunc {
+func (s *Server) archiveAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(401, gin.H{"error": "Authorization header required"})
-			c.Abort()
-			return
-		}
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(401, gin.H{"error": "Invalid authorization header format"})
+		if !s.archiveTokenAuth(c) {
 			c.Abort()
 			return
 		}
-		token := parts[1]
-		claims, err := verifyToken(token)
-		if err != nil {
-			c.JSON(401, gin.H{"error": "Invalid or expired token"})
-			c.Abort()
-			return
-		}
-		if claims.Role != "archive_user" {
+		c.Next()
+	}
+}
+
+// archiveTokenAuth checks that the request carries a live archive token and
+// puts its archive and token in the context; otherwise it answers and
+// returns false
+func (s *Server) archiveTokenAuth(c *gin.Context) bool {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		c.JSON(401, gin.H{"error": "Authorization header required"})
+		return false
+	}
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		c.JSON(401, gin.H{"error": "Invalid authorization header format"})
+		return false
+	}
+	token := parts[1]
+	claims, err := s.verifyArchiveToken(token)
+	if err != nil {
+		if _, uerr := s.verifyToken(token); uerr == nil {
 			c.JSON(403, gin.H{"error": "Not an archive token"})
-			c.Abort()
-			return
+		} else {
+			c.JSON(401, gin.H{"error": "Invalid or expired token"})
 		}
-		// set archive info in context
-		c.Set("archive_id", claims.UserID)
-		c.Set("archive_name", claims.Email)
-		c.Next()
+		return false
 	}
+	_, tok, err := s.currentArchive(claims)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Archive token revoked or expired"})
+		return false
+	}
+	c.Set("archive_token_id", tok.ID)
+	c.Set("archive_token_name", tok.Name)
+	// set archive info in context
+	c.Set("archive_id", claims.ArchiveID)
+	c.Set("archive_name", claims.ArchiveName)
+	return true
 }
 
-func archiveFileHandler(c *gin.Context) {
+func (s *Server) archiveFileHandler(c *gin.Context) {
 	archiveName := c.Param("archiveName")
-	fileName := c.Param("fileName")
+	// a path: multi-file models keep their buffers and textures in a folder
+	fileName := strings.TrimPrefix(c.Param("fileName"), "/")
 
 	// ensure requester is archive user and matches archiveName
 	aidInterface, ok := c.Get("archive_id")
@@ -721,10 +987,8 @@ func archiveFileHandler(c *gin.Context) {
 	}
 	aid := aidInterface.(uint)
 
-	mu.RLock()
-	arch, exists := archives[aid]
-	mu.RUnlock()
-	if !exists || arch.Name != archiveName {
+	arch, err := s.store.GetArchiveByID(aid)
+	if err != nil || arch.Name != archiveName {
 		c.JSON(403, ErrorResponse{Error: "Forbidden"})
 		return
 	}
@@ -736,7 +1000,7 @@ func archiveFileHandler(c *gin.Context) {
 		return
 	}
 
-	p := filepath.Join("model_archives", archiveName, cleanName)
+	p := filepath.Join(s.cfg.ArchiveRoot, archiveName, cleanName)
 	// ensure file exists
 	if _, err := os.Stat(p); os.IsNotExist(err) {
 		c.JSON(404, ErrorResponse{Error: "File not found"})
@@ -746,313 +1010,315 @@ func archiveFileHandler(c *gin.Context) {
 	c.File(p)
 }
 
-func deleteModelHandler(c *gin.Context) {
-	userIDInterface, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(401, ErrorResponse{Error: "Unauthorized"})
+func (s *Server) deleteModelHandler(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+
+	if err := c.BindJSON(&req); err != nil {
+		log.Printf("deleteModelHandler: BindJSON error: %v", err)
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
 		return
 	}
+	log.Printf("deleteModelHandler: request to delete model id=%d by user=%d", req.ID, userID)
 
-	userID, ok := userIDInterface.(uint)
-	if !ok {
-		c.JSON(401, ErrorResponse{Error: "Invalid user ID"})
+	model, err := s.store.GetModelByID(req.ID)
+	if err != nil {
+		c.JSON(404, ErrorResponse{Error: "Model not found"})
+		return
+	}
+	if keyArchive := apiKeyArchive(c); keyArchive != 0 && model.ArchiveID != keyArchive {
+		c.JSON(403, ErrorResponse{Error: "This API key can only change models in its own archive"})
 		return
 	}
 
-	log.Printf("deleteModelHandler: invoked by user interface present: %v", exists)
-	// Check if user is admin
-	mu.RLock()
-	user, userExists := users[userID]
-	mu.RUnlock()
+	// determine file path before the row goes away
+	baseDir := modelBaseDir(s.cfg, s.store, model)
+	filePath := filepath.Join(baseDir, model.FileName)
 
-	if !userExists || user.Role != "admin" {
-		c.JSON(403, ErrorResponse{Error: "Only admins can delete models"})
+	if err := s.store.DeleteModel(req.ID); err != nil {
+		log.Printf("deleteModelHandler: delete model row: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to delete model"})
 		return
 	}
+	log.Printf("deleteModelHandler: model id=%d deleted", req.ID)
 
-	var req struct {
-		ID uint `json:"id" binding:"required"`
+	if err := removeModelFiles(baseDir, model.FileName); err != nil {
+		log.Printf("Warning: Failed to delete file %s: %v\n", filePath, err)
+	} else {
+		log.Printf("deleteModelHandler: file removed %s", filePath)
 	}
 
-	if err := c.BindJSON(&req); err != nil {
-		log.Printf("deleteModelHandler: BindJSON error: %v", err)
-		c.JSON(400, ErrorResponse{Error: "Invalid request"})
-		return
-	}
-	log.Printf("deleteModelHandler: request to delete model id=%d by user=%d", req.ID, userID)
+	c.JSON(200, gin.H{"message": "Model deleted successfully"})
+}
 
-	// First try to delete from DB and determine file path
-	var filePath string
-	if DB != nil {
-		fid := int64(req.ID)
-		// get file info
-		fileName, _, archID, err := func() (string, string, sql.NullInt64, error) {
-			// reuse GetModelRow which returns file_name, file_url, archive_id
-			fn, fu, aid, err := GetModelRow(fid)
-			return fn, fu, aid, err
-		}()
-		if err == nil {
-			// determine path
-			if archID.Valid {
-				// get archive name
-				aname, err2 := GetArchiveNameByID(archID.Int64)
-				if err2 == nil {
-					filePath = filepath.Join("model_archives", aname, fileName)
-				} else {
-					filePath = filepath.Join("model_archives", fileName)
-				}
-			} else {
-				filePath = filepath.Join("uploads", fileName)
-			}
+// ============ INIT DATA ============
+// initData seeds the test accounts and lists the ones it created on out;
+// existing rows are left alone
+func initData(store Store, out io.Writer) {
+	seed := []struct {
+		email, password, role string
+	}{
+		{"admin@test.com", "admin123", RoleAdmin},
+		{"editor@test.com", "editor123", RoleEditor},
+		{"user@test.com", "password123", RoleUser},
+	}
+	var created []string
+	for _, acct := range seed {
+		if _, err := store.GetUserByEmail(acct.email); err == nil {
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			log.Printf("Warning: failed to look up seed user %s: %v", acct.email, err)
+			continue
 		}
-		// delete DB row
-		_, _, err = DeleteModelByID(int64(req.ID))
-		if err != nil {
-			log.Printf("Warning: failed delete model row in sqlite: %v", err)
+		hash, _ := bcrypt.GenerateFromPassword([]byte(acct.password), 10)
+		if err := store.CreateUser(&User{Email: acct.email, PasswordHash: string(hash), Role: acct.role}); err != nil {
+			log.Printf("Warning: failed to seed user %s: %v", acct.email, err)
+			continue
 		}
+		created = append(created, fmt.Sprintf("   %s: %s / %s", acct.role, acct.email, acct.password))
 	}
 
-	// fallback / also remove from in-memory map and filesystem
-	mu.Lock()
-	model, ok := models[req.ID]
-	if ok {
-		// compute filePath if not set above
-		if filePath == "" {
-			if model.ArchiveID != 0 {
-				arch := archives[model.ArchiveID]
-				filePath = filepath.Join("model_archives", arch.Name, model.FileName)
-			} else {
-				filePath = filepath.Join("uploads", model.FileName)
-			}
-		}
-		delete(models, req.ID)
-		log.Printf("deleteModelHandler: model id=%d deleted from memory", req.ID)
+	if len(created) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "✅ Test accounts created")
+	for _, line := range created {
+		fmt.Fprintln(out, line)
 	}
-	mu.Unlock()
+}
 
-	if filePath != "" {
-		if err := os.Remove(filePath); err != nil {
-			log.Printf("Warning: Failed to delete file %s: %v\n", filePath, err)
-		} else {
-			log.Printf("deleteModelHandler: file removed %s", filePath)
-		}
+// friendlyModelName derives a display name from a stored file name
+// (strips the timestamp prefix and extension); multi-file models are named
+// after their folder
+func friendlyModelName(fileName string) string {
+	name, _, _ := strings.Cut(fileName, "/")
+	if idx := strings.Index(name, "_"); idx != -1 {
+		name = name[idx+1:]
 	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
 
-	c.JSON(200, gin.H{"message": "Model deleted successfully"})
+// scanModelFiles calls fn for every .glb and .gltf below dir with its path
+// relative to dir, as stored in the file name of a model
+func scanModelFiles(dir string, fn func(rel string, size int64)) {
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if ext != ".glb" && ext != ".gltf" || derivedModelFile(info.Name()) {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, p); err == nil {
+			fn(filepath.ToSlash(rel), info.Size())
+		}
+		return nil
+	})
 }
 
-// ============ INIT DATA ============
-func initData() {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// Admin user
-	adminPass, _ := bcrypt.GenerateFromPassword([]byte("admin123"), 10)
-	admin := &User{
-		ID:           1,
-		Email:        "admin@test.com",
-		PasswordHash: string(adminPass),
-		Role:         "admin",
-		CreatedAt:    time.Now(),
-	}
-	users[1] = admin
-
-	// Regular user
-	userPass, _ := bcrypt.GenerateFromPassword([]byte("password123"), 10)
-	user := &User{
-		ID:           2,
-		Email:        "user@test.com",
-		PasswordHash: string(userPass),
-		Role:         "user",
-		CreatedAt:    time.Now(),
+// modelBaseDir returns the directory the file name of a model is relative to
+func modelBaseDir(cfg Config, store Store, m *GLBModel) string {
+	if m.ArchiveID == 0 {
+		return cfg.UploadDir
+	}
+	if arch, err := store.GetArchiveByID(m.ArchiveID); err == nil {
+		return filepath.Join(cfg.ArchiveRoot, arch.Name)
 	}
-	users[2] = user
+	return cfg.ArchiveRoot
+}
 
-	fmt.Println("✅ Test data initialized")
-	fmt.Println("   Admin: admin@test.com / admin123")
-	fmt.Println("   User:  user@test.com / password123")
+// registerOrphanModel records a model file found by the startup scan that has
+// no row yet; it is processed once the server runs
+func registerOrphanModel(store Store, fileName, fileURL string, size int64, archiveID uint) {
+	if _, err := store.GetModelByFile(fileName, archiveID); !errors.Is(err, ErrNotFound) {
+		return
+	}
+	model := &GLBModel{
+		Name:      friendlyModelName(fileName),
+		FileURL:   fileURL,
+		FileName:  fileName,
+		ArchiveID: archiveID,
+		FileSize:  size,
+	}
+	if err := store.CreateModel(model); err != nil {
+		log.Printf("Warning: failed to register %s: %v", fileName, err)
+	}
 }
 
 // ============ MAIN ============
 func main() {
-	// Create uploads directory if not exists
-	if _, err := os.Stat("uploads"); os.IsNotExist(err) {
-		os.Mkdir("uploads", 0755)
+	// Load configuration: CONFIG_FILE if set, otherwise an optional config.json
+	configPath, explicit := os.LookupEnv("CONFIG_FILE")
+	if !explicit {
+		configPath = "config.json"
+	}
+	cfg, err := LoadConfig(configPath, explicit)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	if cfg.IsDev() && cfg.JWTSecret == DefaultJWTSecret {
+		log.Printf("Warning: using the default JWT secret; set JWT_SECRET before deploying")
 	}
 
-	// Initialize SQLite DB (path from env SQLITE_DB_PATH or default)
-	dbPath := os.Getenv("SQLITE_DB_PATH")
-	if dbPath == "" {
-		dbPath = "./3d_db.db"
+	// Create uploads directory if not exists
+	if err := os.MkdirAll(cfg.UploadDir, 0755); err != nil {
+		log.Fatalf("Failed to create upload directory %s: %v", cfg.UploadDir, err)
 	}
-	if err := InitDB(dbPath); err != nil {
-		log.Printf("Warning: failed to open sqlite db %s: %v", dbPath, err)
+	if err := os.MkdirAll(cfg.UploadStagingDir, 0755); err != nil {
+		log.Fatalf("Failed to create upload staging directory %s: %v", cfg.UploadStagingDir, err)
 	}
 
-	// Initialize in-memory data
-	initData()
+	// Initialize storage
+	var store Store
+	if cfg.StoreBackend == "memory" {
+		log.Printf("Using in-memory store; data will be lost on restart")
+		store = NewMemoryStore()
+	} else {
+		sqliteStore, err := NewSQLiteStore(cfg.DBPath)
+		if err != nil {
+			log.Fatalf("Failed to open sqlite db %s: %v", cfg.DBPath, err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	}
 
-	// Scan uploads directory and populate models map so uploaded files persist across restarts
-	func() {
-		mu.Lock()
-		defer mu.Unlock()
-		// ensure modelIDCounter continues from any existing entries
-		// walk uploads dir
-		filepath.Walk("uploads", func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return nil
-			}
-			if info.IsDir() {
-				return nil
-			}
-			ext := strings.ToLower(filepath.Ext(info.Name()))
-			if ext != ".glb" && ext != ".gltf" {
-				return nil
-			}
+	// Seed test accounts (SEED_TEST_USERS, development only) and make sure
+	// an admin exists
+	if cfg.SeedTestUsers {
+		initData(store, os.Stdout)
+	}
+	if err := bootstrapAdmin(cfg, store); err != nil {
+		log.Fatalf("Failed to bootstrap admin account: %v", err)
+	}
 
-			// check if already present in models
-			for _, m := range models {
-				if m.FileName == info.Name() {
-					return nil
-				}
-			}
+	// Scan uploads directory and register files copied in without going through the API
+	scanModelFiles(cfg.UploadDir, func(rel string, size int64) {
+		registerOrphanModel(store, rel, fmt.Sprintf("/uploads/%s", rel), size, 0)
+	})
 
-			// derive a friendly name from filename (strip timestamp prefix if present)
-			name := info.Name()
-			if idx := strings.Index(name, "_"); idx != -1 {
-				name = name[idx+1:]
+	// Scan model_archives directory: register archive folders and their models
+	if entries, err := os.ReadDir(cfg.ArchiveRoot); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
 			}
-			name = strings.TrimSuffix(name, ext)
-
-			model := &GLBModel{
-				ID:          modelIDCounter,
-				Name:        name,
-				Description: "",
-				FileURL:     fmt.Sprintf("/uploads/%s", info.Name()),
-				FileName:    info.Name(),
-				UploadedBy:  1, // unknown, mark as admin
-				FileSize:    info.Size(),
-				CreatedAt:   time.Now(),
-				UpdatedAt:   time.Now(),
+			name := entry.Name()
+			path := filepath.Join(cfg.ArchiveRoot, name)
+			arch, err := store.GetArchiveByName(name)
+			if errors.Is(err, ErrNotFound) {
+				arch = &Archive{Name: name}
+				err = store.CreateArchive(arch)
 			}
-			models[modelIDCounter] = model
-			modelIDCounter++
-			return nil
-		})
-	}()
-
-	// Scan model_archives directory: populate archives and models
-	func() {
-		mu.Lock()
-		defer mu.Unlock()
-		if _, err := os.Stat("model_archives"); os.IsNotExist(err) {
-			return
-		}
-		// walk archive folders
-		filepath.Walk("model_archives", func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				return nil
-			}
-			if !info.IsDir() {
-				return nil
-			}
-			// skip root
-			if path == "model_archives" || path == "model_archives." {
-				return nil
-			}
-			// folder name
-			name := filepath.Base(path)
-			// read token if exists
-			tokenPath := filepath.Join(path, "token.txt")
-			var token string
-			if b, err := os.ReadFile(tokenPath); err == nil {
-				token = strings.TrimSpace(string(b))
-			} else {
-				// generate token and write
-				t, _ := generateRandomToken(16)
-				token = t
-				_ = os.WriteFile(tokenPath, []byte(token), 0644)
-			}
-			// check if archive already exists
-			var archID uint = 0
-			for _, a := range archives {
-				if a.Name == name {
-					archID = a.ID
-					break
-				}
-			}
-			if archID == 0 {
-				arch := &Archive{ID: archiveIDCounter, Name: name, Token: token, CreatedAt: time.Now()}
-				archives[archiveIDCounter] = arch
-				archID = archiveIDCounter
-				archiveIDCounter++
+				log.Printf("Warning: failed to register archive %s: %v", name, err)
+				continue
 			}
+			// older versions kept the secret in plaintext next to the models
+			importLegacyArchiveToken(store, arch, path)
 			// now list files inside folder and create model entries for glb/gltf
-			files, _ := os.ReadDir(path)
-			for _, f := range files {
-				if f.IsDir() {
-					continue
-				}
-				ext := strings.ToLower(filepath.Ext(f.Name()))
-				if ext != ".glb" && ext != ".gltf" {
-					continue
-				}
-				// skip token.txt
-				if f.Name() == "token.txt" {
-					continue
-				}
-				// check if model exists
-				exists := false
-				for _, m := range models {
-					if m.FileName == f.Name() && m.ArchiveID == archID {
-						exists = true
-						break
-					}
-				}
-				if exists {
-					continue
-				}
-				info, _ := f.Info()
-				nameOnly := f.Name()
-				if idx := strings.Index(nameOnly, "_"); idx != -1 {
-					nameOnly = nameOnly[idx+1:]
-				}
-				nameOnly = strings.TrimSuffix(nameOnly, ext)
-				model := &GLBModel{ID: modelIDCounter, Name: nameOnly, Description: "", FileURL: fmt.Sprintf("/api/archives/%s/files/%s", name, f.Name()), FileName: f.Name(), ArchiveID: archID, UploadedBy: 1, FileSize: info.Size(), CreatedAt: time.Now(), UpdatedAt: time.Now()}
-				models[modelIDCounter] = model
-				modelIDCounter++
-			}
-			return nil
-		})
-	}()
+			scanModelFiles(path, func(rel string, size int64) {
+				registerOrphanModel(store, rel, fmt.Sprintf("/api/archives/%s/files/%s", name, rel), size, arch.ID)
+			})
+		}
+	}
+
+	if cfg.OIDCEnabled() {
+		log.Printf("SSO login enabled with %s", cfg.OIDCIssuer)
+	}
+	if cfg.MailBackend == "file" {
+		log.Printf("Outgoing mail is written to %s instead of being sent", cfg.MailDir)
+	}
+	server := NewServer(cfg, store, NewMailer(cfg))
+	server.sweepUploads()
+	server.startJobWorkers()
+	// models stored before processing ran in jobs, or copied in, get it now
+	server.queueMissingJobs()
+
+	fmt.Printf("🚀 Server running on %s (%s)\n", cfg.ListenAddr, cfg.Env)
+	if err := server.Router().Run(cfg.ListenAddr); err != nil {
+		log.Fatalf("Server stopped: %v", err)
+	}
+}
 
-	// Setup router
+// Router builds the gin engine with every route wired to s
+func (s *Server) Router() *gin.Engine {
 	router := gin.Default()
+	if err := router.SetTrustedProxies(s.cfg.TrustedProxies); err != nil {
+		log.Fatalf("trusted_proxies: %v", err)
+	}
 
 	// Setup CORS middleware
-	router.Use(corsMiddleware())
+	router.Use(corsMiddleware(s.cfg.CORSOrigins))
 
 	// Public routes
-	router.POST("/api/auth/register", registerHandler)
-	router.POST("/api/auth/login", loginHandler)
-	router.GET("/api/models", getModelsHandler)
-	router.Static("/uploads", "./uploads")
+	router.POST("/api/auth/register", s.registerHandler)
+	router.POST("/api/auth/login", s.loginHandler)
+	router.POST("/api/auth/refresh", s.refreshHandler)
+	router.POST("/api/auth/logout", s.authMiddleware(), s.requireSession(), s.logoutHandler)
+	router.POST("/api/auth/password", s.authMiddleware(), s.requireSession(), s.changePasswordHandler)
+	router.POST("/api/auth/password/forgot", s.forgotPasswordHandler)
+	router.POST("/api/auth/password/reset", s.resetPasswordHandler)
+	router.GET("/api/auth/oidc", s.oidcConfigHandler)
+	router.GET("/api/auth/oidc/login", s.oidcLoginHandler)
+	router.GET("/api/auth/oidc/callback", s.oidcCallbackHandler)
+	router.POST("/api/auth/oidc/exchange", s.oidcExchangeHandler)
+	router.GET("/api/models", s.getModelsHandler)
+	// checks archive tokens itself: models outside archives are public
+	router.GET("/api/models/export", s.exportModelHandler)
+	router.Static("/uploads", s.cfg.UploadDir)
 	// archive login (user token)
-	router.POST("/api/archives/login", archiveLoginHandler)
+	router.POST("/api/archives/login", s.archiveLoginHandler)
 
 	// archive file serving (secured)
-	router.GET("/api/archives/:archiveName/files/:fileName", archiveAuthMiddleware(), archiveFileHandler)
+	router.GET("/api/archives/:archiveName/files/*fileName", s.archiveAuthMiddleware(), s.archiveFileHandler)
 
 	// Protected routes (admin)
-	router.POST("/api/models/upload", authMiddleware(), uploadModelHandler)
-	router.GET("/api/user/profile", authMiddleware(), getUserProfileHandler)
-	router.DELETE("/api/models", authMiddleware(), deleteModelHandler)
-
-	// Admin archive management
-	router.POST("/api/archives", authMiddleware(), createArchiveHandler)
-	router.GET("/api/archives", authMiddleware(), listArchivesHandler)
-	router.DELETE("/api/archives", authMiddleware(), deleteArchiveHandler)
-
-	fmt.Println("🚀 Server running on http://localhost:8080")
-	router.Run(":8080")
+	router.POST("/api/models/upload", s.authMiddleware(), s.requirePermission(PermModelsUpload), s.uploadModelHandler)
+	router.GET("/api/user/profile", s.authMiddleware(), s.getUserProfileHandler)
+	router.DELETE("/api/models", s.authMiddleware(), s.requirePermission(PermModelsDelete), s.deleteModelHandler)
+	router.POST("/api/models/thumbnail", s.authMiddleware(), s.requirePermission(PermModelsUpload), s.regenerateThumbnailHandler)
+	router.POST("/api/models/lods", s.authMiddleware(), s.requirePermission(PermModelsUpload), s.regenerateLODsHandler)
+	router.POST("/api/models/optimize", s.authMiddleware(), s.requirePermission(PermModelsUpload), s.optimizeModelHandler)
+	router.GET("/api/models/jobs", s.authMiddleware(), s.requirePermission(PermModelsUpload), s.modelJobsHandler)
+
+	// Resumable uploads for files too large for a single request
+	upload := s.requirePermission(PermModelsUpload)
+	router.POST("/api/uploads", s.authMiddleware(), upload, s.createUploadHandler)
+	router.GET("/api/uploads", s.authMiddleware(), upload, s.getUploadHandler)
+	router.PATCH("/api/uploads", s.authMiddleware(), upload, s.appendUploadHandler)
+	router.DELETE("/api/uploads", s.authMiddleware(), upload, s.cancelUploadHandler)
+	router.POST("/api/uploads/complete", s.authMiddleware(), upload, s.completeUploadHandler)
+
+	// Archive management
+	manage := s.requirePermission(PermArchivesManage)
+	router.POST("/api/archives", s.authMiddleware(), manage, s.createArchiveHandler)
+	router.GET("/api/archives", s.authMiddleware(), s.requirePermission(PermArchivesRead), s.listArchivesHandler)
+	router.DELETE("/api/archives", s.authMiddleware(), manage, s.deleteArchiveHandler)
+	router.GET("/api/archives/tokens", s.authMiddleware(), manage, s.listArchiveTokensHandler)
+	router.POST("/api/archives/tokens", s.authMiddleware(), manage, s.createArchiveTokenHandler)
+	router.PUT("/api/archives/tokens", s.authMiddleware(), manage, s.updateArchiveTokenHandler)
+	router.DELETE("/api/archives/tokens", s.authMiddleware(), manage, s.revokeArchiveTokenHandler)
+	router.POST("/api/archives/tokens/rotate", s.authMiddleware(), manage, s.rotateArchiveTokenHandler)
+	router.GET("/api/archives/editors", s.authMiddleware(), manage, s.listArchiveEditorsHandler)
+	router.POST("/api/archives/editors", s.authMiddleware(), manage, s.assignArchiveEditorHandler)
+	router.DELETE("/api/archives/editors", s.authMiddleware(), manage, s.unassignArchiveEditorHandler)
+
+	// User management
+	users := s.requirePermission(PermUsersManage)
+	router.GET("/api/users", s.authMiddleware(), users, s.listUsersHandler)
+	router.POST("/api/users", s.authMiddleware(), users, s.createUserHandler)
+	router.PUT("/api/users", s.authMiddleware(), users, s.updateUserHandler)
+	router.DELETE("/api/users", s.authMiddleware(), users, s.deleteUserHandler)
+	router.GET("/api/users/lockouts", s.authMiddleware(), users, s.listLockoutsHandler)
+	router.DELETE("/api/users/lockouts", s.authMiddleware(), users, s.unlockHandler)
+
+	// Personal API keys; managing them needs a login session
+	router.GET("/api/keys", s.authMiddleware(), s.requireSession(), s.listAPIKeysHandler)
+	router.POST("/api/keys", s.authMiddleware(), s.requireSession(), s.createAPIKeyHandler)
+	router.DELETE("/api/keys", s.authMiddleware(), s.requireSession(), s.revokeAPIKeyHandler)
+
+	return router
 }
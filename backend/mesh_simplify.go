@@ -0,0 +1,441 @@
+package main
+
+import (
+	"container/heap"
+	"math"
+)
+
+// quadric is the symmetric 4x4 matrix of Garland and Heckbert's error
+// metric, the weighted sum of squared distances to a set of planes,
+// followed by the sum of the weights
+type quadric [11]float64
+
+func planeQuadric(n vec3, d, w float64) quadric {
+	a, b, c := n[0], n[1], n[2]
+	return quadric{
+		w * a * a, w * a * b, w * a * c, w * a * d,
+		w * b * b, w * b * c, w * b * d,
+		w * c * c, w * c * d,
+		w * d * d,
+		w,
+	}
+}
+
+func (q *quadric) add(o *quadric) {
+	for i := range q {
+		q[i] += o[i]
+	}
+}
+
+// eval returns the weighted sum of squared distances from p to the planes
+func (q *quadric) eval(p vec3) float64 {
+	x, y, z := p[0], p[1], p[2]
+	e := q[0]*x*x + 2*q[1]*x*y + 2*q[2]*x*z + 2*q[3]*x +
+		q[4]*y*y + 2*q[5]*y*z + 2*q[6]*y +
+		q[7]*z*z + 2*q[8]*z +
+		q[9]
+	return math.Max(e, 0)
+}
+
+// distance returns the mean squared distance from p to the planes of q and
+// o together
+func (q *quadric) distance(o *quadric, p vec3) float64 {
+	w := q[10] + o[10]
+	if w <= 0 {
+		return 0
+	}
+	return (q.eval(p) + o.eval(p)) / w
+}
+
+const (
+	// maxNormalTurn is the cosine of the largest turn of a triangle's
+	// normal a single collapse may cause
+	maxNormalTurn = 0.25
+	// edgeConstraintWeight weighs the planes that hold borders and seams
+	// in place against the surface itself
+	edgeConstraintWeight = 10
+)
+
+// Vertex kinds decide where a vertex may move
+const (
+	vertexManifold = iota // inside the surface: onto any neighbour
+	vertexBorder          // on an open edge: along it
+	vertexSeam            // shares its position with one twin across a UV or normal seam: along the seam, with the twin
+	vertexLocked          // corners, poles and non-manifold spots: never
+)
+
+// collapse is a candidate move of vertex from onto its neighbour to
+type collapse struct {
+	cost     float64
+	from, to uint32
+	stamp    int
+}
+
+type collapseHeap []collapse
+
+func (h collapseHeap) Len() int            { return len(h) }
+func (h collapseHeap) Less(i, j int) bool  { return h[i].cost < h[j].cost }
+func (h collapseHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *collapseHeap) Push(x interface{}) { *h = append(*h, x.(collapse)) }
+func (h *collapseHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// simplifier reduces an indexed triangle mesh by collapsing edges
+type simplifier struct {
+	pos   []vec3
+	posID []uint32 // vertex -> first vertex with the same position
+	tris  [][3]uint32
+	dead  []bool  // per triangle
+	vtris [][]int // vertex -> triangles, dead ones included
+	kind  []int
+	twin  []uint32 // of seam vertices
+	gone  []bool   // vertex collapsed away
+	q     []quadric
+	stamp []int
+	heap  collapseHeap
+	live  int
+}
+
+// simplifyMesh reduces the triangles of an indexed mesh to about target by
+// collapsing edges in the order of the quadric error they add. A collapse
+// moves a vertex onto one of its neighbours, so kept vertices keep their
+// attributes as they are. Open borders and seams, where a position has two
+// vertices, only shrink along themselves, so no cracks open. Vertices where
+// more meet never move, and no collapse moves the surface by more than
+// maxError times the size of the mesh; either may leave the result above
+// target.
+func simplifyMesh(pos []vec3, indices []uint32, target int, maxError float64) []uint32 {
+	s := &simplifier{
+		pos:   pos,
+		posID: make([]uint32, len(pos)),
+		vtris: make([][]int, len(pos)),
+		kind:  make([]int, len(pos)),
+		twin:  make([]uint32, len(pos)),
+		gone:  make([]bool, len(pos)),
+		q:     make([]quadric, len(pos)),
+		stamp: make([]int, len(pos)),
+	}
+	first := make(map[vec3]uint32, len(pos))
+	for v, p := range pos {
+		id, ok := first[p]
+		if !ok {
+			id = uint32(v)
+			first[p] = id
+		}
+		s.posID[v] = id
+	}
+
+	for i := 0; i+2 < len(indices); i += 3 {
+		t := [3]uint32{indices[i], indices[i+1], indices[i+2]}
+		if s.posID[t[0]] == s.posID[t[1]] || s.posID[t[1]] == s.posID[t[2]] || s.posID[t[0]] == s.posID[t[2]] {
+			continue // degenerate, dropped
+		}
+		n := len(s.tris)
+		s.tris = append(s.tris, t)
+		for _, v := range t {
+			s.vtris[v] = append(s.vtris[v], n)
+		}
+	}
+	s.dead = make([]bool, len(s.tris))
+	s.live = len(s.tris)
+	if s.live <= target {
+		return s.indices()
+	}
+	s.classify()
+
+	for _, t := range s.tris {
+		p0, p1, p2 := pos[t[0]], pos[t[1]], pos[t[2]]
+		n := p1.sub(p0).cross(p2.sub(p0))
+		l := math.Sqrt(n.dot(n))
+		if l == 0 {
+			continue
+		}
+		n = n.scale(1 / l)
+		q := planeQuadric(n, -n.dot(p0), l/2)
+		for _, v := range t {
+			s.q[v].add(&q)
+		}
+		// a plane through each border or seam edge, upright on the
+		// triangle, keeps the edge from wandering off its line
+		for k := 0; k < 3; k++ {
+			a, b := t[k], t[(k+1)%3]
+			if s.edgeTriangles(a, b) != 1 {
+				continue
+			}
+			e := pos[b].sub(pos[a])
+			side := e.cross(n)
+			sl := math.Sqrt(side.dot(side))
+			if sl == 0 {
+				continue
+			}
+			side = side.scale(1 / sl)
+			eq := planeQuadric(side, -side.dot(pos[a]), e.dot(e)*edgeConstraintWeight)
+			s.q[a].add(&eq)
+			s.q[b].add(&eq)
+		}
+	}
+
+	lo, hi := pos[s.tris[0][0]], pos[s.tris[0][0]]
+	for _, t := range s.tris {
+		for _, v := range t {
+			for k := 0; k < 3; k++ {
+				lo[k] = math.Min(lo[k], pos[v][k])
+				hi[k] = math.Max(hi[k], pos[v][k])
+			}
+		}
+	}
+	size := hi.sub(lo)
+	limit := maxError * maxError * size.dot(size)
+
+	for v := range pos {
+		s.push(uint32(v))
+	}
+	for s.live > target && s.heap.Len() > 0 && s.heap[0].cost <= limit {
+		c := heap.Pop(&s.heap).(collapse)
+		u, v := c.from, c.to
+		if c.stamp != s.stamp[u] || s.gone[u] || s.gone[v] || !s.canCollapse(u, v) {
+			continue
+		}
+		if s.kind[u] == vertexSeam {
+			tv, ok := s.seamTarget(u, v)
+			if !ok || !s.canCollapse(s.twin[u], tv) {
+				continue
+			}
+			s.collapse(s.twin[u], tv)
+		}
+		s.collapse(u, v)
+	}
+	return s.indices()
+}
+
+// classify sorts the vertices into kinds from the shape of the mesh
+func (s *simplifier) classify() {
+	type edge struct{ a, b uint32 }
+	posEdges := make(map[edge]int)
+	for _, t := range s.tris {
+		for k := 0; k < 3; k++ {
+			a, b := s.posID[t[k]], s.posID[t[(k+1)%3]]
+			if a > b {
+				a, b = b, a
+			}
+			posEdges[edge{a, b}]++
+		}
+	}
+	border := make(map[uint32]bool)
+	nonManifold := make(map[uint32]bool)
+	for e, n := range posEdges {
+		switch {
+		case n == 1:
+			border[e.a], border[e.b] = true, true
+		case n > 2:
+			nonManifold[e.a], nonManifold[e.b] = true, true
+		}
+	}
+	group := make(map[uint32][]uint32)
+	for v, ts := range s.vtris {
+		if len(ts) > 0 {
+			group[s.posID[v]] = append(group[s.posID[v]], uint32(v))
+		}
+	}
+	for id, vs := range group {
+		for i, v := range vs {
+			switch {
+			case nonManifold[id]:
+				s.kind[v] = vertexLocked
+			case len(vs) == 1 && border[id]:
+				s.kind[v] = vertexBorder
+			case len(vs) == 1:
+				s.kind[v] = vertexManifold
+			case len(vs) == 2 && !border[id]:
+				s.kind[v] = vertexSeam
+				s.twin[v] = vs[1-i]
+			default:
+				s.kind[v] = vertexLocked
+			}
+		}
+	}
+}
+
+// edgeTriangles counts the live triangles that have both a and b
+func (s *simplifier) edgeTriangles(a, b uint32) int {
+	n := 0
+	for _, t := range s.vtris[a] {
+		if !s.dead[t] {
+			tri := s.tris[t]
+			if tri[0] == b || tri[1] == b || tri[2] == b {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// seamTarget returns where the twin of seam vertex u goes when u moves onto
+// v: the vertex at v's position next to the twin. Both edges must lie on the
+// seam, or the move would tear it open.
+func (s *simplifier) seamTarget(u, v uint32) (uint32, bool) {
+	tu := s.twin[u]
+	if s.gone[tu] || s.edgeTriangles(u, v) != 1 {
+		return 0, false
+	}
+	for _, t := range s.vtris[tu] {
+		if s.dead[t] {
+			continue
+		}
+		for _, w := range s.tris[t] {
+			if w != v && s.posID[w] == s.posID[v] && s.edgeTriangles(tu, w) == 1 {
+				return w, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// push queues the cheapest collapse of v that its kind allows
+func (s *simplifier) push(v uint32) {
+	s.stamp[v]++
+	if s.kind[v] == vertexLocked || s.gone[v] {
+		return
+	}
+	best, to := math.Inf(1), uint32(0)
+	for _, t := range s.vtris[v] {
+		if s.dead[t] {
+			continue
+		}
+		for _, w := range s.tris[t] {
+			if w == v {
+				continue
+			}
+			var cost float64
+			switch s.kind[v] {
+			case vertexManifold:
+				cost = s.q[v].distance(&quadric{}, s.pos[w])
+			case vertexBorder:
+				if s.edgeTriangles(v, w) != 1 {
+					continue
+				}
+				cost = s.q[v].distance(&quadric{}, s.pos[w])
+			case vertexSeam:
+				if _, ok := s.seamTarget(v, w); !ok {
+					continue
+				}
+				cost = s.q[v].distance(&s.q[s.twin[v]], s.pos[w])
+			}
+			if cost < best {
+				best, to = cost, w
+			}
+		}
+	}
+	if !math.IsInf(best, 1) {
+		heap.Push(&s.heap, collapse{cost: best, from: v, to: to, stamp: s.stamp[v]})
+	}
+}
+
+// canCollapse rejects moves that would flip a triangle or pinch the surface
+// into a non-manifold shape
+func (s *simplifier) canCollapse(u, v uint32) bool {
+	shared := 0
+	for _, t := range s.vtris[u] {
+		if s.dead[t] {
+			continue
+		}
+		tri := s.tris[t]
+		if tri[0] == v || tri[1] == v || tri[2] == v {
+			shared++
+			continue
+		}
+		before := s.pos[tri[1]].sub(s.pos[tri[0]]).cross(s.pos[tri[2]].sub(s.pos[tri[0]]))
+		moved := tri
+		for k := range moved {
+			if moved[k] == u {
+				moved[k] = v
+			}
+		}
+		after := s.pos[moved[1]].sub(s.pos[moved[0]]).cross(s.pos[moved[2]].sub(s.pos[moved[0]]))
+		// small turns add up over many collapses, so steep ones count too
+		if before.dot(after) <= maxNormalTurn*math.Sqrt(before.dot(before)*after.dot(after)) {
+			return false
+		}
+	}
+	if shared == 0 {
+		return false
+	}
+	// the two ends may only have the vertices across their shared
+	// triangles in common
+	ru, rv := s.ring(u), s.ring(v)
+	common := 0
+	for w := range ru {
+		if rv[w] && w != s.posID[u] && w != s.posID[v] {
+			common++
+		}
+	}
+	return common <= shared
+}
+
+// ring returns the positions of the vertices around x
+func (s *simplifier) ring(x uint32) map[uint32]bool {
+	r := make(map[uint32]bool)
+	for _, t := range s.vtris[x] {
+		if !s.dead[t] {
+			for _, w := range s.tris[t] {
+				r[s.posID[w]] = true
+			}
+		}
+	}
+	return r
+}
+
+func (s *simplifier) collapse(u, v uint32) {
+	for _, t := range s.vtris[u] {
+		if s.dead[t] {
+			continue
+		}
+		tri := &s.tris[t]
+		if tri[0] == v || tri[1] == v || tri[2] == v {
+			s.dead[t] = true
+			s.live--
+			continue
+		}
+		for k := range tri {
+			if tri[k] == u {
+				tri[k] = v
+			}
+		}
+		s.vtris[v] = append(s.vtris[v], t)
+	}
+	s.gone[u] = true
+	s.vtris[u] = nil
+	s.q[v].add(&s.q[u])
+
+	// costs around v changed, and with them those of seam twins
+	s.push(v)
+	seen := map[uint32]bool{v: true}
+	for _, t := range s.vtris[v] {
+		if s.dead[t] {
+			continue
+		}
+		for _, w := range s.tris[t] {
+			if !seen[w] {
+				seen[w] = true
+				s.push(w)
+				if s.kind[w] == vertexSeam {
+					s.push(s.twin[w])
+				}
+			}
+		}
+	}
+}
+
+func (s *simplifier) indices() []uint32 {
+	out := make([]uint32, 0, s.live*3)
+	for i, t := range s.tris {
+		if !s.dead[i] {
+			out = append(out, t[0], t[1], t[2])
+		}
+	}
+	return out
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// meshOf returns the positions of m as vectors, with its indices
+func meshOf(m testMesh) ([]vec3, []uint32) {
+	pos := make([]vec3, len(m.positions)/3)
+	for v := range pos {
+		pos[v] = vec3{float64(m.positions[v*3]), float64(m.positions[v*3+1]), float64(m.positions[v*3+2])}
+	}
+	return pos, m.indices
+}
+
+// meshArea sums the areas of the triangles of idx; facing reports whether
+// they all face the same way as dir
+func meshArea(pos []vec3, idx []uint32, dir vec3) (area float64, facing bool) {
+	facing = true
+	for i := 0; i+2 < len(idx); i += 3 {
+		n := pos[idx[i+1]].sub(pos[idx[i]]).cross(pos[idx[i+2]].sub(pos[idx[i]]))
+		area += math.Sqrt(n.dot(n)) / 2
+		if n.dot(dir) <= 0 {
+			facing = false
+		}
+	}
+	return area, facing
+}
+
+func TestSimplifyFlatGrid(t *testing.T) {
+	pos, idx := meshOf(testGrid(32))
+	before := len(idx) / 3
+	out := simplifyMesh(pos, idx, before/10, 0.01)
+	if n := len(out) / 3; n > before/10 || n == 0 {
+		t.Fatalf("%d of %d triangles left, want at most %d", n, before, before/10)
+	}
+	// a plane loses nothing: the border holds, no triangle flips
+	area, facing := meshArea(pos, out, vec3{0, 0, 1})
+	if math.Abs(area-16) > 1e-9 || !facing {
+		t.Fatalf("area %v, all facing up %v", area, facing)
+	}
+	for _, v := range out {
+		if v >= uint32(len(pos)) {
+			t.Fatalf("index %d past the vertices", v)
+		}
+	}
+}
+
+func TestSimplifyKeepsSmallMeshes(t *testing.T) {
+	pos, idx := meshOf(testGrid(4))
+	if out := simplifyMesh(pos, idx, len(idx)/3, 0.01); len(out) != len(idx) {
+		t.Fatalf("%d indices of %d left at the full count", len(out), len(idx))
+	}
+	// degenerate triangles go even then
+	withDegenerate := append(append([]uint32(nil), idx...), 0, 0, 1, 2, 2, 2)
+	if out := simplifyMesh(pos, withDegenerate, len(withDegenerate), 0.01); len(out) != len(idx) {
+		t.Fatalf("%d indices left of %d with degenerates", len(out), len(idx))
+	}
+}
+
+func TestSimplifyRespectsMaxError(t *testing.T) {
+	// every move on a curved surface changes its shape
+	grid := testGrid(16)
+	for v := 0; v < len(grid.positions); v += 3 {
+		x, y := grid.positions[v], grid.positions[v+1]
+		grid.positions[v+2] = (x*x + y*y) / 4
+	}
+	pos, idx := meshOf(grid)
+	if out := simplifyMesh(pos, idx, 1, 0); len(out) != len(idx) {
+		t.Fatalf("%d of %d indices left without any error allowed", len(out), len(idx))
+	}
+	if out := simplifyMesh(pos, idx, 1, 0.05); len(out) >= len(idx) {
+		t.Fatal("curved grid not simplified at 5% error")
+	}
+
+	// moving a corner of a cube costs far more than 1% of its size
+	pos, idx = meshOf(testCube())
+	if out := simplifyMesh(pos, idx, 1, lodMaxError); len(out) != len(idx) {
+		t.Fatalf("cube simplified to %d triangles", len(out)/3)
+	}
+}
+
+func TestSimplifyKeepsSeamsClosed(t *testing.T) {
+	// the right half of the grid has vertices of its own along x = 0, as
+	// a UV seam would give it
+	const n = 17
+	grid := testGrid(n)
+	pos, idx := meshOf(grid)
+	twin := make(map[uint32]uint32)
+	for y := 0; y < n; y++ {
+		v := uint32(y*n + n/2)
+		twin[v] = uint32(len(pos))
+		pos = append(pos, pos[v])
+	}
+	right := make(map[uint32]bool) // vertices of the right half
+	for i := 0; i < len(idx); i += 3 {
+		c := pos[idx[i]].add(pos[idx[i+1]]).add(pos[idx[i+2]])
+		if c[0] > 0 {
+			for k := i; k < i+3; k++ {
+				if tv, ok := twin[idx[k]]; ok {
+					idx[k] = tv
+				}
+				right[idx[k]] = true
+			}
+		}
+	}
+
+	out := simplifyMesh(pos, idx, len(idx)/3/8, 0.01)
+	if len(out) >= len(idx)/2 {
+		t.Fatalf("%d of %d triangles left", len(out)/3, len(idx)/3)
+	}
+	// both sides keep the same points on the seam, so no crack opens
+	left, rightSide := make(map[vec3]bool), make(map[vec3]bool)
+	for _, v := range out {
+		if pos[v][0] != 0 {
+			continue
+		}
+		if right[v] {
+			rightSide[pos[v]] = true
+		} else {
+			left[pos[v]] = true
+		}
+	}
+	if len(left) != len(rightSide) || len(left) < 2 {
+		t.Fatalf("seam points: %d left, %d right", len(left), len(rightSide))
+	}
+	for p := range left {
+		if !rightSide[p] {
+			t.Fatalf("seam point %v only on the left", p)
+		}
+	}
+	if area, facing := meshArea(pos, out, vec3{0, 0, 1}); math.Abs(area-16) > 1e-9 || !facing {
+		t.Fatalf("area %v, all facing up %v", area, facing)
+	}
+}
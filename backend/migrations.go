@@ -0,0 +1,342 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a single, ordered schema change. Versions must be strictly
+// increasing; once a migration has shipped it must never be edited, add a
+// new one instead. fn, if set, runs after up in the same transaction for
+// data changes SQL cannot express.
+type migration struct {
+	version int
+	name    string
+	up      string
+	fn      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		up: `CREATE TABLE users (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			email         TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role          TEXT NOT NULL DEFAULT 'user',
+			created_at    DATETIME NOT NULL,
+			updated_at    DATETIME NOT NULL
+		);`,
+	},
+	{
+		version: 2,
+		name:    "create archives",
+		up: `CREATE TABLE archives (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			name       TEXT NOT NULL UNIQUE,
+			token      TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		);`,
+	},
+	{
+		version: 3,
+		name:    "create models",
+		up: `CREATE TABLE models (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			name        TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			file_name   TEXT NOT NULL,
+			file_url    TEXT NOT NULL,
+			file_size   INTEGER NOT NULL DEFAULT 0,
+			archive_id  INTEGER REFERENCES archives(id) ON DELETE CASCADE,
+			uploaded_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+			created_at  DATETIME NOT NULL,
+			updated_at  DATETIME NOT NULL
+		);
+		CREATE INDEX idx_models_archive_id ON models(archive_id);`,
+	},
+	{
+		version: 4,
+		name:    "create sessions and refresh tokens",
+		up: `CREATE TABLE sessions (
+			id         TEXT PRIMARY KEY,
+			user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME
+		);
+		CREATE INDEX idx_sessions_user_id ON sessions(user_id);
+		CREATE TABLE refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			used_at    DATETIME
+		);
+		CREATE INDEX idx_refresh_tokens_session_id ON refresh_tokens(session_id);`,
+	},
+	{
+		version: 5,
+		name:    "archive token expiry, login cap and version",
+		up: `ALTER TABLE archives ADD COLUMN token_expires_at DATETIME;
+		ALTER TABLE archives ADD COLUMN max_logins INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE archives ADD COLUMN login_count INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE archives ADD COLUMN token_version INTEGER NOT NULL DEFAULT 1;`,
+	},
+	{
+		version: 6,
+		name:    "named archive tokens",
+		up: `CREATE TABLE archive_tokens (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			archive_id   INTEGER NOT NULL REFERENCES archives(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL,
+			token        TEXT NOT NULL UNIQUE,
+			created_at   DATETIME NOT NULL,
+			expires_at   DATETIME,
+			max_logins   INTEGER NOT NULL DEFAULT 0,
+			login_count  INTEGER NOT NULL DEFAULT 0,
+			last_used_at DATETIME,
+			revoked_at   DATETIME,
+			version      INTEGER NOT NULL DEFAULT 1
+		);
+		CREATE INDEX idx_archive_tokens_archive_id ON archive_tokens(archive_id);
+		INSERT INTO archive_tokens (archive_id, name, token, created_at, expires_at, max_logins, login_count, version)
+			SELECT id, 'Default', token, created_at, token_expires_at, max_logins, login_count, token_version FROM archives;
+		ALTER TABLE archives DROP COLUMN token;
+		ALTER TABLE archives DROP COLUMN token_expires_at;
+		ALTER TABLE archives DROP COLUMN max_logins;
+		ALTER TABLE archives DROP COLUMN login_count;
+		ALTER TABLE archives DROP COLUMN token_version;`,
+	},
+	{
+		version: 7,
+		name:    "hash archive tokens",
+		// token is UNIQUE and cannot be dropped in place, so the table is
+		// rebuilt; the plaintext is copied into token_hash and hashed by fn
+		up: `CREATE TABLE archive_tokens_new (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			archive_id   INTEGER NOT NULL REFERENCES archives(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL,
+			token_hash   TEXT NOT NULL UNIQUE,
+			token_hint   TEXT NOT NULL DEFAULT '',
+			created_at   DATETIME NOT NULL,
+			expires_at   DATETIME,
+			max_logins   INTEGER NOT NULL DEFAULT 0,
+			login_count  INTEGER NOT NULL DEFAULT 0,
+			last_used_at DATETIME,
+			revoked_at   DATETIME,
+			version      INTEGER NOT NULL DEFAULT 1
+		);
+		INSERT INTO archive_tokens_new (id, archive_id, name, token_hash, token_hint, created_at, expires_at, max_logins, login_count, last_used_at, revoked_at, version)
+			SELECT id, archive_id, name, token, substr(token, -4), created_at, expires_at, max_logins, login_count, last_used_at, revoked_at, version FROM archive_tokens;
+		DROP TABLE archive_tokens;
+		ALTER TABLE archive_tokens_new RENAME TO archive_tokens;
+		CREATE INDEX idx_archive_tokens_archive_id ON archive_tokens(archive_id);`,
+		fn: hashArchiveTokenSecrets,
+	},
+	{
+		version: 8,
+		name:    "create archive editors",
+		up: `CREATE TABLE archive_editors (
+			archive_id INTEGER NOT NULL REFERENCES archives(id) ON DELETE CASCADE,
+			user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (archive_id, user_id)
+		);
+		CREATE INDEX idx_archive_editors_user_id ON archive_editors(user_id);`,
+	},
+	{
+		version: 9,
+		name:    "user disabled flag",
+		up:      `ALTER TABLE users ADD COLUMN disabled_at DATETIME;`,
+	},
+	{
+		version: 10,
+		name:    "create password resets",
+		up: `CREATE TABLE password_resets (
+			token_hash TEXT PRIMARY KEY,
+			user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			used_at    DATETIME
+		);
+		CREATE INDEX idx_password_resets_user_id ON password_resets(user_id);`,
+	},
+	{
+		version: 11,
+		name:    "create api keys",
+		up: `CREATE TABLE api_keys (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name         TEXT NOT NULL,
+			key_hash     TEXT NOT NULL UNIQUE,
+			key_hint     TEXT NOT NULL DEFAULT '',
+			scopes       TEXT NOT NULL,
+			archive_id   INTEGER REFERENCES archives(id) ON DELETE CASCADE,
+			created_at   DATETIME NOT NULL,
+			expires_at   DATETIME,
+			last_used_at DATETIME,
+			revoked_at   DATETIME
+		);
+		CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);`,
+	},
+	{
+		version: 12,
+		name:    "create user identities",
+		up: `CREATE TABLE user_identities (
+			issuer     TEXT NOT NULL,
+			subject    TEXT NOT NULL,
+			user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (issuer, subject)
+		);
+		CREATE INDEX idx_user_identities_user_id ON user_identities(user_id);`,
+	},
+	{
+		version: 13,
+		name:    "create uploads",
+		up: `CREATE TABLE uploads (
+			id            TEXT PRIMARY KEY,
+			user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+			name          TEXT NOT NULL,
+			description   TEXT NOT NULL DEFAULT '',
+			archive_id    INTEGER REFERENCES archives(id) ON DELETE CASCADE,
+			file_name     TEXT NOT NULL,
+			size          INTEGER NOT NULL,
+			sha256        TEXT NOT NULL,
+			upload_offset INTEGER NOT NULL DEFAULT 0,
+			created_at    DATETIME NOT NULL,
+			expires_at    DATETIME NOT NULL
+		);
+		CREATE INDEX idx_uploads_expires_at ON uploads(expires_at);`,
+	},
+	{
+		// JSON of ModelMetadata; NULL until the file has been read
+		version: 14,
+		name:    "model metadata",
+		up:      `ALTER TABLE models ADD COLUMN metadata TEXT`,
+	},
+	{
+		version: 15,
+		name:    "model thumbnails",
+		up:      `ALTER TABLE models ADD COLUMN thumbnail_url TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		// models stored before this were processed during their upload; at
+		// most one queued job per model and kind
+		version: 16,
+		name:    "processing jobs",
+		up: `ALTER TABLE models ADD COLUMN processing_status TEXT NOT NULL DEFAULT 'ready';
+		CREATE TABLE jobs (
+			id           INTEGER PRIMARY KEY AUTOINCREMENT,
+			model_id     INTEGER NOT NULL REFERENCES models(id) ON DELETE CASCADE,
+			kind         TEXT NOT NULL,
+			status       TEXT NOT NULL,
+			attempts     INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL,
+			last_error   TEXT NOT NULL DEFAULT '',
+			run_at       DATETIME NOT NULL,
+			created_at   DATETIME NOT NULL,
+			updated_at   DATETIME NOT NULL
+		);
+		CREATE INDEX idx_jobs_status_run_at ON jobs(status, run_at);
+		CREATE INDEX idx_jobs_model_id ON jobs(model_id);
+		CREATE UNIQUE INDEX idx_jobs_queued ON jobs(model_id, kind) WHERE status = 'queued';`,
+	},
+	{
+		version: 17,
+		name:    "optimized model variants",
+		up: `ALTER TABLE models ADD COLUMN optimized_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE models ADD COLUMN optimized_size INTEGER NOT NULL DEFAULT 0;`,
+	},
+	{
+		version: 18,
+		name:    "model levels of detail",
+		up:      `ALTER TABLE models ADD COLUMN lods TEXT NOT NULL DEFAULT '[]';`,
+	},
+	{
+		version: 19,
+		name:    "converted model sources",
+		up: `ALTER TABLE models ADD COLUMN source_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE models ADD COLUMN source_format TEXT NOT NULL DEFAULT '';`,
+	},
+}
+
+// hashArchiveTokenSecrets replaces the plaintext secrets migration 7 copied
+// into archive_tokens.token_hash with their hashes
+func hashArchiveTokenSecrets(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, token_hash FROM archive_tokens`)
+	if err != nil {
+		return err
+	}
+	plain := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for id, token := range plain {
+		if _, err := tx.Exec(`UPDATE archive_tokens SET token_hash = ? WHERE id = ?`, hashToken(token), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate brings the schema up to the latest version. Each migration runs in
+// its own transaction together with the bookkeeping row in schema_migrations,
+// so a failed migration leaves the database at the previous version.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(m.up); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if m.fn != nil {
+			if err := m.fn(tx); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.version, m.name, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("record migration %d: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d: %s", m.version, m.name)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB opens an empty SQLite database with foreign keys on
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// migrateTo applies the migrations up to and including version
+func migrateTo(t *testing.T, db *sql.DB, version int) {
+	t.Helper()
+	all := migrations
+	defer func() { migrations = all }()
+	for i, m := range all {
+		if m.version > version {
+			migrations = all[:i]
+			break
+		}
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrationVersionsIncrease(t *testing.T) {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			t.Fatalf("migration %d follows %d", migrations[i].version, migrations[i-1].version)
+		}
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+	}
+	var n, max int
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&n, &max); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(migrations) || max != migrations[len(migrations)-1].version {
+		t.Fatalf("%d migrations recorded, latest %d", n, max)
+	}
+}
+
+func TestMigrateResumesFromRecordedVersion(t *testing.T) {
+	db := openTestDB(t)
+	migrateTo(t, db, 3)
+	if _, err := db.Exec(`INSERT INTO users (email, password_hash, role, created_at, updated_at)
+		VALUES ('old@test.com', 'x', 'user', datetime('now'), datetime('now'))`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	var email string
+	if err := db.QueryRow(`SELECT email FROM users`).Scan(&email); err != nil || email != "old@test.com" {
+		t.Fatalf("user after migrate: %q %v", email, err)
+	}
+}
+
+func TestMigrateHashesArchiveTokens(t *testing.T) {
+	db := openTestDB(t)
+	migrateTo(t, db, 5)
+	if _, err := db.Exec(`INSERT INTO archives (name, token, created_at, max_logins, login_count, token_version)
+		VALUES ('ARSIP_001', 'plain-secret-abcd', datetime('now'), 3, 1, 2)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var hash, hint string
+	if err := db.QueryRow(`SELECT token_hash, token_hint FROM archive_tokens`).Scan(&hash, &hint); err != nil {
+		t.Fatal(err)
+	}
+	if hash != hashToken("plain-secret-abcd") || hint != "abcd" {
+		t.Fatalf("migrated token %q, hint %q", hash, hint)
+	}
+	s := &SQLiteStore{db: db}
+	tok, err := s.GetArchiveTokenByHash(hashToken("plain-secret-abcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.Name != "Default" || tok.MaxLogins != 3 || tok.LoginCount != 1 || tok.Version != 2 {
+		t.Fatalf("migrated token %+v", tok)
+	}
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Exports turn the triangles of the default scene into OBJ, STL or PLY,
+// flattened into one coordinate space. OBJ keeps materials and PNG or JPEG
+// base color textures, in a zip with its .mtl; PLY keeps normals and
+// colors; STL only has the surface. Points, lines and meshes the reader
+// cannot decode, like Draco ones, are left out.
+
+// exportFormats maps the formats a model can be exported to to the ending
+// of the file made for them
+var exportFormats = map[string]string{
+	"obj": ".obj.zip",
+	"stl": ".stl",
+	"ply": ".ply",
+}
+
+// exportUnits gives the length of a glTF metre in each unit an export can
+// be written in
+var exportUnits = map[string]float64{
+	"m":  1,
+	"cm": 100,
+	"mm": 1000,
+	"in": 1 / 0.0254,
+	"ft": 1 / 0.3048,
+}
+
+// errExport is wrapped by the errors of models that cannot be exported
+var errExport = errors.New("cannot export model")
+
+// exportOptions says how a model is exported
+type exportOptions struct {
+	format string // a key of exportFormats
+	units  string // a key of exportUnits
+	up     string // "y" as in glTF, or "z" for CAD and printing tools
+}
+
+// exportName returns the file name of an export of a model stored as
+// fileName, next to it
+func exportName(fileName string, opts exportOptions) string {
+	stem := fileName[:len(fileName)-len(path.Ext(fileName))]
+	return fmt.Sprintf("%s.export-%s-%s%s", stem, opts.units, opts.up, exportFormats[opts.format])
+}
+
+// removeExportFiles deletes the cached exports of a model stored as fileName
+func removeExportFiles(baseDir, fileName string) {
+	stem := path.Base(fileName[:len(fileName)-len(path.Ext(fileName))])
+	dir := filepath.Join(baseDir, filepath.FromSlash(path.Dir(fileName)))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), stem+".export-") {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove %s: %v", e.Name(), err)
+			}
+		}
+	}
+}
+
+// matrix returns the transform from glTF space, in metres with +Y up and
+// +Z to the front, into the units and axes of opts
+func (opts exportOptions) matrix() [16]float64 {
+	s := exportUnits[opts.units]
+	m := [16]float64{s, 0, 0, 0, 0, s, 0, 0, 0, 0, s, 0, 0, 0, 0, 1}
+	if opts.up == "z" {
+		// +Y becomes +Z and the front faces -Y
+		m[5], m[6], m[9], m[10] = 0, s, -s, 0
+	}
+	return m
+}
+
+// exportMaterial is the part of a glTF material the formats can carry
+type exportMaterial struct {
+	name      string
+	color     [4]float64
+	emissive  [3]float64
+	roughness float64
+	metallic  float64
+	image     int // glTF image of the base color texture, -1 for none
+}
+
+// exportPart is one primitive instance, already in the export's space
+type exportPart struct {
+	material  int       // into exportScene.materials, -1 for the default
+	positions []float64 // xyz
+	normals   []float64 // xyz, nil when the primitive has none
+	uvs       []float64 // glTF's top-left origin, nil when none
+	colors    []float64 // RGBA, nil when none
+	indices   []uint32  // three per triangle
+}
+
+type exportScene struct {
+	asset     *gltfAsset
+	parts     []exportPart
+	materials []exportMaterial
+	matIDs    map[int]int // glTF material -> materials
+	triangles int
+	skipped   int // primitives left out
+}
+
+// exportModelFile reads the .glb or .gltf at filePath, with the files its
+// URIs refer to, and returns it in the format of opts. An OBJ export names
+// its files after name.
+func exportModelFile(filePath, name string, opts exportOptions) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	files := newModelFiles(filepath.Dir(filePath), false)
+	defer files.Close()
+	asset, errs := openGLTF(f, info.Size(), strings.ToLower(filepath.Ext(filePath)), files.resolve)
+	if asset == nil {
+		return nil, fmt.Errorf("%w: %s", errExport, errs[0].Message)
+	}
+
+	sc := &exportScene{asset: asset, matIDs: make(map[int]int)}
+	space := opts.matrix()
+	forEachMeshInstance(asset.Doc, func(mesh int, world [16]float64) {
+		sc.addMesh(mesh, mulMatrix(space, world))
+	})
+	if sc.triangles == 0 {
+		return nil, fmt.Errorf("%w: it has no triangles that can be read", errExport)
+	}
+	if sc.skipped > 0 {
+		log.Printf("exportModelFile: %s: %d primitives left out", filePath, sc.skipped)
+	}
+	switch opts.format {
+	case "stl":
+		return sc.stl(opts), nil
+	case "ply":
+		return sc.ply(opts), nil
+	}
+	return sc.obj(name, opts)
+}
+
+// addMesh adds the triangle primitives of one instance of mesh i
+func (sc *exportScene) addMesh(i int, world [16]float64) {
+	doc := sc.asset.Doc
+	// normals go through the cofactor matrix, which keeps them
+	// perpendicular under non-uniform scale
+	cols := [3]vec3{{world[0], world[1], world[2]}, {world[4], world[5], world[6]}, {world[8], world[9], world[10]}}
+	cof := [3]vec3{cols[1].cross(cols[2]), cols[2].cross(cols[0]), cols[0].cross(cols[1])}
+	mirrored := cols[0].dot(cof[0]) < 0
+	for _, p := range doc.Meshes[i].Primitives {
+		mode := 4
+		if p.Mode != nil {
+			mode = *p.Mode
+		}
+		pi, ok := p.Attributes["POSITION"]
+		if (mode != 4 && mode != 5 && mode != 6) || !ok || pi < 0 || pi >= len(doc.Accessors) || doc.Accessors[pi].Type != "VEC3" {
+			sc.skipped++
+			continue
+		}
+		pos, err := sc.asset.readFloats(pi)
+		if err != nil {
+			sc.skipped++
+			continue
+		}
+		count := len(pos) / 3
+		var idx []uint32
+		if p.Indices != nil && *p.Indices >= 0 && *p.Indices < len(doc.Accessors) {
+			if idx, err = sc.asset.readIndices(*p.Indices); err != nil {
+				sc.skipped++
+				continue
+			}
+		} else {
+			idx = make([]uint32, count)
+			for n := range idx {
+				idx[n] = uint32(n)
+			}
+		}
+
+		part := exportPart{material: sc.material(p.Material)}
+		for _, t := range triangleList(mode, idx) {
+			if int(t) >= count {
+				part.indices = nil
+				break
+			}
+			part.indices = append(part.indices, t)
+		}
+		if len(part.indices) == 0 {
+			sc.skipped++
+			continue
+		}
+		if mirrored {
+			// keep the faces pointing out
+			for n := 0; n+2 < len(part.indices); n += 3 {
+				part.indices[n+1], part.indices[n+2] = part.indices[n+2], part.indices[n+1]
+			}
+		}
+
+		part.positions = make([]float64, 0, len(pos))
+		for n := 0; n < count; n++ {
+			v := transformPoint(world, vec3{pos[n*3], pos[n*3+1], pos[n*3+2]})
+			part.positions = append(part.positions, v[:]...)
+		}
+		if normals := sc.attribute(p, "NORMAL", count*3); normals != nil {
+			for n := 0; n < count; n++ {
+				v := cof[0].scale(normals[n*3]).add(cof[1].scale(normals[n*3+1])).add(cof[2].scale(normals[n*3+2])).normalize()
+				if mirrored {
+					v = v.scale(-1)
+				}
+				part.normals = append(part.normals, v[:]...)
+			}
+		}
+		part.uvs = sc.attribute(p, "TEXCOORD_0", count*2)
+		if colors := sc.attribute(p, "COLOR_0", count*4); colors != nil {
+			part.colors = colors
+		} else if colors := sc.attribute(p, "COLOR_0", count*3); colors != nil {
+			part.colors = make([]float64, 0, count*4)
+			for n := 0; n < count; n++ {
+				part.colors = append(part.colors, colors[n*3], colors[n*3+1], colors[n*3+2], 1)
+			}
+		}
+		sc.parts = append(sc.parts, part)
+		sc.triangles += len(part.indices) / 3
+	}
+}
+
+// attribute returns the values of attribute name of p when there are n
+func (sc *exportScene) attribute(p GLTFPrimitive, name string, n int) []float64 {
+	a, ok := p.Attributes[name]
+	if !ok || a < 0 || a >= len(sc.asset.Doc.Accessors) {
+		return nil
+	}
+	v, err := sc.asset.readFloats(a)
+	if err != nil || len(v) != n {
+		return nil
+	}
+	return v
+}
+
+// material returns the export material of glTF material i, or -1
+func (sc *exportScene) material(i *int) int {
+	doc := sc.asset.Doc
+	if i == nil || *i < 0 || *i >= len(doc.Materials) {
+		return -1
+	}
+	if m, ok := sc.matIDs[*i]; ok {
+		return m
+	}
+	src := doc.Materials[*i]
+	m := exportMaterial{name: src.Name, color: [4]float64{1, 1, 1, 1}, roughness: 1, metallic: 1, image: -1}
+	if pbr := src.PBRMetallicRoughness; pbr != nil {
+		if len(pbr.BaseColorFactor) == 4 {
+			copy(m.color[:], pbr.BaseColorFactor)
+		}
+		if pbr.RoughnessFactor != nil {
+			m.roughness = *pbr.RoughnessFactor
+		}
+		if pbr.MetallicFactor != nil {
+			m.metallic = *pbr.MetallicFactor
+		}
+		if t := pbr.BaseColorTexture; t != nil && t.Index >= 0 && t.Index < len(doc.Textures) {
+			if src := doc.Textures[t.Index].Source; src != nil && *src >= 0 && *src < len(doc.Images) {
+				m.image = *src
+			}
+		}
+	}
+	if len(src.EmissiveFactor) == 3 {
+		copy(m.emissive[:], src.EmissiveFactor)
+	}
+	sc.materials = append(sc.materials, m)
+	sc.matIDs[*i] = len(sc.materials) - 1
+	return len(sc.materials) - 1
+}
+
+// imageData returns the bytes of glTF image i and their kind, "png" or
+// "jpeg"; other formats cannot be referenced from a .mtl
+func (sc *exportScene) imageData(i int) ([]byte, string) {
+	doc := sc.asset.Doc
+	src := doc.Images[i]
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(src.URI, "data:"):
+		data, _, err = decodeDataURI(src.URI)
+	case src.URI != "" && sc.asset.resolve != nil:
+		var r *io.SectionReader
+		if r, err = sc.asset.resolve(src.URI); err == nil {
+			data, err = io.ReadAll(r)
+		}
+	case src.BufferView != nil && *src.BufferView >= 0 && *src.BufferView < len(doc.BufferViews):
+		bv := doc.BufferViews[*src.BufferView]
+		if bv.Buffer < 0 || bv.Buffer >= len(sc.asset.Data) || sc.asset.Data[bv.Buffer] == nil ||
+			!spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, sc.asset.dataSize(bv.Buffer)) {
+			return nil, ""
+		}
+		data = make([]byte, bv.ByteLength)
+		_, err = sc.asset.Data[bv.Buffer].ReadAt(data, int64(bv.ByteOffset))
+	default:
+		return nil, ""
+	}
+	if err != nil {
+		log.Printf("exportScene: image %d: %v", i, err)
+		return nil, ""
+	}
+	kind := imageKind(bytes.NewReader(data))
+	if kind != "png" && kind != "jpeg" {
+		return nil, ""
+	}
+	return data, kind
+}
+
+// exportHeader names the units of an export, which STL and PLY cannot
+// otherwise record
+func exportHeader(opts exportOptions) string {
+	return fmt.Sprintf("glb-project export, units: %s, up: %s", opts.units, strings.ToUpper(opts.up))
+}
+
+// stl writes the scene as a binary STL
+func (sc *exportScene) stl(opts exportOptions) []byte {
+	out := make([]byte, 84, 84+50*sc.triangles)
+	copy(out, exportHeader(opts))
+	binary.LittleEndian.PutUint32(out[80:], uint32(sc.triangles))
+	var rec [50]byte
+	for _, part := range sc.parts {
+		for n := 0; n+2 < len(part.indices); n += 3 {
+			var v [3][3]float32
+			for k := range v {
+				i := part.indices[n+k]
+				v[k] = [3]float32{float32(part.positions[i*3]), float32(part.positions[i*3+1]), float32(part.positions[i*3+2])}
+			}
+			normal, _ := faceNormal(v[0], v[1], v[2])
+			for k, f := range append(normal[:], append(v[0][:], append(v[1][:], v[2][:]...)...)...) {
+				binary.LittleEndian.PutUint32(rec[k*4:], math.Float32bits(f))
+			}
+			out = append(out, rec[:]...)
+		}
+	}
+	return out
+}
+
+// ply writes the scene as a binary PLY. Normals are kept when every part
+// has them; colors when any part has vertex colors or a colored material,
+// as the vertex color times the base color.
+func (sc *exportScene) ply(opts exportOptions) []byte {
+	var vertices int
+	hasNormals, hasColors := true, false
+	for _, part := range sc.parts {
+		vertices += len(part.positions) / 3
+		hasNormals = hasNormals && part.normals != nil
+		hasColors = hasColors || part.colors != nil || sc.partColor(part) != [4]float64{1, 1, 1, 1}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "ply\nformat binary_little_endian 1.0\ncomment %s\nelement vertex %d\n", exportHeader(opts), vertices)
+	buf.WriteString("property float x\nproperty float y\nproperty float z\n")
+	if hasNormals {
+		buf.WriteString("property float nx\nproperty float ny\nproperty float nz\n")
+	}
+	if hasColors {
+		buf.WriteString("property uchar red\nproperty uchar green\nproperty uchar blue\nproperty uchar alpha\n")
+	}
+	fmt.Fprintf(&buf, "element face %d\nproperty list uchar uint vertex_indices\nend_header\n", sc.triangles)
+
+	var b [4]byte
+	putFloat := func(v float64) {
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(v)))
+		buf.Write(b[:])
+	}
+	for _, part := range sc.parts {
+		color := sc.partColor(part)
+		for n := 0; n < len(part.positions)/3; n++ {
+			for k := 0; k < 3; k++ {
+				putFloat(part.positions[n*3+k])
+			}
+			if hasNormals {
+				for k := 0; k < 3; k++ {
+					putFloat(part.normals[n*3+k])
+				}
+			}
+			if hasColors {
+				for k := 0; k < 4; k++ {
+					c := color[k]
+					if part.colors != nil {
+						c *= part.colors[n*4+k]
+					}
+					buf.WriteByte(uint8(math.Round(math.Min(math.Max(c, 0), 1) * 255)))
+				}
+			}
+		}
+	}
+	var offset uint32
+	for _, part := range sc.parts {
+		for n := 0; n+2 < len(part.indices); n += 3 {
+			buf.WriteByte(3)
+			for k := 0; k < 3; k++ {
+				binary.LittleEndian.PutUint32(b[:], offset+part.indices[n+k])
+				buf.Write(b[:])
+			}
+		}
+		offset += uint32(len(part.positions) / 3)
+	}
+	return buf.Bytes()
+}
+
+// partColor returns the base color of the material of part
+func (sc *exportScene) partColor(part exportPart) [4]float64 {
+	if part.material < 0 {
+		return [4]float64{1, 1, 1, 1}
+	}
+	return sc.materials[part.material].color
+}
+
+var mtlNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// obj writes the scene as a zip holding name.obj, name.mtl and the
+// textures the materials use
+func (sc *exportScene) obj(name string, opts exportOptions) ([]byte, error) {
+	name = mtlNameInvalid.ReplaceAllString(name, "_")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	now := time.Now()
+	create := func(file string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: file, Method: zip.Deflate, Modified: now})
+	}
+
+	// materials get names that are unique and free of spaces
+	matNames := make([]string, len(sc.materials))
+	used := map[string]bool{"default": true}
+	for i, m := range sc.materials {
+		base := strings.Trim(mtlNameInvalid.ReplaceAllString(m.name, "_"), "_")
+		if base == "" {
+			base = fmt.Sprintf("material_%d", i)
+		}
+		n := base
+		for k := 2; used[n]; k++ {
+			n = fmt.Sprintf("%s_%d", base, k)
+		}
+		used[n] = true
+		matNames[i] = n
+	}
+
+	// zip entries are written one after the other, so the .mtl is built
+	// first and stored after the textures it names
+	var mtl bytes.Buffer
+	fmt.Fprintf(&mtl, "# %s\n", exportHeader(opts))
+	textures := make(map[int]string) // glTF image -> file in the zip
+	for i, m := range sc.materials {
+		fmt.Fprintf(&mtl, "\nnewmtl %s\nKd %s %s %s\nd %s\n", matNames[i], objFloat(m.color[0]), objFloat(m.color[1]), objFloat(m.color[2]), objFloat(m.color[3]))
+		fmt.Fprintf(&mtl, "Ke %s %s %s\nPr %s\nPm %s\n", objFloat(m.emissive[0]), objFloat(m.emissive[1]), objFloat(m.emissive[2]), objFloat(m.roughness), objFloat(m.metallic))
+		if m.image < 0 {
+			continue
+		}
+		file, ok := textures[m.image]
+		if !ok {
+			if data, kind := sc.imageData(m.image); data != nil {
+				file = fmt.Sprintf("texture_%d.%s", m.image, map[string]string{"png": "png", "jpeg": "jpg"}[kind])
+				tw, err := create(file)
+				if err != nil {
+					return nil, err
+				}
+				if _, err := tw.Write(data); err != nil {
+					return nil, err
+				}
+			}
+			textures[m.image] = file
+		}
+		if file != "" {
+			fmt.Fprintf(&mtl, "map_Kd %s\n", file)
+		}
+	}
+	mtl.WriteString("\nnewmtl default\nKd 1 1 1\nd 1\nPr 1\nPm 1\n")
+	w, err := create(name + ".mtl")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(mtl.Bytes()); err != nil {
+		return nil, err
+	}
+
+	w, err = create(name + ".obj")
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(w)
+	fmt.Fprintf(out, "# %s\nmtllib %s.mtl\n", exportHeader(opts), name)
+	var vOffset, vtOffset, vnOffset int
+	for pi, part := range sc.parts {
+		fmt.Fprintf(out, "o part_%d\n", pi+1)
+		count := len(part.positions) / 3
+		for n := 0; n < count; n++ {
+			p := part.positions[n*3:]
+			if part.colors != nil {
+				c := part.colors[n*4:]
+				fmt.Fprintf(out, "v %s %s %s %s %s %s\n", objFloat(p[0]), objFloat(p[1]), objFloat(p[2]), objFloat(c[0]), objFloat(c[1]), objFloat(c[2]))
+			} else {
+				fmt.Fprintf(out, "v %s %s %s\n", objFloat(p[0]), objFloat(p[1]), objFloat(p[2]))
+			}
+		}
+		for n := 0; part.uvs != nil && n < count; n++ {
+			// OBJ puts the origin of textures bottom-left
+			fmt.Fprintf(out, "vt %s %s\n", objFloat(part.uvs[n*2]), objFloat(1-part.uvs[n*2+1]))
+		}
+		for n := 0; part.normals != nil && n < count; n++ {
+			fmt.Fprintf(out, "vn %s %s %s\n", objFloat(part.normals[n*3]), objFloat(part.normals[n*3+1]), objFloat(part.normals[n*3+2]))
+		}
+		if part.material >= 0 {
+			fmt.Fprintf(out, "usemtl %s\n", matNames[part.material])
+		} else {
+			out.WriteString("usemtl default\n")
+		}
+		for n := 0; n+2 < len(part.indices); n += 3 {
+			out.WriteString("f")
+			for k := 0; k < 3; k++ {
+				i := int(part.indices[n+k])
+				switch {
+				case part.uvs != nil && part.normals != nil:
+					fmt.Fprintf(out, " %d/%d/%d", vOffset+i+1, vtOffset+i+1, vnOffset+i+1)
+				case part.uvs != nil:
+					fmt.Fprintf(out, " %d/%d", vOffset+i+1, vtOffset+i+1)
+				case part.normals != nil:
+					fmt.Fprintf(out, " %d//%d", vOffset+i+1, vnOffset+i+1)
+				default:
+					fmt.Fprintf(out, " %d", vOffset+i+1)
+				}
+			}
+			out.WriteString("\n")
+		}
+		vOffset += count
+		if part.uvs != nil {
+			vtOffset += count
+		}
+		if part.normals != nil {
+			vnOffset += count
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// objFloat formats v as short as float32 precision allows
+func objFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 32)
+}
+
+// ============ EXPORT HANDLER ============
+
+// exportModelHandler serves a model as OBJ, STL or PLY. Exports are cached
+// next to the model until it changes. A model in an archive needs a token
+// of that archive, as its files do; other models are public like /uploads.
+func (s *Server) exportModelHandler(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Invalid model id"})
+		return
+	}
+	opts := exportOptions{
+		format: strings.ToLower(c.Query("format")),
+		units:  strings.ToLower(c.DefaultQuery("units", "m")),
+		up:     strings.ToLower(c.DefaultQuery("up", "y")),
+	}
+	if exportFormats[opts.format] == "" {
+		c.JSON(400, gin.H{"error": "format must be obj, stl or ply"})
+		return
+	}
+	if exportUnits[opts.units] == 0 {
+		c.JSON(400, gin.H{"error": "units must be m, cm, mm, in or ft"})
+		return
+	}
+	if opts.up != "y" && opts.up != "z" {
+		c.JSON(400, gin.H{"error": "up must be y or z"})
+		return
+	}
+
+	m, err := s.store.GetModelByID(uint(id))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Model not found"})
+		return
+	}
+	if m.ArchiveID != 0 {
+		if !s.archiveTokenAuth(c) {
+			return
+		}
+		if c.GetUint("archive_id") != m.ArchiveID {
+			c.JSON(403, gin.H{"error": "Forbidden"})
+			return
+		}
+	}
+
+	name := friendlyModelName(m.FileName)
+	baseDir := modelBaseDir(s.cfg, s.store, m)
+	src := filepath.Join(baseDir, filepath.FromSlash(m.FileName))
+	dst := filepath.Join(baseDir, filepath.FromSlash(exportName(m.FileName, opts)))
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "File not found"})
+		return
+	}
+	if info, err := os.Stat(dst); err != nil || info.ModTime().Before(srcInfo.ModTime()) {
+		data, err := exportModelFile(src, name, opts)
+		if errors.Is(err, errExport) {
+			c.JSON(422, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("exportModelHandler: model %d: %v", m.ID, err)
+			c.JSON(500, gin.H{"error": "Error exporting model"})
+			return
+		}
+		if err := writeDerivedFile(dst, data); err != nil {
+			log.Printf("exportModelHandler: model %d: write %s: %v", m.ID, dst, err)
+			c.JSON(500, gin.H{"error": "Error exporting model"})
+			return
+		}
+		if _, err := s.store.GetModelByID(m.ID); errors.Is(err, ErrNotFound) {
+			// deleted while exporting
+			os.Remove(dst)
+			c.JSON(404, gin.H{"error": "Model not found"})
+			return
+		}
+		log.Printf("exportModelHandler: model %d: wrote %s (%d bytes)", m.ID, path.Base(filepath.ToSlash(dst)), len(data))
+	}
+
+	c.FileAttachment(dst, name+exportFormats[opts.format])
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportDoc writes doc and bin as a GLB and exports it with opts
+func exportDoc(t *testing.T, doc *GLTF, bin []byte, opts exportOptions) ([]byte, error) {
+	t.Helper()
+	glb, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exportModelFile(writeTestFile(t, t.TempDir(), "model.glb", glb), "model", opts)
+}
+
+// extent returns the smallest and largest coordinate on each axis
+func extent(pos []float64) (lo, hi vec3) {
+	lo = vec3{math.Inf(1), math.Inf(1), math.Inf(1)}
+	hi = vec3{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+	for i, v := range pos {
+		lo[i%3], hi[i%3] = math.Min(lo[i%3], v), math.Max(hi[i%3], v)
+	}
+	return lo, hi
+}
+
+// facingOut reports whether every triangle faces away from center
+func facingOut(pos []float64, idx []uint32, center vec3) bool {
+	at := func(i uint32) vec3 { return vec3{pos[i*3], pos[i*3+1], pos[i*3+2]} }
+	for n := 0; n+2 < len(idx); n += 3 {
+		a, b, c := at(idx[n]), at(idx[n+1]), at(idx[n+2])
+		mid := a.add(b).add(c).scale(1.0 / 3)
+		if b.sub(a).cross(c.sub(a)).dot(mid.sub(center)) <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExportOptionsMatrix(t *testing.T) {
+	m := exportOptions{units: "mm", up: "z"}.matrix()
+	for _, c := range []struct{ in, want vec3 }{
+		{vec3{1, 0, 0}, vec3{1000, 0, 0}},
+		{vec3{0, 1, 0}, vec3{0, 0, 1000}},  // up
+		{vec3{0, 0, 1}, vec3{0, -1000, 0}}, // the front
+	} {
+		if got := transformPoint(m, c.in); got.sub(c.want).dot(got.sub(c.want)) > 1e-12 {
+			t.Errorf("%v becomes %v, want %v", c.in, got, c.want)
+		}
+	}
+	if in := (exportOptions{units: "in", up: "y"}).matrix(); math.Abs(in[0]*0.0254-1) > 1e-12 || in[5] != in[0] {
+		t.Fatalf("inch matrix %v", in)
+	}
+	if got := exportName("1_house/house.gltf", exportOptions{format: "obj", units: "cm", up: "z"}); got != "1_house/house.export-cm-z.obj.zip" {
+		t.Fatalf("export name %q", got)
+	}
+}
+
+func TestExportSTL(t *testing.T) {
+	doc, bin := testDoc(testCube())
+	doc.Nodes[0].Translation = []float64{0, 5, 0}
+	data, err := exportDoc(t, doc, bin, exportOptions{format: "stl", units: "mm", up: "z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 84+50*12 || !strings.HasPrefix(string(data), "glb-project export, units: mm, up: Z") {
+		t.Fatalf("%d bytes, header %q", len(data), data[:40])
+	}
+
+	// the node's transform is applied before the units and axes
+	asset, _, err := importFiles(t, "model.stl", map[string][]byte{"model.stl": data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, _, _, _, idx := primitiveData(t, asset, asset.Doc.Meshes[0].Primitives[0])
+	lo, hi := extent(pos)
+	if lo != (vec3{-1000, -1000, 4000}) || hi != (vec3{1000, 1000, 6000}) || len(idx) != 36 {
+		t.Fatalf("bounds %v %v, %d indices", lo, hi, len(idx))
+	}
+	if !facingOut(pos, idx, vec3{0, 0, 5000}) {
+		t.Fatal("faces turned inward")
+	}
+}
+
+func TestExportKeepsMirroredFacesOut(t *testing.T) {
+	doc, bin := testDoc(testCube())
+	doc.Nodes[0].Scale = []float64{-1, 1, 1}
+	data, err := exportDoc(t, doc, bin, exportOptions{format: "stl", units: "m", up: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset, _, err := importFiles(t, "model.stl", map[string][]byte{"model.stl": data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, _, _, _, idx := primitiveData(t, asset, asset.Doc.Meshes[0].Primitives[0])
+	if !facingOut(pos, idx, vec3{}) {
+		t.Fatal("mirrored cube exported inside out")
+	}
+}
+
+func TestExportPLY(t *testing.T) {
+	cube := testCube()
+	// normals pointing away from the center, not of unit length
+	cube.normals = append([]float32(nil), cube.positions...)
+	doc, bin := testDoc(cube)
+	zero := 0
+	doc.Materials = []GLTFMaterial{{PBRMetallicRoughness: &GLTFPBR{BaseColorFactor: []float64{1, 0.5, 0, 1}}}}
+	doc.Meshes[0].Primitives[0].Material = &zero
+
+	data, err := exportDoc(t, doc, bin, exportOptions{format: "ply", units: "cm", up: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("comment glb-project export, units: cm, up: Y\n")) {
+		t.Fatal("units missing from the header")
+	}
+	asset, _, err := importFiles(t, "model.ply", map[string][]byte{"model.ply": data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, normals, _, colors, idx := primitiveData(t, asset, asset.Doc.Meshes[0].Primitives[0])
+	lo, hi := extent(pos)
+	if lo != (vec3{-100, -100, -100}) || hi != (vec3{100, 100, 100}) || len(idx) != 36 {
+		t.Fatalf("bounds %v %v, %d indices", lo, hi, len(idx))
+	}
+	s := 1 / math.Sqrt(3)
+	if !closeTo(normals[:3], -s, -s, -s) {
+		t.Fatalf("normal %v", normals[:3])
+	}
+	// the base color becomes the vertex color, in 8 bits
+	if !closeTo(colors[:4], 1, 128.0/255, 0, 1) {
+		t.Fatalf("color %v", colors[:4])
+	}
+}
+
+func TestExportOBJ(t *testing.T) {
+	gltf, bin, img := texturedGLTF(t, "crate.bin", "textures/crate.png")
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "crate.gltf", gltf)
+	writeTestFile(t, dir, "crate.bin", bin)
+	writeTestFile(t, dir, "textures/crate.png", img)
+
+	data, err := exportModelFile(path, "old crate", exportOptions{format: "obj", units: "m", up: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+	// names lose their spaces, which OBJ cannot carry
+	if len(files) != 3 || files["old_crate.obj"] == nil || files["old_crate.mtl"] == nil || !bytes.Equal(files["texture_0.png"], img) {
+		t.Fatalf("zip holds %d files", len(files))
+	}
+	if mtl := string(files["old_crate.mtl"]); !strings.Contains(mtl, "map_Kd texture_0.png\n") || !strings.Contains(mtl, "newmtl default\n") {
+		t.Fatalf("mtl:\n%s", mtl)
+	}
+
+	// the files open again, with the texture and UVs where they were
+	asset, warnings, err := importFiles(t, "old_crate.obj", files)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("%v %q", err, warnings)
+	}
+	prim := asset.Doc.Meshes[0].Primitives[0]
+	pos, _, uvs, _, idx := primitiveData(t, asset, prim)
+	if len(pos) != 8*3 || len(idx) != 36 {
+		t.Fatalf("%d positions, %d indices", len(pos)/3, len(idx))
+	}
+	cube := testCube()
+	for v := 0; v < 8; v++ {
+		for c := 0; c < 8; c++ {
+			if closeTo(pos[v*3:v*3+3], float64(cube.positions[c*3]), float64(cube.positions[c*3+1]), float64(cube.positions[c*3+2])) &&
+				!closeTo(uvs[v*2:v*2+2], float64(c%2), float64(c/4)) {
+				t.Fatalf("corner %d has uv %v", c, uvs[v*2:v*2+2])
+			}
+		}
+	}
+	if prim.Material == nil || asset.Doc.Materials[*prim.Material].PBRMetallicRoughness.BaseColorTexture == nil {
+		t.Fatal("texture lost on the way")
+	}
+}
+
+func TestExportNeedsTriangles(t *testing.T) {
+	doc, bin := testDoc(testCube())
+	points := 0
+	doc.Meshes[0].Primitives[0].Mode = &points
+	doc.Meshes[0].Primitives[0].Indices = nil
+	if _, err := exportDoc(t, doc, bin, exportOptions{format: "stl", units: "m", up: "y"}); !errors.Is(err, errExport) {
+		t.Fatalf("point cloud exported: %v", err)
+	}
+}
+
+func TestExportModelHandler(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	m, _ := ts.store.GetModelByID(id)
+	target := fmt.Sprintf("/api/models/export?id=%d&format=stl&units=mm&up=z", id)
+
+	// public like /uploads
+	w := ts.do("GET", target, "", nil)
+	expectStatus(t, w, 200)
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, `filename="cube.stl"`) || w.Body.Len() != 84+50*12 {
+		t.Fatalf("served %q with %d bytes", cd, w.Body.Len())
+	}
+
+	// the export is reused until the model changes
+	cached := filepath.Join(ts.cfg.UploadDir, exportName(m.FileName, exportOptions{format: "stl", units: "mm", up: "z"}))
+	os.WriteFile(cached, []byte("cached"), 0644)
+	if w := ts.do("GET", target, "", nil); w.Body.String() != "cached" {
+		t.Fatalf("export made again: %d bytes", w.Body.Len())
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(ts.cfg.UploadDir, m.FileName), later, later)
+	if w := ts.do("GET", target, "", nil); w.Body.Len() != 84+50*12 {
+		t.Fatalf("stale export served: %q", w.Body)
+	}
+
+	for query, code := range map[string]int{
+		"id=x&format=stl":                            400,
+		fmt.Sprintf("id=%d&format=fbx", id):          400,
+		fmt.Sprintf("id=%d&format=ply&units=km", id): 400,
+		fmt.Sprintf("id=%d&format=ply&up=x", id):     400,
+		fmt.Sprintf("id=%d&format=ply", id+100):      404,
+	} {
+		if w := ts.do("GET", "/api/models/export?"+query, "", nil); w.Code != code {
+			t.Errorf("%s: %d, want %d", query, w.Code, code)
+		}
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, map[string]uint{"id": id}), 200)
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Fatalf("export left behind: %v", err)
+	}
+}
+
+func TestExportArchiveModel(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	_, otherSecret := ts.createArchive(admin, "ARSIP_002")
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), map[string]string{"archive_id": fmt.Sprint(archID)})
+	target := fmt.Sprintf("/api/models/export?id=%d&format=obj", id)
+
+	// the same rules as the archive's files
+	expectStatus(t, ts.do("GET", target, "", nil), 401)
+	expectStatus(t, ts.do("GET", target, admin, nil), 403)
+	expectStatus(t, ts.do("GET", target, ts.archiveLogin(otherSecret), nil), 403)
+	w := ts.do("GET", target, ts.archiveLogin(secret), nil)
+	expectStatus(t, w, 200)
+	if !strings.Contains(w.Header().Get("Content-Disposition"), `filename="cube.obj.zip"`) {
+		t.Fatalf("served as %q", w.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestExportRejectsUnreadableModels(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	doc, bin := testDoc(testCube())
+	points := 0
+	doc.Meshes[0].Primitives[0].Mode = &points
+	doc.Meshes[0].Primitives[0].Indices = nil
+	glb, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := ts.uploadModel(admin, "cloud.glb", glb, nil)
+	w := ts.do("GET", fmt.Sprintf("/api/models/export?id=%d&format=stl", id), "", nil)
+	expectStatus(t, w, 422)
+	if msg := errorOf(t, w); !strings.Contains(msg, "no triangles") {
+		t.Fatalf("error %q", msg)
+	}
+}
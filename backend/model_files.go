@@ -0,0 +1,394 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxZipEntries bounds how many files a zipped model may contain
+const maxZipEntries = 10000
+
+// gltfResolver opens the file an external glTF URI refers to
+type gltfResolver func(uri string) (*io.SectionReader, error)
+
+// uriPath turns a relative glTF URI into a clean slash-separated path below
+// the directory of the .gltf, rejecting URLs and paths that leave it
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid URI %q", uri)
+	}
+	if u.Scheme != "" || u.Host != "" {
+		return "", fmt.Errorf("%q points outside the upload; only relative paths are allowed", uri)
+	}
+	p := path.Clean(u.Path)
+	if u.Path == "" || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") || strings.Contains(p, "\\") {
+		return "", fmt.Errorf("%q is not a relative path inside the upload", uri)
+	}
+	return p, nil
+}
+
+// modelFiles resolves the external URIs of a glTF staged in dir and
+// remembers the files it handed out. With flat set, a URI whose path is
+// not found falls back to a file of the same base name, as multipart
+// uploads carry no directories.
+type modelFiles struct {
+	dir   string
+	flat  bool
+	used  map[string]string // URI path -> staged file
+	files []*os.File
+}
+
+func newModelFiles(dir string, flat bool) *modelFiles {
+	return &modelFiles{dir: dir, flat: flat, used: make(map[string]string)}
+}
+
+func (m *modelFiles) resolve(uri string) (*io.SectionReader, error) {
+	p, err := uriPath(uri)
+	if err != nil {
+		return nil, err
+	}
+	src := filepath.Join(m.dir, filepath.FromSlash(p))
+	info, err := os.Stat(src)
+	if err != nil && m.flat {
+		src = filepath.Join(m.dir, path.Base(p))
+		info, err = os.Stat(src)
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is missing from the upload", p)
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	m.files = append(m.files, f)
+	m.used[p] = src
+	return io.NewSectionReader(f, 0, info.Size()), nil
+}
+
+func (m *modelFiles) Close() {
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.files = nil
+}
+
+// errBadResources is wrapped by stageMultipart errors the client can fix
+var errBadResources = errors.New("invalid resource files")
+
+// stageMultipart saves a .gltf and the files it references into dir and
+// returns the name of the .gltf; the resources are stored flat under their
+// base names
+func stageMultipart(dir string, main *multipart.FileHeader, resources []*multipart.FileHeader) (string, error) {
+	mainName := filepath.Base(main.Filename)
+	seen := map[string]bool{mainName: true}
+	for _, fh := range resources {
+		name := filepath.Base(fh.Filename)
+		if name == "." || name == string(filepath.Separator) || seen[name] {
+			return "", fmt.Errorf("%w: %s is uploaded twice or has no name", errBadResources, fh.Filename)
+		}
+		seen[name] = true
+	}
+	for _, fh := range append([]*multipart.FileHeader{main}, resources...) {
+		if err := saveMultipartFile(fh, filepath.Join(dir, filepath.Base(fh.Filename))); err != nil {
+			return "", err
+		}
+	}
+	return mainName, nil
+}
+
+func saveMultipartFile(fh *multipart.FileHeader, dst string) error {
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// errBadZip is wrapped by extractZip errors the client can fix
+var errBadZip = errors.New("invalid zip")
+
+// extractZip unpacks the zip of size bytes read from r into dir, refusing
+// paths that leave dir and more than limit bytes in total. It returns the
+// path of the one model file the zip must contain.
+func extractZip(r io.ReaderAt, size int64, dir string, limit int64) (string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadZip, err)
+	}
+	if len(zr.File) > maxZipEntries {
+		return "", fmt.Errorf("%w: more than %d entries", errBadZip, maxZipEntries)
+	}
+	var mains []string
+	var total int64
+	for _, zf := range zr.File {
+		name := strings.ReplaceAll(zf.Name, "\\", "/")
+		if zf.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") {
+			continue
+		}
+		p := path.Clean(name)
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return "", fmt.Errorf("%w: entry %q leaves the archive", errBadZip, zf.Name)
+		}
+		if modelExtension(strings.ToLower(path.Ext(p))) {
+			mains = append(mains, p)
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(p))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		in, err := zf.Open()
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %v", errBadZip, zf.Name, err)
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			in.Close()
+			return "", err
+		}
+		n, err := io.Copy(out, io.LimitReader(in, limit-total+1))
+		in.Close()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %v", errBadZip, zf.Name, err)
+		}
+		if total += n; total > limit {
+			return "", fmt.Errorf("%w: unpacks to more than %d bytes", errBadZip, limit)
+		}
+	}
+	if len(mains) != 1 {
+		return "", fmt.Errorf("%w: it must contain exactly one model file (.gltf, .glb, .obj, .stl, .ply or .fbx), found %d", errBadZip, len(mains))
+	}
+	return mains[0], nil
+}
+
+// storedModel is a model stored under an upload's destination directory
+type storedModel struct {
+	fileName string // relative to the destination directory
+	size     int64
+	// sourceFileName is the uploaded file a model converted to GLB was
+	// made from, in sourceFormat; warnings tell what the conversion left out
+	sourceFileName string
+	sourceFormat   string
+	warnings       []string
+}
+
+// storeModelFiles stages a multi-file model in a scratch directory with
+// stage, which returns the path of the main file inside it, then validates
+// and stores it under destDir like storeModelDir. It answers the request
+// itself when ok is false: 400 for a zip the client must fix, 422 for an
+// invalid model and 500 otherwise.
+func (s *Server) storeModelFiles(c *gin.Context, destDir string, flat bool, stage func(dir string) (string, error)) (storedModel, bool) {
+	dir, err := os.MkdirTemp(s.cfg.UploadStagingDir, "model-*")
+	if err != nil {
+		log.Printf("storeModelFiles: staging dir: %v", err)
+		c.JSON(500, gin.H{"error": "Error saving file"})
+		return storedModel{}, false
+	}
+	defer os.RemoveAll(dir)
+
+	mainRel, err := stage(dir)
+	if errors.Is(err, errBadZip) || errors.Is(err, errBadResources) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return storedModel{}, false
+	}
+	if err != nil {
+		log.Printf("storeModelFiles: stage: %v", err)
+		c.JSON(500, gin.H{"error": "Error saving file"})
+		return storedModel{}, false
+	}
+	return storeModelDir(c, dir, mainRel, flat, destDir)
+}
+
+// storeModelDir validates the model mainRel staged in dir, resolving its
+// external URIs there, and moves it together with the files it references
+// into a directory of its own under destDir. A model in another format is
+// converted to a GLB next to a source/ directory with the uploaded files.
+// It answers the request itself when ok is false, with 422 for a model
+// that is invalid or cannot be converted.
+func storeModelDir(c *gin.Context, dir, mainRel string, flat bool, destDir string) (storedModel, bool) {
+	mainPath := filepath.Join(dir, filepath.FromSlash(mainRel))
+	// URIs are relative to the .gltf, wherever it sits in a zip
+	files := newModelFiles(filepath.Dir(mainPath), flat)
+	var stored storedModel
+	var converted []byte
+	if stored.sourceFormat = importFormat(filepath.Ext(mainPath)); stored.sourceFormat != "" {
+		var err error
+		converted, stored.warnings, err = importModel(mainPath, files.resolve)
+		files.Close()
+		if errors.Is(err, errImport) {
+			c.JSON(422, gin.H{"error": err.Error()})
+			return storedModel{}, false
+		}
+		if err != nil {
+			log.Printf("storeModelDir: convert %s: %v", mainRel, err)
+			c.JSON(500, gin.H{"error": "Error converting model"})
+			return storedModel{}, false
+		}
+		if !checkModelFile(c, bytes.NewReader(converted), int64(len(converted)), ".glb", nil) {
+			return storedModel{}, false
+		}
+	} else {
+		f, err := os.Open(mainPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "Error reading file"})
+			return storedModel{}, false
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			c.JSON(500, gin.H{"error": "Error reading file"})
+			return storedModel{}, false
+		}
+		valid := checkModelFile(c, f, info.Size(), strings.ToLower(filepath.Ext(mainPath)), files.resolve)
+		files.Close()
+		f.Close()
+		if !valid {
+			return storedModel{}, false
+		}
+	}
+
+	// <timestamp>_<name>/ like single files, with a suffix on a clash
+	base := filepath.Base(mainPath)
+	stem := fmt.Sprintf("%d_%s", time.Now().Unix(), strings.TrimSuffix(base, filepath.Ext(base)))
+	modelDir := stem
+	var err error
+	for n := 2; ; n++ {
+		err = os.Mkdir(filepath.Join(destDir, modelDir), 0755)
+		if !os.IsExist(err) {
+			break
+		}
+		modelDir = fmt.Sprintf("%s_%d", stem, n)
+	}
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error creating destination directory"})
+		return storedModel{}, false
+	}
+	root := filepath.Join(destDir, modelDir)
+
+	// the uploaded files of a converted model are kept below source/
+	sourceDir := ""
+	if converted != nil {
+		sourceDir = "source/"
+		glbName := strings.TrimSuffix(base, filepath.Ext(base)) + ".glb"
+		if err := os.WriteFile(filepath.Join(root, glbName), converted, 0644); err != nil {
+			os.RemoveAll(root)
+			c.JSON(500, gin.H{"error": "Error saving file"})
+			return storedModel{}, false
+		}
+		stored.fileName = modelDir + "/" + glbName
+		stored.sourceFileName = modelDir + "/" + sourceDir + base
+		stored.size = int64(len(converted))
+	} else {
+		stored.fileName = modelDir + "/" + base
+	}
+
+	moves := map[string]string{base: mainPath}
+	for p, src := range files.used {
+		moves[p] = src
+	}
+	for p, src := range moves {
+		dst := filepath.Join(root, filepath.FromSlash(sourceDir+p))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+			err = copyFile(src, dst)
+		}
+		if err != nil {
+			os.RemoveAll(root)
+			c.JSON(500, gin.H{"error": "Error saving file"})
+			return storedModel{}, false
+		}
+		if st, err := os.Stat(dst); err == nil {
+			stored.size += st.Size()
+		}
+	}
+	return stored, true
+}
+
+// copyFile copies src to a new file dst; several URIs may share one source
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeDerivedFile replaces dst, a file made from a model, with data. Readers
+// see either the old file or the new one, never a part.
+func writeDerivedFile(dst string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".derived-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file private; it is served like the model
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// removeModelFiles deletes the stored files of a model: its directory for
+// a multi-file model, otherwise the single file with its thumbnail,
+// optimized variant, LODs and exports
+func removeModelFiles(baseDir, fileName string) error {
+	if dir, _, ok := strings.Cut(fileName, "/"); ok {
+		return os.RemoveAll(filepath.Join(baseDir, dir))
+	}
+	for _, derived := range []string{thumbnailName(fileName), optimizedName(fileName)} {
+		if err := os.Remove(filepath.Join(baseDir, derived)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove %s: %v", derived, err)
+		}
+	}
+	removeLODFiles(baseDir, fileName, 1)
+	removeExportFiles(baseDir, fileName)
+	return os.Remove(filepath.Join(baseDir, fileName))
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// texturedGLTF returns a .gltf of a cube whose buffer is in bufURI and whose
+// base color texture is in imageURI, with the bytes of both
+func texturedGLTF(t *testing.T, bufURI, imageURI string) (gltf, bin, img []byte) {
+	t.Helper()
+	cube := testCube()
+	for i := 0; i < 8; i++ {
+		cube.uvs = append(cube.uvs, float32(i%2), float32(i/4))
+	}
+	doc, bin := testDoc(cube)
+	doc.Buffers[0].URI = bufURI
+	zero := 0
+	doc.Images = []GLTFImage{{URI: imageURI}}
+	doc.Textures = []GLTFTexture{{Source: &zero}}
+	doc.Materials = []GLTFMaterial{{PBRMetallicRoughness: &GLTFPBR{BaseColorTexture: &GLTFTextureInfo{Index: 0}}}}
+	doc.Meshes[0].Primitives[0].Material = &zero
+	gltf, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gltf, bin, testPNG(t, 4, color.RGBA{200, 50, 50, 255})
+}
+
+func TestUploadGLTFWithResources(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	gltf, bin, img := texturedGLTF(t, "cube.bin", "textures/wall.png")
+
+	w := ts.upload(token, map[string]string{"name": "cube"},
+		testFile{"file", "cube.gltf", gltf},
+		testFile{"resources", "cube.bin", bin},
+		testFile{"resources", "wall.png", img},
+		testFile{"resources", "notes.txt", []byte("not referenced")},
+	)
+	expectStatus(t, w, 201)
+	var resp struct {
+		Data GLBModel `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	dir, main, ok := strings.Cut(resp.Data.FileName, "/")
+	if !ok || main != "cube.gltf" || resp.Data.FileURL != "/uploads/"+resp.Data.FileName {
+		t.Fatalf("stored as %q at %q", resp.Data.FileName, resp.Data.FileURL)
+	}
+	if want := int64(len(gltf) + len(bin) + len(img)); resp.Data.FileSize != want {
+		t.Fatalf("file_size %d, want %d", resp.Data.FileSize, want)
+	}
+
+	// resources keep the path of their URI; unreferenced ones are dropped
+	root := filepath.Join(ts.cfg.UploadDir, dir)
+	for _, name := range []string{"cube.gltf", "cube.bin", "textures/wall.png"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s not stored: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("unreferenced resource stored: %v", err)
+	}
+	w = ts.do("GET", "/uploads/"+dir+"/textures/wall.png", "", nil)
+	expectStatus(t, w, 200)
+	if w.Body.String() != string(img) {
+		t.Fatal("texture served with other bytes")
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/models", token, map[string]uint{"id": resp.Data.ID}), 200)
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("model folder left behind: %v", err)
+	}
+}
+
+func TestUploadGLTFRejectsBadResources(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	gltf, bin, img := texturedGLTF(t, "cube.bin", "wall.png")
+	glb := testGLB(t, testCube())
+
+	for _, tc := range []struct {
+		name  string
+		files []testFile
+		want  int
+	}{
+		{"missing texture", []testFile{{"file", "cube.gltf", gltf}, {"resources", "cube.bin", bin}}, 422},
+		{"texture not an image", []testFile{{"file", "cube.gltf", gltf}, {"resources", "cube.bin", bin}, {"resources", "wall.png", []byte("text")}}, 422},
+		{"resource twice", []testFile{{"file", "cube.gltf", gltf}, {"resources", "cube.bin", bin}, {"resources", "cube.bin", bin}}, 400},
+		{"resources next to a GLB", []testFile{{"file", "cube.glb", glb}, {"resources", "wall.png", img}}, 400},
+	} {
+		if w := ts.upload(token, map[string]string{"name": "cube"}, tc.files...); w.Code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+
+	for _, uri := range []string{"../cube.bin", "/etc/cube.bin", "https://example.com/cube.bin"} {
+		gltf, bin, img := texturedGLTF(t, uri, "wall.png")
+		w := ts.upload(token, map[string]string{"name": "cube"},
+			testFile{"file", "cube.gltf", gltf}, testFile{"resources", "cube.bin", bin}, testFile{"resources", "wall.png", img})
+		if w.Code != 422 {
+			t.Errorf("buffer at %s: %d %s", uri, w.Code, w.Body)
+		}
+	}
+	if models, _ := ts.store.ListModels(0); len(models) != 0 {
+		t.Fatalf("rejected models stored: %+v", models)
+	}
+}
+
+func TestUploadZippedGLTF(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	gltf, bin, img := texturedGLTF(t, "data/cube.bin", "textures/wall.png")
+	zipped := testZip(t, map[string][]byte{
+		"model/cube.gltf":         gltf,
+		"model/data/cube.bin":     bin,
+		"model/textures/wall.png": img,
+		"__MACOSX/._cube.gltf":    []byte("resource fork"),
+	})
+
+	w := ts.upload(admin, map[string]string{"name": "cube", "archive_id": fmt.Sprint(archID)}, testFile{"file", "cube.zip", zipped})
+	expectStatus(t, w, 201)
+	var resp struct {
+		Data GLBModel `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	dir, _, _ := strings.Cut(resp.Data.FileName, "/")
+	if resp.Data.FileURL != "/api/archives/ARSIP_001/files/"+dir+"/cube.gltf" {
+		t.Fatalf("file_url %q", resp.Data.FileURL)
+	}
+
+	// the archive route serves the files below the model folder
+	token := ts.archiveLogin(secret)
+	expectStatus(t, ts.do("GET", resp.Data.FileURL, token, nil), 200)
+	w = ts.do("GET", "/api/archives/ARSIP_001/files/"+dir+"/data/cube.bin", token, nil)
+	expectStatus(t, w, 200)
+	if w.Body.Len() != len(bin) {
+		t.Fatalf("buffer of %d bytes served", w.Body.Len())
+	}
+	expectStatus(t, ts.do("GET", "/api/archives/ARSIP_001/files/"+dir+"/../../x", token, nil), 400)
+}
+
+func TestUploadRejectsBadZips(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	glb := testGLB(t, testCube())
+	for name, files := range map[string]map[string][]byte{
+		"escaping entry": {"cube.glb": glb, "../evil.txt": []byte("x")},
+		"two models":     {"a.glb": glb, "b.glb": glb},
+		"no model":       {"readme.txt": []byte("x")},
+	} {
+		w := ts.upload(token, map[string]string{"name": "cube"}, testFile{"file", "cube.zip", testZip(t, files)})
+		if w.Code != 400 || !strings.Contains(errorOf(t, w), "invalid zip") {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+	w := ts.upload(token, map[string]string{"name": "cube"}, testFile{"file", "cube.zip", []byte("not a zip")})
+	expectStatus(t, w, 400)
+}
+
+func TestURIPath(t *testing.T) {
+	for uri, want := range map[string]string{
+		"cube.bin":             "cube.bin",
+		"./textures/a%20b.png": "textures/a b.png",
+		"a/../b.bin":           "b.bin",
+		"../b.bin":             "",
+		"a/../../b.bin":        "",
+		"/abs.bin":             "",
+		"http://host/b.bin":    "",
+		"//host/b.bin":         "",
+		`dir\b.bin`:            "",
+		"":                     "",
+	} {
+		got, err := uriPath(uri)
+		if got != want || (err != nil) != (want == "") {
+			t.Errorf("uriPath(%q) = %q, %v", uri, got, err)
+		}
+	}
+}
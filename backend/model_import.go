@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// importFormats maps the extensions of the formats converted to GLB on
+// upload to their names
+var importFormats = map[string]string{
+	".obj": "obj",
+	".stl": "stl",
+	".ply": "ply",
+	".fbx": "fbx",
+}
+
+// importFormat returns the format a file with extension ext is converted
+// from, or "" for glTF and everything else
+func importFormat(ext string) string {
+	return importFormats[strings.ToLower(ext)]
+}
+
+// modelExtension reports whether ext is the extension of a model file that
+// can be uploaded, as glTF or for conversion, in any case
+func modelExtension(ext string) bool {
+	ext = strings.ToLower(ext)
+	return ext == ".glb" || ext == ".gltf" || importFormat(ext) != ""
+}
+
+// errImport is wrapped by the errors of files that cannot be converted
+var errImport = errors.New("cannot convert model")
+
+// importScene is a model read from another format, on its way to a GLB
+type importScene struct {
+	format    string
+	nodes     []importNode
+	roots     []int
+	meshes    []importMesh
+	materials []importMaterial
+	images    []importImage
+	// warnings tell what the conversion had to leave out
+	warnings []string
+}
+
+type importNode struct {
+	name     string
+	mesh     int       // -1 for none
+	matrix   []float64 // column-major 4x4, nil for identity
+	children []int
+}
+
+type importMesh struct {
+	name       string
+	primitives []*importPrimitive
+}
+
+// importPrimitive holds flat attribute lists. Normals, UVs and colors are
+// either given for every vertex or left empty; UVs have glTF's top-left
+// origin.
+type importPrimitive struct {
+	points    bool // a point cloud rather than triangles
+	positions []float32
+	normals   []float32
+	uvs       []float32
+	colors    []float32 // RGBA
+	indices   []uint32
+	material  int // -1 for the default material
+}
+
+type importMaterial struct {
+	name      string
+	color     [4]float64
+	texture   int // image with the base color, -1 for none
+	emissive  [3]float64
+	roughness float64
+	metallic  float64
+}
+
+func newImportMaterial(name string) importMaterial {
+	return importMaterial{name: name, color: [4]float64{1, 1, 1, 1}, texture: -1, roughness: 1}
+}
+
+type importImage struct {
+	name     string
+	mimeType string
+	data     []byte
+}
+
+func (sc *importScene) warnf(format string, args ...interface{}) {
+	sc.warnings = append(sc.warnings, fmt.Sprintf(format, args...))
+}
+
+// addMesh adds a mesh with a root node of the same name to show it
+func (sc *importScene) addMesh(m importMesh) {
+	sc.meshes = append(sc.meshes, m)
+	sc.nodes = append(sc.nodes, importNode{name: m.name, mesh: len(sc.meshes) - 1})
+	sc.roots = append(sc.roots, len(sc.nodes)-1)
+}
+
+// loadImage reads a texture through resolve from the first of paths that
+// exists, once per texture. Model files often name textures by where they
+// were on the author's disk, so callers add fallbacks like the bare file
+// name. Missing files and formats glTF cannot show are left out with a
+// warning; the image index is -1 then.
+func (sc *importScene) loadImage(resolve gltfResolver, paths []string, cache map[string]int) int {
+	if i, ok := cache[paths[0]]; ok {
+		return i
+	}
+	cache[paths[0]] = -1
+	var r *io.SectionReader
+	var err error
+	for _, p := range paths {
+		if r, err = resolve(fileURI(p)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		sc.warnf("texture %s is left out: %v", paths[0], err)
+		return -1
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		sc.warnf("texture %s is left out: %v", paths[0], err)
+		return -1
+	}
+	mime := map[string]string{"png": "image/png", "jpeg": "image/jpeg"}[imageKind(r)]
+	if mime == "" {
+		sc.warnf("texture %s is left out: only PNG and JPEG textures are supported", paths[0])
+		return -1
+	}
+	sc.images = append(sc.images, importImage{name: path.Base(cleanFilePath(paths[0])), mimeType: mime, data: data})
+	cache[paths[0]] = len(sc.images) - 1
+	return cache[paths[0]]
+}
+
+// cleanFilePath turns a path from a model file, which may use backslashes,
+// into a slash-separated one
+func cleanFilePath(p string) string {
+	return strings.ReplaceAll(strings.TrimSpace(p), "\\", "/")
+}
+
+// fileURI turns a path from a model file, which may use backslashes and
+// spaces, into a URI for a gltfResolver
+func fileURI(p string) string {
+	return (&url.URL{Path: cleanFilePath(p)}).String()
+}
+
+// texturePaths lists where a texture named p in a file in dir may be: next
+// to that file, below the model, or by its bare name. Absolute paths, like
+// C:/Users/..., only leave the bare name.
+func texturePaths(dir, p string) []string {
+	p = cleanFilePath(p)
+	if path.IsAbs(p) || len(p) > 1 && p[1] == ':' {
+		p = path.Base(p)
+	}
+	paths := []string{path.Join(dir, p)}
+	for _, alt := range []string{p, path.Base(p)} {
+		if !containsString(paths, alt) {
+			paths = append(paths, alt)
+		}
+	}
+	return paths
+}
+
+// importVertex is one corner of a face with all its attributes
+type importVertex struct {
+	p  [3]float32
+	n  [3]float32
+	uv [2]float32
+	c  [4]float32
+}
+
+// primitiveBuilder collects triangles into a primitive, storing each
+// distinct vertex once
+type primitiveBuilder struct {
+	prim                 *importPrimitive
+	ids                  map[importVertex]uint32
+	normals, uvs, colors bool // some vertex had one
+	noNormal             bool // some vertex had none
+}
+
+func newPrimitiveBuilder(material int) *primitiveBuilder {
+	return &primitiveBuilder{prim: &importPrimitive{material: material}, ids: make(map[importVertex]uint32)}
+}
+
+// vertex adds v, which has a normal, UV and color as flagged, and returns
+// its index
+func (b *primitiveBuilder) vertex(v importVertex, hasNormal, hasUV, hasColor bool) uint32 {
+	b.normals, b.noNormal = b.normals || hasNormal, b.noNormal || !hasNormal
+	b.uvs = b.uvs || hasUV
+	b.colors = b.colors || hasColor
+	if !hasColor {
+		v.c = [4]float32{1, 1, 1, 1}
+	}
+	if id, ok := b.ids[v]; ok {
+		return id
+	}
+	p := b.prim
+	id := uint32(len(p.positions) / 3)
+	p.positions = append(p.positions, v.p[:]...)
+	p.normals = append(p.normals, v.n[:]...)
+	p.uvs = append(p.uvs, v.uv[:]...)
+	p.colors = append(p.colors, v.c[:]...)
+	b.ids[v] = id
+	return id
+}
+
+func (b *primitiveBuilder) triangle(a, c, d uint32) {
+	b.prim.indices = append(b.prim.indices, a, c, d)
+}
+
+// done returns the primitive, dropping attributes no vertex had. Normals
+// are dropped as well when only some vertices had them; viewers then shade
+// the faces flat.
+func (b *primitiveBuilder) done() *importPrimitive {
+	p := b.prim
+	if !b.normals || b.noNormal {
+		p.normals = nil
+	}
+	if !b.uvs {
+		p.uvs = nil
+	}
+	if !b.colors {
+		p.colors = nil
+	}
+	return p
+}
+
+// faceNormal returns the unit normal of the triangle abc by its winding, or
+// false for a degenerate triangle
+func faceNormal(a, b, c [3]float32) ([3]float32, bool) {
+	u := vec3{float64(b[0] - a[0]), float64(b[1] - a[1]), float64(b[2] - a[2])}
+	v := vec3{float64(c[0] - a[0]), float64(c[1] - a[1]), float64(c[2] - a[2])}
+	n := u.cross(v)
+	l := math.Sqrt(n.dot(n))
+	if l == 0 {
+		return [3]float32{}, false
+	}
+	return [3]float32{float32(n[0] / l), float32(n[1] / l), float32(n[2] / l)}, true
+}
+
+// importModel converts the model file at filePath to a GLB. Files it
+// refers to, like OBJ materials and textures, are opened through resolve.
+func importModel(filePath string, resolve gltfResolver) ([]byte, []string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	stem := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+
+	var sc *importScene
+	switch format := importFormat(filepath.Ext(filePath)); format {
+	case "obj":
+		sc, err = importOBJ(f, info.Size(), stem, resolve)
+	case "stl":
+		sc, err = importSTL(f, info.Size(), stem)
+	case "ply":
+		sc, err = importPLY(f, info.Size(), stem, resolve)
+	case "fbx":
+		sc, err = importFBX(f, info.Size(), resolve)
+	default:
+		return nil, nil, fmt.Errorf("%w: %s files are not supported", errImport, filepath.Ext(filePath))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := sc.glb()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, sc.warnings, nil
+}
+
+// ============ GLB ============
+
+// gltfBuilder assembles a new glTF document and its BIN chunk
+type gltfBuilder struct {
+	doc GLTF
+	bin []byte
+}
+
+func (b *gltfBuilder) view(data []byte, target int) int {
+	for len(b.bin)%4 != 0 {
+		b.bin = append(b.bin, 0)
+	}
+	b.doc.BufferViews = append(b.doc.BufferViews, GLTFBufferView{ByteOffset: len(b.bin), ByteLength: len(data), Target: target})
+	b.bin = append(b.bin, data...)
+	return len(b.doc.BufferViews) - 1
+}
+
+// floats stores values as a float accessor of type typ; bounds adds the
+// min and max POSITION accessors need
+func (b *gltfBuilder) floats(values []float32, typ string, bounds bool) int {
+	n := componentCount(typ)
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(v))
+	}
+	v := b.view(data, gltfArrayBuffer)
+	acc := GLTFAccessor{BufferView: &v, ComponentType: gltfFloat, Count: len(values) / n, Type: typ}
+	if bounds {
+		acc.Min, acc.Max = make([]float64, n), make([]float64, n)
+		for k := 0; k < n; k++ {
+			acc.Min[k], acc.Max[k] = math.Inf(1), math.Inf(-1)
+		}
+		for i, v := range values {
+			acc.Min[i%n] = math.Min(acc.Min[i%n], float64(v))
+			acc.Max[i%n] = math.Max(acc.Max[i%n], float64(v))
+		}
+	}
+	b.doc.Accessors = append(b.doc.Accessors, acc)
+	return len(b.doc.Accessors) - 1
+}
+
+// indices stores idx as 16-bit indices when the vertices allow, leaving
+// out the primitive restart value glTF forbids
+func (b *gltfBuilder) indices(idx []uint32, vertexCount int) int {
+	var data []byte
+	ct := gltfUnsignedInt
+	if vertexCount < math.MaxUint16 {
+		ct = gltfUnsignedShort
+		data = make([]byte, 0, 2*len(idx))
+		for _, i := range idx {
+			data = binary.LittleEndian.AppendUint16(data, uint16(i))
+		}
+	} else {
+		data = make([]byte, 0, 4*len(idx))
+		for _, i := range idx {
+			data = binary.LittleEndian.AppendUint32(data, i)
+		}
+	}
+	v := b.view(data, gltfElementArrayBuffer)
+	b.doc.Accessors = append(b.doc.Accessors, GLTFAccessor{BufferView: &v, ComponentType: ct, Count: len(idx), Type: "SCALAR"})
+	return len(b.doc.Accessors) - 1
+}
+
+// glb writes the scene as a self-contained GLB
+func (sc *importScene) glb() ([]byte, error) {
+	b := &gltfBuilder{}
+	b.doc.Asset = GLTFAsset{Version: "2.0", Generator: "glb-project " + strings.ToUpper(sc.format) + " importer"}
+
+	for i, img := range sc.images {
+		v := b.view(img.data, 0)
+		b.doc.Images = append(b.doc.Images, GLTFImage{Name: img.name, MimeType: img.mimeType, BufferView: &v})
+		src := i
+		b.doc.Textures = append(b.doc.Textures, GLTFTexture{Source: &src})
+	}
+	for _, m := range sc.materials {
+		metallic, roughness := m.metallic, m.roughness
+		out := GLTFMaterial{
+			Name: m.name,
+			PBRMetallicRoughness: &GLTFPBR{
+				BaseColorFactor: append([]float64(nil), m.color[:]...),
+				MetallicFactor:  &metallic,
+				RoughnessFactor: &roughness,
+			},
+		}
+		if m.texture >= 0 {
+			out.PBRMetallicRoughness.BaseColorTexture = &GLTFTextureInfo{Index: m.texture}
+		}
+		if m.emissive != [3]float64{} {
+			out.EmissiveFactor = append([]float64(nil), m.emissive[:]...)
+		}
+		if m.color[3] < 1 {
+			out.AlphaMode = "BLEND"
+		}
+		b.doc.Materials = append(b.doc.Materials, out)
+	}
+
+	meshIDs := make([]*int, len(sc.meshes))
+	for mi, m := range sc.meshes {
+		out := GLTFMesh{Name: m.name}
+		for _, p := range m.primitives {
+			count := len(p.positions) / 3
+			if count == 0 || !p.points && len(p.indices) < 3 {
+				continue
+			}
+			prim := GLTFPrimitive{Attributes: map[string]int{"POSITION": b.floats(p.positions, "VEC3", true)}}
+			if len(p.normals) > 0 {
+				prim.Attributes["NORMAL"] = b.floats(unitNormals(p.normals), "VEC3", false)
+			}
+			if len(p.uvs) > 0 {
+				prim.Attributes["TEXCOORD_0"] = b.floats(p.uvs, "VEC2", false)
+			}
+			if len(p.colors) > 0 {
+				prim.Attributes["COLOR_0"] = b.floats(p.colors, "VEC4", false)
+			}
+			if p.points {
+				mode := 0
+				prim.Mode = &mode
+			} else {
+				idx := b.indices(p.indices, count)
+				prim.Indices = &idx
+			}
+			if p.material >= 0 && p.material < len(sc.materials) {
+				mat := p.material
+				prim.Material = &mat
+			}
+			out.Primitives = append(out.Primitives, prim)
+		}
+		if len(out.Primitives) > 0 {
+			id := len(b.doc.Meshes)
+			meshIDs[mi] = &id
+			b.doc.Meshes = append(b.doc.Meshes, out)
+		}
+	}
+	if len(b.doc.Meshes) == 0 {
+		return nil, fmt.Errorf("%w: the file has no faces or points", errImport)
+	}
+
+	for _, n := range sc.nodes {
+		out := GLTFNode{Name: n.name, Children: n.children, Matrix: n.matrix}
+		if n.mesh >= 0 {
+			out.Mesh = meshIDs[n.mesh]
+		}
+		b.doc.Nodes = append(b.doc.Nodes, out)
+	}
+	scene := 0
+	b.doc.Scene = &scene
+	b.doc.Scenes = []GLTFScene{{Nodes: sc.roots}}
+	b.doc.Buffers = []GLTFBuffer{{ByteLength: len(b.bin)}}
+	return encodeGLB(&b.doc, b.bin)
+}
+
+// unitNormals returns normals scaled to unit length; zero normals, which
+// glTF does not allow, point up instead
+func unitNormals(normals []float32) []float32 {
+	out := make([]float32, len(normals))
+	for i := 0; i+2 < len(normals); i += 3 {
+		x, y, z := float64(normals[i]), float64(normals[i+1]), float64(normals[i+2])
+		l := math.Sqrt(x*x + y*y + z*z)
+		if l == 0 || math.IsNaN(l) || math.IsInf(l, 0) {
+			out[i+1] = 1
+			continue
+		}
+		out[i], out[i+1], out[i+2] = float32(x/l), float32(y/l), float32(z/l)
+	}
+	return out
+}
@@ -0,0 +1,798 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxFBXDepth bounds the nesting of FBX nodes
+const maxFBXDepth = 64
+
+// fbxNode is a node of an ASCII FBX file, like
+//
+//	Geometry: 140000, "Geometry::Cube", "Mesh" { ... }
+//
+// Its values are split by kind, which is all the importer needs: names and
+// words in strs, numbers in nums. Integers outside "a:" arrays are kept
+// exactly in ids as well, since object IDs do not fit a float64.
+type fbxNode struct {
+	name     string
+	strs     []string
+	nums     []float64
+	ids      []int64
+	children []*fbxNode
+}
+
+func (n *fbxNode) child(name string) *fbxNode {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// array returns the numbers of child name, written as "*N { a: ... }" since
+// FBX 7.1 or as plain values before
+func (n *fbxNode) array(name string) []float64 {
+	c := n.child(name)
+	if c == nil {
+		return nil
+	}
+	if a := c.child("a"); a != nil {
+		return a.nums
+	}
+	return c.nums
+}
+
+// str returns the first string of child name
+func (n *fbxNode) str(name string) string {
+	if c := n.child(name); c != nil && len(c.strs) > 0 {
+		return c.strs[0]
+	}
+	return ""
+}
+
+// prop returns the "P" entry of a property, whose numbers are its value
+func (n *fbxNode) prop(name string) *fbxNode {
+	props := n.child("Properties70")
+	if props == nil {
+		return nil
+	}
+	for _, p := range props.children {
+		if p.name == "P" && len(p.strs) > 0 && p.strs[0] == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (n *fbxNode) propNum(name string, def float64) float64 {
+	if p := n.prop(name); p != nil && len(p.nums) > 0 {
+		return p.nums[len(p.nums)-1]
+	}
+	return def
+}
+
+func (n *fbxNode) propVec(name string, def vec3) vec3 {
+	if p := n.prop(name); p != nil && len(p.nums) >= 3 {
+		k := len(p.nums) - 3
+		return vec3{p.nums[k], p.nums[k+1], p.nums[k+2]}
+	}
+	return def
+}
+
+// objectName returns the name of an object without its class prefix, as in
+// "Model::Cube"
+func (n *fbxNode) objectName() string {
+	if len(n.strs) == 0 {
+		return ""
+	}
+	s := n.strs[0]
+	if i := strings.Index(s, "::"); i >= 0 {
+		s = s[i+2:]
+	}
+	return s
+}
+
+// objectClass returns the last string of an object header, like "Mesh"
+func (n *fbxNode) objectClass() string {
+	if len(n.strs) < 2 {
+		return ""
+	}
+	return n.strs[len(n.strs)-1]
+}
+
+// ============ ASCII FBX parser ============
+
+type fbxToken struct {
+	kind byte // 'k' for a key, 's' a string, 'w' a number or word, or the character
+	text string
+}
+
+type fbxParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *fbxParser) line() int {
+	return bytes.Count(p.data[:p.pos], []byte("\n")) + 1
+}
+
+func (p *fbxParser) next() fbxToken {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch c {
+		case ';':
+			if end := bytes.IndexByte(p.data[p.pos:], '\n'); end >= 0 {
+				p.pos += end
+			} else {
+				p.pos = len(p.data)
+			}
+			continue
+		case ' ', '\t', '\r', ':':
+			p.pos++
+			continue
+		case '\n', ',', '{', '}':
+			p.pos++
+			return fbxToken{kind: c}
+		case '"':
+			start := p.pos + 1
+			end := bytes.IndexByte(p.data[start:], '"')
+			if end < 0 {
+				end = len(p.data) - start
+			}
+			p.pos = min(start+end+1, len(p.data))
+			return fbxToken{kind: 's', text: strings.ReplaceAll(string(p.data[start:start+end]), "&quot;", "\"")}
+		}
+		start := p.pos
+		for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n,{};:\"", rune(p.data[p.pos])) {
+			p.pos++
+		}
+		text := string(p.data[start:p.pos])
+		if p.pos < len(p.data) && p.data[p.pos] == ':' {
+			p.pos++
+			return fbxToken{kind: 'k', text: text}
+		}
+		return fbxToken{kind: 'w', text: text}
+	}
+	return fbxToken{}
+}
+
+// nodes parses nodes up to the end of the file, or up to a closing brace
+// when inside one
+func (p *fbxParser) nodes(depth int) ([]*fbxNode, error) {
+	if depth > maxFBXDepth {
+		return nil, fmt.Errorf("%w: line %d: nodes are nested too deeply", errImport, p.line())
+	}
+	var out []*fbxNode
+	for {
+		t := p.next()
+		switch t.kind {
+		case '\n', ',':
+		case 0:
+			if depth > 0 {
+				return nil, fmt.Errorf("%w: the file ends inside a node", errImport)
+			}
+			return out, nil
+		case '}':
+			if depth == 0 {
+				return nil, fmt.Errorf("%w: line %d: unexpected \"}\"", errImport, p.line())
+			}
+			return out, nil
+		case 'k':
+			n, err := p.node(t.text, depth)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, n)
+		default:
+			return nil, fmt.Errorf("%w: line %d: expected a name, found %q", errImport, p.line(), t.text)
+		}
+	}
+}
+
+// node parses the values and children of a node. Long value lists wrap
+// over lines, with the comma at the end of a line or the start of the next.
+func (p *fbxParser) node(name string, depth int) (*fbxNode, error) {
+	n := &fbxNode{name: name}
+	afterComma := false
+	for {
+		save := p.pos
+		t := p.next()
+		switch t.kind {
+		case 's':
+			n.strs = append(n.strs, t.text)
+			afterComma = false
+		case 'w':
+			n.value(t.text)
+			afterComma = false
+		case ',':
+			afterComma = true
+		case '\n':
+			if !afterComma && !p.commaNext() {
+				return n, nil
+			}
+			afterComma = true
+		case '{':
+			children, err := p.nodes(depth + 1)
+			n.children = children
+			return n, err
+		default:
+			// a closing brace, the next node or the end of the file
+			p.pos = save
+			return n, nil
+		}
+	}
+}
+
+// commaNext reports whether the next token after blank lines is a comma,
+// consuming them if so
+func (p *fbxParser) commaNext() bool {
+	save := p.pos
+	for {
+		switch p.next().kind {
+		case '\n':
+			continue
+		case ',':
+			return true
+		}
+		p.pos = save
+		return false
+	}
+}
+
+func (n *fbxNode) value(word string) {
+	if strings.HasPrefix(word, "*") {
+		// the length of an array
+		return
+	}
+	v, err := strconv.ParseFloat(word, 64)
+	if err != nil {
+		n.strs = append(n.strs, word)
+		return
+	}
+	n.nums = append(n.nums, v)
+	if n.name != "a" {
+		if id, err := strconv.ParseInt(word, 10, 64); err == nil {
+			n.ids = append(n.ids, id)
+		}
+	}
+}
+
+// ============ Scene ============
+
+type fbxLink struct {
+	id   int64
+	prop string // the property an "OP" connection targets
+}
+
+type fbxReader struct {
+	sc        *importScene
+	resolve   gltfResolver
+	objects   map[int64]*fbxNode
+	children  map[int64][]fbxLink // by parent, in file order
+	materials map[int64]int
+	images    map[string]int
+}
+
+// importFBX reads an ASCII FBX 7 file, as Autodesk tools write it. Models
+// become nodes with their full FBX transform, including pivots and pre-
+// and post-rotation; their meshes keep normals, UVs, vertex colors and
+// materials with diffuse textures, embedded or beside the file. The scene
+// is scaled to meters and turned Y-up by its global settings. Binary FBX
+// files, animation and skinning are not supported.
+func importFBX(r io.ReaderAt, size int64, resolve gltfResolver) (*importScene, error) {
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte("Kaydara FBX Binary")) {
+		return nil, fmt.Errorf("%w: binary FBX files are not supported, export the model as ASCII FBX, OBJ or glTF", errImport)
+	}
+	p := &fbxParser{data: data}
+	top, err := p.nodes(0)
+	if err != nil {
+		return nil, err
+	}
+	doc := &fbxNode{children: top}
+	if h := doc.child("FBXHeaderExtension"); h != nil {
+		if v := h.child("FBXVersion"); v != nil && len(v.nums) > 0 && v.nums[0] < 7000 {
+			return nil, fmt.Errorf("%w: FBX version %g is not supported, export as FBX 2011 or later", errImport, v.nums[0]/1000)
+		}
+	}
+	objects := doc.child("Objects")
+	if objects == nil {
+		return nil, fmt.Errorf("%w: not an ASCII FBX 7 file: it has no Objects section", errImport)
+	}
+
+	f := &fbxReader{
+		sc:        &importScene{format: "fbx"},
+		resolve:   resolve,
+		objects:   make(map[int64]*fbxNode),
+		children:  make(map[int64][]fbxLink),
+		materials: make(map[int64]int),
+		images:    make(map[string]int),
+	}
+	warned := map[string]bool{}
+	for _, o := range objects.children {
+		if len(o.ids) > 0 {
+			f.objects[o.ids[0]] = o
+		}
+		warning := map[string]string{
+			"Deformer":       "skinning and blend shapes are left out",
+			"AnimationCurve": "animations are left out",
+		}[o.name]
+		if warning != "" && !warned[o.name] {
+			warned[o.name] = true
+			f.sc.warnf("%s", warning)
+		}
+	}
+	parent := make(map[int64]int64)
+	if conns := doc.child("Connections"); conns != nil {
+		for _, c := range conns.children {
+			if c.name != "C" || len(c.strs) == 0 || len(c.ids) < 2 {
+				continue
+			}
+			link := fbxLink{id: c.ids[0]}
+			if c.strs[0] == "OP" && len(c.strs) > 1 {
+				link.prop = c.strs[1]
+			}
+			f.children[c.ids[1]] = append(f.children[c.ids[1]], link)
+			if c.strs[0] == "OO" && f.isModel(c.ids[0]) && f.isModel(c.ids[1]) {
+				if _, ok := parent[c.ids[0]]; !ok && !fbxAncestor(parent, c.ids[1], c.ids[0]) {
+					parent[c.ids[0]] = c.ids[1]
+				}
+			}
+		}
+	}
+
+	nodeIDs := make(map[int64]int)
+	var models []int64
+	for _, o := range objects.children {
+		if o.name != "Model" || len(o.ids) == 0 {
+			continue
+		}
+		id := o.ids[0]
+		if _, ok := nodeIDs[id]; ok {
+			continue
+		}
+		node := importNode{name: o.objectName(), mesh: -1}
+		if m := fbxModelMatrix(o); m != identityMatrix() {
+			node.matrix = m[:]
+		}
+		if mesh, ok, err := f.mesh(id, o); err != nil {
+			return nil, err
+		} else if ok {
+			f.sc.meshes = append(f.sc.meshes, mesh)
+			node.mesh = len(f.sc.meshes) - 1
+		}
+		nodeIDs[id] = len(f.sc.nodes)
+		f.sc.nodes = append(f.sc.nodes, node)
+		models = append(models, id)
+	}
+	var roots []int
+	for _, id := range models {
+		if p, ok := parent[id]; ok {
+			n := &f.sc.nodes[nodeIDs[p]]
+			n.children = append(n.children, nodeIDs[id])
+		} else {
+			roots = append(roots, nodeIDs[id])
+		}
+	}
+
+	// glTF is in meters with Y up; FBX is in centimeters unless the file
+	// says otherwise, with the axes it names
+	settings := doc.child("GlobalSettings")
+	if settings == nil {
+		settings = &fbxNode{}
+	}
+	root := fbxAxisMatrix(settings)
+	if scale := settings.propNum("UnitScaleFactor", 1) / 100; scale > 0 {
+		root = mulMatrix(scaleMatrix(vec3{scale, scale, scale}), root)
+	}
+	if root == identityMatrix() {
+		f.sc.roots = roots
+	} else {
+		f.sc.nodes = append(f.sc.nodes, importNode{name: "RootNode", mesh: -1, matrix: root[:], children: roots})
+		f.sc.roots = []int{len(f.sc.nodes) - 1}
+	}
+	return f.sc, nil
+}
+
+func (f *fbxReader) isModel(id int64) bool {
+	o := f.objects[id]
+	return o != nil && o.name == "Model"
+}
+
+// fbxAncestor reports whether a is id or above it in the parent chain
+func fbxAncestor(parent map[int64]int64, id, a int64) bool {
+	for depth := 0; depth <= len(parent); depth++ {
+		if id == a {
+			return true
+		}
+		p, ok := parent[id]
+		if !ok {
+			return false
+		}
+		id = p
+	}
+	return true
+}
+
+// fbxAxisMatrix returns the rotation from the axis system of the file to
+// glTF's, where +X is right, +Y up and +Z the front
+func fbxAxisMatrix(settings *fbxNode) [16]float64 {
+	axes := [3][2]float64{
+		{settings.propNum("CoordAxis", 0), settings.propNum("CoordAxisSign", 1)},
+		{settings.propNum("UpAxis", 1), settings.propNum("UpAxisSign", 1)},
+		{settings.propNum("FrontAxis", 2), settings.propNum("FrontAxisSign", 1)},
+	}
+	var m [16]float64
+	m[15] = 1
+	used := map[int]bool{}
+	for row, a := range axes {
+		axis := int(a[0])
+		if axis < 0 || axis > 2 || used[axis] || a[1] == 0 {
+			// not an axis system
+			return identityMatrix()
+		}
+		used[axis] = true
+		m[axis*4+row] = math.Copysign(1, a[1])
+	}
+	return m
+}
+
+// ============ Transforms ============
+
+func translationMatrix(t vec3) [16]float64 {
+	m := identityMatrix()
+	m[12], m[13], m[14] = t[0], t[1], t[2]
+	return m
+}
+
+func scaleMatrix(s vec3) [16]float64 {
+	m := identityMatrix()
+	m[0], m[5], m[10] = s[0], s[1], s[2]
+	return m
+}
+
+// fbxRotationOrders lists the axes of each FBX rotation order in the order
+// they are applied
+var fbxRotationOrders = [][3]int{{0, 1, 2}, {0, 2, 1}, {1, 2, 0}, {1, 0, 2}, {2, 0, 1}, {2, 1, 0}}
+
+// fbxRotation returns the rotation by Euler angles in degrees
+func fbxRotation(deg vec3, order int) [16]float64 {
+	if order < 0 || order >= len(fbxRotationOrders) {
+		// spheric XYZ rotates like XYZ
+		order = 0
+	}
+	m := identityMatrix()
+	for _, axis := range fbxRotationOrders[order] {
+		s, c := math.Sincos(deg[axis] * math.Pi / 180)
+		r := identityMatrix()
+		i, j := (axis+1)%3, (axis+2)%3
+		r[i*4+i], r[i*4+j] = c, s
+		r[j*4+i], r[j*4+j] = -s, c
+		m = mulMatrix(r, m)
+	}
+	return m
+}
+
+// transposeRotation inverts a rotation matrix
+func transposeRotation(m [16]float64) [16]float64 {
+	out := identityMatrix()
+	for col := 0; col < 3; col++ {
+		for row := 0; row < 3; row++ {
+			out[col*4+row] = m[row*4+col]
+		}
+	}
+	return out
+}
+
+func mulMatrices(ms ...[16]float64) [16]float64 {
+	out := identityMatrix()
+	for _, m := range ms {
+		out = mulMatrix(out, m)
+	}
+	return out
+}
+
+// fbxModelMatrix returns the local transform of a model as FBX defines it:
+// T * Roff * Rp * Rpre * R * Rpost⁻¹ * Rp⁻¹ * Soff * Sp * S * Sp⁻¹
+func fbxModelMatrix(o *fbxNode) [16]float64 {
+	zero, one := vec3{}, vec3{1, 1, 1}
+	rp := o.propVec("RotationPivot", zero)
+	sp := o.propVec("ScalingPivot", zero)
+	return mulMatrices(
+		translationMatrix(o.propVec("Lcl Translation", zero)),
+		translationMatrix(o.propVec("RotationOffset", zero)),
+		translationMatrix(rp),
+		fbxRotation(o.propVec("PreRotation", zero), 0),
+		fbxRotation(o.propVec("Lcl Rotation", zero), int(o.propNum("RotationOrder", 0))),
+		transposeRotation(fbxRotation(o.propVec("PostRotation", zero), 0)),
+		translationMatrix(rp.scale(-1)),
+		translationMatrix(o.propVec("ScalingOffset", zero)),
+		translationMatrix(sp),
+		scaleMatrix(o.propVec("Lcl Scaling", one)),
+		translationMatrix(sp.scale(-1)),
+	)
+}
+
+// ============ Meshes ============
+
+// fbxLayer is a layer element of a geometry, like its normals or UVs
+type fbxLayer struct {
+	data, index  []float64
+	mapping, ref string
+	size         int
+}
+
+// fbxLayerOf returns layer element name of g, the one of layer 0 if there
+// are several, or nil
+func fbxLayerOf(g *fbxNode, name, dataName, indexName string, size int) *fbxLayer {
+	var el *fbxNode
+	for _, c := range g.children {
+		if c.name != name {
+			continue
+		}
+		if el == nil {
+			el = c
+		}
+		if len(c.nums) > 0 && c.nums[0] == 0 {
+			el = c
+			break
+		}
+	}
+	if el == nil {
+		return nil
+	}
+	l := &fbxLayer{data: el.array(dataName), mapping: el.str("MappingInformationType"), ref: el.str("ReferenceInformationType"), size: size}
+	if indexName != "" {
+		l.index = el.array(indexName)
+	} else {
+		// material layers list the material of each polygon directly
+		l.ref = "Direct"
+	}
+	return l
+}
+
+// at returns the offset in l.data of the value for a polygon corner, given
+// its index among all corners, its control point and its polygon
+func (l *fbxLayer) at(corner, point, polygon int) (int, bool) {
+	if l == nil {
+		return 0, false
+	}
+	var i int
+	switch l.mapping {
+	case "ByPolygonVertex":
+		i = corner
+	case "ByVertice", "ByVertex", "ByControlPoint":
+		i = point
+	case "ByPolygon":
+		i = polygon
+	case "AllSame":
+	default:
+		return 0, false
+	}
+	if l.ref == "IndexToDirect" || l.ref == "Index" {
+		if i >= len(l.index) {
+			return 0, false
+		}
+		i = int(l.index[i])
+	}
+	if i < 0 || (i+1)*l.size > len(l.data) {
+		return 0, false
+	}
+	return i * l.size, true
+}
+
+// mesh builds the mesh of model id from its geometries and materials, with
+// the model's geometric transform baked in
+func (f *fbxReader) mesh(id int64, model *fbxNode) (importMesh, bool, error) {
+	var geometries []*fbxNode
+	var mats []int
+	for _, link := range f.children[id] {
+		o := f.objects[link.id]
+		if o == nil {
+			continue
+		}
+		switch o.name {
+		case "Geometry":
+			if o.objectClass() == "Mesh" {
+				geometries = append(geometries, o)
+			} else if o.objectClass() != "Shape" {
+				f.sc.warnf("geometry %s is left out: %s geometry is not supported", o.objectName(), o.objectClass())
+			}
+		case "Material":
+			mats = append(mats, f.material(link.id, o))
+		}
+	}
+	if len(geometries) == 0 {
+		return importMesh{}, false, nil
+	}
+
+	zero := vec3{}
+	scale := model.propVec("GeometricScaling", vec3{1, 1, 1})
+	rot := fbxRotation(model.propVec("GeometricRotation", zero), 0)
+	geo := mulMatrices(translationMatrix(model.propVec("GeometricTranslation", zero)), rot, scaleMatrix(scale))
+	// normals take the inverse transpose, which for R * S is R * S⁻¹
+	inv := vec3{}
+	for k := range scale {
+		if scale[k] != 0 {
+			inv[k] = 1 / scale[k]
+		}
+	}
+	normalMatrix := mulMatrix(rot, scaleMatrix(inv))
+
+	m := importMesh{name: model.objectName()}
+	for _, g := range geometries {
+		prims, err := fbxPrimitives(g, mats, geo, normalMatrix)
+		if err != nil {
+			return importMesh{}, false, err
+		}
+		m.primitives = append(m.primitives, prims...)
+	}
+	return m, true, nil
+}
+
+// fbxPrimitives turns the polygons of a geometry into a primitive per
+// material. mats maps the material slots of the geometry to scene
+// materials.
+func fbxPrimitives(g *fbxNode, mats []int, geo, normalMatrix [16]float64) ([]*importPrimitive, error) {
+	verts := g.array("Vertices")
+	poly := g.array("PolygonVertexIndex")
+	normals := fbxLayerOf(g, "LayerElementNormal", "Normals", "NormalsIndex", 3)
+	uvs := fbxLayerOf(g, "LayerElementUV", "UV", "UVIndex", 2)
+	colors := fbxLayerOf(g, "LayerElementColor", "Colors", "ColorIndex", 4)
+	materials := fbxLayerOf(g, "LayerElementMaterial", "Materials", "", 1)
+
+	builders := make(map[int]*primitiveBuilder)
+	var order []int
+	var b *primitiveBuilder
+	var ids []uint32
+	polygon := 0
+	for corner, raw := range poly {
+		point := int(raw)
+		end := point < 0
+		if end {
+			// the last corner of a polygon is stored as -index-1
+			point = -point - 1
+		}
+		if 3*point+3 > len(verts) {
+			return nil, fmt.Errorf("%w: geometry %s: vertex %d does not exist", errImport, g.objectName(), point)
+		}
+		if len(ids) == 0 {
+			mat := -1
+			if len(mats) > 0 && materials == nil {
+				mat = mats[0]
+			}
+			if k, ok := materials.at(corner, point, polygon); ok {
+				if slot := int(materials.data[k]); slot >= 0 && slot < len(mats) {
+					mat = mats[slot]
+				}
+			}
+			if b = builders[mat]; b == nil {
+				b = newPrimitiveBuilder(mat)
+				builders[mat] = b
+				order = append(order, mat)
+			}
+		}
+
+		var v importVertex
+		p := transformPoint(geo, vec3{verts[3*point], verts[3*point+1], verts[3*point+2]})
+		v.p = [3]float32{float32(p[0]), float32(p[1]), float32(p[2])}
+		k, hasNormal := normals.at(corner, point, polygon)
+		if hasNormal {
+			n := transformDir(normalMatrix, vec3{normals.data[k], normals.data[k+1], normals.data[k+2]})
+			v.n = [3]float32{float32(n[0]), float32(n[1]), float32(n[2])}
+		}
+		k, hasUV := uvs.at(corner, point, polygon)
+		if hasUV {
+			v.uv = [2]float32{float32(uvs.data[k]), float32(1 - uvs.data[k+1])}
+		}
+		k, hasColor := colors.at(corner, point, polygon)
+		if hasColor {
+			for c := range v.c {
+				v.c[c] = float32(colors.data[k+c])
+			}
+		}
+		ids = append(ids, b.vertex(v, hasNormal, hasUV, hasColor))
+
+		if end {
+			for k := 1; k+1 < len(ids); k++ {
+				b.triangle(ids[0], ids[k], ids[k+1])
+			}
+			ids = ids[:0]
+			polygon++
+		}
+	}
+
+	prims := make([]*importPrimitive, len(order))
+	for i, mat := range order {
+		prims[i] = builders[mat].done()
+	}
+	return prims, nil
+}
+
+// ============ Materials ============
+
+// material converts a Phong or Lambert material, once
+func (f *fbxReader) material(id int64, o *fbxNode) int {
+	if i, ok := f.materials[id]; ok {
+		return i
+	}
+	m := newImportMaterial(o.objectName())
+	diffuse := o.propVec("DiffuseColor", o.propVec("Diffuse", vec3{1, 1, 1})).scale(o.propNum("DiffuseFactor", 1))
+	copy(m.color[:3], diffuse[:])
+	opacity := 1 - o.propNum("TransparencyFactor", 0)
+	if p := o.prop("Opacity"); p != nil && len(p.nums) > 0 {
+		opacity = p.nums[len(p.nums)-1]
+	}
+	m.color[3] = math.Min(math.Max(opacity, 0), 1)
+	emissive := o.propVec("EmissiveColor", vec3{}).scale(o.propNum("EmissiveFactor", 1))
+	for k := range emissive {
+		m.emissive[k] = math.Min(math.Max(emissive[k], 0), 1)
+	}
+	if p := o.prop("Shininess"); p != nil && len(p.nums) > 0 {
+		m.roughness = math.Min(math.Sqrt(2/(math.Max(p.nums[len(p.nums)-1], 0)+2)), 1)
+	}
+	for _, link := range f.children[id] {
+		tex := f.objects[link.id]
+		prop := strings.ToLower(link.prop)
+		if tex != nil && tex.name == "Texture" && (strings.Contains(prop, "diffuse") || strings.Contains(prop, "basecolor")) {
+			m.texture = f.texture(link.id, tex)
+			break
+		}
+	}
+	f.sc.materials = append(f.sc.materials, m)
+	f.materials[id] = len(f.sc.materials) - 1
+	return f.materials[id]
+}
+
+// texture loads the image of a texture, preferring the copy embedded in
+// its video to the file it names
+func (f *fbxReader) texture(id int64, tex *fbxNode) int {
+	names := []string{tex.str("RelativeFilename"), tex.str("FileName")}
+	for _, link := range f.children[id] {
+		video := f.objects[link.id]
+		if video == nil || video.name != "Video" {
+			continue
+		}
+		names = append(names, video.str("RelativeFilename"), video.str("Filename"))
+		if c := video.child("Content"); c != nil && len(c.strs) > 0 {
+			key := fmt.Sprintf("video:%d", link.id)
+			if i, ok := f.images[key]; ok {
+				return i
+			}
+			data, err := base64.StdEncoding.DecodeString(strings.Join(c.strs, ""))
+			mime := map[string]string{"png": "image/png", "jpeg": "image/jpeg"}[imageKind(bytes.NewReader(data))]
+			if err == nil && mime != "" {
+				f.sc.images = append(f.sc.images, importImage{name: video.objectName(), mimeType: mime, data: data})
+				f.images[key] = len(f.sc.images) - 1
+				return f.images[key]
+			}
+		}
+	}
+	var paths []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, p := range texturePaths(".", name) {
+			if !containsString(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		f.sc.warnf("texture %s is left out: it names no file", tex.objectName())
+		return -1
+	}
+	return f.sc.loadImage(f.resolve, paths, f.images)
+}
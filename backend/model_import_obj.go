@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// maxImportLine bounds a line of a text model file
+const maxImportLine = 16 << 20
+
+// objReader holds what an OBJ file has declared so far
+type objReader struct {
+	sc        *importScene
+	resolve   gltfResolver
+	positions []float32
+	colors    []float32 // per position, when any has one
+	uvs       []float32
+	normals   []float32
+	materials map[string]int
+	images    map[string]int
+
+	meshName string
+	prims    map[int]*primitiveBuilder
+	order    []int // materials in order of first use
+	material int
+}
+
+// importOBJ reads a Wavefront OBJ file with the MTL material libraries it
+// names. Each object becomes a mesh with a primitive per material; lines,
+// points and free-form surfaces are left out.
+func importOBJ(r io.ReaderAt, size int64, name string, resolve gltfResolver) (*importScene, error) {
+	o := &objReader{
+		sc:        &importScene{format: "obj"},
+		resolve:   resolve,
+		materials: make(map[string]int),
+		images:    make(map[string]int),
+		meshName:  name,
+		prims:     make(map[int]*primitiveBuilder),
+		material:  -1,
+	}
+	s := bufio.NewScanner(io.NewSectionReader(r, 0, size))
+	s.Buffer(make([]byte, 64<<10), maxImportLine)
+	skipped := map[string]bool{}
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "v":
+			err = o.vertex(fields[1:])
+		case "vt":
+			var uv []float64
+			if uv, err = parseFloats(fields[1:], 1, 3); err == nil {
+				v := 0.0
+				if len(uv) > 1 {
+					v = uv[1]
+				}
+				o.uvs = append(o.uvs, float32(uv[0]), float32(1-v))
+			}
+		case "vn":
+			var nv []float64
+			if nv, err = parseFloats(fields[1:], 3, 3); err == nil {
+				o.normals = append(o.normals, float32(nv[0]), float32(nv[1]), float32(nv[2]))
+			}
+		case "f":
+			err = o.face(fields[1:])
+		case "o":
+			o.flush()
+			o.meshName = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s.Text()), "o"))
+		case "usemtl":
+			o.useMaterial(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s.Text()), "usemtl")))
+		case "mtllib":
+			o.loadLibraries(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(s.Text()), "mtllib")), fields[1:])
+		case "g", "s":
+			// groups and smoothing groups do not change the geometry
+		case "l", "p", "curv", "curv2", "surf", "cstype":
+			if !skipped[fields[0]] {
+				skipped[fields[0]] = true
+				o.sc.warnf("%q elements are left out: only faces are converted", fields[0])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %v", errImport, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errImport, err)
+	}
+	o.flush()
+	return o.sc, nil
+}
+
+// parseFloats parses between min and max numbers
+func parseFloats(fields []string, min, max int) ([]float64, error) {
+	if len(fields) < min {
+		return nil, fmt.Errorf("needs %d numbers, has %d", min, len(fields))
+	}
+	if len(fields) > max {
+		fields = fields[:max]
+	}
+	out := make([]float64, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%q is not a number", f)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// vertex reads "x y z" with an optional "r g b" color
+func (o *objReader) vertex(fields []string) error {
+	v, err := parseFloats(fields, 3, 6)
+	if err != nil {
+		return err
+	}
+	o.positions = append(o.positions, float32(v[0]), float32(v[1]), float32(v[2]))
+	if len(v) == 6 && o.colors == nil {
+		// colors start here; the vertices before are white
+		o.colors = make([]float32, len(o.positions)-3, len(o.positions)*2)
+		for i := range o.colors {
+			o.colors[i] = 1
+		}
+	}
+	switch {
+	case len(v) == 6:
+		o.colors = append(o.colors, float32(v[3]), float32(v[4]), float32(v[5]))
+	case o.colors != nil:
+		o.colors = append(o.colors, 1, 1, 1)
+	}
+	return nil
+}
+
+// objIndex resolves a 1-based or negative, relative OBJ index into a list
+// of count elements
+func objIndex(s string, count int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not an index", s)
+	}
+	if i < 0 {
+		i += count
+	} else {
+		i--
+	}
+	if i < 0 || i >= count {
+		return 0, fmt.Errorf("index %s refers to an element that does not exist", s)
+	}
+	return i, nil
+}
+
+// face reads "v", "v/vt", "v//vn" or "v/vt/vn" corners and adds the
+// polygon as a fan of triangles
+func (o *objReader) face(corners []string) error {
+	if len(corners) < 3 {
+		return nil
+	}
+	b := o.prims[o.material]
+	if b == nil {
+		b = newPrimitiveBuilder(o.material)
+		o.prims[o.material] = b
+		o.order = append(o.order, o.material)
+	}
+	ids := make([]uint32, len(corners))
+	for k, c := range corners {
+		parts := strings.Split(c, "/")
+		var v importVertex
+		pi, err := objIndex(parts[0], len(o.positions)/3)
+		if err != nil {
+			return err
+		}
+		copy(v.p[:], o.positions[3*pi:3*pi+3])
+		hasColor := o.colors != nil
+		if hasColor {
+			copy(v.c[:3], o.colors[3*pi:3*pi+3])
+			v.c[3] = 1
+		}
+		hasUV := len(parts) > 1 && parts[1] != ""
+		if hasUV {
+			ti, err := objIndex(parts[1], len(o.uvs)/2)
+			if err != nil {
+				return err
+			}
+			copy(v.uv[:], o.uvs[2*ti:2*ti+2])
+		}
+		hasNormal := len(parts) > 2 && parts[2] != ""
+		if hasNormal {
+			ni, err := objIndex(parts[2], len(o.normals)/3)
+			if err != nil {
+				return err
+			}
+			copy(v.n[:], o.normals[3*ni:3*ni+3])
+		}
+		ids[k] = b.vertex(v, hasNormal, hasUV, hasColor)
+	}
+	for k := 1; k+1 < len(ids); k++ {
+		b.triangle(ids[0], ids[k], ids[k+1])
+	}
+	return nil
+}
+
+// flush ends the current object
+func (o *objReader) flush() {
+	if len(o.order) == 0 {
+		return
+	}
+	m := importMesh{name: o.meshName}
+	for _, mat := range o.order {
+		m.primitives = append(m.primitives, o.prims[mat].done())
+	}
+	o.sc.addMesh(m)
+	o.prims = make(map[int]*primitiveBuilder)
+	o.order = nil
+}
+
+func (o *objReader) useMaterial(name string) {
+	i, ok := o.materials[name]
+	if !ok {
+		// not in any library; faces still get a material of their own
+		o.sc.materials = append(o.sc.materials, newImportMaterial(name))
+		i = len(o.sc.materials) - 1
+		o.materials[name] = i
+	}
+	o.material = i
+}
+
+// loadLibraries reads the MTL files of an mtllib line. The names are split
+// at spaces unless the whole line names one file.
+func (o *objReader) loadLibraries(line string, names []string) {
+	if r, err := o.resolve(fileURI(line)); err == nil {
+		o.loadMTL(cleanFilePath(line), r)
+		return
+	}
+	for _, name := range names {
+		r, err := o.resolve(fileURI(name))
+		if err != nil {
+			o.sc.warnf("material library %s is left out: %v", name, err)
+			continue
+		}
+		o.loadMTL(cleanFilePath(name), r)
+	}
+}
+
+// loadMTL reads the materials of the MTL file at mtlPath. Diffuse color and
+// texture, opacity, emission and the PBR roughness and metalness extension
+// are carried over; shininess is turned into roughness.
+func (o *objReader) loadMTL(mtlPath string, r io.Reader) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), maxImportLine)
+	mat := -1
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "newmtl" {
+			name := strings.TrimSpace(strings.TrimPrefix(line, "newmtl"))
+			if i, ok := o.materials[name]; ok {
+				mat = i
+				continue
+			}
+			o.sc.materials = append(o.sc.materials, newImportMaterial(name))
+			mat = len(o.sc.materials) - 1
+			o.materials[name] = mat
+			continue
+		}
+		if mat < 0 {
+			continue
+		}
+		m := &o.sc.materials[mat]
+		v, _ := parseFloats(fields[1:], 1, 3)
+		switch {
+		case fields[0] == "Kd" && len(v) == 3:
+			m.color[0], m.color[1], m.color[2] = v[0], v[1], v[2]
+		case fields[0] == "d" && len(v) >= 1:
+			m.color[3] = math.Min(math.Max(v[0], 0), 1)
+		case fields[0] == "Ke" && len(v) == 3:
+			m.emissive = [3]float64{v[0], v[1], v[2]}
+		case fields[0] == "Ns" && len(v) >= 1:
+			m.roughness = math.Min(math.Sqrt(2/(math.Max(v[0], 0)+2)), 1)
+		case fields[0] == "Pr" && len(v) >= 1:
+			m.roughness = math.Min(math.Max(v[0], 0), 1)
+		case fields[0] == "Pm" && len(v) >= 1:
+			m.metallic = math.Min(math.Max(v[0], 0), 1)
+		case fields[0] == "map_Kd":
+			if file := mtlMapFile(fields[1:]); file != "" {
+				m.texture = o.sc.loadImage(o.resolve, texturePaths(path.Dir(mtlPath), file), o.images)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		o.sc.warnf("material library %s: %v", mtlPath, err)
+	}
+}
+
+// mtlMapFile returns the file name of a texture map statement, skipping
+// the options before it
+func mtlMapFile(args []string) string {
+	optionArgs := map[string]int{
+		"-blendu": 1, "-blendv": 1, "-cc": 1, "-clamp": 1, "-texres": 1, "-bm": 1,
+		"-boost": 1, "-imfchan": 1, "-type": 1, "-mm": 2,
+	}
+	i := 0
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		opt := args[i]
+		i++
+		switch opt {
+		case "-o", "-s", "-t":
+			// one to three numbers
+			for n := 0; n < 3 && i < len(args); n++ {
+				if _, err := strconv.ParseFloat(args[i], 64); err != nil {
+					break
+				}
+				i++
+			}
+		default:
+			i = min(i+optionArgs[opt], len(args))
+		}
+	}
+	return strings.Join(args[i:], " ")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// plyTypeSizes gives the byte size of each PLY value type, under its old
+// and its sized name
+var plyTypeSizes = map[string]int{
+	"char": 1, "int8": 1, "uchar": 1, "uint8": 1,
+	"short": 2, "int16": 2, "ushort": 2, "uint16": 2,
+	"int": 4, "int32": 4, "uint": 4, "uint32": 4,
+	"float": 4, "float32": 4, "double": 8, "float64": 8,
+}
+
+// maxPLYList bounds the length of a list property, like the corners of a face
+const maxPLYList = 1 << 16
+
+type plyProperty struct {
+	name      string
+	typ       string
+	countType string // type of the length of a list, "" for a single value
+}
+
+type plyElement struct {
+	name  string
+	count int
+	props []plyProperty
+}
+
+// plyReader reads the values of a PLY body in its format
+type plyReader struct {
+	ascii  *bufio.Scanner
+	binary *bufio.Reader
+	order  binary.ByteOrder
+	buf    [8]byte
+}
+
+func (p *plyReader) value(typ string) (float64, error) {
+	if p.ascii != nil {
+		if !p.ascii.Scan() {
+			if err := p.ascii.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.ErrUnexpectedEOF
+		}
+		v, err := strconv.ParseFloat(p.ascii.Text(), 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", p.ascii.Text())
+		}
+		return v, nil
+	}
+	b := p.buf[:plyTypeSizes[typ]]
+	if _, err := io.ReadFull(p.binary, b); err != nil {
+		return 0, err
+	}
+	switch typ {
+	case "char", "int8":
+		return float64(int8(b[0])), nil
+	case "uchar", "uint8":
+		return float64(b[0]), nil
+	case "short", "int16":
+		return float64(int16(p.order.Uint16(b))), nil
+	case "ushort", "uint16":
+		return float64(p.order.Uint16(b)), nil
+	case "int", "int32":
+		return float64(int32(p.order.Uint32(b))), nil
+	case "uint", "uint32":
+		return float64(p.order.Uint32(b)), nil
+	case "float", "float32":
+		return float64(math.Float32frombits(p.order.Uint32(b))), nil
+	}
+	return math.Float64frombits(p.order.Uint64(b)), nil
+}
+
+// list reads a list property, or a single value as a list of one
+func (p *plyReader) list(prop plyProperty, dst []float64) ([]float64, error) {
+	dst = dst[:0]
+	n := 1
+	if prop.countType != "" {
+		c, err := p.value(prop.countType)
+		if err != nil {
+			return nil, err
+		}
+		if c < 0 || c > maxPLYList {
+			return nil, fmt.Errorf("list %s has %v entries", prop.name, c)
+		}
+		n = int(c)
+	}
+	for i := 0; i < n; i++ {
+		v, err := p.value(prop.typ)
+		if err != nil {
+			return nil, err
+		}
+		dst = append(dst, v)
+	}
+	return dst, nil
+}
+
+// importPLY reads an ASCII or binary PLY file. Vertices may carry normals,
+// texture coordinates and colors; faces become triangles, and a file
+// without faces becomes a point cloud. A texture named in a "TextureFile"
+// comment, as MeshLab writes it, is applied.
+func importPLY(r io.ReaderAt, size int64, name string, resolve gltfResolver) (*importScene, error) {
+	br := bufio.NewReader(io.NewSectionReader(r, 0, size))
+	var elements []plyElement
+	var format, texture string
+	for n := 1; ; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("%w: the PLY header does not end", errImport)
+		}
+		fields := strings.Fields(line)
+		if n == 1 {
+			if len(fields) != 1 || fields[0] != "ply" {
+				return nil, fmt.Errorf("%w: not a PLY file", errImport)
+			}
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		bad := fmt.Errorf("%w: header line %d: %q is malformed", errImport, n, strings.TrimSpace(line))
+		switch fields[0] {
+		case "format":
+			if len(fields) < 2 {
+				return nil, bad
+			}
+			format = fields[1]
+		case "comment":
+			if len(fields) > 2 && strings.EqualFold(fields[1], "TextureFile") {
+				texture = strings.TrimSpace(strings.SplitN(strings.TrimSpace(line), fields[1], 2)[1])
+			}
+		case "element":
+			if len(fields) != 3 {
+				return nil, bad
+			}
+			count, err := strconv.Atoi(fields[2])
+			if err != nil || count < 0 || int64(count) > size {
+				return nil, bad
+			}
+			elements = append(elements, plyElement{name: fields[1], count: count})
+		case "property":
+			if len(elements) == 0 {
+				return nil, bad
+			}
+			var prop plyProperty
+			switch {
+			case len(fields) == 3:
+				prop = plyProperty{name: fields[2], typ: fields[1]}
+			case len(fields) == 5 && fields[1] == "list":
+				prop = plyProperty{name: fields[4], typ: fields[3], countType: fields[2]}
+				if plyTypeSizes[prop.countType] == 0 {
+					return nil, bad
+				}
+			default:
+				return nil, bad
+			}
+			if plyTypeSizes[prop.typ] == 0 {
+				return nil, bad
+			}
+			el := &elements[len(elements)-1]
+			el.props = append(el.props, prop)
+		}
+		if fields[0] == "end_header" {
+			break
+		}
+	}
+
+	p := &plyReader{}
+	switch format {
+	case "ascii":
+		p.ascii = bufio.NewScanner(br)
+		p.ascii.Buffer(make([]byte, 64<<10), maxImportLine)
+		p.ascii.Split(bufio.ScanWords)
+	case "binary_little_endian":
+		p.binary, p.order = br, binary.LittleEndian
+	case "binary_big_endian":
+		p.binary, p.order = br, binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: PLY format %q is not supported", errImport, format)
+	}
+
+	sc := &importScene{format: "ply"}
+	prim := &importPrimitive{material: -1}
+	var vertexCount int
+	var hasFaces, hasNormals, hasUVs, hasColors bool
+	var wedges *primitiveBuilder // faces with UVs per corner
+	var vals []float64
+	for _, el := range elements {
+		if el.name == "face" {
+			hasFaces = el.count > 0
+		}
+		for i := 0; i < el.count; i++ {
+			var v importVertex
+			var corners, cornerUVs []float64
+			v.c = [4]float32{1, 1, 1, 1}
+			for _, prop := range el.props {
+				var err error
+				if vals, err = p.list(prop, vals); err != nil {
+					return nil, fmt.Errorf("%w: %s %d: %v", errImport, el.name, i, err)
+				}
+				switch {
+				case el.name == "vertex" && prop.countType == "":
+					plyVertexValue(&v, prop, vals[0], &hasNormals, &hasUVs, &hasColors)
+				case el.name == "face" && (prop.name == "vertex_indices" || prop.name == "vertex_index"):
+					corners = append(corners[:0], vals...)
+				case el.name == "face" && prop.name == "texcoord":
+					cornerUVs = append(cornerUVs[:0], vals...)
+				}
+			}
+			switch el.name {
+			case "vertex":
+				prim.positions = append(prim.positions, v.p[:]...)
+				prim.normals = append(prim.normals, v.n[:]...)
+				prim.uvs = append(prim.uvs, v.uv[:]...)
+				prim.colors = append(prim.colors, v.c[:]...)
+				vertexCount++
+			case "face":
+				if err := plyFace(prim, &wedges, corners, cornerUVs, vertexCount, hasNormals, hasColors); err != nil {
+					return nil, fmt.Errorf("%w: face %d: %v", errImport, i, err)
+				}
+			}
+		}
+	}
+
+	if wedges != nil {
+		prim = wedges.done()
+	} else {
+		if !hasNormals {
+			prim.normals = nil
+		}
+		if !hasUVs {
+			prim.uvs = nil
+		}
+		if !hasColors {
+			prim.colors = nil
+		}
+		prim.points = !hasFaces
+	}
+	if texture != "" {
+		m := newImportMaterial(name)
+		m.texture = sc.loadImage(resolve, texturePaths(".", texture), make(map[string]int))
+		sc.materials = append(sc.materials, m)
+		prim.material = 0
+	}
+	sc.addMesh(importMesh{name: name, primitives: []*importPrimitive{prim}})
+	return sc, nil
+}
+
+// plyVertexValue stores a vertex property by its common names
+func plyVertexValue(v *importVertex, prop plyProperty, x float64, hasNormals, hasUVs, hasColors *bool) {
+	// integer colors span their type's range
+	color := float32(x)
+	switch prop.typ {
+	case "uchar", "uint8":
+		color = float32(x / 255)
+	case "ushort", "uint16":
+		color = float32(x / 65535)
+	}
+	switch prop.name {
+	case "x":
+		v.p[0] = float32(x)
+	case "y":
+		v.p[1] = float32(x)
+	case "z":
+		v.p[2] = float32(x)
+	case "nx":
+		v.n[0], *hasNormals = float32(x), true
+	case "ny":
+		v.n[1] = float32(x)
+	case "nz":
+		v.n[2] = float32(x)
+	case "u", "s", "texture_u", "texture_s":
+		v.uv[0], *hasUVs = float32(x), true
+	case "v", "t", "texture_v", "texture_t":
+		v.uv[1] = float32(1 - x)
+	case "red", "diffuse_red":
+		v.c[0], *hasColors = color, true
+	case "green", "diffuse_green":
+		v.c[1] = color
+	case "blue", "diffuse_blue":
+		v.c[2] = color
+	case "alpha":
+		v.c[3] = color
+	}
+}
+
+// plyFace adds a polygon as a fan of triangles. Faces with UVs per corner
+// need vertices of their own, so once one turns up all faces go through a
+// primitiveBuilder instead of indexing prim's vertices.
+func plyFace(prim *importPrimitive, wedges **primitiveBuilder, corners, uvs []float64, vertexCount int, hasNormals, hasColors bool) error {
+	for _, c := range corners {
+		if c < 0 || int(c) >= vertexCount {
+			return fmt.Errorf("vertex %v does not exist", c)
+		}
+	}
+	if len(uvs) == 2*len(corners) && *wedges == nil {
+		*wedges = newPrimitiveBuilder(-1)
+		for t := 0; t+2 < len(prim.indices); t += 3 {
+			var ids [3]uint32
+			for k := range ids {
+				ids[k] = (*wedges).vertex(plyCorner(prim, int(prim.indices[t+k]), nil), hasNormals, false, hasColors)
+			}
+			(*wedges).triangle(ids[0], ids[1], ids[2])
+		}
+	}
+	if *wedges == nil {
+		for k := 1; k+1 < len(corners); k++ {
+			prim.indices = append(prim.indices, uint32(corners[0]), uint32(corners[k]), uint32(corners[k+1]))
+		}
+		return nil
+	}
+	ids := make([]uint32, len(corners))
+	for k, c := range corners {
+		var uv []float64
+		if len(uvs) == 2*len(corners) {
+			uv = uvs[2*k : 2*k+2]
+		}
+		ids[k] = (*wedges).vertex(plyCorner(prim, int(c), uv), hasNormals, uv != nil, hasColors)
+	}
+	for k := 1; k+1 < len(ids); k++ {
+		(*wedges).triangle(ids[0], ids[k], ids[k+1])
+	}
+	return nil
+}
+
+// plyCorner returns vertex i of prim, with uv when given
+func plyCorner(prim *importPrimitive, i int, uv []float64) importVertex {
+	var v importVertex
+	copy(v.p[:], prim.positions[3*i:])
+	copy(v.n[:], prim.normals[3*i:])
+	copy(v.c[:], prim.colors[4*i:])
+	if uv != nil {
+		v.uv = [2]float32{float32(uv[0]), float32(1 - uv[1])}
+	}
+	return v
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// importSTL reads a binary or ASCII STL file into a single flat-shaded
+// mesh. Normals follow the winding of each triangle; the stored facet
+// normal is only used for triangles too thin to have one.
+func importSTL(r io.ReaderAt, size int64, name string) (*importScene, error) {
+	head := make([]byte, 84)
+	n, _ := r.ReadAt(head, 0)
+	head = head[:n]
+	b := newPrimitiveBuilder(-1)
+	var err error
+	switch {
+	case n == 84 && size == 84+50*int64(binary.LittleEndian.Uint32(head[80:])):
+		// exporters write "solid" into binary headers too, so the size
+		// decides
+		err = readBinarySTL(io.NewSectionReader(r, 84, size-84), int(binary.LittleEndian.Uint32(head[80:])), b)
+	case bytes.HasPrefix(bytes.TrimLeft(head, " \t\r\n"), []byte("solid")):
+		var solid string
+		solid, err = readASCIISTL(io.NewSectionReader(r, 0, size), b)
+		if solid != "" {
+			name = solid
+		}
+	default:
+		return nil, fmt.Errorf("%w: not an STL file: too short for a binary STL and not starting with \"solid\"", errImport)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := &importScene{format: "stl"}
+	sc.addMesh(importMesh{name: name, primitives: []*importPrimitive{b.done()}})
+	return sc, nil
+}
+
+// stlTriangle adds a triangle with the normal of its winding
+func stlTriangle(b *primitiveBuilder, facet [3]float32, v [3][3]float32) {
+	n, ok := faceNormal(v[0], v[1], v[2])
+	if !ok {
+		n = facet
+	}
+	var ids [3]uint32
+	for k := range v {
+		ids[k] = b.vertex(importVertex{p: v[k], n: n}, true, false, false)
+	}
+	b.triangle(ids[0], ids[1], ids[2])
+}
+
+func readBinarySTL(r io.Reader, count int, b *primitiveBuilder) error {
+	br := bufio.NewReader(r)
+	var rec [50]byte
+	for t := 0; t < count; t++ {
+		if _, err := io.ReadFull(br, rec[:]); err != nil {
+			return fmt.Errorf("%w: triangle %d: %v", errImport, t, err)
+		}
+		var f [12]float32
+		for i := range f {
+			f[i] = math.Float32frombits(binary.LittleEndian.Uint32(rec[4*i:]))
+			if math.IsNaN(float64(f[i])) || math.IsInf(float64(f[i]), 0) {
+				return fmt.Errorf("%w: triangle %d has a coordinate that is not a number", errImport, t)
+			}
+		}
+		stlTriangle(b, [3]float32{f[0], f[1], f[2]}, [3][3]float32{{f[3], f[4], f[5]}, {f[6], f[7], f[8]}, {f[9], f[10], f[11]}})
+	}
+	return nil
+}
+
+// readASCIISTL reads "facet normal" blocks of three "vertex" lines and
+// returns the name after "solid"
+func readASCIISTL(r io.Reader, b *primitiveBuilder) (string, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64<<10), maxImportLine)
+	var name string
+	var facet [3]float32
+	var v [3][3]float32
+	corners := 0
+	for n := 1; s.Scan(); n++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "solid":
+			if n == 1 {
+				name = strings.Join(fields[1:], " ")
+			}
+		case "facet":
+			if len(fields) < 2 || fields[1] != "normal" {
+				return "", fmt.Errorf("%w: line %d: expected \"facet normal\"", errImport, n)
+			}
+			f, err := parseFloats(fields[2:], 3, 3)
+			if err != nil {
+				return "", fmt.Errorf("%w: line %d: %v", errImport, n, err)
+			}
+			facet = [3]float32{float32(f[0]), float32(f[1]), float32(f[2])}
+			corners = 0
+		case "vertex":
+			f, err := parseFloats(fields[1:], 3, 3)
+			if err != nil {
+				return "", fmt.Errorf("%w: line %d: %v", errImport, n, err)
+			}
+			if corners == 3 {
+				return "", fmt.Errorf("%w: line %d: a facet has more than three vertices", errImport, n)
+			}
+			v[corners] = [3]float32{float32(f[0]), float32(f[1]), float32(f[2])}
+			corners++
+		case "endfacet":
+			if corners != 3 {
+				return "", fmt.Errorf("%w: line %d: a facet needs three vertices, has %d", errImport, n, corners)
+			}
+			stlTriangle(b, facet, v)
+			corners = 0
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("%w: %v", errImport, err)
+	}
+	return name, nil
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// importFiles writes files to a directory, converts the model main among
+// them and opens the GLB, which must be valid
+func importFiles(t *testing.T, main string, files map[string][]byte) (*gltfAsset, []string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		writeTestFile(t, dir, name, data)
+	}
+	mf := newModelFiles(dir, false)
+	defer mf.Close()
+	glb, warnings, err := importModel(filepath.Join(dir, main), mf.resolve)
+	if err != nil {
+		return nil, warnings, err
+	}
+	if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); errs != nil {
+		t.Fatalf("converted %s is invalid: %+v", main, errs)
+	}
+	asset, _ := openGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+	return asset, warnings, nil
+}
+
+// expectImportError checks that main cannot be converted, for a reason
+// naming want
+func expectImportError(t *testing.T, main string, data []byte, want string) {
+	t.Helper()
+	_, _, err := importFiles(t, main, map[string][]byte{main: data})
+	if !errors.Is(err, errImport) || !strings.Contains(err.Error(), want) {
+		t.Errorf("%s: %v, want an import error about %q", main, err, want)
+	}
+}
+
+// primitiveData reads the positions, normals, UVs, colors and indices of
+// a primitive; missing attributes are nil
+func primitiveData(t *testing.T, a *gltfAsset, p GLTFPrimitive) (pos, normals, uvs, colors []float64, idx []uint32) {
+	t.Helper()
+	read := func(attr string) []float64 {
+		i, ok := p.Attributes[attr]
+		if !ok {
+			return nil
+		}
+		v, err := a.readFloats(i)
+		if err != nil {
+			t.Fatalf("%s: %v", attr, err)
+		}
+		return v
+	}
+	if p.Indices != nil {
+		var err error
+		if idx, err = a.readIndices(*p.Indices); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return read("POSITION"), read("NORMAL"), read("TEXCOORD_0"), read("COLOR_0"), idx
+}
+
+func closeTo(got []float64, want ...float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+// ============ OBJ ============
+
+const testOBJ = `# two objects
+mtllib box.mtl
+o Top
+v 0 0 0
+v 1 0 0
+v 1 1 0
+v 0 1 0
+vt 0 0
+vt 1 0
+vt 1 1
+vt 0 1
+vn 0 0 1
+usemtl wood
+f 1/1/1 2/2/1 3/3/1 4/4/1
+o Side
+v 0 0 1 1 0 0
+v 1 0 1 0 1 0
+v 0 1 1 0 0 1
+usemtl red
+f -3 -2 -1
+l 1 2
+`
+
+const testMTL = `newmtl wood
+Kd 0.8 0.6 0.4
+Ns 98
+map_Kd -s 1 1 1 textures\wood.png
+newmtl red
+Kd 1 0 0
+d 0.5
+map_Kd missing.png
+`
+
+func TestImportOBJ(t *testing.T) {
+	asset, warnings, err := importFiles(t, "box.obj", map[string][]byte{
+		"box.obj":           []byte(testOBJ),
+		"box.mtl":           []byte(testMTL),
+		"textures/wood.png": testPNG(t, 4, color.RGBA{150, 100, 50, 255}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := asset.Doc
+	if len(doc.Meshes) != 2 || doc.Meshes[0].Name != "Top" || doc.Meshes[1].Name != "Side" || len(doc.Scenes[0].Nodes) != 2 {
+		t.Fatalf("meshes %+v", doc.Meshes)
+	}
+
+	// the quad becomes two triangles; OBJ's v runs up, glTF's down
+	top := doc.Meshes[0].Primitives[0]
+	pos, normals, uvs, colors, idx := primitiveData(t, asset, top)
+	if len(pos) != 12 || !reflect.DeepEqual(idx, []uint32{0, 1, 2, 0, 2, 3}) || colors != nil {
+		t.Fatalf("top: %d positions, indices %v, colors %v", len(pos)/3, idx, colors)
+	}
+	if !closeTo(normals[:3], 0, 0, 1) || !closeTo(uvs, 0, 1, 1, 1, 1, 0, 0, 0) {
+		t.Fatalf("top: normals %v, uvs %v", normals, uvs)
+	}
+	wood := doc.Materials[*top.Material]
+	pbr := wood.PBRMetallicRoughness
+	if wood.Name != "wood" || !closeTo(pbr.BaseColorFactor, 0.8, 0.6, 0.4, 1) || math.Abs(*pbr.RoughnessFactor-math.Sqrt(0.02)) > 1e-9 {
+		t.Fatalf("wood %+v %+v", wood, pbr)
+	}
+	if pbr.BaseColorTexture == nil || len(doc.Images) != 1 || doc.Images[0].MimeType != "image/png" || doc.Images[0].Name != "wood.png" {
+		t.Fatalf("wood texture %+v, images %+v", pbr.BaseColorTexture, doc.Images)
+	}
+
+	// negative indices count back from the last vertex, colors come along
+	side := doc.Meshes[1].Primitives[0]
+	pos, normals, _, colors, idx = primitiveData(t, asset, side)
+	if len(pos) != 9 || len(idx) != 3 || normals != nil || !closeTo(colors[:4], 1, 0, 0, 1) {
+		t.Fatalf("side: %d positions, normals %v, colors %v", len(pos)/3, normals, colors)
+	}
+	red := doc.Materials[*side.Material]
+	if red.AlphaMode != "BLEND" || red.PBRMetallicRoughness.BaseColorTexture != nil {
+		t.Fatalf("red %+v", red)
+	}
+
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "missing.png") || !strings.Contains(warnings[1], `"l" elements`) {
+		t.Fatalf("warnings %q", warnings)
+	}
+}
+
+func TestImportOBJWithoutMaterials(t *testing.T) {
+	// a library that is not there, and a material it would have held
+	asset, warnings, err := importFiles(t, "tri.obj", map[string][]byte{
+		"tri.obj": []byte("mtllib gone.mtl\nv 0 0 0\nv 1 0 0\nv 0 1 0\nusemtl paint\nf 1 2 3\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "gone.mtl") {
+		t.Fatalf("warnings %q", warnings)
+	}
+	if m := asset.Doc.Meshes[0]; m.Name != "tri" || len(asset.Doc.Materials) != 1 || asset.Doc.Materials[0].Name != "paint" {
+		t.Fatalf("mesh %+v, materials %+v", m, asset.Doc.Materials)
+	}
+}
+
+func TestImportOBJErrors(t *testing.T) {
+	expectImportError(t, "a.obj", []byte("v 0 0 0\nv 1 0 0\nf 1 2 3\n"), "line 3")
+	expectImportError(t, "b.obj", []byte("v 0 zero 0\n"), `"zero" is not a number`)
+	expectImportError(t, "c.obj", []byte("v 0 0 0\nv 1 0 0\nv 0 1 0\nf 1/4 2 3\n"), "does not exist")
+	expectImportError(t, "d.obj", []byte("v 0 0 0\nl 1 1\n"), "no faces")
+}
+
+// ============ STL ============
+
+const testASCIISTL = `solid bracket
+facet normal 0 0 1
+ outer loop
+  vertex 0 0 0
+  vertex 1 0 0
+  vertex 0 1 0
+ endloop
+endfacet
+facet normal 0 0 1
+ outer loop
+  vertex 1 0 0
+  vertex 1 1 0
+  vertex 0 1 0
+ endloop
+endfacet
+endsolid bracket
+`
+
+// binarySTL encodes triangles of a facet normal and three corners
+func binarySTL(header string, triangles ...[12]float32) []byte {
+	data := make([]byte, 80, 84+50*len(triangles))
+	copy(data, header)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(triangles)))
+	for _, tri := range triangles {
+		for _, f := range tri {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+		}
+		data = append(data, 0, 0)
+	}
+	return data
+}
+
+func TestImportSTL(t *testing.T) {
+	ascii, _, err := importFiles(t, "part.stl", map[string][]byte{"part.stl": []byte(testASCIISTL)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, normals, _, _, idx := primitiveData(t, ascii, ascii.Doc.Meshes[0].Primitives[0])
+	// corners shared by both triangles are stored once
+	if ascii.Doc.Meshes[0].Name != "bracket" || len(pos) != 12 || len(idx) != 6 || !closeTo(normals[:3], 0, 0, 1) {
+		t.Fatalf("ascii: %q, %d positions, %d indices, normals %v", ascii.Doc.Meshes[0].Name, len(pos)/3, len(idx), normals)
+	}
+
+	// the header starts with "solid" but the size says binary; the wrong
+	// facet normal of the second triangle gives way to its winding
+	bin, _, err := importFiles(t, "part.stl", map[string][]byte{"part.stl": binarySTL("solid from an exporter",
+		[12]float32{0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 1, 0},
+		[12]float32{0, 0, -1, 1, 0, 0, 1, 1, 0, 0, 1, 0},
+	)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	binPos, binNormals, _, _, binIdx := primitiveData(t, bin, bin.Doc.Meshes[0].Primitives[0])
+	if bin.Doc.Meshes[0].Name != "part" || !reflect.DeepEqual(binPos, pos) || !reflect.DeepEqual(binNormals, normals) || !reflect.DeepEqual(binIdx, idx) {
+		t.Fatalf("binary: %q, positions %v, normals %v", bin.Doc.Meshes[0].Name, binPos, binNormals)
+	}
+}
+
+func TestImportSTLErrors(t *testing.T) {
+	expectImportError(t, "a.stl", []byte("not a model"), "not an STL file")
+	expectImportError(t, "b.stl", []byte("solid x\nfacet normal 0 0 1\nvertex 0 0 0\nvertex 1 0 0\nendfacet\n"), "has 2")
+	nan := float32(math.NaN())
+	expectImportError(t, "c.stl", binarySTL("", [12]float32{0, 0, 1, nan, 0, 0, 1, 0, 0, 0, 1, 0}), "not a number")
+	expectImportError(t, "d.stl", []byte("solid empty\nendsolid empty\n"), "no faces")
+}
+
+// ============ PLY ============
+
+const testPLY = `ply
+format ascii 1.0
+comment TextureFile tex.png
+element vertex 4
+property float x
+property float y
+property float z
+property uchar red
+property uchar green
+property uchar blue
+element face 1
+property list uchar int vertex_indices
+property list uchar float texcoord
+end_header
+0 0 0 255 0 0
+1 0 0 0 255 0
+1 1 0 0 0 255
+0 1 0 255 255 255
+4 0 1 2 3 8 0 0 1 0 1 1 0 1
+`
+
+func TestImportPLY(t *testing.T) {
+	asset, warnings, err := importFiles(t, "scan.ply", map[string][]byte{
+		"scan.ply": []byte(testPLY),
+		"tex.png":  testPNG(t, 4, color.RGBA{0, 0, 255, 255}),
+	})
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("%v %q", err, warnings)
+	}
+	prim := asset.Doc.Meshes[0].Primitives[0]
+	pos, normals, uvs, colors, idx := primitiveData(t, asset, prim)
+	if len(pos) != 12 || normals != nil || !reflect.DeepEqual(idx, []uint32{0, 1, 2, 0, 2, 3}) {
+		t.Fatalf("%d positions, normals %v, indices %v", len(pos)/3, normals, idx)
+	}
+	// 8-bit colors span 0..255; UVs per face corner, flipped to glTF's
+	if !closeTo(colors[:8], 1, 0, 0, 1, 0, 1, 0, 1) || !closeTo(uvs, 0, 1, 1, 1, 1, 0, 0, 0) {
+		t.Fatalf("colors %v, uvs %v", colors, uvs)
+	}
+	if prim.Material == nil || asset.Doc.Materials[*prim.Material].PBRMetallicRoughness.BaseColorTexture == nil || len(asset.Doc.Images) != 1 {
+		t.Fatalf("texture not applied: %+v", asset.Doc.Materials)
+	}
+}
+
+func TestImportBinaryPLY(t *testing.T) {
+	header := func(format string, faces bool) []byte {
+		h := "ply\nformat " + format + " 1.0\nelement vertex 3\nproperty float x\nproperty float y\nproperty float z\nproperty float nx\nproperty float ny\nproperty float nz\n"
+		if faces {
+			h += "element face 1\nproperty list uchar int vertex_indices\n"
+		}
+		return []byte(h + "end_header\n")
+	}
+	vertices := [][6]float32{{0, 0, 0, 0, 0, 1}, {1, 0, 0, 0, 0, 1}, {0, 1, 0, 0, 0, 1}}
+
+	for format, order := range map[string]binary.AppendByteOrder{"binary_little_endian": binary.LittleEndian, "binary_big_endian": binary.BigEndian} {
+		data := header(format, true)
+		for _, v := range vertices {
+			for _, f := range v {
+				data = order.AppendUint32(data, math.Float32bits(f))
+			}
+		}
+		data = append(data, 3)
+		for _, i := range []uint32{0, 1, 2} {
+			data = order.AppendUint32(data, i)
+		}
+		asset, _, err := importFiles(t, "tri.ply", map[string][]byte{"tri.ply": data})
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		pos, normals, _, colors, idx := primitiveData(t, asset, asset.Doc.Meshes[0].Primitives[0])
+		if !closeTo(pos, 0, 0, 0, 1, 0, 0, 0, 1, 0) || !closeTo(normals[6:], 0, 0, 1) || colors != nil || len(idx) != 3 {
+			t.Fatalf("%s: positions %v, normals %v, colors %v, indices %v", format, pos, normals, colors, idx)
+		}
+	}
+
+	// without faces the vertices are a point cloud
+	data := header("binary_little_endian", false)
+	for _, v := range vertices {
+		for _, f := range v {
+			data = binary.LittleEndian.AppendUint32(data, math.Float32bits(f))
+		}
+	}
+	asset, _, err := importFiles(t, "cloud.ply", map[string][]byte{"cloud.ply": data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := asset.Doc.Meshes[0].Primitives[0]; p.Mode == nil || *p.Mode != 0 || p.Indices != nil {
+		t.Fatalf("point cloud %+v", p)
+	}
+}
+
+func TestImportPLYErrors(t *testing.T) {
+	expectImportError(t, "a.ply", []byte("solid\n"), "not a PLY file")
+	expectImportError(t, "b.ply", []byte("ply\nformat ascii 1.0\nelement vertex 1\n"), "header does not end")
+	expectImportError(t, "c.ply", []byte("ply\nformat ascii 1.0\nelement vertex 1\nproperty quad x\nend_header\n"), "malformed")
+	expectImportError(t, "d.ply", []byte("ply\nformat binary_middle_endian 1.0\nend_header\n"), "not supported")
+	expectImportError(t, "e.ply", []byte("ply\nformat ascii 1.0\nelement vertex 3\nproperty float x\nproperty float y\nproperty float z\n"+
+		"element face 1\nproperty list uchar int vertex_indices\nend_header\n0 0 0\n1 0 0\n0 1 0\n3 0 1 7\n"), "face 0")
+	expectImportError(t, "f.ply", []byte("ply\nformat ascii 1.0\nelement vertex 2\nproperty float x\nend_header\n0\n"), "vertex 1")
+}
+
+// ============ FBX ============
+
+// testFBX is a quad with a textured material on a model with a child, in
+// centimeters unless unitScale says otherwise
+func testFBX(unitScale string) []byte {
+	return []byte(`; FBX 7.4.0 project file
+FBXHeaderExtension:  {
+	FBXVersion: 7400
+}
+GlobalSettings:  {
+	Version: 1000
+	Properties70:  {
+		P: "UpAxis", "int", "Integer", "",1
+		P: "FrontAxis", "int", "Integer", "",2
+		P: "CoordAxis", "int", "Integer", "",0` + unitScale + `
+	}
+}
+Objects:  {
+	Geometry: 1000, "Geometry::Quad", "Mesh" {
+		Vertices: *12 {
+			a: 0,0,0,1,0,0,1,1,0
+			,0,1,0
+		}
+		PolygonVertexIndex: *4 {
+			a: 0,1,2,-4
+		}
+		LayerElementNormal: 0 {
+			MappingInformationType: "ByPolygonVertex"
+			ReferenceInformationType: "Direct"
+			Normals: *12 {
+				a: 0,0,1,0,0,1,0,0,1,0,0,1
+			}
+		}
+		LayerElementUV: 0 {
+			MappingInformationType: "ByPolygonVertex"
+			ReferenceInformationType: "IndexToDirect"
+			UV: *8 {
+				a: 0,0,1,0,1,1,0,1
+			}
+			UVIndex: *4 {
+				a: 0,1,2,3
+			}
+		}
+		LayerElementMaterial: 0 {
+			MappingInformationType: "AllSame"
+			ReferenceInformationType: "IndexToDirect"
+			Materials: *1 {
+				a: 0
+			}
+		}
+	}
+	Model: 2000, "Model::Quad", "Mesh" {
+		Properties70:  {
+			P: "Lcl Translation", "Lcl Translation", "", "A",0,2,0
+		}
+	}
+	Model: 2001, "Model::Handle", "Null" {
+		Properties70:  {
+			P: "Lcl Scaling", "Lcl Scaling", "", "A",2,2,2
+		}
+	}
+	Material: 3000, "Material::Paint", "" {
+		Properties70:  {
+			P: "DiffuseColor", "Color", "", "A",0,0.5,1
+		}
+	}
+	Texture: 4000, "Texture::Paint", "" {
+		RelativeFilename: "C:\Users\artist\maps\paint.png"
+	}
+	Deformer: 5000, "Deformer::Skin", "Skin" {
+	}
+}
+Connections:  {
+	;Model::Quad, Model::RootNode
+	C: "OO",2000,0
+	C: "OO",2001,2000
+	C: "OO",1000,2000
+	C: "OO",3000,2000
+	C: "OP",4000,3000, "DiffuseColor"
+}
+`)
+}
+
+func TestImportFBX(t *testing.T) {
+	asset, warnings, err := importFiles(t, "quad.fbx", map[string][]byte{
+		"quad.fbx":  testFBX("\n\t\tP: \"UnitScaleFactor\", \"double\", \"Number\", \"\",100"),
+		"paint.png": testPNG(t, 4, color.RGBA{0, 128, 255, 255}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "skinning") {
+		t.Fatalf("warnings %q", warnings)
+	}
+
+	// a file in meters and Y-up needs no root node
+	doc := asset.Doc
+	if len(doc.Nodes) != 2 || !reflect.DeepEqual(doc.Scenes[0].Nodes, []int{0}) || !reflect.DeepEqual(doc.Nodes[0].Children, []int{1}) {
+		t.Fatalf("nodes %+v, roots %v", doc.Nodes, doc.Scenes[0].Nodes)
+	}
+	quad, handle := doc.Nodes[0], doc.Nodes[1]
+	if quad.Name != "Quad" || quad.Mesh == nil || !closeTo(quad.Matrix[12:15], 0, 2, 0) || handle.Mesh != nil || !closeTo(handle.Matrix[:1], 2) {
+		t.Fatalf("quad %+v, handle %+v", quad, handle)
+	}
+
+	prim := doc.Meshes[*quad.Mesh].Primitives[0]
+	pos, normals, uvs, _, idx := primitiveData(t, asset, prim)
+	if len(pos) != 12 || !reflect.DeepEqual(idx, []uint32{0, 1, 2, 0, 2, 3}) || !closeTo(normals[:3], 0, 0, 1) || !closeTo(uvs[:4], 0, 1, 1, 1) {
+		t.Fatalf("positions %v, indices %v, normals %v, uvs %v", pos, idx, normals, uvs)
+	}
+	// the texture is found by its bare name, away from the artist's disk
+	mat := doc.Materials[*prim.Material]
+	if mat.Name != "Paint" || !closeTo(mat.PBRMetallicRoughness.BaseColorFactor, 0, 0.5, 1, 1) || mat.PBRMetallicRoughness.BaseColorTexture == nil || len(doc.Images) != 1 {
+		t.Fatalf("material %+v %+v", mat, mat.PBRMetallicRoughness)
+	}
+}
+
+func TestImportFBXUnits(t *testing.T) {
+	// centimeters by default: a root node scales the scene to meters
+	asset, warnings, err := importFiles(t, "quad.fbx", map[string][]byte{"quad.fbx": testFBX("")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := asset.Doc
+	root := doc.Nodes[len(doc.Nodes)-1]
+	if !reflect.DeepEqual(doc.Scenes[0].Nodes, []int{len(doc.Nodes) - 1}) || root.Name != "RootNode" || !closeTo(root.Matrix[:1], 0.01) || !reflect.DeepEqual(root.Children, []int{0}) {
+		t.Fatalf("root %+v", root)
+	}
+	// the missing texture is reported, the material kept
+	if len(warnings) != 2 || !strings.Contains(warnings[1], "paint.png") || len(doc.Materials) != 1 || len(doc.Images) != 0 {
+		t.Fatalf("warnings %q, materials %+v", warnings, doc.Materials)
+	}
+}
+
+func TestImportFBXErrors(t *testing.T) {
+	expectImportError(t, "a.fbx", []byte("Kaydara FBX Binary  \x00\x1a\x00"), "binary FBX")
+	expectImportError(t, "b.fbx", []byte("FBXHeaderExtension: {\n\tFBXVersion: 6100\n}\nObjects: {\n}\n"), "version 6.1")
+	expectImportError(t, "c.fbx", []byte("GlobalSettings: {\n}\n"), "no Objects")
+	expectImportError(t, "d.fbx", []byte("Objects: {\n\tModel: 1, \"Model::A\", \"Null\" {\n"), "ends inside a node")
+	expectImportError(t, "e.fbx", []byte("Objects: {\n}\n}\n"), `unexpected "}"`)
+	expectImportError(t, "f.fbx", []byte("Objects: {\n}\n"), "no faces")
+}
+
+// ============ Upload ============
+
+func TestUploadConvertsModels(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+
+	// an OBJ with its library and texture; multipart files carry no folders,
+	// so textures\wood.png is found by its name
+	w := ts.upload(admin, map[string]string{"name": "box"},
+		testFile{"file", "box.obj", []byte(testOBJ)},
+		testFile{"resources", "box.mtl", []byte(testMTL)},
+		testFile{"resources", "wood.png", testPNG(t, 4, color.RGBA{150, 100, 50, 255})},
+	)
+	expectStatus(t, w, 201)
+	var resp struct {
+		Data struct {
+			ID           uint     `json:"id"`
+			FileURL      string   `json:"file_url"`
+			FileName     string   `json:"file_name"`
+			SourceURL    string   `json:"source_url"`
+			SourceFormat string   `json:"source_format"`
+			Warnings     []string `json:"warnings"`
+		} `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	got := resp.Data
+	if got.SourceFormat != "obj" || !strings.HasSuffix(got.FileName, "/box.glb") || len(got.Warnings) != 2 {
+		t.Fatalf("upload %+v", got)
+	}
+	dir, _, _ := strings.Cut(got.FileName, "/")
+	if got.SourceURL != "/uploads/"+dir+"/source/box.obj" {
+		t.Fatalf("source at %q", got.SourceURL)
+	}
+
+	// the GLB is served as the model, the uploaded files beside it
+	w = ts.do("GET", got.FileURL, "", nil)
+	expectStatus(t, w, 200)
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("glTF")) {
+		t.Fatalf("model served as %q", w.Body.Bytes()[:4])
+	}
+	w = ts.do("GET", got.SourceURL, "", nil)
+	expectStatus(t, w, 200)
+	if w.Body.String() != testOBJ {
+		t.Fatal("source differs from the upload")
+	}
+	// at the paths the files name them by, so the source still opens
+	for _, name := range []string{"box.mtl", "textures/wood.png"} {
+		if _, err := os.Stat(filepath.Join(ts.cfg.UploadDir, dir, "source", filepath.FromSlash(name))); err != nil {
+			t.Fatalf("%s not kept: %v", name, err)
+		}
+	}
+	if models := ts.listModels(admin); models[0].SourceURL != got.SourceURL || models[0].SourceFormat != "obj" {
+		t.Fatalf("listed %+v", models[0])
+	}
+
+	// a zipped STL in a folder
+	w = ts.upload(admin, map[string]string{"name": "part"},
+		testFile{"file", "part.zip", testZip(t, map[string][]byte{"parts/part.stl": []byte(testASCIISTL)})})
+	expectStatus(t, w, 201)
+	decodeJSON(t, w, &resp)
+	if resp.Data.SourceFormat != "stl" || !strings.HasSuffix(resp.Data.SourceURL, "/source/part.stl") {
+		t.Fatalf("zipped upload %+v", resp.Data)
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, map[string]uint{"id": got.ID}), 200)
+	if _, err := os.Stat(filepath.Join(ts.cfg.UploadDir, dir)); !os.IsNotExist(err) {
+		t.Fatalf("model folder left behind: %v", err)
+	}
+}
+
+func TestUploadAcceptsUpperCaseExtensions(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+
+	ts.uploadModel(admin, "Cube.GLB", testGLB(t, testCube()), nil)
+	ts.uploadModel(admin, "Box.OBJ", []byte(testOBJ), nil)
+	ts.uploadModel(admin, "Part.ZIP", testZip(t, map[string][]byte{"Part.STL": []byte(testASCIISTL)}), nil)
+	models := ts.listModels(admin)
+	if len(models) != 3 {
+		t.Fatalf("listed %d models", len(models))
+	}
+	for _, m := range models {
+		w := ts.do("GET", m.FileURL, "", nil)
+		expectStatus(t, w, 200)
+		if !bytes.HasPrefix(w.Body.Bytes(), []byte("glTF")) {
+			t.Fatalf("%s served as %q", m.Name, w.Body.Bytes()[:4])
+		}
+	}
+}
+
+func TestUploadRejectsUnconvertibleModels(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+
+	w := ts.upload(admin, map[string]string{"name": "broken"}, testFile{"file", "broken.obj", []byte("v 0 0 0\nf 1 2 3\n")})
+	expectStatus(t, w, 422)
+	if msg := errorOf(t, w); !strings.Contains(msg, "line 2") {
+		t.Fatalf("error %q", msg)
+	}
+	w = ts.upload(admin, map[string]string{"name": "bin"}, testFile{"file", "bin.fbx", []byte("Kaydara FBX Binary  \x00")})
+	expectStatus(t, w, 422)
+	// STL files have nothing to refer to
+	w = ts.upload(admin, map[string]string{"name": "part"},
+		testFile{"file", "part.stl", []byte(testASCIISTL)},
+		testFile{"resources", "notes.txt", []byte("x")})
+	expectStatus(t, w, 400)
+
+	if entries, _ := os.ReadDir(ts.cfg.UploadDir); len(entries) != 0 {
+		t.Fatalf("rejected uploads left %d entries", len(entries))
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelLOD is a simplified version of a model, stored as a GLB next to it
+type ModelLOD struct {
+	Level     int     `json:"level"` // 1 is the most detailed
+	Ratio     float64 `json:"ratio"` // share of the triangles asked to keep
+	Triangles int64   `json:"triangles"`
+	FileURL   string  `json:"file_url"`
+	FileSize  int64   `json:"file_size"`
+}
+
+// lodName returns the name under which level of a model file is stored
+func lodName(fileName string, level int) string {
+	return fmt.Sprintf("%s.lod%d.glb", fileName[:len(fileName)-len(path.Ext(fileName))], level)
+}
+
+var lodFilePattern = regexp.MustCompile(`\.lod[0-9]+\.glb$`)
+
+// derivedModelFile reports whether name is a file made from a model rather
+// than a model of its own
+func derivedModelFile(name string) bool {
+	return strings.HasSuffix(name, optimizedSuffix) || lodFilePattern.MatchString(name)
+}
+
+// removeLODFiles deletes the LOD files of a model from level on
+func removeLODFiles(baseDir, fileName string, level int) {
+	for ; ; level++ {
+		err := os.Remove(filepath.Join(baseDir, filepath.FromSlash(lodName(fileName, level))))
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Warning: failed to remove LOD %d of %s: %v", level, fileName, err)
+		}
+	}
+}
+
+// lodMaxError bounds how far, relative to its size, simplifying may move
+// the surface of a primitive; a level stops short of its ratio rather than
+// crush the shape
+const lodMaxError = 0.01
+
+// lodPrimitive is the geometry of a primitive the simplifier can work on
+type lodPrimitive struct {
+	attrs     []string // attribute names, sorted
+	raw       [][]byte // packed elements of each attribute
+	pos       []vec3
+	indices   []uint32 // welded: identical vertices all point at the first
+	triangles int
+}
+
+// lodLevel is one generated LOD
+type lodLevel struct {
+	ratio     float64
+	data      []byte
+	triangles int64
+}
+
+// buildModelLODs simplifies every triangle mesh of the model at filePath
+// once for each ratio and returns the levels as GLBs, most detailed first.
+// Models with fewer than minTriangles triangles get none, and levels the
+// simplifier could not make lighter than the one before are left out.
+func buildModelLODs(filePath string, ratios []float64, minTriangles int, tex textureOptions) ([]lodLevel, error) {
+	asset, files, err := openOptimizable(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer files.Close()
+	triangles := modelMetadata(asset.Doc).Triangles
+	if len(ratios) == 0 || triangles < int64(minTriangles) {
+		return nil, nil
+	}
+
+	prims := make(map[string]*lodPrimitive)
+	for _, mesh := range asset.Doc.Meshes {
+		for _, p := range mesh.Primitives {
+			key, err := primitiveKey(p)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := prims[key]; !ok {
+				prims[key] = readLODPrimitive(asset, p)
+			}
+		}
+	}
+
+	var levels []lodLevel
+	for _, r := range ratios {
+		derived, err := deriveLOD(asset, prims, r)
+		if err != nil {
+			return nil, err
+		}
+		out, _, err := optimizeAsset(derived, files.resolve, tex)
+		if err != nil {
+			return nil, err
+		}
+		n := modelMetadata(derived.Doc).Triangles
+		if n >= triangles {
+			break
+		}
+		levels = append(levels, lodLevel{ratio: r, data: out, triangles: n})
+		triangles = n
+	}
+	return levels, nil
+}
+
+// primitiveKey identifies primitives drawing the same geometry
+func primitiveKey(p GLTFPrimitive) (string, error) {
+	key, err := json.Marshal(struct {
+		A map[string]int
+		I *int
+		M *int
+		T []map[string]int
+	}{p.Attributes, p.Indices, p.Mode, p.Targets})
+	return string(key), err
+}
+
+// readLODPrimitive returns the geometry of p, or nil when it is not a plain
+// triangle list the simplifier can handle; such primitives are kept as
+// they are in every level
+func readLODPrimitive(asset *gltfAsset, p GLTFPrimitive) *lodPrimitive {
+	if p.Mode != nil && *p.Mode != 4 || len(p.Targets) > 0 {
+		return nil
+	}
+	pa, ok := p.Attributes["POSITION"]
+	if !ok || pa < 0 || pa >= len(asset.Doc.Accessors) {
+		return nil
+	}
+	posAcc := asset.Doc.Accessors[pa]
+	if posAcc.ComponentType != gltfFloat || posAcc.Type != "VEC3" {
+		return nil
+	}
+	count := posAcc.Count
+
+	lp := &lodPrimitive{attrs: sortedKeys(p.Attributes)}
+	for _, name := range lp.attrs {
+		a := p.Attributes[name]
+		if a < 0 || a >= len(asset.Doc.Accessors) {
+			return nil
+		}
+		acc := asset.Doc.Accessors[a]
+		if acc.BufferView == nil || acc.Sparse != nil || acc.Count != count {
+			return nil
+		}
+		raw, err := asset.rawElements(acc)
+		if err != nil {
+			return nil
+		}
+		lp.raw = append(lp.raw, raw)
+	}
+	floats, err := asset.readFloats(pa)
+	if err != nil {
+		return nil
+	}
+	lp.pos = make([]vec3, count)
+	for v := range lp.pos {
+		lp.pos[v] = vec3{floats[v*3], floats[v*3+1], floats[v*3+2]}
+	}
+
+	var idx []uint32
+	if p.Indices != nil {
+		if idx, err = asset.readIndices(*p.Indices); err != nil {
+			return nil
+		}
+	} else {
+		idx = make([]uint32, count)
+		for i := range idx {
+			idx[i] = uint32(i)
+		}
+	}
+
+	// vertices alike in every attribute become one, so unindexed and
+	// split meshes get their topology back
+	first := make(map[string]uint32, count)
+	weld := make([]uint32, count)
+	var key []byte
+	for v := 0; v < count; v++ {
+		key = key[:0]
+		for _, raw := range lp.raw {
+			size := len(raw) / count
+			key = append(key, raw[v*size:(v+1)*size]...)
+		}
+		id, ok := first[string(key)]
+		if !ok {
+			id = uint32(v)
+			first[string(key)] = id
+		}
+		weld[v] = id
+	}
+	lp.indices = make([]uint32, len(idx)-len(idx)%3)
+	for i := range lp.indices {
+		if idx[i] >= uint32(count) {
+			return nil
+		}
+		lp.indices[i] = weld[idx[i]]
+	}
+	lp.triangles = len(lp.indices) / 3
+	return lp
+}
+
+// deriveLOD returns a copy of asset whose simplifiable primitives keep
+// about ratio of their triangles. The new geometry goes into an extra
+// buffer; the accessors it replaces are left for the optimizer to drop.
+func deriveLOD(asset *gltfAsset, prims map[string]*lodPrimitive, ratio float64) (*gltfAsset, error) {
+	src := asset.Doc
+	doc := *src
+	doc.Accessors = append([]GLTFAccessor(nil), src.Accessors...)
+	doc.BufferViews = append([]GLTFBufferView(nil), src.BufferViews...)
+	buffer := len(src.Buffers)
+	var bin []byte
+	addView := func(data []byte, target int) int {
+		bin = append(bin, make([]byte, align4(len(bin))-len(bin))...)
+		doc.BufferViews = append(doc.BufferViews, GLTFBufferView{Buffer: buffer, ByteOffset: len(bin), ByteLength: len(data), Target: target})
+		bin = append(bin, data...)
+		return len(doc.BufferViews) - 1
+	}
+
+	done := make(map[string]GLTFPrimitive)
+	doc.Meshes = make([]GLTFMesh, len(src.Meshes))
+	for mi, mesh := range src.Meshes {
+		doc.Meshes[mi] = mesh
+		doc.Meshes[mi].Primitives = append([]GLTFPrimitive(nil), mesh.Primitives...)
+		for pi, p := range mesh.Primitives {
+			key, err := primitiveKey(p)
+			if err != nil {
+				return nil, err
+			}
+			lp := prims[key]
+			if lp == nil {
+				continue
+			}
+			if np, ok := done[key]; ok {
+				p.Attributes, p.Indices = np.Attributes, np.Indices
+				doc.Meshes[mi].Primitives[pi] = p
+				continue
+			}
+
+			target := int(math.Ceil(float64(lp.triangles) * ratio))
+			idx := simplifyMesh(lp.pos, lp.indices, target, lodMaxError)
+			if len(idx) == 0 {
+				continue
+			}
+			// keep only the vertices still in use, in order of first use
+			remap := make(map[uint32]uint32)
+			var order []uint32
+			out := make([]byte, 0, len(idx)*4)
+			for _, v := range idx {
+				n, ok := remap[v]
+				if !ok {
+					n = uint32(len(order))
+					remap[v] = n
+					order = append(order, v)
+				}
+				out = binary.LittleEndian.AppendUint32(out, n)
+			}
+
+			attrs := make(map[string]int, len(lp.attrs))
+			for k, name := range lp.attrs {
+				acc := src.Accessors[p.Attributes[name]]
+				size := len(lp.raw[k]) / acc.Count
+				data := make([]byte, 0, size*len(order))
+				for _, v := range order {
+					data = append(data, lp.raw[k][int(v)*size:(int(v)+1)*size]...)
+				}
+				view := addView(data, gltfArrayBuffer)
+				acc.BufferView, acc.ByteOffset, acc.Count = &view, 0, len(order)
+				acc.Min, acc.Max = nil, nil
+				if name == "POSITION" {
+					lo, hi := lp.pos[order[0]], lp.pos[order[0]]
+					for _, v := range order {
+						for c := 0; c < 3; c++ {
+							lo[c] = math.Min(lo[c], lp.pos[v][c])
+							hi[c] = math.Max(hi[c], lp.pos[v][c])
+						}
+					}
+					acc.Min, acc.Max = lo[:], hi[:]
+				}
+				doc.Accessors = append(doc.Accessors, acc)
+				attrs[name] = len(doc.Accessors) - 1
+			}
+			view := addView(out, gltfElementArrayBuffer)
+			doc.Accessors = append(doc.Accessors, GLTFAccessor{BufferView: &view, ComponentType: gltfUnsignedInt, Count: len(idx), Type: "SCALAR"})
+			indices := len(doc.Accessors) - 1
+
+			p.Attributes, p.Indices = attrs, &indices
+			done[key] = p
+			doc.Meshes[mi].Primitives[pi] = p
+		}
+	}
+
+	doc.Buffers = append(append([]GLTFBuffer(nil), src.Buffers...), GLTFBuffer{ByteLength: len(bin)})
+	data := append(append([]io.ReaderAt(nil), asset.Data...), bytes.NewReader(bin))
+	return &gltfAsset{Doc: &doc, Data: data, resolve: asset.resolve}, nil
+}
+
+// ============ JOB ============
+
+// lodJob writes the LODs of a model next to it and records them
+func (s *Server) lodJob(modelID uint) error {
+	m, err := s.store.GetModelByID(modelID)
+	if err != nil {
+		return err
+	}
+	baseDir := modelBaseDir(s.cfg, s.store, m)
+	levels, err := buildModelLODs(filepath.Join(baseDir, filepath.FromSlash(m.FileName)), s.cfg.LODRatios, s.cfg.LODMinTriangles, s.textureOptions())
+	if errors.Is(err, errNotOptimizable) {
+		log.Printf("lodJob: model %d: %v", modelID, err)
+		levels = nil
+	} else if err != nil {
+		return err
+	}
+
+	lods := []ModelLOD{}
+	version := time.Now().Unix()
+	for i, l := range levels {
+		level := i + 1
+		if err := writeDerivedFile(filepath.Join(baseDir, filepath.FromSlash(lodName(m.FileName, level))), l.data); err != nil {
+			return err
+		}
+		lods = append(lods, ModelLOD{
+			Level:     level,
+			Ratio:     l.ratio,
+			Triangles: l.triangles,
+			FileURL:   fmt.Sprintf("%s?v=%d", lodName(m.FileURL, level), version),
+			FileSize:  int64(len(l.data)),
+		})
+	}
+	// levels dropped from the configuration or no longer reached
+	removeLODFiles(baseDir, m.FileName, len(lods)+1)
+
+	if err := s.store.SetModelLODs(modelID, lods); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// deleted while simplifying
+			removeLODFiles(baseDir, m.FileName, 1)
+		}
+		return err
+	}
+	for _, l := range lods {
+		log.Printf("lodJob: model %d: level %d has %d triangles in %d bytes", modelID, l.Level, l.Triangles, l.FileSize)
+	}
+	return nil
+}
+
+// regenerateLODsHandler queues the LOD generation of a model
+func (s *Server) regenerateLODsHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	m, err := s.store.GetModelByID(req.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Model not found"})
+		return
+	}
+	if !s.checkModelAccess(c, m) {
+		return
+	}
+	job, err := s.enqueueJob(m.ID, JobLOD)
+	if err != nil {
+		log.Printf("regenerateLODsHandler: queue job: %v", err)
+		c.JSON(500, gin.H{"error": "Error queueing LOD generation"})
+		return
+	}
+	c.JSON(202, gin.H{"message": "LOD generation queued", "data": job})
+}
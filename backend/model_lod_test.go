@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLODName(t *testing.T) {
+	for name, want := range map[string]string{
+		"1700000000_chair.glb":        "1700000000_chair.lod1.glb",
+		"1700000000_house/house.gltf": "1700000000_house/house.lod1.glb",
+	} {
+		if got := lodName(name, 1); got != want {
+			t.Errorf("lodName(%q) = %q", name, got)
+		}
+	}
+	for name, want := range map[string]bool{
+		"1_chair.lod2.glb":      true,
+		"1_chair.optimized.glb": true,
+		"1_chair.glb":           false,
+		"1_lod2.glb.glb":        false,
+	} {
+		if derivedModelFile(name) != want {
+			t.Errorf("derivedModelFile(%q) = %v", name, !want)
+		}
+	}
+}
+
+func TestBuildModelLODs(t *testing.T) {
+	// a grid and a point cloud, which every level keeps as it is
+	doc, bin := testDoc(testGrid(64), testCube())
+	points := 0
+	doc.Meshes[1].Primitives[0].Mode = &points
+	doc.Meshes[1].Primitives[0].Indices = nil
+	glb, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, t.TempDir(), "grid.glb", glb)
+	full := int64(63 * 63 * 2)
+
+	levels, err := buildModelLODs(path, []float64{0.5, 0.1}, 1000, textureOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 {
+		t.Fatalf("%d levels", len(levels))
+	}
+	for i, l := range levels {
+		if l.triangles > int64(float64(full)*l.ratio)+1 || i > 0 && l.triangles >= levels[i-1].triangles {
+			t.Fatalf("level %d: %d triangles at ratio %v", i+1, l.triangles, l.ratio)
+		}
+		if errs := validateGLTF(bytes.NewReader(l.data), int64(len(l.data)), ".glb", nil); errs != nil {
+			t.Fatalf("level %d: %+v", i+1, errs)
+		}
+		asset, _ := openGLTF(bytes.NewReader(l.data), int64(len(l.data)), ".glb", nil)
+		md := modelMetadata(asset.Doc)
+		if md.Triangles != l.triangles || md.Meshes != 2 || md.Vertices < 8 {
+			t.Fatalf("level %d metadata %+v", i+1, md)
+		}
+		if len(l.data) >= len(glb) {
+			t.Fatalf("level %d of %d bytes, model %d", i+1, len(l.data), len(glb))
+		}
+	}
+
+	// light models get none
+	if levels, err := buildModelLODs(path, []float64{0.5}, int(full)+1, textureOptions{}); err != nil || levels != nil {
+		t.Fatalf("levels below the minimum: %d %v", len(levels), err)
+	}
+	// levels that cannot get lighter are left out: a cube has nothing to give
+	cube := writeTestFile(t, t.TempDir(), "cube.glb", testGLB(t, testCube()))
+	if levels, err := buildModelLODs(cube, []float64{0.5, 0.1}, 0, textureOptions{}); err != nil || len(levels) != 0 {
+		t.Fatalf("cube levels: %d %v", len(levels), err)
+	}
+}
+
+func TestLODJob(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.LODMinTriangles = 1000 })
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "grid.glb", testGLB(t, testGrid(64)), nil)
+	ts.runJobs()
+
+	models := ts.listModels(admin)
+	lods := models[0].LODs
+	if len(lods) != 2 || lods[0].Level != 1 || lods[0].Ratio != 0.5 || lods[1].Level != 2 || lods[1].Triangles >= lods[0].Triangles {
+		t.Fatalf("lods %+v", lods)
+	}
+	m, _ := ts.store.GetModelByID(id)
+	for _, l := range lods {
+		url, _, _ := strings.Cut(l.FileURL, "?v=")
+		if url != lodName(m.FileURL, l.Level) {
+			t.Fatalf("level %d at %q", l.Level, l.FileURL)
+		}
+		w := ts.do("GET", url, "", nil)
+		expectStatus(t, w, 200)
+		if int64(w.Body.Len()) != l.FileSize {
+			t.Fatalf("level %d served with %d bytes, recorded %d", l.Level, w.Body.Len(), l.FileSize)
+		}
+	}
+
+	// fewer ratios drop the files of the levels past them
+	level2 := filepath.Join(ts.cfg.UploadDir, lodName(m.FileName, 2))
+	ts.cfg.LODRatios = []float64{0.3}
+	expectStatus(t, ts.do("POST", "/api/models/lods", admin, gin.H{"id": id}), 202)
+	ts.runJobs()
+	if m, _ := ts.store.GetModelByID(id); len(m.LODs) != 1 || m.LODs[0].Ratio != 0.3 {
+		t.Fatalf("lods after reconfiguring %+v", m.LODs)
+	}
+	if _, err := os.Stat(level2); !os.IsNotExist(err) {
+		t.Fatalf("level 2 left behind: %v", err)
+	}
+	expectStatus(t, ts.do("POST", "/api/models/lods", admin, gin.H{"id": id + 100}), 404)
+	editor := ts.userToken("editor@test.com", RoleEditor)
+	expectStatus(t, ts.do("POST", "/api/models/lods", editor, gin.H{"id": id}), 403)
+
+	level1 := filepath.Join(ts.cfg.UploadDir, lodName(m.FileName, 1))
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": id}), 200)
+	if _, err := os.Stat(level1); !os.IsNotExist(err) {
+		t.Fatalf("level 1 left behind: %v", err)
+	}
+}
+
+func TestLODJobSkipsLightModels(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	ts.runJobs()
+	if m, _ := ts.store.GetModelByID(id); len(m.LODs) != 0 || m.ProcessingStatus != ProcessingReady {
+		t.Fatalf("light model %+v", m)
+	}
+	if models := ts.listModels(admin); models[0].LODs == nil {
+		t.Fatal("lods listed as null instead of []")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ModelMetadata summarizes what a viewer has to load and draw for a model
+type ModelMetadata struct {
+	Triangles  int64     `json:"triangles"` // drawn triangles, counting every mesh instance
+	Vertices   int64     `json:"vertices"`  // POSITION vertices, counting every mesh instance
+	Meshes     int       `json:"meshes"`
+	Materials  int       `json:"materials"`
+	Textures   int       `json:"textures"`
+	Animations int       `json:"animations"`
+	BoundsMin  []float64 `json:"bounds_min,omitempty"` // world-space bounding box of the default scene
+	BoundsMax  []float64 `json:"bounds_max,omitempty"`
+	Extensions []string  `json:"extensions"` // extensionsUsed, e.g. KHR_draco_mesh_compression
+	Generator  string    `json:"generator"`
+}
+
+// readModelMetadata parses the .glb or .gltf at filePath and summarizes it.
+// Only the glTF JSON is needed, so external buffers are not opened.
+func readModelMetadata(filePath string) (*ModelMetadata, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	asset, errs := openGLTF(f, info.Size(), strings.ToLower(filepath.Ext(filePath)), nil)
+	if asset == nil {
+		return nil, fmt.Errorf("%s: %s", filePath, errs[0].Message)
+	}
+	return modelMetadata(asset.Doc), nil
+}
+
+// modelMetadata computes the summary of doc
+func modelMetadata(doc *GLTF) *ModelMetadata {
+	md := &ModelMetadata{
+		Meshes:     len(doc.Meshes),
+		Materials:  len(doc.Materials),
+		Textures:   len(doc.Textures),
+		Animations: len(doc.Animations),
+		Extensions: append([]string{}, doc.ExtensionsUsed...),
+		Generator:  doc.Asset.Generator,
+	}
+	sort.Strings(md.Extensions)
+
+	b := newBounds()
+	forEachMeshInstance(doc, func(mesh int, world [16]float64) {
+		md.addMesh(doc, mesh, world, b)
+	})
+	if b.valid() {
+		md.BoundsMin = b.min[:]
+		md.BoundsMax = b.max[:]
+	}
+	return md
+}
+
+// forEachMeshInstance calls fn for every node of the default scene that
+// instances a mesh, with the world transform of the node. A file without
+// scenes shows each mesh once, untransformed.
+func forEachMeshInstance(doc *GLTF, fn func(mesh int, world [16]float64)) {
+	if len(doc.Scenes) == 0 {
+		for i := range doc.Meshes {
+			fn(i, identityMatrix())
+		}
+		return
+	}
+	scene := 0
+	if doc.Scene != nil && *doc.Scene >= 0 && *doc.Scene < len(doc.Scenes) {
+		scene = *doc.Scene
+	}
+	visited := make([]bool, len(doc.Nodes))
+	var walk func(n int, parent [16]float64)
+	walk = func(n int, parent [16]float64) {
+		if n < 0 || n >= len(doc.Nodes) || visited[n] {
+			return
+		}
+		visited[n] = true
+		node := doc.Nodes[n]
+		world := mulMatrix(parent, nodeMatrix(node))
+		if node.Mesh != nil && *node.Mesh >= 0 && *node.Mesh < len(doc.Meshes) {
+			fn(*node.Mesh, world)
+		}
+		for _, c := range node.Children {
+			walk(c, world)
+		}
+	}
+	for _, n := range doc.Scenes[scene].Nodes {
+		walk(n, identityMatrix())
+	}
+}
+
+// addMesh counts one instance of mesh i placed with world
+func (md *ModelMetadata) addMesh(doc *GLTF, i int, world [16]float64, b *bounds) {
+	if i < 0 || i >= len(doc.Meshes) {
+		return
+	}
+	for _, p := range doc.Meshes[i].Primitives {
+		pos, ok := p.Attributes["POSITION"]
+		if !ok || pos < 0 || pos >= len(doc.Accessors) {
+			continue
+		}
+		acc := doc.Accessors[pos]
+		md.Vertices += int64(acc.Count)
+		if len(acc.Min) == 3 && len(acc.Max) == 3 {
+			b.addBox(acc.Min, acc.Max, world)
+		}
+
+		n := int64(acc.Count)
+		if p.Indices != nil && *p.Indices >= 0 && *p.Indices < len(doc.Accessors) {
+			n = int64(doc.Accessors[*p.Indices].Count)
+		}
+		mode := 4
+		if p.Mode != nil {
+			mode = *p.Mode
+		}
+		switch {
+		case mode == 4:
+			md.Triangles += n / 3
+		case (mode == 5 || mode == 6) && n > 2:
+			md.Triangles += n - 2
+		}
+	}
+}
+
+// bounds is an axis-aligned box that grows to contain what is added
+type bounds struct {
+	min, max [3]float64
+}
+
+func newBounds() *bounds {
+	inf := math.Inf(1)
+	return &bounds{min: [3]float64{inf, inf, inf}, max: [3]float64{-inf, -inf, -inf}}
+}
+
+func (b *bounds) valid() bool { return b.min[0] <= b.max[0] }
+
+// addBox adds the local box min-max transformed by m; all eight corners
+// are transformed so rotated boxes stay covered
+func (b *bounds) addBox(min, max []float64, m [16]float64) {
+	for c := 0; c < 8; c++ {
+		p := [3]float64{min[0], min[1], min[2]}
+		for axis := 0; axis < 3; axis++ {
+			if c&(1<<axis) != 0 {
+				p[axis] = max[axis]
+			}
+		}
+		for axis := 0; axis < 3; axis++ {
+			// column-major, as in glTF
+			v := m[axis]*p[0] + m[4+axis]*p[1] + m[8+axis]*p[2] + m[12+axis]
+			b.min[axis] = math.Min(b.min[axis], v)
+			b.max[axis] = math.Max(b.max[axis], v)
+		}
+	}
+}
+
+func identityMatrix() [16]float64 {
+	return [16]float64{1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 0, 1}
+}
+
+// mulMatrix returns a*b for column-major 4x4 matrices
+func mulMatrix(a, b [16]float64) [16]float64 {
+	var out [16]float64
+	for col := 0; col < 4; col++ {
+		for row := 0; row < 4; row++ {
+			var sum float64
+			for k := 0; k < 4; k++ {
+				sum += a[k*4+row] * b[col*4+k]
+			}
+			out[col*4+row] = sum
+		}
+	}
+	return out
+}
+
+// nodeMatrix returns the local transform of a node, from matrix or TRS
+func nodeMatrix(n GLTFNode) [16]float64 {
+	if len(n.Matrix) == 16 {
+		var m [16]float64
+		copy(m[:], n.Matrix)
+		return m
+	}
+	t := [3]float64{0, 0, 0}
+	r := [4]float64{0, 0, 0, 1}
+	s := [3]float64{1, 1, 1}
+	if len(n.Translation) == 3 {
+		copy(t[:], n.Translation)
+	}
+	if len(n.Rotation) == 4 {
+		copy(r[:], n.Rotation)
+	}
+	if len(n.Scale) == 3 {
+		copy(s[:], n.Scale)
+	}
+	x, y, z, w := r[0], r[1], r[2], r[3]
+	return [16]float64{
+		(1 - 2*(y*y+z*z)) * s[0], (2 * (x*y + z*w)) * s[0], (2 * (x*z - y*w)) * s[0], 0,
+		(2 * (x*y - z*w)) * s[1], (1 - 2*(x*x+z*z)) * s[1], (2 * (y*z + x*w)) * s[1], 0,
+		(2 * (x*z + y*w)) * s[2], (2 * (y*z - x*w)) * s[2], (1 - 2*(x*x+y*y)) * s[2], 0,
+		t[0], t[1], t[2], 1,
+	}
+}
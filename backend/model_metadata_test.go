@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestModelMetadata(t *testing.T) {
+	doc, _ := testDoc(testCube(), testCube())
+	doc.Asset.Generator = "Blender"
+	doc.ExtensionsUsed = []string{"KHR_texture_transform", "KHR_draco_mesh_compression"}
+	// mesh 1 also draws its vertices as a strip and as points
+	strip, points := 5, 0
+	doc.Meshes[1].Primitives = append(doc.Meshes[1].Primitives,
+		GLTFPrimitive{Attributes: map[string]int{"POSITION": 0}, Mode: &strip},
+		GLTFPrimitive{Attributes: map[string]int{"POSITION": 0}, Mode: &points})
+	// node 1 moves mesh 1 and holds a scaled instance of mesh 0
+	zero := 0
+	doc.Nodes[1].Translation = []float64{10, 0, 0}
+	doc.Nodes[1].Children = []int{2}
+	doc.Nodes = append(doc.Nodes, GLTFNode{Mesh: &zero, Scale: []float64{2, 2, 2}})
+
+	md := modelMetadata(doc)
+	want := &ModelMetadata{
+		Triangles:  12 + 12 + 6 + 12,
+		Vertices:   8 + 8 + 8 + 8 + 8,
+		Meshes:     2,
+		Extensions: []string{"KHR_draco_mesh_compression", "KHR_texture_transform"},
+		Generator:  "Blender",
+		BoundsMin:  []float64{-1, -2, -2},
+		BoundsMax:  []float64{12, 2, 2},
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Fatalf("metadata\n got %+v\nwant %+v", md, want)
+	}
+
+	// without scenes every mesh counts once, where it is
+	doc.Scenes = nil
+	md = modelMetadata(doc)
+	if md.Triangles != 12+18 || md.BoundsMax[0] != 1 {
+		t.Fatalf("metadata without scenes %+v", md)
+	}
+}
+
+func TestReadModelMetadataNeedsOnlyJSON(t *testing.T) {
+	gltf, _, _ := texturedGLTF(t, "missing.bin", "missing.png")
+	p := writeTestFile(t, t.TempDir(), "cube.gltf", gltf)
+	md, err := readModelMetadata(p)
+	if err != nil || md.Triangles != 12 || md.Materials != 1 || md.Textures != 1 {
+		t.Fatalf("metadata %+v: %v", md, err)
+	}
+	if _, err := readModelMetadata(writeTestFile(t, t.TempDir(), "x.glb", []byte("nope"))); err == nil {
+		t.Fatal("metadata of a broken file")
+	}
+}
+
+func TestUploadRecordsMetadata(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	ts.uploadModel(token, "cube.glb", testGLB(t, testCube()), nil)
+
+	models := ts.listModels(token)
+	if len(models) != 1 || models[0].Metadata != nil || models[0].ProcessingStatus != ProcessingPending {
+		t.Fatalf("before processing %+v", models)
+	}
+	ts.runJobs()
+	models = ts.listModels(token)
+	md := models[0].Metadata
+	if md == nil || md.Triangles != 12 || md.Vertices != 8 || md.Extensions == nil || models[0].ProcessingStatus != ProcessingReady {
+		t.Fatalf("after processing %+v %+v", models[0], md)
+	}
+}
@@ -0,0 +1,945 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// glTF buffer view targets
+const (
+	gltfArrayBuffer        = 34962 // vertex attributes
+	gltfElementArrayBuffer = 34963 // indices
+)
+
+// optimizedSuffix replaces the extension of a model file in the name of its
+// optimized variant
+const optimizedSuffix = ".optimized.glb"
+
+// optimizedName returns the file name of the optimized variant of a model
+// stored as fileName, next to it. The same holds for the file URL.
+func optimizedName(fileName string) string {
+	return fileName[:len(fileName)-len(path.Ext(fileName))] + optimizedSuffix
+}
+
+// errNotOptimizable is wrapped by optimizeModelFile for models it leaves as
+// they are
+var errNotOptimizable = errors.New("model is left unoptimized")
+
+// optimizableExtension reports whether the optimizer can carry an extension
+// through: it must not refer to the accessors, buffer views or materials
+// the optimizer renumbers. Files that are already compressed are left alone.
+func optimizableExtension(name string) bool {
+	switch name {
+	case "KHR_mesh_quantization", "KHR_texture_transform", "KHR_lights_punctual",
+		"KHR_texture_basisu", "EXT_texture_webp":
+		return true
+	}
+	return strings.HasPrefix(name, "KHR_materials_") && name != "KHR_materials_variants"
+}
+
+// optimizeStats tells what the optimizer changed
+type optimizeStats struct {
+	QuantizedMeshes    int   // positions stored as 16-bit integers
+	QuantizedAccessors int   // normals, tangents, UVs, colors and indices made smaller
+	DedupedAccessors   int   // identical accessors merged
+	DedupedMaterials   int   // identical materials merged
+	DroppedAccessors   int   // accessors nothing referred to
+	CompressedViews    int   // vertex and index buffer views stored with EXT_meshopt_compression
+	EmbeddedImages     int   // external images moved into the GLB
+	ResizedImages      int   // images scaled down to the maximum texture size
+	JPEGImages         int   // opaque PNGs re-encoded as JPEG
+	SourceSize         int64 // the model and every file it references
+}
+
+// accessor encodings chosen by the optimizer
+const (
+	encCopy     = iota
+	encPosition // UNSIGNED_SHORT on a per-mesh grid, undone by a node transform
+	encNormal   // BYTE normalized
+	encTangent  // BYTE normalized
+	encUnorm16  // UNSIGNED_SHORT normalized, for values in [0,1]
+	encIndex16  // UNSIGNED_SHORT indices
+)
+
+// meshGrid maps the positions of a mesh onto 16-bit integers: p = min + q*scale
+type meshGrid struct {
+	min   [3]float64
+	scale float64
+}
+
+// optimizer rewrites a glTF asset into a compact GLB. Accessors are
+// re-encoded with smaller component types where that loses no visible
+// precision (KHR_mesh_quantization), identical data is stored once and
+// everything, images included, ends up in the single BIN chunk. Vertex and
+// index data is then compressed (EXT_meshopt_compression). Images are
+// scaled down and re-encoded as tex asks.
+type optimizer struct {
+	asset *gltfAsset
+	src   *GLTF // the parsed input, read only
+	doc   GLTF  // the output document
+	tex   textureOptions
+
+	enc   map[int]int // accessor -> encoding
+	grids map[int]meshGrid
+
+	bin       []byte
+	views     []GLTFBufferView
+	viewIDs   map[string]int
+	accessors []GLTFAccessor
+	accIDs    map[string]int
+	accMap    map[int]int    // input accessor -> output accessor
+	role      map[int]string // what each input accessor holds
+	vertex    map[int]bool   // input accessors used as vertex attributes
+
+	stats optimizeStats
+}
+
+// optimizeModelFile reads the .glb or .gltf at filePath, with the files its
+// URIs refer to, and returns an optimized self-contained GLB
+func optimizeModelFile(filePath string, tex textureOptions) ([]byte, *optimizeStats, error) {
+	asset, files, err := openOptimizable(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer files.Close()
+	out, stats, err := optimizeAsset(asset, files.resolve, tex)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi, err := os.Stat(filePath); err == nil {
+		stats.SourceSize = fi.Size()
+	}
+	for _, src := range files.used {
+		if fi, err := os.Stat(src); err == nil {
+			stats.SourceSize += fi.Size()
+		}
+	}
+	return out, stats, nil
+}
+
+// openOptimizable opens the model at filePath with every buffer it refers
+// to; the files stay open until the returned modelFiles is closed
+func openOptimizable(filePath string) (*gltfAsset, *modelFiles, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	files := newModelFiles(filepath.Dir(filePath), false)
+	files.files = append(files.files, f)
+	asset, errs := openGLTF(f, info.Size(), strings.ToLower(filepath.Ext(filePath)), files.resolve)
+	if asset == nil {
+		files.Close()
+		return nil, nil, fmt.Errorf("%w: %s", errPermanent, errs[0].Message)
+	}
+	for _, ext := range asset.Doc.ExtensionsUsed {
+		if !optimizableExtension(ext) {
+			files.Close()
+			return nil, nil, fmt.Errorf("%w: it uses %s", errNotOptimizable, ext)
+		}
+	}
+	for i := range asset.Data {
+		if asset.Data[i] == nil {
+			files.Close()
+			return nil, nil, fmt.Errorf("buffer %d is not available", i)
+		}
+	}
+	return asset, files, nil
+}
+
+// optimizeAsset returns asset as an optimized, validated GLB
+func optimizeAsset(asset *gltfAsset, resolve gltfResolver, tex textureOptions) ([]byte, *optimizeStats, error) {
+	o := &optimizer{
+		asset:   asset,
+		src:     asset.Doc,
+		doc:     *asset.Doc,
+		tex:     tex,
+		enc:     make(map[int]int),
+		grids:   make(map[int]meshGrid),
+		viewIDs: make(map[string]int),
+		accIDs:  make(map[string]int),
+		accMap:  make(map[int]int),
+		role:    make(map[int]string),
+		vertex:  make(map[int]bool),
+	}
+	if err := o.run(resolve); err != nil {
+		return nil, nil, err
+	}
+	out, err := o.glb()
+	if err != nil {
+		return nil, nil, err
+	}
+	// never publish a variant that viewers may choke on
+	if errs := validateGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil); len(errs) > 0 {
+		return nil, nil, fmt.Errorf("%w: optimized model is invalid: %s %s", errPermanent, errs[0].Pointer, errs[0].Message)
+	}
+	return out, &o.stats, nil
+}
+
+func (o *optimizer) run(resolve gltfResolver) error {
+	o.planEncodings()
+
+	// meshes are copied so the input stays intact
+	o.doc.Meshes = make([]GLTFMesh, len(o.src.Meshes))
+	matMap := o.dedupMaterials()
+	for mi, mesh := range o.src.Meshes {
+		out := mesh
+		out.Primitives = make([]GLTFPrimitive, len(mesh.Primitives))
+		for pi, p := range mesh.Primitives {
+			np := p
+			np.Attributes = make(map[string]int, len(p.Attributes))
+			// sorted, so the same input always gives the same file
+			for _, name := range sortedKeys(p.Attributes) {
+				n, err := o.accessor(p.Attributes[name])
+				if err != nil {
+					return err
+				}
+				np.Attributes[name] = n
+			}
+			if p.Indices != nil {
+				n, err := o.accessor(*p.Indices)
+				if err != nil {
+					return err
+				}
+				np.Indices = &n
+			}
+			np.Targets = nil
+			for _, t := range p.Targets {
+				nt := make(map[string]int, len(t))
+				for _, name := range sortedKeys(t) {
+					n, err := o.accessor(t[name])
+					if err != nil {
+						return err
+					}
+					nt[name] = n
+				}
+				np.Targets = append(np.Targets, nt)
+			}
+			if p.Material != nil && *p.Material >= 0 && *p.Material < len(matMap) {
+				m := matMap[*p.Material]
+				np.Material = &m
+			}
+			out.Primitives[pi] = np
+		}
+		o.doc.Meshes[mi] = out
+	}
+
+	o.doc.Skins = append([]GLTFSkin(nil), o.src.Skins...)
+	for i, sk := range o.doc.Skins {
+		if sk.InverseBindMatrices != nil {
+			n, err := o.accessor(*sk.InverseBindMatrices)
+			if err != nil {
+				return err
+			}
+			o.doc.Skins[i].InverseBindMatrices = &n
+		}
+	}
+	o.doc.Animations = make([]GLTFAnimation, len(o.src.Animations))
+	for i, an := range o.src.Animations {
+		o.doc.Animations[i] = an
+		o.doc.Animations[i].Samplers = append([]GLTFAnimationSampler(nil), an.Samplers...)
+		for si, s := range an.Samplers {
+			in, err := o.accessor(s.Input)
+			if err != nil {
+				return err
+			}
+			out, err := o.accessor(s.Output)
+			if err != nil {
+				return err
+			}
+			o.doc.Animations[i].Samplers[si].Input, o.doc.Animations[i].Samplers[si].Output = in, out
+		}
+	}
+
+	if err := o.embedImages(resolve); err != nil {
+		return err
+	}
+	o.placeQuantizedMeshes()
+
+	o.stats.DroppedAccessors = len(o.src.Accessors) - len(o.accMap)
+	o.doc.Accessors = o.accessors
+	fallback := o.compressViews()
+	o.doc.BufferViews = o.views
+	o.doc.Buffers = nil
+	if len(o.bin) > 0 {
+		o.doc.Buffers = []GLTFBuffer{{ByteLength: len(o.bin)}}
+	}
+	if fallback > 0 {
+		o.doc.Buffers = append(o.doc.Buffers, GLTFBuffer{
+			ByteLength: fallback,
+			Extensions: map[string]json.RawMessage{meshoptExtension: json.RawMessage(`{"fallback":true}`)},
+		})
+		o.requireExtension(meshoptExtension)
+	}
+	return nil
+}
+
+// planEncodings decides how each accessor is stored. An accessor is only
+// re-encoded when every use of it agrees on what it holds.
+func (o *optimizer) planEncodings() {
+	conflict := "mixed"
+	use := func(a int, role string) {
+		if a < 0 || a >= len(o.src.Accessors) {
+			return
+		}
+		if r, ok := o.role[a]; ok && r != role {
+			role = conflict
+		}
+		o.role[a] = role
+	}
+	posMeshes := make(map[int]map[int]bool) // POSITION accessor -> meshes
+	for mi, mesh := range o.src.Meshes {
+		for _, p := range mesh.Primitives {
+			for name, a := range p.Attributes {
+				role := name
+				if i := strings.IndexByte(name, '_'); i > 0 && (strings.HasPrefix(name, "TEXCOORD_") || strings.HasPrefix(name, "COLOR_")) {
+					role = name[:i]
+				}
+				use(a, role)
+				o.vertex[a] = true
+				if name == "POSITION" {
+					if posMeshes[a] == nil {
+						posMeshes[a] = make(map[int]bool)
+					}
+					posMeshes[a][mi] = true
+				}
+			}
+			if p.Indices != nil {
+				use(*p.Indices, "indices")
+			}
+			for _, t := range p.Targets {
+				for _, a := range t {
+					use(a, "target")
+					o.vertex[a] = true
+				}
+			}
+		}
+	}
+	for _, sk := range o.src.Skins {
+		if sk.InverseBindMatrices != nil {
+			use(*sk.InverseBindMatrices, "other")
+		}
+	}
+	for _, an := range o.src.Animations {
+		for _, s := range an.Samplers {
+			use(s.Input, "other")
+			use(s.Output, "other")
+		}
+	}
+
+	for a, role := range o.role {
+		acc := o.src.Accessors[a]
+		plain := acc.BufferView != nil && acc.Sparse == nil
+		float := plain && acc.ComponentType == gltfFloat
+		switch {
+		case role == "NORMAL" && float && acc.Type == "VEC3":
+			o.enc[a] = encNormal
+		case role == "TANGENT" && float && acc.Type == "VEC4":
+			o.enc[a] = encTangent
+		case (role == "TEXCOORD" && acc.Type == "VEC2" || role == "COLOR" && (acc.Type == "VEC3" || acc.Type == "VEC4")) && float:
+			if o.unitRange(a) {
+				o.enc[a] = encUnorm16
+			}
+		case role == "indices" && plain && acc.ComponentType == gltfUnsignedInt:
+			if idx, err := o.asset.readIndices(a); err == nil && maxIndex(idx) < 65535 {
+				o.enc[a] = encIndex16
+			}
+		}
+	}
+
+	// positions need a transform on the nodes of their mesh; skinned and
+	// morphed meshes, and positions shared between meshes, keep floats
+	skinned := make(map[int]bool)
+	used := make(map[int]bool)
+	for _, n := range o.src.Nodes {
+		if n.Mesh != nil {
+			used[*n.Mesh] = true
+			if n.Skin != nil {
+				skinned[*n.Mesh] = true
+			}
+		}
+	}
+meshes:
+	for mi, mesh := range o.src.Meshes {
+		if !used[mi] || skinned[mi] || len(mesh.Primitives) == 0 {
+			continue
+		}
+		b := newBounds()
+		var accs []int
+		for _, p := range mesh.Primitives {
+			a, ok := p.Attributes["POSITION"]
+			if !ok || len(p.Targets) > 0 || o.role[a] != "POSITION" || len(posMeshes[a]) != 1 {
+				continue meshes
+			}
+			acc := o.src.Accessors[a]
+			if acc.BufferView == nil || acc.Sparse != nil || acc.ComponentType != gltfFloat || len(acc.Min) != 3 || len(acc.Max) != 3 {
+				continue meshes
+			}
+			b.addBox(acc.Min, acc.Max, identityMatrix())
+			accs = append(accs, a)
+		}
+		extent := math.Max(b.max[0]-b.min[0], math.Max(b.max[1]-b.min[1], b.max[2]-b.min[2]))
+		if !b.valid() || extent <= 0 || math.IsInf(extent, 0) || math.IsNaN(extent) {
+			continue
+		}
+		// one uniform scale keeps normals valid under the node transform
+		o.grids[mi] = meshGrid{min: b.min, scale: extent / 65535}
+		for _, a := range accs {
+			o.enc[a] = encPosition
+		}
+		o.stats.QuantizedMeshes++
+	}
+}
+
+// unitRange reports whether every component of float accessor a is in [0,1]
+func (o *optimizer) unitRange(a int) bool {
+	v, err := o.asset.readFloats(a)
+	if err != nil {
+		return false
+	}
+	for _, x := range v {
+		if !(x >= 0 && x <= 1) {
+			return false
+		}
+	}
+	return true
+}
+
+func maxIndex(idx []uint32) uint32 {
+	var m uint32
+	for _, v := range idx {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
+
+// gridOf returns the grid of the mesh using POSITION accessor a
+func (o *optimizer) gridOf(a int) meshGrid {
+	for mi, mesh := range o.src.Meshes {
+		if g, ok := o.grids[mi]; ok {
+			for _, p := range mesh.Primitives {
+				if p.Attributes["POSITION"] == a {
+					return g
+				}
+			}
+		}
+	}
+	return meshGrid{scale: 1}
+}
+
+// accessor writes input accessor a to the output, once, and returns its
+// output index
+func (o *optimizer) accessor(a int) (int, error) {
+	if n, ok := o.accMap[a]; ok {
+		return n, nil
+	}
+	if a < 0 || a >= len(o.src.Accessors) {
+		return 0, fmt.Errorf("%w: accessor %d does not exist", errPermanent, a)
+	}
+	acc := o.src.Accessors[a]
+	target := 0
+	switch {
+	case o.role[a] == "indices":
+		target = gltfElementArrayBuffer
+	case o.vertex[a]:
+		target = gltfArrayBuffer
+	}
+
+	out := acc
+	out.ByteOffset = 0
+	var data []byte
+	var err error
+	switch o.enc[a] {
+	case encPosition:
+		data, err = o.quantizePositions(a, &out)
+	case encNormal, encTangent:
+		data, err = o.quantizeSigned(a, &out)
+	case encUnorm16:
+		data, err = o.quantizeUnorm16(a, &out)
+	case encIndex16:
+		data, err = o.narrowIndices(a, &out)
+	default:
+		data, err = o.copyAccessor(a, &out, target)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("accessor %d: %w", a, err)
+	}
+	if o.enc[a] != encCopy {
+		o.stats.QuantizedAccessors++
+	}
+	if data != nil {
+		size := elementSize(out.ComponentType, out.Type)
+		stride := 0
+		if target == gltfArrayBuffer {
+			stride = align4(size)
+		}
+		v := o.addView(pack(data, size, stride, out.Count), stride, target)
+		out.BufferView = &v
+	}
+
+	// identical accessors are stored once; names do not count
+	keyAcc := out
+	keyAcc.Name = ""
+	key, err := json.Marshal(keyAcc)
+	if err != nil {
+		return 0, err
+	}
+	if n, ok := o.accIDs[string(key)]; ok {
+		o.stats.DedupedAccessors++
+		o.accMap[a] = n
+		return n, nil
+	}
+	n := len(o.accessors)
+	o.accessors = append(o.accessors, out)
+	o.accIDs[string(key)] = n
+	o.accMap[a] = n
+	return n, nil
+}
+
+// rawElements returns the elements of a plain accessor packed tightly
+func (a *gltfAsset) rawElements(acc GLTFAccessor) ([]byte, error) {
+	size := elementSize(acc.ComponentType, acc.Type)
+	raw, stride, err := a.accessorBytes(acc, size)
+	if err != nil || stride == size {
+		return raw, err
+	}
+	out := make([]byte, size*acc.Count)
+	for e := 0; e < acc.Count; e++ {
+		copy(out[e*size:(e+1)*size], raw[e*stride:])
+	}
+	return out, nil
+}
+
+// viewBytes returns count elements of elemSize bytes at offset into buffer
+// view v
+func (o *optimizer) viewBytes(v, offset, count, elemSize int) ([]byte, error) {
+	if v < 0 || v >= len(o.src.BufferViews) {
+		return nil, errors.New("buffer view does not exist")
+	}
+	bv := o.src.BufferViews[v]
+	if bv.Buffer < 0 || bv.Buffer >= len(o.asset.Data) || o.asset.Data[bv.Buffer] == nil {
+		return nil, errors.New("buffer bytes are not available")
+	}
+	if !spanFits(bv.ByteOffset, bv.ByteLength, 1, 1, o.asset.dataSize(bv.Buffer)) ||
+		!spanFits(offset, count, elemSize, elemSize, int64(bv.ByteLength)) {
+		return nil, errors.New("data lies outside its buffer")
+	}
+	out := make([]byte, count*elemSize)
+	if len(out) == 0 {
+		return out, nil
+	}
+	if _, err := o.asset.Data[bv.Buffer].ReadAt(out, int64(bv.ByteOffset+offset)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// copyAccessor returns the elements of a as they are; sparse storage is
+// copied into views of its own
+func (o *optimizer) copyAccessor(a int, out *GLTFAccessor, target int) ([]byte, error) {
+	acc := o.src.Accessors[a]
+	if acc.Sparse != nil {
+		sp := *acc.Sparse
+		idx, err := o.viewBytes(sp.Indices.BufferView, sp.Indices.ByteOffset, sp.Count, componentSize(sp.Indices.ComponentType))
+		if err != nil {
+			return nil, err
+		}
+		vals, err := o.viewBytes(sp.Values.BufferView, sp.Values.ByteOffset, sp.Count, elementSize(acc.ComponentType, acc.Type))
+		if err != nil {
+			return nil, err
+		}
+		sp.Indices.BufferView, sp.Indices.ByteOffset = o.addView(idx, 0, 0), 0
+		sp.Values.BufferView, sp.Values.ByteOffset = o.addView(vals, 0, 0), 0
+		out.Sparse = &sp
+	}
+	if acc.BufferView == nil {
+		return nil, nil
+	}
+	return o.asset.rawElements(acc)
+}
+
+func (o *optimizer) quantizePositions(a int, out *GLTFAccessor) ([]byte, error) {
+	v, err := o.asset.readFloats(a)
+	if err != nil {
+		return nil, err
+	}
+	g := o.gridOf(a)
+	data := make([]byte, len(v)*2)
+	lo := []float64{65535, 65535, 65535}
+	hi := []float64{0, 0, 0}
+	for i, x := range v {
+		q := math.Round((x - g.min[i%3]) / g.scale)
+		q = math.Max(0, math.Min(65535, q))
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(q))
+		lo[i%3] = math.Min(lo[i%3], q)
+		hi[i%3] = math.Max(hi[i%3], q)
+	}
+	out.ComponentType, out.Normalized = gltfUnsignedShort, false
+	out.Min, out.Max = lo, hi
+	return data, nil
+}
+
+// quantizeSigned stores unit vectors as normalized bytes
+func (o *optimizer) quantizeSigned(a int, out *GLTFAccessor) ([]byte, error) {
+	v, err := o.asset.readFloats(a)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(v))
+	for i, x := range v {
+		data[i] = byte(int8(math.Round(math.Max(-1, math.Min(1, x)) * 127)))
+	}
+	out.ComponentType, out.Normalized = gltfByte, true
+	out.Min, out.Max = nil, nil
+	return data, nil
+}
+
+func (o *optimizer) quantizeUnorm16(a int, out *GLTFAccessor) ([]byte, error) {
+	v, err := o.asset.readFloats(a)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(v)*2)
+	for i, x := range v {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(math.Round(x*65535)))
+	}
+	out.ComponentType, out.Normalized = gltfUnsignedShort, true
+	out.Min, out.Max = nil, nil
+	return data, nil
+}
+
+func (o *optimizer) narrowIndices(a int, out *GLTFAccessor) ([]byte, error) {
+	idx, err := o.asset.readIndices(a)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(idx)*2)
+	for i, x := range idx {
+		binary.LittleEndian.PutUint16(data[i*2:], uint16(x))
+	}
+	out.ComponentType = gltfUnsignedShort
+	return data, nil
+}
+
+// addView appends data to the BIN chunk as a buffer view and returns its
+// index; identical views are stored once
+func (o *optimizer) addView(data []byte, stride, target int) int {
+	sum := sha256.Sum256(data)
+	key := fmt.Sprintf("%x/%d/%d", sum, stride, target)
+	if v, ok := o.viewIDs[key]; ok {
+		return v
+	}
+	for len(o.bin)%4 != 0 {
+		o.bin = append(o.bin, 0)
+	}
+	v := GLTFBufferView{Buffer: 0, ByteOffset: len(o.bin), ByteLength: len(data), ByteStride: stride, Target: target}
+	o.bin = append(o.bin, data...)
+	o.views = append(o.views, v)
+	o.viewIDs[key] = len(o.views) - 1
+	return len(o.views) - 1
+}
+
+// pack spreads count elements of size bytes to stride bytes each
+func pack(data []byte, size, stride, count int) []byte {
+	if stride == 0 || stride == size {
+		return data
+	}
+	out := make([]byte, stride*count)
+	for e := 0; e < count; e++ {
+		copy(out[e*stride:], data[e*size:(e+1)*size])
+	}
+	return out
+}
+
+func align4(n int) int { return (n + 3) &^ 3 }
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dedupMaterials merges materials that differ in name only and returns the
+// output index of every input material
+func (o *optimizer) dedupMaterials() []int {
+	matMap := make([]int, len(o.src.Materials))
+	seen := make(map[string]int)
+	o.doc.Materials = nil
+	for i, m := range o.src.Materials {
+		keyMat := m
+		keyMat.Name = ""
+		key, err := json.Marshal(keyMat)
+		if err == nil {
+			if n, ok := seen[string(key)]; ok {
+				matMap[i] = n
+				o.stats.DedupedMaterials++
+				continue
+			}
+			seen[string(key)] = len(o.doc.Materials)
+		}
+		matMap[i] = len(o.doc.Materials)
+		o.doc.Materials = append(o.doc.Materials, m)
+	}
+	return matMap
+}
+
+// embedImages moves every image into the BIN chunk, processing PNGs and
+// JPEGs on the way
+func (o *optimizer) embedImages(resolve gltfResolver) error {
+	mimeTypes := map[string]string{"png": "image/png", "jpeg": "image/jpeg", "webp": "image/webp", "ktx2": "image/ktx2"}
+	o.doc.Images = append([]GLTFImage(nil), o.src.Images...)
+	for i, img := range o.doc.Images {
+		var data []byte
+		var err error
+		switch {
+		case img.BufferView != nil:
+			if *img.BufferView < 0 || *img.BufferView >= len(o.src.BufferViews) {
+				return fmt.Errorf("%w: image %d has no buffer view", errPermanent, i)
+			}
+			data, err = o.viewBytes(*img.BufferView, 0, o.src.BufferViews[*img.BufferView].ByteLength, 1)
+		case strings.HasPrefix(img.URI, "data:"):
+			data, _, err = decodeDataURI(img.URI)
+		default:
+			var r *io.SectionReader
+			if r, err = resolve(img.URI); err == nil {
+				data, err = io.ReadAll(r)
+			}
+			o.stats.EmbeddedImages++
+		}
+		if err != nil {
+			return fmt.Errorf("image %d: %w", i, err)
+		}
+		kind := imageKind(bytes.NewReader(data))
+		if mimeTypes[kind] == "" {
+			return fmt.Errorf("%w: image %d is not PNG, JPEG, WebP or KTX2", errPermanent, i)
+		}
+		out, outKind, resized, err := processTexture(data, kind, o.tex)
+		if err != nil {
+			log.Printf("embedImages: image %d is kept as it is: %v", i, err)
+		}
+		if resized {
+			o.stats.ResizedImages++
+		}
+		if outKind != kind {
+			o.stats.JPEGImages++
+		}
+		v := o.addView(out, 0, 0)
+		o.doc.Images[i].BufferView = &v
+		o.doc.Images[i].URI = ""
+		o.doc.Images[i].MimeType = mimeTypes[outKind]
+	}
+	return nil
+}
+
+// placeQuantizedMeshes moves each quantized mesh onto a new child of the
+// nodes using it, whose transform turns the grid back into positions
+func (o *optimizer) placeQuantizedMeshes() {
+	if len(o.grids) == 0 && !o.usesQuantization() {
+		return
+	}
+	o.doc.Nodes = append([]GLTFNode(nil), o.src.Nodes...)
+	for i := range o.src.Nodes {
+		n := &o.doc.Nodes[i]
+		if n.Mesh == nil {
+			continue
+		}
+		g, ok := o.grids[*n.Mesh]
+		if !ok {
+			continue
+		}
+		child := GLTFNode{
+			Mesh:        n.Mesh,
+			Translation: g.min[:],
+			Scale:       []float64{g.scale, g.scale, g.scale},
+		}
+		n.Mesh = nil
+		n.Children = append(append([]int(nil), n.Children...), len(o.doc.Nodes))
+		o.doc.Nodes = append(o.doc.Nodes, child)
+	}
+	o.requireExtension("KHR_mesh_quantization")
+}
+
+// requireExtension lists name as used and required by the output
+func (o *optimizer) requireExtension(name string) {
+	if !containsString(o.doc.ExtensionsUsed, name) {
+		o.doc.ExtensionsUsed = append(append([]string(nil), o.doc.ExtensionsUsed...), name)
+	}
+	if !containsString(o.doc.ExtensionsRequired, name) {
+		o.doc.ExtensionsRequired = append(append([]string(nil), o.doc.ExtensionsRequired...), name)
+	}
+}
+
+// usesQuantization reports whether any normal or tangent was quantized,
+// which needs KHR_mesh_quantization like quantized positions do
+func (o *optimizer) usesQuantization() bool {
+	for _, e := range o.enc {
+		if e == encNormal || e == encTangent {
+			return true
+		}
+	}
+	return false
+}
+
+// compressViews stores vertex and index buffer views with the meshopt
+// codecs wherever that makes them smaller, and lays out the BIN chunk
+// again without their plain bytes. A compressed view moves to a fallback
+// buffer with no data, as the extension asks; it returns the byte length
+// of that buffer, 0 when nothing was compressed.
+func (o *optimizer) compressViews() int {
+	indexSize := make(map[int]int) // index buffer view -> component size
+	for _, acc := range o.accessors {
+		if acc.BufferView == nil || o.views[*acc.BufferView].Target != gltfElementArrayBuffer {
+			continue
+		}
+		size := componentSize(acc.ComponentType)
+		if s, ok := indexSize[*acc.BufferView]; ok && s != size {
+			size = 0 // bytes shared by indices of two sizes
+		}
+		indexSize[*acc.BufferView] = size
+	}
+
+	bin := make([]byte, 0, len(o.bin))
+	fallback := 0
+	for i := range o.views {
+		v := &o.views[i]
+		data := o.bin[v.ByteOffset : v.ByteOffset+v.ByteLength]
+		m := meshoptView{Buffer: 0}
+		var enc []byte
+		switch size := indexSize[i]; {
+		case v.Target == gltfArrayBuffer && v.ByteStride > 0:
+			m.Mode, m.ByteStride = "ATTRIBUTES", v.ByteStride
+			enc = encodeMeshoptVertices(data, v.ByteStride)
+		case v.Target == gltfElementArrayBuffer && (size == 2 || size == 4):
+			idx := make([]uint32, len(data)/size)
+			for n := range idx {
+				if size == 2 {
+					idx[n] = uint32(binary.LittleEndian.Uint16(data[n*2:]))
+				} else {
+					idx[n] = binary.LittleEndian.Uint32(data[n*4:])
+				}
+			}
+			m.Mode, m.ByteStride = "INDICES", size
+			enc = encodeMeshoptIndices(idx)
+		}
+		for len(bin)%4 != 0 {
+			bin = append(bin, 0)
+		}
+		if enc == nil || len(enc) >= len(data) {
+			v.ByteOffset = len(bin)
+			bin = append(bin, data...)
+			continue
+		}
+		m.ByteOffset, m.ByteLength, m.Count = len(bin), len(enc), len(data)/m.ByteStride
+		ext, _ := json.Marshal(m) // a plain struct always encodes
+		bin = append(bin, enc...)
+		v.Buffer, v.ByteOffset = 1, fallback
+		v.Extensions = map[string]json.RawMessage{meshoptExtension: ext}
+		fallback += align4(len(data))
+		o.stats.CompressedViews++
+	}
+	o.bin = bin
+	return fallback
+}
+
+// glb encodes the output document and BIN chunk as a GLB container
+func (o *optimizer) glb() ([]byte, error) {
+	return encodeGLB(&o.doc, o.bin)
+}
+
+// ============ JOB ============
+
+// optimizeModelJob writes the optimized variant of a model next to it. The
+// variant is only kept when it is smaller than the original.
+func (s *Server) optimizeModelJob(modelID uint) error {
+	m, err := s.store.GetModelByID(modelID)
+	if err != nil {
+		return err
+	}
+	baseDir := modelBaseDir(s.cfg, s.store, m)
+	dst := filepath.Join(baseDir, filepath.FromSlash(optimizedName(m.FileName)))
+	data, stats, err := optimizeModelFile(filepath.Join(baseDir, filepath.FromSlash(m.FileName)), s.textureOptions())
+	if errors.Is(err, errNotOptimizable) {
+		log.Printf("optimizeModelJob: model %d: %v", modelID, err)
+		return s.clearOptimized(modelID, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) >= stats.SourceSize {
+		log.Printf("optimizeModelJob: model %d: optimized size %d is not below %d, keeping the original only", modelID, len(data), stats.SourceSize)
+		return s.clearOptimized(modelID, dst)
+	}
+
+	if err := writeDerivedFile(dst, data); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s?v=%d", optimizedName(m.FileURL), time.Now().Unix())
+	if err := s.store.SetModelOptimized(modelID, url, int64(len(data))); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// deleted while optimizing
+			os.Remove(dst)
+		}
+		return err
+	}
+	log.Printf("optimizeModelJob: model %d: %d -> %d bytes (%+v)", modelID, stats.SourceSize, len(data), *stats)
+	return nil
+}
+
+// clearOptimized drops a variant left by an earlier run
+func (s *Server) clearOptimized(modelID uint, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		log.Printf("clearOptimized: model %d: %v", modelID, err)
+	}
+	return s.store.SetModelOptimized(modelID, "", 0)
+}
+
+// optimizeModelHandler queues the optimization of a model
+func (s *Server) optimizeModelHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	m, err := s.store.GetModelByID(req.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Model not found"})
+		return
+	}
+	if !s.checkModelAccess(c, m) {
+		return
+	}
+	job, err := s.enqueueJob(m.ID, JobOptimize)
+	if err != nil {
+		log.Printf("optimizeModelHandler: queue job: %v", err)
+		c.JSON(500, gin.H{"error": "Error queueing optimization"})
+		return
+	}
+	c.JSON(202, gin.H{"message": "Optimization queued", "data": job})
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testGrid is a flat grid of n×n vertices in the xy plane, facing +z, with
+// normals and UVs and two triangles per cell
+func testGrid(n int) testMesh {
+	m := testMesh{}
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			u, v := float32(x)/float32(n-1), float32(y)/float32(n-1)
+			m.positions = append(m.positions, u*4-2, v*4-2, 0)
+			m.normals = append(m.normals, 0, 0, 1)
+			m.uvs = append(m.uvs, u, v)
+		}
+	}
+	for y := 0; y < n-1; y++ {
+		for x := 0; x < n-1; x++ {
+			i := uint32(y*n + x)
+			m.indices = append(m.indices, i, i+1, i+uint32(n), i+1, i+uint32(n)+1, i+uint32(n))
+		}
+	}
+	return m
+}
+
+// optimizeGLB optimizes the GLB of doc and bin and opens the result
+func optimizeGLB(t *testing.T, doc *GLTF, bin []byte) (*gltfAsset, *optimizeStats, []byte) {
+	t.Helper()
+	glb, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asset, errs := openGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+	if asset == nil {
+		t.Fatalf("open: %+v", errs)
+	}
+	out, stats, err := optimizeAsset(asset, nil, textureOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt, errs := openGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil)
+	if opt == nil {
+		t.Fatalf("open optimized: %+v", errs)
+	}
+	return opt, stats, out
+}
+
+// The streams meshoptimizer's own tests check its encoders against
+func TestMeshoptReferenceStreams(t *testing.T) {
+	var vertices []byte
+	for _, v := range [][7]uint16{{0, 0, 0, 0, 0, 0, 0}, {300, 0, 0, 0, 0, 500, 0}, {0, 300, 0, 0, 0, 0, 500}, {300, 300, 0, 0, 0, 500, 500}} {
+		// three 16-bit positions, two 8-bit normal values, two 16-bit UVs
+		vertices = binary.LittleEndian.AppendUint16(vertices, v[0])
+		vertices = binary.LittleEndian.AppendUint16(vertices, v[1])
+		vertices = binary.LittleEndian.AppendUint16(vertices, v[2])
+		vertices = append(vertices, byte(v[3]), byte(v[4]))
+		vertices = binary.LittleEndian.AppendUint16(vertices, v[5])
+		vertices = binary.LittleEndian.AppendUint16(vertices, v[6])
+	}
+	wantVertices := append([]byte{
+		0xa0, 0x01, 0x3f, 0x00, 0x00, 0x00, 0x58, 0x57, 0x58, 0x01, 0x26, 0x00, 0x00, 0x00, 0x01,
+		0x0c, 0x00, 0x00, 0x00, 0x58, 0x01, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0x3f, 0x00, 0x00, 0x00, 0x17, 0x18, 0x17, 0x01, 0x26, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x00,
+		0x00, 0x00, 0x17, 0x01, 0x08, 0x00, 0x00, 0x00,
+	}, make([]byte, 32)...)
+	if got := encodeMeshoptVertices(vertices, 12); !bytes.Equal(got, wantVertices) {
+		t.Fatalf("vertex stream\n% x\nwant\n% x", got, wantVertices)
+	}
+	decoded := make([]byte, len(vertices))
+	if err := decodeMeshoptVertices(decoded, wantVertices, 12); err != nil || !bytes.Equal(decoded, vertices) {
+		t.Fatalf("decoded vertices % x: %v", decoded, err)
+	}
+
+	indices := []uint32{0, 1, 51, 2, 49, 1000}
+	wantIndices := []byte{0xd1, 0x00, 0x04, 0xcd, 0x01, 0x04, 0x07, 0x98, 0x1f, 0x00, 0x00, 0x00, 0x00}
+	if got := encodeMeshoptIndices(indices); !bytes.Equal(got, wantIndices) {
+		t.Fatalf("index sequence % x", got)
+	}
+	decoded = make([]byte, 4*len(indices))
+	if err := decodeMeshoptIndices(decoded, wantIndices, 4); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range indices {
+		if got := binary.LittleEndian.Uint32(decoded[i*4:]); got != want {
+			t.Fatalf("index %d decoded as %d", i, got)
+		}
+	}
+}
+
+func TestMeshoptRoundTrip(t *testing.T) {
+	seed := uint32(1)
+	random := func() byte {
+		seed = seed*1664525 + 1013904223
+		return byte(seed >> 24)
+	}
+	for _, stride := range []int{4, 8, 12, 64, 256} {
+		for _, count := range []int{1, 15, 17, 300, 1000} {
+			data := make([]byte, stride*count)
+			for i := range data {
+				// smooth columns, noisy columns and constant ones
+				switch i % stride % 3 {
+				case 0:
+					data[i] = byte(i / stride)
+				case 1:
+					data[i] = random()
+				}
+			}
+			enc := encodeMeshoptVertices(data, stride)
+			got := make([]byte, len(data))
+			if err := decodeMeshoptVertices(got, enc, stride); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%d vertices of %d bytes: %v", count, stride, err)
+			}
+		}
+	}
+
+	var indices []uint32
+	for i := uint32(0); i < 2000; i++ {
+		indices = append(indices, i, i+1, i/2, 70000-i, 5)
+	}
+	enc := encodeMeshoptIndices(indices)
+	got := make([]byte, 4*len(indices))
+	if err := decodeMeshoptIndices(got, enc, 4); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range indices {
+		if binary.LittleEndian.Uint32(got[i*4:]) != want {
+			t.Fatalf("index %d", i)
+		}
+	}
+	if encodeMeshoptIndices([]uint32{1 << 30}) != nil {
+		t.Fatal("index past the codec range encoded")
+	}
+}
+
+func TestMeshoptDecodeRejectsBadStreams(t *testing.T) {
+	data := bytes.Repeat([]byte{1, 2, 3, 4, 200, 100, 7, 0}, 40)
+	enc := encodeMeshoptVertices(data, 8)
+	dst := make([]byte, len(data))
+	for name, src := range map[string][]byte{
+		"empty":       nil,
+		"header":      append([]byte{0xa1}, enc[1:]...),
+		"truncated":   append(append([]byte(nil), enc[:20]...), enc[len(enc)-32:]...),
+		"left over":   append(append(append([]byte(nil), enc[:len(enc)-32]...), 0), enc[len(enc)-32:]...),
+		"only a tail": enc[len(enc)-33:],
+	} {
+		if err := decodeMeshoptVertices(dst, src, 8); err == nil {
+			t.Errorf("vertex stream %s decoded", name)
+		}
+	}
+
+	idx := encodeMeshoptIndices([]uint32{0, 1, 2, 2, 1, 3})
+	dst = make([]byte, 12)
+	for name, src := range map[string][]byte{
+		"header":    append([]byte{0xe1}, idx[1:]...),
+		"short":     idx[:len(idx)-5],
+		"left over": append(append(append([]byte(nil), idx[:len(idx)-4]...), 0), idx[len(idx)-4:]...),
+		"varint":    {0xd1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0},
+	} {
+		if err := decodeMeshoptIndices(dst, src, 2); err == nil {
+			t.Errorf("index sequence %s decoded", name)
+		}
+	}
+}
+
+func TestOptimizeAsset(t *testing.T) {
+	grid := testGrid(32)
+	doc, bin := testDoc(grid)
+	opt, stats, out := optimizeGLB(t, doc, bin)
+
+	// positions, normals, UVs and indices are quantized and compressed
+	if stats.QuantizedMeshes != 1 || stats.QuantizedAccessors != 4 || stats.CompressedViews != 4 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if len(out) >= len(bin)/2 {
+		t.Fatalf("optimized to %d bytes from a %d byte buffer", len(out), len(bin))
+	}
+	for _, ext := range []string{"KHR_mesh_quantization", meshoptExtension} {
+		if !containsString(opt.Doc.ExtensionsRequired, ext) || !containsString(opt.Doc.ExtensionsUsed, ext) {
+			t.Fatalf("%s not required: %v %v", ext, opt.Doc.ExtensionsUsed, opt.Doc.ExtensionsRequired)
+		}
+	}
+	if len(opt.Doc.Buffers) != 2 || !isMeshoptFallback(opt.Doc.Buffers[1]) || opt.Doc.Buffers[1].URI != "" {
+		t.Fatalf("buffers %+v", opt.Doc.Buffers)
+	}
+
+	// the decoded data matches the input within the quantization steps
+	prim := opt.Doc.Meshes[0].Primitives[0]
+	pos, err := opt.readFloats(prim.Attributes["POSITION"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := opt.Doc.Nodes[len(opt.Doc.Nodes)-1]
+	if *child.Mesh != 0 || len(child.Scale) != 3 {
+		t.Fatalf("quantized mesh placed on %+v", child)
+	}
+	for i, q := range pos {
+		if got, want := q*child.Scale[i%3]+child.Translation[i%3], float64(grid.positions[i]); math.Abs(got-want) > 4.0/65535 {
+			t.Fatalf("position component %d is %v, want %v", i, got, want)
+		}
+	}
+	normals, err := opt.readFloats(prim.Attributes["NORMAL"])
+	if err != nil || len(normals) != len(grid.normals) || normals[2] != 1 {
+		t.Fatalf("normals %v: %v", normals[:3], err)
+	}
+	uvs, err := opt.readFloats(prim.Attributes["TEXCOORD_0"])
+	if err != nil || math.Abs(uvs[2]-float64(grid.uvs[2])) > 1.0/65535 {
+		t.Fatalf("uvs %v: %v", uvs[:4], err)
+	}
+	idx, err := opt.readIndices(*prim.Indices)
+	if err != nil || !reflect.DeepEqual(idx, grid.indices) {
+		t.Fatalf("indices differ: %v", err)
+	}
+	if opt.Doc.Accessors[*prim.Indices].ComponentType != gltfUnsignedShort {
+		t.Fatal("indices not narrowed to 16 bits")
+	}
+}
+
+func TestOptimizeAssetLeavesSmallViewsPlain(t *testing.T) {
+	// the views of a single triangle are smaller than their streams
+	doc, bin := testDoc(testMesh{positions: []float32{0, 0, 0, 1, 0, 0, 0, 1, 0}, indices: []uint32{0, 1, 2}})
+	opt, stats, _ := optimizeGLB(t, doc, bin)
+	if stats.CompressedViews != 0 || len(opt.Doc.Buffers) != 1 || containsString(opt.Doc.ExtensionsUsed, meshoptExtension) {
+		t.Fatalf("stats %+v, buffers %+v", stats, opt.Doc.Buffers)
+	}
+}
+
+func TestOptimizeAssetDedup(t *testing.T) {
+	doc, bin := testDoc(testGrid(16), testGrid(16))
+	zero, one := 0, 1
+	doc.Materials = []GLTFMaterial{{Name: "a"}, {Name: "b"}}
+	doc.Meshes[0].Primitives[0].Material = &zero
+	doc.Meshes[1].Primitives[0].Material = &one
+	// an accessor nothing refers to
+	doc.Accessors = append(doc.Accessors, doc.Accessors[0])
+
+	opt, stats, _ := optimizeGLB(t, doc, bin)
+	if stats.DedupedAccessors != 4 || stats.DedupedMaterials != 1 || stats.DroppedAccessors != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if len(opt.Doc.Accessors) != 4 || len(opt.Doc.Materials) != 1 {
+		t.Fatalf("%d accessors, %d materials", len(opt.Doc.Accessors), len(opt.Doc.Materials))
+	}
+	a, b := opt.Doc.Meshes[0].Primitives[0], opt.Doc.Meshes[1].Primitives[0]
+	if !reflect.DeepEqual(a.Attributes, b.Attributes) || *a.Indices != *b.Indices || *a.Material != 0 || *b.Material != 0 {
+		t.Fatalf("primitives %+v %+v", a, b)
+	}
+}
+
+func TestValidateMeshopt(t *testing.T) {
+	doc, bin := testDoc(testGrid(32))
+	_, _, out := optimizeGLB(t, doc, bin)
+	if errs := validateGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil); errs != nil {
+		t.Fatalf("optimized GLB: %+v", errs)
+	}
+
+	// changes to the JSON of the optimized GLB
+	rewrite := func(mutate func(doc *GLTF, bin []byte)) []byte {
+		jsonData, binData, errs := parseGLB(bytes.NewReader(out), int64(len(out)))
+		if errs != nil {
+			t.Fatal(errs)
+		}
+		var doc GLTF
+		if err := json.Unmarshal(jsonData, &doc); err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, binData.Size())
+		binData.ReadAt(data, 0)
+		mutate(&doc, data)
+		glb, err := encodeGLB(&doc, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return glb
+	}
+	setExt := func(doc *GLTF, view int, change func(m *meshoptView)) {
+		m, _ := meshoptViewOf(doc.BufferViews[view])
+		change(m)
+		raw, _ := json.Marshal(m)
+		doc.BufferViews[view].Extensions = map[string]json.RawMessage{meshoptExtension: raw}
+	}
+	asset, _ := openGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil)
+	var view int // a compressed vertex view
+	for i, bv := range asset.Doc.BufferViews {
+		if m, _ := meshoptViewOf(bv); m != nil && m.Mode == "ATTRIBUTES" {
+			view = i
+			break
+		}
+	}
+	p := ptr("bufferViews", view, "extensions", meshoptExtension)
+	for _, tc := range []struct {
+		name    string
+		mutate  func(doc *GLTF, bin []byte)
+		pointer string
+	}{
+		{"bad mode", func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.Mode = "ZIP" }) }, p},
+		{"bad stride", func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.ByteStride = 6 }) }, p},
+		{"count", func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.Count++ }) }, p},
+		{"past the buffer", func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.ByteOffset = 1 << 40 }) }, p},
+		{"from the fallback", func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.Buffer = 1 }) }, p},
+		{"not used", func(doc *GLTF, _ []byte) { doc.ExtensionsUsed, doc.ExtensionsRequired = nil, nil }, p},
+		{"corrupt stream", func(doc *GLTF, bin []byte) {
+			m, _ := meshoptViewOf(doc.BufferViews[view])
+			bin[m.ByteOffset] = 0
+		}, "/buffers/1"},
+	} {
+		glb := rewrite(tc.mutate)
+		if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); !hasError(errs, tc.pointer) {
+			t.Errorf("%s: want a problem at %s, got %+v", tc.name, tc.pointer, errs)
+		}
+	}
+
+	// filters and the triangle codec are valid, just not read here
+	glb := rewrite(func(doc *GLTF, _ []byte) { setExt(doc, view, func(m *meshoptView) { m.Filter = "OCTAHEDRAL" }) })
+	if errs := validateGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil); errs != nil {
+		t.Fatalf("filtered view: %+v", errs)
+	}
+	asset, _ = openGLTF(bytes.NewReader(glb), int64(len(glb)), ".glb", nil)
+	if asset.Data[1] != nil {
+		t.Fatal("fallback buffer with a filtered view is readable")
+	}
+}
+
+// A crafted file cannot make the decoder allocate more than its compressed
+// bytes can hold
+func TestMeshoptDecodeLimitsMemory(t *testing.T) {
+	doc, bin := testDoc(testGrid(32))
+	_, _, out := optimizeGLB(t, doc, bin)
+	asset, _ := openGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil)
+	for i := range asset.Doc.BufferViews {
+		if asset.Doc.BufferViews[i].Buffer == 1 {
+			asset.Doc.BufferViews[i].ByteOffset += 1 << 40
+		}
+	}
+	asset.Data[1] = nil
+	asset.attachMeshopt()
+	if _, err := asset.readIndices(*asset.Doc.Meshes[0].Primitives[0].Indices); err == nil || !strings.Contains(err.Error(), "cannot come from") {
+		t.Fatalf("read %v", err)
+	}
+}
+
+func TestOptimizeModelJob(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.OptimizeModels = true })
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "grid.glb", testGLB(t, testGrid(32)), nil)
+	ts.runJobs()
+
+	m, _ := ts.store.GetModelByID(id)
+	gridID := id
+	url, _, _ := strings.Cut(m.OptimizedURL, "?v=")
+	if url != optimizedName(m.FileURL) || m.OptimizedSize <= 0 || m.OptimizedSize >= m.FileSize {
+		t.Fatalf("optimized %q of %d bytes, file %d bytes", m.OptimizedURL, m.OptimizedSize, m.FileSize)
+	}
+	w := ts.do("GET", url, "", nil)
+	expectStatus(t, w, 200)
+	if errs := validateGLTF(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()), ".glb", nil); errs != nil {
+		t.Fatalf("served variant: %+v", errs)
+	}
+
+	// files the optimizer cannot carry through keep no variant
+	draco := cubeWith(t, func(doc *GLTF) { doc.ExtensionsUsed = []string{"KHR_draco_mesh_compression"} })
+	id = ts.uploadModel(admin, "draco.glb", draco, nil)
+	expectStatus(t, ts.do("POST", "/api/models/optimize", admin, gin.H{"id": id}), 202)
+	ts.runJobs()
+	if m, _ := ts.store.GetModelByID(id); m.OptimizedURL != "" || m.ProcessingStatus != ProcessingReady {
+		t.Fatalf("draco model %+v", m)
+	}
+	expectStatus(t, ts.do("POST", "/api/models/optimize", admin, gin.H{"id": id + 100}), 404)
+
+	// the variant goes with the model
+	m, _ = ts.store.GetModelByID(gridID)
+	path := filepath.Join(ts.cfg.UploadDir, optimizedName(m.FileName))
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": gridID}), 200)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("variant left behind: %v", err)
+	}
+}
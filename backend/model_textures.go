@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// textureOptions tells the optimizer how to process the images of a model
+type textureOptions struct {
+	maxSize     int // longest edge in pixels, 0 for any
+	jpeg        bool
+	jpegQuality int
+}
+
+func (s *Server) textureOptions() textureOptions {
+	return textureOptions{
+		maxSize:     s.cfg.TextureMaxSize,
+		jpeg:        s.cfg.TextureFormat == "jpeg",
+		jpegQuality: s.cfg.TextureJPEGQuality,
+	}
+}
+
+// processTexture scales a PNG or JPEG image of the given kind down to
+// opts.maxSize and, with opts.jpeg, re-encodes opaque PNGs as JPEG. Images
+// that need neither, other formats and re-encodings that would come out
+// larger are returned as they are. JPEGs are only re-encoded when scaled,
+// so they lose no more quality than that costs anyway.
+func processTexture(data []byte, kind string, opts textureOptions) ([]byte, string, bool, error) {
+	if kind != "png" && kind != "jpeg" {
+		return data, kind, false, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return data, kind, false, err
+	}
+	longest := max(cfg.Width, cfg.Height)
+	resize := opts.maxSize > 0 && longest > opts.maxSize
+	toJPEG := opts.jpeg && kind == "png"
+	if !resize && !toJPEG {
+		return data, kind, false, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, kind, false, err
+	}
+	if o, ok := img.(interface{ Opaque() bool }); toJPEG && (!ok || !o.Opaque()) {
+		// JPEG has no alpha channel
+		toJPEG = false
+		if !resize {
+			return data, kind, false, nil
+		}
+	}
+	if resize {
+		scale := float64(opts.maxSize) / float64(longest)
+		w := max(1, int(float64(cfg.Width)*scale+0.5))
+		h := max(1, int(float64(cfg.Height)*scale+0.5))
+		img = downscale(img, w, h)
+	}
+
+	var buf bytes.Buffer
+	outKind := kind
+	if toJPEG || kind == "jpeg" {
+		outKind = "jpeg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: opts.jpegQuality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	if err != nil {
+		return data, kind, false, fmt.Errorf("encode %s: %w", outKind, err)
+	}
+	if !resize && buf.Len() >= len(data) {
+		return data, kind, false, nil
+	}
+	return buf.Bytes(), outKind, resize, nil
+}
+
+// downscale shrinks src to w x h by averaging the source pixels under each
+// target pixel. Source rows are converted a band at a time, so a large
+// texture never needs a second full-size copy. Grayscale images stay
+// grayscale, which keeps their PNGs small.
+func downscale(src image.Image, w, h int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	band := image.NewRGBA(image.Rect(0, 0, sw, (sh+h-1)/h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		draw.Draw(band, image.Rect(0, 0, sw, y1-y0), src, image.Pt(b.Min.X, b.Min.Y+y0), draw.Src)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			var sum [4]int
+			for yy := 0; yy < y1-y0; yy++ {
+				row := band.Pix[yy*band.Stride:]
+				for xx := x0; xx < x1; xx++ {
+					p := row[xx*4 : xx*4+4]
+					sum[0] += int(p[0])
+					sum[1] += int(p[1])
+					sum[2] += int(p[2])
+					sum[3] += int(p[3])
+				}
+			}
+			n := (x1 - x0) * (y1 - y0)
+			p := dst.Pix[y*dst.Stride+x*4:]
+			for k := range sum {
+				p[k] = uint8((sum[k] + n/2) / n)
+			}
+		}
+	}
+	switch src.(type) {
+	case *image.Gray, *image.Gray16:
+		gray := image.NewGray(dst.Bounds())
+		draw.Draw(gray, gray.Bounds(), dst, image.Point{}, draw.Src)
+		return gray
+	}
+	return dst
+}
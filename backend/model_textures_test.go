@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// encodeTestImage encodes img as a PNG, or as a JPEG at quality 95
+func encodeTestImage(t *testing.T, img image.Image, kind string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if kind == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// noisyImage is a w×h image of random pixels, which compresses badly
+func noisyImage(w, h int, alpha uint8) *image.NRGBA {
+	r := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), alpha
+	}
+	return img
+}
+
+func imageSize(t *testing.T, data []byte) (string, int, int) {
+	t.Helper()
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return format, cfg.Width, cfg.Height
+}
+
+func TestProcessTextureResizes(t *testing.T) {
+	for _, kind := range []string{"png", "jpeg"} {
+		data := encodeTestImage(t, noisyImage(200, 50, 255), kind)
+		out, outKind, resized, err := processTexture(data, kind, textureOptions{maxSize: 64, jpegQuality: 85})
+		if err != nil || !resized || outKind != kind {
+			t.Fatalf("%s: kind %q, resized %v, %v", kind, outKind, resized, err)
+		}
+		// the longest edge hits the limit, the other keeps the aspect ratio
+		if format, w, h := imageSize(t, out); format != kind || w != 64 || h != 16 {
+			t.Fatalf("%s: resized to %s %dx%d", kind, format, w, h)
+		}
+	}
+
+	// images within the limit, and a limit of 0, keep their bytes
+	data := testPNG(t, 32, color.RGBA{10, 20, 30, 255})
+	for _, maxSize := range []int{0, 32} {
+		if out, _, resized, err := processTexture(data, "png", textureOptions{maxSize: maxSize}); err != nil || resized || !bytes.Equal(out, data) {
+			t.Fatalf("max size %d: changed, resized %v, %v", maxSize, resized, err)
+		}
+	}
+}
+
+func TestProcessTextureJPEG(t *testing.T) {
+	opts := textureOptions{jpeg: true, jpegQuality: 85}
+
+	opaque := encodeTestImage(t, noisyImage(64, 64, 255), "png")
+	out, kind, resized, err := processTexture(opaque, "png", opts)
+	if err != nil || kind != "jpeg" || resized || len(out) >= len(opaque) {
+		t.Fatalf("opaque PNG: kind %q of %d bytes (from %d), resized %v, %v", kind, len(out), len(opaque), resized, err)
+	}
+	if format, _, _ := imageSize(t, out); format != "jpeg" {
+		t.Fatalf("encoded as %s", format)
+	}
+
+	// JPEG has no alpha, so transparent PNGs stay PNG, even when scaled
+	clear := encodeTestImage(t, noisyImage(64, 64, 128), "png")
+	if out, kind, _, err := processTexture(clear, "png", opts); err != nil || kind != "png" || !bytes.Equal(out, clear) {
+		t.Fatalf("transparent PNG became %q: %v", kind, err)
+	}
+	opts.maxSize = 16
+	if out, kind, resized, err := processTexture(clear, "png", opts); err != nil || kind != "png" || !resized {
+		t.Fatalf("transparent PNG scaled to %q, resized %v: %v", kind, resized, err)
+	} else if format, w, _ := imageSize(t, out); format != "png" || w != 16 {
+		t.Fatalf("scaled to %s of width %d", format, w)
+	}
+
+	// a one-colour PNG is smaller than any JPEG of it, so it is kept
+	flat := testPNG(t, 8, color.RGBA{200, 50, 50, 255})
+	if out, kind, _, err := processTexture(flat, "png", textureOptions{jpeg: true, jpegQuality: 100}); err != nil || kind != "png" || !bytes.Equal(out, flat) {
+		t.Fatalf("larger JPEG used as %q: %v", kind, err)
+	}
+	// JPEGs are not re-encoded just to change quality
+	photo := encodeTestImage(t, noisyImage(32, 32, 255), "jpeg")
+	if out, _, _, err := processTexture(photo, "jpeg", textureOptions{jpeg: true, jpegQuality: 10}); err != nil || !bytes.Equal(out, photo) {
+		t.Fatalf("JPEG re-encoded: %v", err)
+	}
+}
+
+func TestProcessTextureKeepsOtherFormats(t *testing.T) {
+	// WebP and KTX2 have no encoder here, so they pass through untouched
+	opts := textureOptions{maxSize: 1, jpeg: true, jpegQuality: 85}
+	for kind, data := range map[string][]byte{
+		"webp": []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		"ktx2": []byte("\xabKTX 20\xbb\r\n\x1a\n"),
+	} {
+		if out, outKind, resized, err := processTexture(data, kind, opts); err != nil || outKind != kind || resized || !bytes.Equal(out, data) {
+			t.Fatalf("%s: kind %q, resized %v, %v", kind, outKind, resized, err)
+		}
+	}
+	// a broken PNG is reported and kept
+	broken := []byte("\x89PNG\r\n\x1a\nbroken")
+	if out, kind, _, err := processTexture(broken, "png", opts); err == nil || kind != "png" || !bytes.Equal(out, broken) {
+		t.Fatalf("broken PNG: kind %q, %v", kind, err)
+	}
+}
+
+func TestDownscale(t *testing.T) {
+	// each 2×2 block of black and white averages to mid gray
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.RGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	dst := downscale(src, 2, 2)
+	if b := dst.Bounds(); b.Dx() != 2 || b.Dy() != 2 {
+		t.Fatalf("size %v", b)
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			if c := color.RGBAModel.Convert(dst.At(x, y)).(color.RGBA); c != (color.RGBA{128, 128, 128, 255}) {
+				t.Fatalf("pixel %d,%d = %v", x, y, c)
+			}
+		}
+	}
+
+	// the bounds of a sub-image are honoured
+	sub := src.SubImage(image.Rect(1, 0, 2, 1))
+	if c := color.RGBAModel.Convert(downscale(sub, 1, 1).At(0, 0)).(color.RGBA); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Fatalf("sub-image pixel %v", c)
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, 6, 3))
+	for i := range gray.Pix {
+		gray.Pix[i] = 90
+	}
+	out, ok := downscale(gray, 2, 1).(*image.Gray)
+	if !ok || out.Pix[0] != 90 || out.Pix[1] != 90 {
+		t.Fatalf("grayscale image scaled to %T", out)
+	}
+}
+
+func TestValidateTextureFormat(t *testing.T) {
+	for format, want := range map[string]string{
+		"original": "",
+		"jpeg":     "",
+		"webp":     "no WEBP encoder",
+		"ktx2":     "no KTX2 encoder",
+		"avif":     `texture_format must be "original" or "jpeg"`,
+	} {
+		cfg := DefaultConfig()
+		cfg.TextureFormat = format
+		err := cfg.Validate()
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("%s: %v", format, err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.TextureMaxSize = -1
+	cfg.TextureJPEGQuality = 0
+	err := cfg.Validate()
+	for _, want := range []string{"texture_max_size", "texture_jpeg_quality"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q missing from %v", want, err)
+		}
+	}
+}
+
+func TestOptimizeProcessesTextures(t *testing.T) {
+	gltf, bin, _ := texturedGLTF(t, "cube.bin", "textures/wall.png")
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "cube.gltf", gltf)
+	writeTestFile(t, dir, "cube.bin", bin)
+	writeTestFile(t, dir, "textures/wall.png", encodeTestImage(t, noisyImage(64, 32, 255), "png"))
+
+	out, stats, err := optimizeModelFile(path, textureOptions{maxSize: 16, jpeg: true, jpegQuality: 85})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.EmbeddedImages != 1 || stats.ResizedImages != 1 || stats.JPEGImages != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	asset, errs := openGLTF(bytes.NewReader(out), int64(len(out)), ".glb", nil)
+	if asset == nil {
+		t.Fatalf("open optimized: %+v", errs)
+	}
+	img := asset.Doc.Images[0]
+	if img.URI != "" || img.BufferView == nil || img.MimeType != "image/jpeg" {
+		t.Fatalf("image %+v", img)
+	}
+	view := asset.Doc.BufferViews[*img.BufferView]
+	data := make([]byte, view.ByteLength)
+	if _, err := asset.Data[view.Buffer].ReadAt(data, int64(view.ByteOffset)); err != nil {
+		t.Fatal(err)
+	}
+	if format, w, h := imageSize(t, data); format != "jpeg" || w != 16 || h != 8 {
+		t.Fatalf("embedded %s %dx%d", format, w, h)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcLoginTTL   = 10 * time.Minute // from redirect to IdP until the callback
+	oidcHandoffTTL = time.Minute      // from callback until the frontend exchanges the code
+	oidcJWKSMinAge = 30 * time.Second // unknown key ids refetch the JWKS at most this often
+)
+
+var (
+	errOIDCNoRole     = errors.New("no role for the user's groups")
+	errOIDCNoEmail    = errors.New("id token has no email")
+	errOIDCEmailTaken = errors.New("email belongs to an account the IdP cannot prove it owns")
+	errOIDCDisabled   = errors.New("account disabled")
+)
+
+// oidcDiscovery is the part of the IdP's openid-configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcPending is a login that was sent to the IdP and awaits its callback
+type oidcPending struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	expires  time.Time
+}
+
+// oidcHandoff lets the frontend pick up the session of a finished login
+type oidcHandoff struct {
+	userID  uint
+	expires time.Time
+}
+
+// oidcProvider talks to one OpenID Connect IdP with the authorization code
+// flow (PKCE, state and nonce). Discovery and keys are fetched lazily so the
+// server starts while the IdP is down. Pending logins are kept in memory,
+// so the callback must reach the instance that started the login.
+type oidcProvider struct {
+	cfg    Config
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+	pending     map[string]*oidcPending // by state
+	handoffs    map[string]*oidcHandoff // by code
+}
+
+// newOIDCProvider returns nil when OIDC login is not configured
+func newOIDCProvider(cfg Config) *oidcProvider {
+	if !cfg.OIDCEnabled() {
+		return nil
+	}
+	return &oidcProvider{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		pending:  make(map[string]*oidcPending),
+		handoffs: make(map[string]*oidcHandoff),
+	}
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover fetches and caches the IdP's openid-configuration
+func (p *oidcProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	issuer := strings.TrimRight(p.cfg.OIDCIssuer, "/")
+	var d oidcDiscovery
+	if err := p.getJSON(issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document lacks an endpoint")
+	}
+	p.discovery = &d
+	return &d, nil
+}
+
+// jwk is one key of a JWKS; only RSA and EC signing keys are understood
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the IdP signing key kid, refetching the JWKS when the IdP has
+// rotated to a key we have not seen. An empty kid matches a lone key.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < oidcJWKSMinAge {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysFetched = time.Now()
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			log.Printf("oidc: skipping key %q: %v", k.Kid, err)
+			continue
+		}
+		p.keys[k.Kid] = pub
+	}
+	if k := p.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a cached key. Callers hold mu.
+func (p *oidcProvider) lookupKey(kid string) crypto.PublicKey {
+	if k, ok := p.keys[kid]; ok {
+		return k
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k
+		}
+	}
+	return nil
+}
+
+// authURL starts a login and returns where to send the browser
+func (p *oidcProvider) authURL() (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	state, err := generateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateRandomToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	for k, v := range p.pending {
+		if now.After(v.expires) {
+			delete(p.pending, k)
+		}
+	}
+	p.pending[state] = &oidcPending{verifier: verifier, nonce: nonce, expires: now.Add(oidcLoginTTL)}
+	p.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.OIDCClientID},
+		"redirect_uri":          {p.cfg.OIDCRedirectURL},
+		"scope":                 {strings.Join(p.cfg.OIDCScopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// takePending removes and returns the unexpired login started with state
+func (p *oidcProvider) takePending(state string) *oidcPending {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pend, ok := p.pending[state]
+	delete(p.pending, state)
+	if !ok || time.Now().After(pend.expires) {
+		return nil
+	}
+	return pend
+}
+
+// exchange trades an authorization code for the ID token
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	d, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.OIDCRedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.OIDCClientID), url.QueryEscape(p.cfg.OIDCClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != 200 || body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, expiry and nonce of
+// an ID token and returns its claims
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (jwt.MapClaims, error) {
+	d, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.OIDCClientID),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if exp, _ := claims.GetExpirationTime(); exp == nil {
+		return nil, errors.New("id token has no expiry")
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// newHandoff stores a finished login under a one-time code
+func (p *oidcProvider) newHandoff(userID uint) (string, error) {
+	code, err := generateRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for k, v := range p.handoffs {
+		if now.After(v.expires) {
+			delete(p.handoffs, k)
+		}
+	}
+	p.handoffs[code] = &oidcHandoff{userID: userID, expires: now.Add(oidcHandoffTTL)}
+	return code, nil
+}
+
+// takeHandoff redeems a one-time code
+func (p *oidcProvider) takeHandoff(code string) (uint, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h, ok := p.handoffs[code]
+	delete(p.handoffs, code)
+	if !ok || time.Now().After(h.expires) {
+		return 0, false
+	}
+	return h.userID, true
+}
+
+// claimStrings reads a claim that is a string list, or a single string
+// separated by commas or spaces
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case []interface{}:
+		var out []string
+		for _, x := range v {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	return nil
+}
+
+// claimBool reads a boolean claim; some IdPs send it as the string "true"
+func claimBool(v interface{}) bool {
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// oidcRole picks the strongest role the groups map to, or the default role
+func (p *oidcProvider) oidcRole(groups []string) string {
+	granted := map[string]bool{}
+	for _, g := range groups {
+		if role, ok := p.cfg.OIDCRoleMap[g]; ok {
+			granted[role] = true
+		}
+	}
+	for _, role := range []string{RoleAdmin, RoleEditor, RoleUser} {
+		if granted[role] {
+			return role
+		}
+	}
+	return p.cfg.OIDCDefaultRole
+}
+
+// oidcUser finds or provisions the user for verified ID token claims. Known
+// logins are matched by issuer and subject; a first login is linked to the
+// account with the same email only if the IdP marks the email verified.
+// With a role map configured the role follows the IdP groups on every login,
+// except that the last enabled admin keeps the admin role.
+func (s *Server) oidcUser(claims jwt.MapClaims) (*User, error) {
+	p := s.oidc
+	issuer, _ := claims.GetIssuer()
+	subject, _ := claims.GetSubject()
+	email, _ := claims["email"].(string)
+	verified := claimBool(claims["email_verified"])
+	role := p.oidcRole(claimStrings(claims[p.cfg.OIDCGroupsClaim]))
+	syncRole := len(p.cfg.OIDCRoleMap) > 0
+
+	user, err := s.store.GetUserByIdentity(issuer, subject)
+	if errors.Is(err, ErrNotFound) {
+		if email == "" {
+			return nil, errOIDCNoEmail
+		}
+		user, err = s.store.GetUserByEmail(email)
+		switch {
+		case err == nil:
+			if !verified {
+				return nil, errOIDCEmailTaken
+			}
+		case errors.Is(err, ErrNotFound):
+			if role == "" {
+				return nil, errOIDCNoRole
+			}
+			// no password: the account can only log in through the IdP
+			// until one is set with a password reset
+			user = &User{Email: email, Role: role}
+			if err := s.store.CreateUser(user); err != nil {
+				return nil, err
+			}
+			log.Printf("oidc: provisioned %s as %s", email, role)
+		default:
+			return nil, err
+		}
+		if err := s.store.LinkUserIdentity(user.ID, issuer, subject); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.DisabledAt != nil {
+		return nil, errOIDCDisabled
+	}
+	if syncRole && role != user.Role {
+		if role == "" {
+			return nil, errOIDCNoRole
+		}
+		if err := s.checkNotLastAdmin(user); err != nil {
+			log.Printf("Warning: oidc: IdP groups make %s %s, keeping %s: %v", user.Email, role, user.Role, err)
+			return user, nil
+		}
+		if user, err = s.store.UpdateUserRole(user.ID, role); err != nil {
+			return nil, err
+		}
+		log.Printf("oidc: role of %s set to %s from IdP groups", user.Email, role)
+	}
+	return user, nil
+}
+
+// oidcRedirect sends the browser back to the frontend login page with the
+// outcome in the query string
+func (s *Server) oidcRedirect(c *gin.Context, key, value string) {
+	target := strings.TrimRight(s.cfg.AppURL, "/") + "/index.html?" + url.Values{key: {value}}.Encode()
+	c.Redirect(302, target)
+}
+
+// ============ OIDC HANDLERS ============
+// oidcConfigHandler tells the login page whether to offer SSO
+func (s *Server) oidcConfigHandler(c *gin.Context) {
+	c.JSON(200, gin.H{"enabled": s.oidc != nil})
+}
+
+func (s *Server) oidcLoginHandler(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(404, ErrorResponse{Error: "SSO login is not configured"})
+		return
+	}
+	target, err := s.oidc.authURL()
+	if err != nil {
+		log.Printf("oidcLoginHandler: %v", err)
+		s.oidcRedirect(c, "oidc_error", "Identity provider unavailable")
+		return
+	}
+	c.Redirect(302, target)
+}
+
+// oidcCallbackHandler finishes the login at the IdP's redirect and hands
+// the frontend a one-time code for the session
+func (s *Server) oidcCallbackHandler(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(404, ErrorResponse{Error: "SSO login is not configured"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		log.Printf("oidcCallbackHandler: IdP error %s: %s", e, c.Query("error_description"))
+		s.oidcRedirect(c, "oidc_error", "Login cancelled or refused by the identity provider")
+		return
+	}
+	pend := s.oidc.takePending(c.Query("state"))
+	if pend == nil {
+		s.oidcRedirect(c, "oidc_error", "Login expired; please try again")
+		return
+	}
+
+	raw, err := s.oidc.exchange(c.Query("code"), pend.verifier)
+	if err != nil {
+		log.Printf("oidcCallbackHandler: exchange: %v", err)
+		s.oidcRedirect(c, "oidc_error", "Identity provider rejected the login")
+		return
+	}
+	claims, err := s.oidc.verifyIDToken(raw, pend.nonce)
+	if err != nil {
+		log.Printf("oidcCallbackHandler: verify id token: %v", err)
+		s.oidcRedirect(c, "oidc_error", "Invalid response from the identity provider")
+		return
+	}
+
+	user, err := s.oidcUser(claims)
+	if err != nil {
+		msg := "Login failed"
+		switch {
+		case errors.Is(err, errOIDCNoRole):
+			msg = "Your account has no access to this application"
+		case errors.Is(err, errOIDCDisabled):
+			msg = "Account disabled"
+		case errors.Is(err, errOIDCNoEmail), errors.Is(err, errOIDCEmailTaken):
+			msg = "Your identity provider account cannot be matched to a user"
+		default:
+			log.Printf("oidcCallbackHandler: provision: %v", err)
+		}
+		s.oidcRedirect(c, "oidc_error", msg)
+		return
+	}
+
+	code, err := s.oidc.newHandoff(user.ID)
+	if err != nil {
+		s.oidcRedirect(c, "oidc_error", "Login failed")
+		return
+	}
+	s.oidcRedirect(c, "oidc_code", code)
+}
+
+// oidcExchangeHandler trades the one-time code from the callback redirect
+// for a session, like loginHandler
+func (s *Server) oidcExchangeHandler(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	if s.oidc == nil {
+		c.JSON(404, ErrorResponse{Error: "SSO login is not configured"})
+		return
+	}
+	userID, ok := s.oidc.takeHandoff(req.Code)
+	if !ok {
+		c.JSON(401, ErrorResponse{Error: "Invalid or expired login code"})
+		return
+	}
+	user, err := s.store.GetUserByID(userID)
+	if err != nil || user.DisabledAt != nil {
+		c.JSON(403, ErrorResponse{Error: "Account disabled"})
+		return
+	}
+
+	resp, err := s.startSession(user)
+	if err != nil {
+		log.Printf("oidcExchangeHandler: start session: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Error generating token"})
+		return
+	}
+	c.JSON(200, resp)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeIdP is an OpenID Connect provider that signs whatever claims the test
+// sets for the next token request
+type fakeIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": {{
+			Kid: "k1", Kty: "RSA", Use: "sig",
+			N: enc(key.N.Bytes()), E: enc(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		claims := jwt.MapClaims{"iss": idp.URL, "aud": "glb", "exp": time.Now().Add(time.Minute).Unix()}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "k1"
+		raw, _ := tok.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": raw})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func newOIDCTestServer(t *testing.T, idp *fakeIdP, roleMap map[string]string) *testServer {
+	return newTestServer(t, func(c *Config) {
+		c.OIDCIssuer = idp.URL
+		c.OIDCClientID = "glb"
+		c.OIDCClientSecret = "secret"
+		c.OIDCRoleMap = roleMap
+		c.AppURL = "http://app.test"
+	})
+}
+
+// oidcLogin runs the browser side of an SSO login with claims and returns
+// the query the frontend is redirected to
+func oidcLogin(ts *testServer, idp *fakeIdP, claims jwt.MapClaims) url.Values {
+	ts.t.Helper()
+	w := ts.do("GET", "/api/auth/oidc/login", "", nil)
+	expectStatus(ts.t, w, 302)
+	auth, _ := url.Parse(w.Header().Get("Location"))
+	q := auth.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("client_id") != "glb" {
+		ts.t.Fatalf("authorization request %s", auth)
+	}
+	idp.claims = jwt.MapClaims{"nonce": q.Get("nonce")}
+	for k, v := range claims {
+		idp.claims[k] = v
+	}
+	w = ts.do("GET", "/api/auth/oidc/callback?code=abc&state="+url.QueryEscape(q.Get("state")), "", nil)
+	expectStatus(ts.t, w, 302)
+	back, _ := url.Parse(w.Header().Get("Location"))
+	return back.Query()
+}
+
+func TestOIDCLoginProvisionsUser(t *testing.T) {
+	idp := newFakeIdP(t)
+	ts := newOIDCTestServer(t, idp, map[string]string{"glb-editors": RoleEditor})
+
+	q := oidcLogin(ts, idp, jwt.MapClaims{"sub": "u1", "email": "sso@test.com", "groups": []string{"glb-editors"}})
+	if q.Get("oidc_code") == "" {
+		t.Fatalf("callback redirected with %v", q)
+	}
+	w := ts.do("POST", "/api/auth/oidc/exchange", "", gin.H{"code": q.Get("oidc_code")})
+	expectStatus(t, w, 200)
+	var resp AuthResponse
+	decodeJSON(t, w, &resp)
+	if resp.User.Email != "sso@test.com" || resp.Role != RoleEditor {
+		t.Fatalf("sso session %+v", resp)
+	}
+	// the code is single use
+	expectStatus(t, ts.do("POST", "/api/auth/oidc/exchange", "", gin.H{"code": q.Get("oidc_code")}), 401)
+
+	// an ID token for another login is refused
+	if q := oidcLogin(ts, idp, jwt.MapClaims{"sub": "u1", "email": "sso@test.com", "nonce": "other"}); q.Get("oidc_error") == "" {
+		t.Fatalf("wrong nonce accepted: %v", q)
+	}
+}
+
+func TestOIDCEmailVerified(t *testing.T) {
+	idp := newFakeIdP(t)
+	ts := newOIDCTestServer(t, idp, nil)
+	ts.addUser("taken@test.com", "secret123", RoleUser)
+
+	if q := oidcLogin(ts, idp, jwt.MapClaims{"sub": "u1", "email": "taken@test.com"}); q.Get("oidc_error") == "" {
+		t.Fatalf("unverified email linked to an existing account: %v", q)
+	}
+	// some IdPs send the flag as a string
+	if q := oidcLogin(ts, idp, jwt.MapClaims{"sub": "u1", "email": "taken@test.com", "email_verified": "true"}); q.Get("oidc_code") == "" {
+		t.Fatalf("string email_verified refused: %v", q)
+	}
+	u, _ := ts.store.GetUserByEmail("taken@test.com")
+	if linked, err := ts.store.GetUserByIdentity(idp.URL, "u1"); err != nil || linked.ID != u.ID {
+		t.Fatalf("identity not linked: %v", err)
+	}
+}
+
+func TestClaimBool(t *testing.T) {
+	for v, want := range map[interface{}]bool{true: true, false: false, "true": true, "TRUE": true, "false": false, "yes": false, 1.0: false} {
+		if got := claimBool(v); got != want {
+			t.Errorf("claimBool(%#v) = %v", v, got)
+		}
+	}
+	if claimBool(nil) {
+		t.Error("claimBool(nil)")
+	}
+}
+
+func TestOIDCRoleSync(t *testing.T) {
+	idp := newFakeIdP(t)
+	ts := newOIDCTestServer(t, idp, map[string]string{"glb-admins": RoleAdmin, "glb-editors": RoleEditor})
+	// claims as they come out of a parsed token
+	claims := func(groups ...interface{}) jwt.MapClaims {
+		return jwt.MapClaims{"iss": idp.URL, "sub": "u1", "email": "sso@test.com", "groups": groups}
+	}
+
+	u, err := ts.oidcUser(claims("glb-admins", "glb-editors"))
+	if err != nil || u.Role != RoleAdmin {
+		t.Fatalf("provisioned %+v: %v", u, err)
+	}
+
+	// the only admin keeps the role when the IdP drops it
+	u, err = ts.oidcUser(claims("glb-editors"))
+	if err != nil || u.Role != RoleAdmin {
+		t.Fatalf("last admin demoted: %+v %v", u, err)
+	}
+	if stored, _ := ts.store.GetUserByID(u.ID); stored.Role != RoleAdmin {
+		t.Fatalf("stored role %q", stored.Role)
+	}
+
+	// with another admin around the demotion goes through
+	ts.addUser("admin2@test.com", "secret123", RoleAdmin)
+	if u, err = ts.oidcUser(claims("glb-editors")); err != nil || u.Role != RoleEditor {
+		t.Fatalf("demotion: %+v %v", u, err)
+	}
+	// unmapped groups fall back to the default role
+	if u, err = ts.oidcUser(claims("strangers")); err != nil || u.Role != RoleUser {
+		t.Fatalf("unmapped groups: %+v %v", u, err)
+	}
+	ts.oidc.cfg.OIDCDefaultRole = ""
+	if _, err := ts.oidcUser(claims("strangers")); !errors.Is(err, errOIDCNoRole) {
+		t.Fatalf("unmapped groups without a default role: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordReset is a single-use token mailed to a user who forgot their
+// password. Only its hash is stored.
+type PasswordReset struct {
+	TokenHash string
+	UserID    uint
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=6"`
+}
+
+// resetLink is the frontend page a reset mail points to
+func (s *Server) resetLink(token string) string {
+	return strings.TrimRight(s.cfg.AppURL, "/") + "/reset.html?token=" + url.QueryEscape(token)
+}
+
+// ============ PASSWORD HANDLERS ============
+// changePasswordHandler sets a new password for the logged in user. Every
+// session, including the caller's, is revoked and a fresh one returned.
+func (s *Server) changePasswordHandler(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request; new_password needs at least 6 characters"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(c.GetUint("user_id"))
+	if err != nil {
+		c.JSON(404, gin.H{"error": "User not found"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		c.JSON(401, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error processing password"})
+		return
+	}
+	if err := s.store.UpdateUserPassword(user.ID, string(hash)); err != nil {
+		log.Printf("changePasswordHandler: update password: %v", err)
+		c.JSON(500, gin.H{"error": "Error updating password"})
+		return
+	}
+	if err := s.store.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("changePasswordHandler: revoke sessions: %v", err)
+	}
+
+	resp, err := s.startSession(user)
+	if err != nil {
+		log.Printf("changePasswordHandler: start session: %v", err)
+		c.JSON(500, gin.H{"error": "Password changed; please log in again"})
+		return
+	}
+	c.JSON(200, resp)
+}
+
+// forgotPasswordHandler mails a reset link. It answers the same whether or
+// not the email is registered so it cannot be used to probe for accounts.
+func (s *Server) forgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	const done = "If the email is registered, a reset link has been sent"
+
+	user, err := s.store.GetUserByEmail(req.Email)
+	if err != nil || user.DisabledAt != nil {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("forgotPasswordHandler: lookup user: %v", err)
+		}
+		c.JSON(200, gin.H{"message": done})
+		return
+	}
+
+	token, err := generateRandomToken(32)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error generating reset token"})
+		return
+	}
+	reset := &PasswordReset{
+		TokenHash: hashToken(token),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(s.cfg.PasswordResetTTL.Duration),
+	}
+	if err := s.store.CreatePasswordReset(reset); err != nil {
+		log.Printf("forgotPasswordHandler: create reset: %v", err)
+		c.JSON(500, gin.H{"error": "Error generating reset token"})
+		return
+	}
+
+	err = s.mailer.Send(Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of %s.\n\n"+
+			"Open this link within %s to choose a new password:\n%s\n\n"+
+			"If it wasn't you, ignore this mail; your password stays the same.\n",
+			user.Email, s.cfg.PasswordResetTTL.Duration, s.resetLink(token)),
+	})
+	if err != nil {
+		log.Printf("forgotPasswordHandler: send mail to %s: %v", user.Email, err)
+	}
+
+	c.JSON(200, gin.H{"message": done})
+}
+
+// resetPasswordHandler sets a new password with a mailed reset token and
+// signs the user out everywhere
+func (s *Server) resetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request; new_password needs at least 6 characters"})
+		return
+	}
+
+	hash := hashToken(req.Token)
+	reset, err := s.store.GetPasswordReset(hash)
+	if err != nil || reset.UsedAt != nil || !time.Now().Before(reset.ExpiresAt) {
+		c.JSON(400, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+	user, err := s.store.GetUserByID(reset.UserID)
+	if err != nil || user.DisabledAt != nil {
+		c.JSON(400, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+	// consuming first makes a concurrent second use of the token fail
+	if err := s.store.ConsumePasswordReset(hash); err != nil {
+		if !errors.Is(err, ErrConflict) {
+			log.Printf("resetPasswordHandler: consume reset: %v", err)
+		}
+		c.JSON(400, gin.H{"error": "Reset link is invalid or has expired"})
+		return
+	}
+
+	pwHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error processing password"})
+		return
+	}
+	if err := s.store.UpdateUserPassword(user.ID, string(pwHash)); err != nil {
+		log.Printf("resetPasswordHandler: update password: %v", err)
+		c.JSON(500, gin.H{"error": "Error updating password"})
+		return
+	}
+	if err := s.store.RevokeUserSessions(user.ID); err != nil {
+		log.Printf("resetPasswordHandler: revoke sessions: %v", err)
+	}
+
+	c.JSON(200, gin.H{"message": "Password has been reset; please log in"})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var resetLinkRe = regexp.MustCompile(`https?://\S+`)
+
+// resetToken asks for a reset of email and returns the token from the mail
+func resetToken(ts *testServer, email string) string {
+	ts.t.Helper()
+	before := len(ts.mail.messages())
+	expectStatus(ts.t, ts.do("POST", "/api/auth/password/forgot", "", gin.H{"email": email}), 200)
+	sent := ts.mail.messages()
+	if len(sent) != before+1 {
+		ts.t.Fatalf("%d mails sent", len(sent)-before)
+	}
+	link, err := url.Parse(resetLinkRe.FindString(sent[len(sent)-1].Body))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestChangePassword(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	old := ts.login("a@test.com", "secret123")
+	other := ts.login("a@test.com", "secret123")
+
+	expectStatus(t, ts.do("POST", "/api/auth/password", old.Token, gin.H{"current_password": "wrong", "new_password": "newsecret"}), 401)
+	expectStatus(t, ts.do("POST", "/api/auth/password", old.Token, gin.H{"current_password": "secret123", "new_password": "123"}), 400)
+	w := ts.do("POST", "/api/auth/password", old.Token, gin.H{"current_password": "secret123", "new_password": "newsecret"})
+	expectStatus(t, w, 200)
+	var fresh AuthResponse
+	decodeJSON(t, w, &fresh)
+
+	// every earlier session ends; the response carries a new one
+	expectStatus(t, ts.do("GET", "/api/user/profile", old.Token, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/user/profile", other.Token, nil), 401)
+	expectStatus(t, ts.do("GET", "/api/user/profile", fresh.Token, nil), 200)
+	ts.login("a@test.com", "newsecret")
+}
+
+func TestResetPassword(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.AppURL = "https://viewer.example.com/" })
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	session := ts.login("a@test.com", "secret123")
+
+	token := resetToken(ts, "a@test.com")
+	if body := ts.mail.messages()[0].Body; !strings.Contains(body, "https://viewer.example.com/reset.html?token=") {
+		t.Fatalf("mail body %q", body)
+	}
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": "bogus", "new_password": "newsecret"}), 400)
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": token, "new_password": "newsecret"}), 200)
+	expectStatus(t, ts.do("GET", "/api/user/profile", session.Token, nil), 401)
+	ts.login("a@test.com", "newsecret")
+
+	// a token works once
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": token, "new_password": "again123"}), 400)
+}
+
+func TestResetPasswordOneTokenAtATime(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	first := resetToken(ts, "a@test.com")
+	second := resetToken(ts, "a@test.com")
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": second, "new_password": "newsecret"}), 200)
+	// using one token voids the other pending ones
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": first, "new_password": "again123"}), 400)
+}
+
+func TestResetPasswordExpires(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.PasswordResetTTL = Duration{time.Nanosecond} })
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	token := resetToken(ts, "a@test.com")
+	time.Sleep(time.Millisecond)
+	expectStatus(t, ts.do("POST", "/api/auth/password/reset", "", gin.H{"token": token, "new_password": "newsecret"}), 400)
+}
+
+func TestForgotPasswordDoesNotRevealAccounts(t *testing.T) {
+	ts := newTestServer(t)
+	u := ts.addUser("off@test.com", "secret123", RoleUser)
+	ts.store.SetUserDisabled(u.ID, true)
+	for _, email := range []string{"nobody@test.com", "off@test.com"} {
+		expectStatus(t, ts.do("POST", "/api/auth/password/forgot", "", gin.H{"email": email}), 200)
+	}
+	if n := len(ts.mail.messages()); n != 0 {
+		t.Fatalf("%d mails sent", n)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir, From: "no-reply@test.com"}
+	if err := m.Send(Mail{To: "a@test.com", Subject: "Hi", Body: "line one\nline two\n"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || !strings.HasSuffix(entries[0].Name(), ".eml") {
+		t.Fatalf("outbox %v", entries)
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	for _, want := range []string{"From: no-reply@test.com\r\n", "To: a@test.com\r\n", "Subject: Hi\r\n", "line one\r\nline two"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("%q missing from the mail", want)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permission names one action a role may perform
+type Permission string
+
+const (
+	PermModelsUpload   Permission = "models:upload"
+	PermModelsDelete   Permission = "models:delete"
+	PermArchivesRead   Permission = "archives:read"   // see archives (editors only their assigned ones)
+	PermArchivesManage Permission = "archives:manage" // create/delete archives, tokens and editor assignments
+	PermUsersManage    Permission = "users:manage"
+)
+
+const (
+	RoleAdmin  = "admin"
+	RoleEditor = "editor"
+	RoleUser   = "user"
+)
+
+// rolePermissions maps every known role to what it may do. A role missing
+// from the map has no permissions.
+var rolePermissions = map[string][]Permission{
+	RoleAdmin: {
+		PermModelsUpload,
+		PermModelsDelete,
+		PermArchivesRead,
+		PermArchivesManage,
+		PermUsersManage,
+	},
+	// editors upload into the archives they are assigned to, nothing else
+	RoleEditor: {
+		PermModelsUpload,
+		PermArchivesRead,
+	},
+	RoleUser: {},
+}
+
+// validRole reports whether role is one of the known roles
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// hasPermission reports whether role grants p
+func hasPermission(role string, p Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionsOf lists what role may do, for clients deciding what to show
+func permissionsOf(role string) []Permission {
+	perms := rolePermissions[role]
+	if perms == nil {
+		return []Permission{}
+	}
+	return perms
+}
+
+// requirePermission rejects requests whose user lacks p. It must run after
+// authMiddleware, which puts the role (and any API key) into the context.
+func (s *Server) requirePermission(p Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !can(c, p) {
+			c.JSON(403, gin.H{"error": "Missing permission: " + string(p)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// can reports whether the authenticated user of c has p. Requests made with
+// an API key are further limited to the key's scopes.
+func can(c *gin.Context, p Permission) bool {
+	if !hasPermission(c.GetString("role"), p) {
+		return false
+	}
+	if v, ok := c.Get("api_key"); ok {
+		return v.(*APIKey).allows(p)
+	}
+	return true
+}
+
+// ============ ARCHIVE EDITOR HANDLERS ============
+type archiveEditorRequest struct {
+	ArchiveID uint `json:"archive_id" binding:"required"`
+	UserID    uint `json:"user_id" binding:"required"`
+}
+
+func (s *Server) listArchiveEditorsHandler(c *gin.Context) {
+	archiveID, err := strconv.ParseUint(c.Query("archive_id"), 10, 64)
+	if err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid archive_id"})
+		return
+	}
+	editors, err := s.store.ListArchiveEditors(uint(archiveID))
+	if err != nil {
+		log.Printf("listArchiveEditorsHandler: list %d: %v", archiveID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to list editors"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Archive editors retrieved", "data": editors})
+}
+
+func (s *Server) assignArchiveEditorHandler(c *gin.Context) {
+	var req archiveEditorRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	user, err := s.store.GetUserByID(req.UserID)
+	if err != nil {
+		c.JSON(404, ErrorResponse{Error: "User not found"})
+		return
+	}
+	if user.Role != RoleEditor {
+		c.JSON(400, ErrorResponse{Error: "Only editors can be assigned to archives"})
+		return
+	}
+
+	if err := s.store.AssignArchiveEditor(req.ArchiveID, req.UserID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(404, ErrorResponse{Error: "Archive not found"})
+			return
+		}
+		log.Printf("assignArchiveEditorHandler: assign %d to %d: %v", req.UserID, req.ArchiveID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to assign editor"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Editor assigned"})
+}
+
+func (s *Server) unassignArchiveEditorHandler(c *gin.Context) {
+	var req archiveEditorRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	if err := s.store.UnassignArchiveEditor(req.ArchiveID, req.UserID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(404, ErrorResponse{Error: "Assignment not found"})
+			return
+		}
+		log.Printf("unassignArchiveEditorHandler: unassign %d from %d: %v", req.UserID, req.ArchiveID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to unassign editor"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Editor unassigned"})
+}
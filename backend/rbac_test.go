@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRolePermissions(t *testing.T) {
+	for _, tc := range []struct {
+		role string
+		p    Permission
+		want bool
+	}{
+		{RoleAdmin, PermUsersManage, true},
+		{RoleAdmin, PermModelsDelete, true},
+		{RoleEditor, PermModelsUpload, true},
+		{RoleEditor, PermArchivesRead, true},
+		{RoleEditor, PermModelsDelete, false},
+		{RoleEditor, PermArchivesManage, false},
+		{RoleUser, PermModelsUpload, false},
+		{"root", PermModelsUpload, false},
+	} {
+		if got := hasPermission(tc.role, tc.p); got != tc.want {
+			t.Errorf("hasPermission(%q, %q) = %v", tc.role, tc.p, got)
+		}
+	}
+	if validRole("root") || !validRole(RoleEditor) {
+		t.Error("validRole")
+	}
+	if perms := permissionsOf("root"); perms == nil || len(perms) != 0 {
+		t.Errorf("permissions of unknown role %v", perms)
+	}
+}
+
+func TestLoginReportsPermissions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("editor@test.com", "secret123", RoleEditor)
+	resp := ts.login("editor@test.com", "secret123")
+	if resp.Role != RoleEditor || len(resp.Permissions) != 2 {
+		t.Fatalf("login response %+v", resp)
+	}
+}
+
+func TestEditorUploadsOnlyIntoAssignedArchives(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	editorUser := ts.addUser("editor@test.com", "secret123", RoleEditor)
+	editor := ts.login("editor@test.com", "secret123").Token
+	plain := ts.addUser("user@test.com", "secret123", RoleUser)
+	assigned, _ := ts.createArchive(admin, "ARSIP_001")
+	other, _ := ts.createArchive(admin, "ARSIP_002")
+	glb := testGLB(t, testCube())
+
+	expectStatus(t, ts.do("POST", "/api/archives/editors", admin, gin.H{"archive_id": assigned, "user_id": plain.ID}), 400)
+	expectStatus(t, ts.do("POST", "/api/archives/editors", admin, gin.H{"archive_id": assigned, "user_id": editorUser.ID}), 200)
+	expectStatus(t, ts.do("POST", "/api/archives/editors", editor, gin.H{"archive_id": other, "user_id": editorUser.ID}), 403)
+
+	upload := func(archiveID uint) int {
+		fields := map[string]string{"name": "cube"}
+		if archiveID != 0 {
+			fields["archive_id"] = fmt.Sprint(archiveID)
+		}
+		return ts.upload(editor, fields, testFile{"file", "cube.glb", glb}).Code
+	}
+	if code := upload(0); code != 403 {
+		t.Fatalf("editor upload outside archives: %d", code)
+	}
+	if code := upload(other); code != 403 {
+		t.Fatalf("editor upload into unassigned archive: %d", code)
+	}
+	if code := upload(assigned); code != 201 {
+		t.Fatalf("editor upload into assigned archive: %d", code)
+	}
+
+	// editors see only their archives
+	w := ts.do("GET", "/api/archives", editor, nil)
+	expectStatus(t, w, 200)
+	var list struct {
+		Data []struct {
+			ID     uint          `json:"id"`
+			Tokens []interface{} `json:"tokens"`
+		} `json:"data"`
+	}
+	decodeJSON(t, w, &list)
+	if len(list.Data) != 1 || list.Data[0].ID != assigned || list.Data[0].Tokens != nil {
+		t.Fatalf("editor archives %+v", list.Data)
+	}
+
+	// nor can they delete
+	models, _ := ts.store.ListModels(assigned)
+	expectStatus(t, ts.do("DELETE", "/api/models", editor, gin.H{"id": models[0].ID}), 403)
+
+	expectStatus(t, ts.do("DELETE", "/api/archives/editors", admin, gin.H{"archive_id": assigned, "user_id": editorUser.ID}), 200)
+	if code := upload(assigned); code != 403 {
+		t.Fatalf("upload after unassign: %d", code)
+	}
+}
+
+func TestRoleChangeTakesEffectImmediately(t *testing.T) {
+	ts := newTestServer(t)
+	u := ts.addUser("a@test.com", "secret123", RoleAdmin)
+	token := ts.login("a@test.com", "secret123").Token
+	expectStatus(t, ts.do("GET", "/api/users", token, nil), 200)
+	if _, err := ts.store.UpdateUserRole(u.ID, RoleUser); err != nil {
+		t.Fatal(err)
+	}
+	// the role in the access token is not trusted over the store
+	expectStatus(t, ts.do("GET", "/api/users", token, nil), 403)
+}
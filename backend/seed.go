@@ -7,9 +7,9 @@ import (
 )
 
 // Utility script untuk seed database dengan test data
-// Sekarang menggunakan in-memory storage di main.go
+// Akun test di-seed ke SQLite oleh initData() di main.go (hanya mode development, dengan SEED_TEST_USERS=true)
 func seedDatabase() {
-	fmt.Println("Using in-memory storage. Test data initialized in initData() function.")
+	fmt.Println("Using SQLite storage. Test data is seeded by initData() when SEED_TEST_USERS=true in development mode.")
 
 	// Hash passwords untuk reference
 	adminPass, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The handler tests run the real router against a MemoryStore, with files
+// in a temporary directory and mail kept in memory.
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testMailer keeps the mail the server sends
+type testMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *testMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+func (m *testMailer) messages() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
+
+type testServer struct {
+	*Server
+	t      *testing.T
+	router *gin.Engine
+	mail   *testMailer
+}
+
+// newTestServer returns a server on a fresh MemoryStore; configure may
+// change the settings before it is built
+func newTestServer(t *testing.T, configure ...func(*Config)) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.JWTSecret = "test-secret"
+	cfg.UploadDir = filepath.Join(dir, "uploads")
+	cfg.ArchiveRoot = filepath.Join(dir, "model_archives")
+	cfg.UploadStagingDir = filepath.Join(dir, "upload_staging")
+	cfg.MailDir = filepath.Join(dir, "mail")
+	for _, f := range configure {
+		f(&cfg)
+	}
+	for _, d := range []string{cfg.UploadDir, cfg.ArchiveRoot, cfg.UploadStagingDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mail := &testMailer{}
+	s := NewServer(cfg, NewMemoryStore(), mail)
+	return &testServer{Server: s, t: t, router: s.Router(), mail: mail}
+}
+
+// do sends a request through the router. body is sent as it is when it is
+// a string or []byte and as JSON otherwise; headers come in name, value
+// pairs.
+func (ts *testServer) do(method, target, token string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var r io.Reader
+	contentType := ""
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	case []byte:
+		r = bytes.NewReader(b)
+	default:
+		js, err := json.Marshal(b)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		r = bytes.NewReader(js)
+		contentType = "application/json"
+	}
+	req := httptest.NewRequest(method, target, r)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	return w
+}
+
+// testFile is a file sent in a multipart form
+type testFile struct {
+	field string
+	name  string
+	data  []byte
+}
+
+// upload posts a multipart form to /api/models/upload
+func (ts *testServer) upload(token string, fields map[string]string, files ...testFile) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		w, err := mw.CreateFormFile(f.field, f.name)
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		w.Write(f.data)
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/api/models/upload", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	ts.router.ServeHTTP(w, req)
+	return w
+}
+
+// addUser creates an account directly in the store
+func (ts *testServer) addUser(email, password, role string) *User {
+	ts.t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	u := &User{Email: email, PasswordHash: string(hash), Role: role}
+	if err := ts.store.CreateUser(u); err != nil {
+		ts.t.Fatal(err)
+	}
+	return u
+}
+
+// login signs in through the API and returns the login response
+func (ts *testServer) login(email, password string) AuthResponse {
+	ts.t.Helper()
+	w := ts.do("POST", "/api/auth/login", "", gin.H{"email": email, "password": password})
+	if w.Code != 200 {
+		ts.t.Fatalf("login %s: %d %s", email, w.Code, w.Body)
+	}
+	var resp AuthResponse
+	decodeJSON(ts.t, w, &resp)
+	return resp
+}
+
+// userToken creates an account with role and returns an access token for it
+func (ts *testServer) userToken(email, role string) string {
+	ts.t.Helper()
+	ts.addUser(email, "secret123", role)
+	return ts.login(email, "secret123").Token
+}
+
+// createArchive creates an archive through the API and returns its id and
+// plaintext token
+func (ts *testServer) createArchive(adminToken, name string) (uint, string) {
+	ts.t.Helper()
+	w := ts.do("POST", "/api/archives", adminToken, "name="+name, "Content-Type", "application/x-www-form-urlencoded")
+	if w.Code != 201 {
+		ts.t.Fatalf("create archive %s: %d %s", name, w.Code, w.Body)
+	}
+	var resp struct {
+		Data struct {
+			ID    uint   `json:"id"`
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data.ID, resp.Data.Token
+}
+
+// archiveLogin exchanges an archive token for an archive access token
+func (ts *testServer) archiveLogin(secret string) string {
+	ts.t.Helper()
+	w := ts.do("POST", "/api/archives/login", "", gin.H{"token": secret})
+	if w.Code != 200 {
+		ts.t.Fatalf("archive login: %d %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Token
+}
+
+// uploadModel uploads data as a model and returns its id
+func (ts *testServer) uploadModel(token, fileName string, data []byte, fields map[string]string) uint {
+	ts.t.Helper()
+	form := map[string]string{"name": fileName}
+	for k, v := range fields {
+		form[k] = v
+	}
+	w := ts.upload(token, form, testFile{"file", fileName, data})
+	if w.Code != 201 {
+		ts.t.Fatalf("upload %s: %d %s", fileName, w.Code, w.Body)
+	}
+	var resp struct {
+		Data struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data.ID
+}
+
+// runJobs processes the queued jobs that are due, one after the other, in
+// place of the background workers
+func (ts *testServer) runJobs() {
+	ts.t.Helper()
+	for {
+		j, err := ts.store.ClaimJob(time.Now())
+		if errors.Is(err, ErrNotFound) {
+			return
+		}
+		if err != nil {
+			ts.t.Fatal(err)
+		}
+		ts.processJob(j)
+	}
+}
+
+// listedModel is a model as GET /api/models lists it
+type listedModel struct {
+	ID               uint           `json:"id"`
+	Name             string         `json:"name"`
+	FileURL          string         `json:"file_url"`
+	FileName         string         `json:"file_name"`
+	FileSize         int64          `json:"file_size"`
+	UploadedBy       string         `json:"uploaded_by"`
+	ArchiveID        uint           `json:"archive_id"`
+	Metadata         *ModelMetadata `json:"metadata"`
+	ThumbnailURL     string         `json:"thumbnail_url"`
+	ProcessingStatus string         `json:"processing_status"`
+	OptimizedURL     string         `json:"optimized_url"`
+	OptimizedSize    int64          `json:"optimized_size"`
+	LODs             []ModelLOD     `json:"lods"`
+	SourceURL        string         `json:"source_url"`
+	SourceFormat     string         `json:"source_format"`
+}
+
+// listModels returns the models GET /api/models answers with for token
+func (ts *testServer) listModels(token string) []listedModel {
+	ts.t.Helper()
+	w := ts.do("GET", "/api/models", token, nil)
+	expectStatus(ts.t, w, 200)
+	var resp struct {
+		Data []listedModel `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body, err)
+	}
+}
+
+// expectStatus fails the test unless w answered code
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if w.Code != code {
+		t.Fatalf("status %d, want %d: %s", w.Code, code, w.Body)
+	}
+}
+
+// errorOf returns the "error" field of a JSON answer
+func errorOf(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp struct {
+		Error string `json:"error"`
+	}
+	decodeJSON(t, w, &resp)
+	return resp.Error
+}
+
+// testMesh is geometry for building test models
+type testMesh struct {
+	positions []float32 // xyz
+	normals   []float32 // optional, xyz
+	uvs       []float32 // optional
+	indices   []uint32  // optional
+}
+
+// testCube is a unit cube of 12 triangles around the origin, wound outward
+func testCube() testMesh {
+	m := testMesh{}
+	for _, p := range [][3]float32{{-1, -1, -1}, {1, -1, -1}, {1, 1, -1}, {-1, 1, -1}, {-1, -1, 1}, {1, -1, 1}, {1, 1, 1}, {-1, 1, 1}} {
+		m.positions = append(m.positions, p[:]...)
+	}
+	m.indices = []uint32{
+		0, 2, 1, 0, 3, 2, // -z
+		4, 5, 6, 4, 6, 7, // +z
+		0, 1, 5, 0, 5, 4, // -y
+		3, 7, 6, 3, 6, 2, // +y
+		0, 4, 7, 0, 7, 3, // -x
+		1, 2, 6, 1, 6, 5, // +x
+	}
+	return m
+}
+
+// testGLB builds a GLB of one node with one triangle mesh per entry of
+// meshes. Index accessors are UNSIGNED_INT.
+func testGLB(t *testing.T, meshes ...testMesh) []byte {
+	t.Helper()
+	doc, bin := testDoc(meshes...)
+	data, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testDoc returns the glTF document and BIN chunk testGLB encodes
+func testDoc(meshes ...testMesh) (*GLTF, []byte) {
+	doc := &GLTF{Asset: GLTFAsset{Version: "2.0"}, Scenes: []GLTFScene{{}}}
+	var bin []byte
+	addAccessor := func(data []byte, count int, typ string, componentType int, target int) int {
+		view := len(doc.BufferViews)
+		doc.BufferViews = append(doc.BufferViews, GLTFBufferView{Buffer: 0, ByteOffset: len(bin), ByteLength: len(data), Target: target})
+		bin = append(bin, data...)
+		for len(bin)%4 != 0 {
+			bin = append(bin, 0)
+		}
+		doc.Accessors = append(doc.Accessors, GLTFAccessor{BufferView: &view, ComponentType: componentType, Count: count, Type: typ})
+		return len(doc.Accessors) - 1
+	}
+	floats := func(v []float32) []byte {
+		out := make([]byte, 0, 4*len(v))
+		for _, f := range v {
+			out = binary.LittleEndian.AppendUint32(out, math.Float32bits(f))
+		}
+		return out
+	}
+	for _, m := range meshes {
+		count := len(m.positions) / 3
+		prim := GLTFPrimitive{Attributes: map[string]int{}}
+		pos := addAccessor(floats(m.positions), count, "VEC3", gltfFloat, gltfArrayBuffer)
+		min := []float64{math.Inf(1), math.Inf(1), math.Inf(1)}
+		max := []float64{math.Inf(-1), math.Inf(-1), math.Inf(-1)}
+		for i, f := range m.positions {
+			min[i%3] = math.Min(min[i%3], float64(f))
+			max[i%3] = math.Max(max[i%3], float64(f))
+		}
+		doc.Accessors[pos].Min, doc.Accessors[pos].Max = min, max
+		prim.Attributes["POSITION"] = pos
+		if m.normals != nil {
+			prim.Attributes["NORMAL"] = addAccessor(floats(m.normals), count, "VEC3", gltfFloat, gltfArrayBuffer)
+		}
+		if m.uvs != nil {
+			prim.Attributes["TEXCOORD_0"] = addAccessor(floats(m.uvs), count, "VEC2", gltfFloat, gltfArrayBuffer)
+		}
+		if m.indices != nil {
+			var idx []byte
+			for _, i := range m.indices {
+				idx = binary.LittleEndian.AppendUint32(idx, i)
+			}
+			n := addAccessor(idx, len(m.indices), "SCALAR", gltfUnsignedInt, gltfElementArrayBuffer)
+			prim.Indices = &n
+		}
+		mesh := len(doc.Meshes)
+		doc.Meshes = append(doc.Meshes, GLTFMesh{Primitives: []GLTFPrimitive{prim}})
+		doc.Nodes = append(doc.Nodes, GLTFNode{Mesh: &mesh})
+		doc.Scenes[0].Nodes = append(doc.Scenes[0].Nodes, len(doc.Nodes)-1)
+	}
+	doc.Buffers = []GLTFBuffer{{ByteLength: len(bin)}}
+	return doc, bin
+}
+
+// testPNG is a w×w PNG filled with c
+func testPNG(t *testing.T, w int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, w))
+	for y := 0; y < w; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testZip zips files, keyed by their path in the zip
+func testZip(t *testing.T, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeTestFile writes data to name below dir and returns its path
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	w := ts.do("POST", "/api/auth/register", "", gin.H{"email": "new@test.com", "password": "secret123"})
+	expectStatus(t, w, 201)
+	w = ts.do("POST", "/api/auth/register", "", gin.H{"email": "new@test.com", "password": "secret123"})
+	expectStatus(t, w, 409)
+	w = ts.do("POST", "/api/auth/register", "", gin.H{"email": "short@test.com", "password": "123"})
+	expectStatus(t, w, 400)
+
+	resp := ts.login("new@test.com", "secret123")
+	if resp.Role != RoleUser || resp.Token == "" || resp.RefreshToken == "" {
+		t.Fatalf("login response %+v", resp)
+	}
+	w = ts.do("POST", "/api/auth/login", "", gin.H{"email": "new@test.com", "password": "wrong"})
+	expectStatus(t, w, 401)
+
+	w = ts.do("GET", "/api/user/profile", resp.Token, nil)
+	expectStatus(t, w, 200)
+	var profile struct {
+		Data struct {
+			Email string `json:"email"`
+		} `json:"data"`
+	}
+	decodeJSON(t, w, &profile)
+	if profile.Data.Email != "new@test.com" {
+		t.Fatalf("profile of %q", profile.Data.Email)
+	}
+	expectStatus(t, ts.do("GET", "/api/user/profile", "", nil), 401)
+	expectStatus(t, ts.do("GET", "/api/user/profile", "not-a-jwt", nil), 401)
+}
+
+func TestUploadListAndDeleteModel(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	user := ts.userToken("user@test.com", RoleUser)
+	glb := testGLB(t, testCube())
+
+	expectStatus(t, ts.upload(user, map[string]string{"name": "cube"}, testFile{"file", "cube.glb", glb}), 403)
+	expectStatus(t, ts.upload(admin, map[string]string{"name": "cube"}, testFile{"file", "cube.txt", glb}), 400)
+	expectStatus(t, ts.upload(admin, nil, testFile{"file", "cube.glb", glb}), 400)
+	w := ts.upload(admin, map[string]string{"name": "bad"}, testFile{"file", "bad.glb", []byte("not a glb at all")})
+	expectStatus(t, w, 422)
+
+	id := ts.uploadModel(admin, "cube.glb", glb, map[string]string{"description": "a cube"})
+	m, err := ts.store.GetModelByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Description != "a cube" || m.FileSize != int64(len(glb)) || !strings.HasPrefix(m.FileURL, "/uploads/") {
+		t.Fatalf("stored model %+v", m)
+	}
+	stored, err := os.ReadFile(filepath.Join(ts.cfg.UploadDir, m.FileName))
+	if err != nil || !bytes.Equal(stored, glb) {
+		t.Fatalf("stored file: %v", err)
+	}
+	// the public file route serves it
+	expectStatus(t, ts.do("GET", m.FileURL, "", nil), 200)
+
+	w = ts.do("GET", "/api/models", "", nil)
+	expectStatus(t, w, 200)
+	var list struct {
+		Data []struct {
+			ID   uint   `json:"id"`
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	decodeJSON(t, w, &list)
+	if len(list.Data) != 1 || list.Data[0].ID != id {
+		t.Fatalf("models %+v", list.Data)
+	}
+
+	expectStatus(t, ts.do("DELETE", "/api/models", user, gin.H{"id": id}), 403)
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": id}), 200)
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": id}), 404)
+	if _, err := os.Stat(filepath.Join(ts.cfg.UploadDir, m.FileName)); !os.IsNotExist(err) {
+		t.Fatalf("file left after delete: %v", err)
+	}
+}
+
+func TestArchiveModelsNeedArchiveToken(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	archID, secret := ts.createArchive(admin, "ARSIP_001")
+	_, otherSecret := ts.createArchive(admin, "ARSIP_002")
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), map[string]string{"archive_id": fmt.Sprint(archID)})
+	m, _ := ts.store.GetModelByID(id)
+	if m.ArchiveID != archID || !strings.HasPrefix(m.FileURL, "/api/archives/ARSIP_001/files/") {
+		t.Fatalf("archive model %+v", m)
+	}
+
+	expectStatus(t, ts.do("GET", m.FileURL, "", nil), 401)
+	expectStatus(t, ts.do("GET", m.FileURL, admin, nil), 403)
+	expectStatus(t, ts.do("GET", m.FileURL, ts.archiveLogin(otherSecret), nil), 403)
+	archive := ts.archiveLogin(secret)
+	expectStatus(t, ts.do("GET", m.FileURL, archive, nil), 200)
+
+	// archive users only see their own archive
+	ts.uploadModel(admin, "other.glb", testGLB(t, testCube()), nil)
+	var list struct {
+		Data []struct {
+			ID uint `json:"id"`
+		} `json:"data"`
+	}
+	decodeJSON(t, ts.do("GET", "/api/models", archive, nil), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != id {
+		t.Fatalf("archive sees %+v", list.Data)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Session is a server-side login. Access tokens carry the session id, so
+// revoking the session cuts off every token issued for it.
+type Session struct {
+	ID        string     `json:"id"`
+	UserID    uint       `json:"user_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the session can still be used at t
+func (sess *Session) Active(t time.Time) bool {
+	return sess.RevokedAt == nil && t.Before(sess.ExpiresAt)
+}
+
+// RefreshToken is a single-use token that can be exchanged for a new
+// access/refresh pair. Only its hash is stored.
+type RefreshToken struct {
+	TokenHash string
+	SessionID string
+	CreatedAt time.Time
+	UsedAt    *time.Time
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// hashToken returns the hex SHA-256 of a high-entropy random token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens mints a new access token and refresh token for sess and slides
+// the session expiry forward by the refresh token lifetime
+func (s *Server) issueTokens(user *User, sess *Session) (access string, refresh string, err error) {
+	refresh, err = generateRandomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.store.CreateRefreshToken(&RefreshToken{TokenHash: hashToken(refresh), SessionID: sess.ID}); err != nil {
+		return "", "", err
+	}
+	if err := s.store.ExtendSession(sess.ID, time.Now().Add(s.cfg.RefreshTTL.Duration)); err != nil {
+		return "", "", err
+	}
+	access, err = s.generateToken(user.ID, user.Email, user.Role, sess.ID)
+	if err != nil {
+		return "", "", err
+	}
+	return access, refresh, nil
+}
+
+// startSession creates a session for user and returns the login response
+func (s *Server) startSession(user *User) (*AuthResponse, error) {
+	sid, err := generateRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		ID:        sid,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(s.cfg.RefreshTTL.Duration),
+	}
+	if err := s.store.CreateSession(sess); err != nil {
+		return nil, err
+	}
+	access, refresh, err := s.issueTokens(user, sess)
+	if err != nil {
+		return nil, err
+	}
+	return s.authResponse(user, access, refresh), nil
+}
+
+func (s *Server) authResponse(user *User, access, refresh string) *AuthResponse {
+	return &AuthResponse{
+		Token:        access,
+		RefreshToken: refresh,
+		ExpiresIn:    int64(s.cfg.TokenTTL.Seconds()),
+		User: User{
+			ID:    user.ID,
+			Email: user.Email,
+			Role:  user.Role,
+		},
+		Role:        user.Role,
+		Permissions: permissionsOf(user.Role),
+	}
+}
+
+// ============ SESSION HANDLERS ============
+func (s *Server) refreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	hash := hashToken(req.RefreshToken)
+	rt, err := s.store.GetRefreshToken(hash)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	sess, err := s.store.GetSession(rt.SessionID)
+	if err != nil || !sess.Active(time.Now()) {
+		c.JSON(401, gin.H{"error": "Session expired or revoked"})
+		return
+	}
+
+	// A refresh token is single use. Seeing one twice means it leaked, so the
+	// whole session is revoked rather than guessing which caller is genuine.
+	if err := s.store.ConsumeRefreshToken(hash); err != nil {
+		if errors.Is(err, ErrConflict) {
+			log.Printf("refreshHandler: refresh token reuse on session %s, revoking", sess.ID)
+			if err := s.store.RevokeSession(sess.ID); err != nil {
+				log.Printf("refreshHandler: revoke session: %v", err)
+			}
+			c.JSON(401, gin.H{"error": "Refresh token already used; session revoked"})
+			return
+		}
+		log.Printf("refreshHandler: consume refresh token: %v", err)
+		c.JSON(500, gin.H{"error": "Error refreshing session"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(sess.UserID)
+	if err != nil {
+		c.JSON(401, gin.H{"error": "User not found"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(403, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	access, refresh, err := s.issueTokens(user, sess)
+	if err != nil {
+		log.Printf("refreshHandler: issue tokens: %v", err)
+		c.JSON(500, gin.H{"error": "Error generating token"})
+		return
+	}
+
+	c.JSON(200, s.authResponse(user, access, refresh))
+}
+
+// logoutHandler revokes the caller's session, or every session of the
+// caller when {"all": true} is sent
+func (s *Server) logoutHandler(c *gin.Context) {
+	var req struct {
+		All bool `json:"all"`
+	}
+	// body is optional
+	_ = c.ShouldBindJSON(&req)
+
+	var err error
+	if req.All {
+		err = s.store.RevokeUserSessions(c.GetUint("user_id"))
+	} else {
+		err = s.store.RevokeSession(c.GetString("session_id"))
+	}
+	if err != nil {
+		log.Printf("logoutHandler: revoke: %v", err)
+		c.JSON(500, gin.H{"error": "Error revoking session"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Logged out"})
+}
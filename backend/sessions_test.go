@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func refresh(ts *testServer, token string) (AuthResponse, int) {
+	ts.t.Helper()
+	w := ts.do("POST", "/api/auth/refresh", "", gin.H{"refresh_token": token})
+	var resp AuthResponse
+	if w.Code == 200 {
+		decodeJSON(ts.t, w, &resp)
+	}
+	return resp, w.Code
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	first := ts.login("a@test.com", "secret123")
+
+	second, code := refresh(ts, first.RefreshToken)
+	if code != 200 || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh: %d %+v", code, second)
+	}
+	expectStatus(t, ts.do("GET", "/api/user/profile", second.Token, nil), 200)
+	if _, code := refresh(ts, second.RefreshToken); code != 200 {
+		t.Fatalf("refresh with rotated token: %d", code)
+	}
+	if _, code := refresh(ts, "unknown"); code != 401 {
+		t.Fatalf("unknown refresh token: %d", code)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	first := ts.login("a@test.com", "secret123")
+	second, _ := refresh(ts, first.RefreshToken)
+
+	if _, code := refresh(ts, first.RefreshToken); code != 401 {
+		t.Fatalf("reused refresh token: %d", code)
+	}
+	// the whole session is gone, the legitimate holder included
+	if _, code := refresh(ts, second.RefreshToken); code != 401 {
+		t.Fatalf("refresh after reuse: %d", code)
+	}
+	expectStatus(t, ts.do("GET", "/api/user/profile", second.Token, nil), 401)
+}
+
+func TestLogout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addUser("a@test.com", "secret123", RoleUser)
+	one := ts.login("a@test.com", "secret123")
+	two := ts.login("a@test.com", "secret123")
+	three := ts.login("a@test.com", "secret123")
+
+	expectStatus(t, ts.do("POST", "/api/auth/logout", one.Token, nil), 200)
+	expectStatus(t, ts.do("GET", "/api/user/profile", one.Token, nil), 401)
+	if _, code := refresh(ts, one.RefreshToken); code != 401 {
+		t.Fatalf("refresh after logout: %d", code)
+	}
+	expectStatus(t, ts.do("GET", "/api/user/profile", two.Token, nil), 200)
+
+	expectStatus(t, ts.do("POST", "/api/auth/logout", two.Token, gin.H{"all": true}), 200)
+	expectStatus(t, ts.do("GET", "/api/user/profile", three.Token, nil), 401)
+}
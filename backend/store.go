@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a lookup matches no record
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write violates a uniqueness constraint
+	ErrConflict = errors.New("already exists")
+	// ErrLimitReached is returned when a counter-limited action is exhausted
+	ErrLimitReached = errors.New("limit reached")
+)
+
+// Store is the persistence layer the HTTP handlers talk to. Implementations
+// return ErrNotFound / ErrConflict so handlers never see driver errors.
+type Store interface {
+	UserStore
+	ArchiveStore
+	ModelStore
+	SessionStore
+	APIKeyStore
+	UploadStore
+	JobStore
+}
+
+type UserStore interface {
+	CreateUser(u *User) error
+	GetUserByID(id uint) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	ListUsers() ([]*User, error)
+	UpdateUserRole(id uint, role string) (*User, error)
+	// SetUserDisabled disables or re-enables an account; disabling twice keeps
+	// the original timestamp
+	SetUserDisabled(id uint, disabled bool) (*User, error)
+	// DeleteUser also removes the user's sessions, API keys, external logins,
+	// pending uploads and archive assignments; models the user uploaded are
+	// kept
+	DeleteUser(id uint) error
+	// CountEnabledUsers counts accounts with role that are not disabled
+	CountEnabledUsers(role string) (int, error)
+	UpdateUserPassword(id uint, passwordHash string) error
+	// GetUserByIdentity finds the user linked to an external login
+	GetUserByIdentity(issuer, subject string) (*User, error)
+	// LinkUserIdentity links an external login to a user; a login can be
+	// linked to only one user (ErrConflict)
+	LinkUserIdentity(userID uint, issuer, subject string) error
+
+	CreatePasswordReset(r *PasswordReset) error
+	GetPasswordReset(hash string) (*PasswordReset, error)
+	// ConsumePasswordReset marks an unused reset token, and every other
+	// pending token of the same user, as used; it returns ErrConflict if the
+	// token was already used
+	ConsumePasswordReset(hash string) error
+}
+
+type ArchiveStore interface {
+	CreateArchive(a *Archive) error
+	GetArchiveByID(id uint) (*Archive, error)
+	GetArchiveByName(name string) (*Archive, error)
+	ListArchives() ([]*Archive, error)
+	// DeleteArchive also removes every model and token of the archive, and
+	// every API key and pending upload aimed at it
+	DeleteArchive(id uint) error
+
+	// CreateArchiveToken stores t.TokenHash and t.Hint; the plaintext
+	// t.Token is never persisted
+	CreateArchiveToken(t *ArchiveToken) error
+	GetArchiveToken(id uint) (*ArchiveToken, error)
+	GetArchiveTokenByHash(tokenHash string) (*ArchiveToken, error)
+	ListArchiveTokens(archiveID uint) ([]*ArchiveToken, error)
+	// RotateArchiveToken replaces the secret hash, bumps the token version
+	// and resets the login counter
+	RotateArchiveToken(id uint, tokenHash, hint string) (*ArchiveToken, error)
+	UpdateArchiveTokenAccess(id uint, expiresAt *time.Time, maxLogins int) (*ArchiveToken, error)
+	RevokeArchiveToken(id uint) error
+	// RecordArchiveTokenLogin counts a login and stamps last use, returning
+	// ErrLimitReached once max_logins is used up
+	RecordArchiveTokenLogin(id uint) error
+
+	// AssignArchiveEditor lets a user upload into an archive; assigning twice
+	// is a no-op
+	AssignArchiveEditor(archiveID, userID uint) error
+	UnassignArchiveEditor(archiveID, userID uint) error
+	ListArchiveEditors(archiveID uint) ([]*User, error)
+	ListEditorArchives(userID uint) ([]*Archive, error)
+	IsArchiveEditor(archiveID, userID uint) (bool, error)
+}
+
+type ModelStore interface {
+	CreateModel(m *GLBModel) error
+	GetModelByID(id uint) (*GLBModel, error)
+	// GetModelByFile looks up by stored file name; archiveID 0 means uploads/
+	GetModelByFile(fileName string, archiveID uint) (*GLBModel, error)
+	// ListModels returns every model when archiveID is 0
+	ListModels(archiveID uint) ([]*GLBModel, error)
+	CountModels(archiveID uint) (int, error)
+	DeleteModel(id uint) error
+	// SetModelMetadata stores the metadata read from the model file
+	SetModelMetadata(id uint, md *ModelMetadata) error
+	SetModelThumbnail(id uint, url string) error
+	SetModelProcessingStatus(id uint, status string) error
+	// SetModelOptimized records the optimized variant of a model; an empty
+	// url means there is none
+	SetModelOptimized(id uint, url string, size int64) error
+	// SetModelLODs replaces the simplified versions of a model
+	SetModelLODs(id uint, lods []ModelLOD) error
+}
+
+type SessionStore interface {
+	CreateSession(sess *Session) error
+	GetSession(id string) (*Session, error)
+	ExtendSession(id string, expiresAt time.Time) error
+	RevokeSession(id string) error
+	RevokeUserSessions(userID uint) error
+	CreateRefreshToken(t *RefreshToken) error
+	GetRefreshToken(hash string) (*RefreshToken, error)
+	// ConsumeRefreshToken marks an unused token as used; it returns
+	// ErrConflict if the token was already used
+	ConsumeRefreshToken(hash string) error
+}
+
+type APIKeyStore interface {
+	// CreateAPIKey stores k.KeyHash and k.Hint; the plaintext k.Key is never
+	// persisted
+	CreateAPIKey(k *APIKey) error
+	GetAPIKey(id uint) (*APIKey, error)
+	GetAPIKeyByHash(keyHash string) (*APIKey, error)
+	// ListAPIKeys returns the keys of a user, revoked ones included
+	ListAPIKeys(userID uint) ([]*APIKey, error)
+	// RevokeAPIKey marks a key revoked; revoking twice is a no-op
+	RevokeAPIKey(id uint) error
+	TouchAPIKey(id uint, at time.Time) error
+}
+
+// UploadStore keeps track of resumable uploads; the staged bytes themselves
+// live in files, not in the store
+type UploadStore interface {
+	CreateUpload(u *Upload) error
+	GetUpload(id string) (*Upload, error)
+	// SetUploadOffset records how many bytes are staged and extends the
+	// upload's expiry
+	SetUploadOffset(id string, offset int64, expiresAt time.Time) error
+	DeleteUpload(id string) error
+	// ListExpiredUploads returns uploads that expired before now
+	ListExpiredUploads(now time.Time) ([]*Upload, error)
+}
+
+// JobStore is the persistent queue of post-upload processing jobs; jobs are
+// removed together with their model
+type JobStore interface {
+	// CreateJob queues j; it returns ErrConflict if the model already has a
+	// queued job of the same kind and ErrNotFound if the model is gone
+	CreateJob(j *Job) error
+	GetJob(id uint) (*Job, error)
+	// ListModelJobs returns the jobs of a model, oldest first
+	ListModelJobs(modelID uint) ([]*Job, error)
+	// ClaimJob marks the queued job that is due first as running and counts
+	// the attempt; it returns ErrNotFound when no job is due at now
+	ClaimJob(now time.Time) (*Job, error)
+	// FinishJob records the outcome of a run: JobDone, JobFailed, or
+	// JobQueued to retry at runAt
+	FinishJob(id uint, status, lastError string, runAt time.Time) error
+	// RequeueRunningJobs puts jobs interrupted by a restart back in the queue
+	RequeueRunningJobs() (int, error)
+}
+
+var (
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
@@ -0,0 +1,1069 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store that keeps everything in maps guarded by a single
+// lock. Data is lost on restart; it exists for tests and throwaway setups.
+type MemoryStore struct {
+	mu               sync.RWMutex
+	users            map[uint]*User
+	models           map[uint]*GLBModel
+	archives         map[uint]*Archive
+	archiveTokens    map[uint]*ArchiveToken
+	archiveEditors   map[uint]map[uint]bool // archive id -> user ids
+	sessions         map[string]*Session
+	refreshTokens    map[string]*RefreshToken
+	passwordResets   map[string]*PasswordReset
+	apiKeys          map[uint]*APIKey
+	identities       map[[2]string]uint // (issuer, subject) -> user id
+	uploads          map[string]*Upload
+	jobs             map[uint]*Job
+	userIDCounter    uint
+	modelIDCounter   uint
+	archiveIDCounter uint
+	tokenIDCounter   uint
+	apiKeyIDCounter  uint
+	jobIDCounter     uint
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:            make(map[uint]*User),
+		models:           make(map[uint]*GLBModel),
+		archives:         make(map[uint]*Archive),
+		archiveTokens:    make(map[uint]*ArchiveToken),
+		archiveEditors:   make(map[uint]map[uint]bool),
+		sessions:         make(map[string]*Session),
+		refreshTokens:    make(map[string]*RefreshToken),
+		passwordResets:   make(map[string]*PasswordReset),
+		apiKeys:          make(map[uint]*APIKey),
+		identities:       make(map[[2]string]uint),
+		uploads:          make(map[string]*Upload),
+		jobs:             make(map[uint]*Job),
+		userIDCounter:    1,
+		modelIDCounter:   1,
+		archiveIDCounter: 1,
+		tokenIDCounter:   1,
+		apiKeyIDCounter:  1,
+		jobIDCounter:     1,
+	}
+}
+
+// copies are handed out so callers cannot mutate stored records without the lock
+func cloneUser(u *User) *User                         { c := *u; return &c }
+func cloneArchive(a *Archive) *Archive                { c := *a; return &c }
+func cloneArchiveToken(t *ArchiveToken) *ArchiveToken { c := *t; return &c }
+func cloneUpload(u *Upload) *Upload                   { c := *u; return &c }
+func cloneJob(j *Job) *Job                            { c := *j; return &c }
+
+func cloneModel(m *GLBModel) *GLBModel {
+	c := *m
+	if m.Metadata != nil {
+		md := *m.Metadata
+		md.BoundsMin = append([]float64(nil), md.BoundsMin...)
+		md.BoundsMax = append([]float64(nil), md.BoundsMax...)
+		md.Extensions = append([]string{}, md.Extensions...)
+		c.Metadata = &md
+	}
+	c.LODs = append([]ModelLOD(nil), m.LODs...)
+	return &c
+}
+
+func cloneAPIKey(k *APIKey) *APIKey {
+	c := *k
+	c.Scopes = append([]Permission(nil), k.Scopes...)
+	return &c
+}
+
+// ============ USERS ============
+func (s *MemoryStore) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.users {
+		if existing.Email == u.Email {
+			return ErrConflict
+		}
+	}
+	now := time.Now().UTC()
+	u.ID = s.userIDCounter
+	u.CreatedAt = now
+	u.UpdatedAt = now
+	s.users[u.ID] = cloneUser(u)
+	s.userIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetUserByID(id uint) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneUser(u), nil
+}
+
+func (s *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u.Email == email {
+			return cloneUser(u), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		out = append(out, cloneUser(u))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) UpdateUserRole(id uint, role string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u.Role = role
+	u.UpdatedAt = time.Now().UTC()
+	return cloneUser(u), nil
+}
+
+func (s *MemoryStore) SetUserDisabled(id uint, disabled bool) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	switch {
+	case !disabled:
+		u.DisabledAt = nil
+	case u.DisabledAt == nil:
+		u.DisabledAt = &now
+	}
+	u.UpdatedAt = now
+	return cloneUser(u), nil
+}
+
+func (s *MemoryStore) DeleteUser(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[id]; !ok {
+		return ErrNotFound
+	}
+	for sid, sess := range s.sessions {
+		if sess.UserID != id {
+			continue
+		}
+		for hash, rt := range s.refreshTokens {
+			if rt.SessionID == sid {
+				delete(s.refreshTokens, hash)
+			}
+		}
+		delete(s.sessions, sid)
+	}
+	for _, editors := range s.archiveEditors {
+		delete(editors, id)
+	}
+	for hash, r := range s.passwordResets {
+		if r.UserID == id {
+			delete(s.passwordResets, hash)
+		}
+	}
+	for kid, k := range s.apiKeys {
+		if k.UserID == id {
+			delete(s.apiKeys, kid)
+		}
+	}
+	for ident, uid := range s.identities {
+		if uid == id {
+			delete(s.identities, ident)
+		}
+	}
+	for uid, u := range s.uploads {
+		if u.UserID == id {
+			delete(s.uploads, uid)
+		}
+	}
+	for _, m := range s.models {
+		if m.UploadedBy == id {
+			m.UploadedBy = 0
+		}
+	}
+	delete(s.users, id)
+	return nil
+}
+
+func (s *MemoryStore) CountEnabledUsers(role string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, u := range s.users {
+		if u.Role == role && u.DisabledAt == nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) UpdateUserPassword(id uint, passwordHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.PasswordHash = passwordHash
+	u.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+func (s *MemoryStore) GetUserByIdentity(issuer, subject string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[s.identities[[2]string{issuer, subject}]]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneUser(u), nil
+}
+
+func (s *MemoryStore) LinkUserIdentity(userID uint, issuer, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[userID]; !ok {
+		return ErrNotFound
+	}
+	key := [2]string{issuer, subject}
+	if _, ok := s.identities[key]; ok {
+		return ErrConflict
+	}
+	s.identities[key] = userID
+	return nil
+}
+
+// ============ PASSWORD RESETS ============
+func (s *MemoryStore) CreatePasswordReset(r *PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[r.UserID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.passwordResets[r.TokenHash]; ok {
+		return ErrConflict
+	}
+	r.CreatedAt = time.Now().UTC()
+	c := *r
+	s.passwordResets[r.TokenHash] = &c
+	return nil
+}
+
+func (s *MemoryStore) GetPasswordReset(hash string) (*PasswordReset, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	r, ok := s.passwordResets[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *MemoryStore) ConsumePasswordReset(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.passwordResets[hash]
+	if !ok || r.UsedAt != nil {
+		return ErrConflict
+	}
+	now := time.Now().UTC()
+	for _, other := range s.passwordResets {
+		if other.UserID == r.UserID && other.UsedAt == nil {
+			other.UsedAt = &now
+		}
+	}
+	return nil
+}
+
+// ============ ARCHIVES ============
+func (s *MemoryStore) CreateArchive(a *Archive) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.archives {
+		if existing.Name == a.Name {
+			return ErrConflict
+		}
+	}
+	a.ID = s.archiveIDCounter
+	a.CreatedAt = time.Now().UTC()
+	s.archives[a.ID] = cloneArchive(a)
+	s.archiveIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetArchiveByID(id uint) (*Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.archives[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneArchive(a), nil
+}
+
+func (s *MemoryStore) findArchive(match func(*Archive) bool) (*Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, a := range s.archives {
+		if match(a) {
+			return cloneArchive(a), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetArchiveByName(name string) (*Archive, error) {
+	return s.findArchive(func(a *Archive) bool { return a.Name == name })
+}
+
+func (s *MemoryStore) ListArchives() ([]*Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]*Archive, 0, len(s.archives))
+	for _, a := range s.archives {
+		out = append(out, cloneArchive(a))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) DeleteArchive(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.archives[id]; !ok {
+		return ErrNotFound
+	}
+	for mid, m := range s.models {
+		if m.ArchiveID == id {
+			delete(s.models, mid)
+			s.deleteModelJobs(mid)
+		}
+	}
+	for tid, t := range s.archiveTokens {
+		if t.ArchiveID == id {
+			delete(s.archiveTokens, tid)
+		}
+	}
+	for kid, k := range s.apiKeys {
+		if k.ArchiveID == id {
+			delete(s.apiKeys, kid)
+		}
+	}
+	for uid, u := range s.uploads {
+		if u.ArchiveID == id {
+			delete(s.uploads, uid)
+		}
+	}
+	delete(s.archiveEditors, id)
+	delete(s.archives, id)
+	return nil
+}
+
+// ============ ARCHIVE TOKENS ============
+func (s *MemoryStore) CreateArchiveToken(t *ArchiveToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.archives[t.ArchiveID]; !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.archiveTokens {
+		if existing.TokenHash == t.TokenHash {
+			return ErrConflict
+		}
+	}
+	t.ID = s.tokenIDCounter
+	t.CreatedAt = time.Now().UTC()
+	t.LoginCount = 0
+	t.Version = 1
+	stored := cloneArchiveToken(t)
+	stored.Token = "" // only the hash is kept
+	s.archiveTokens[t.ID] = stored
+	s.tokenIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetArchiveToken(id uint) (*ArchiveToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.archiveTokens[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneArchiveToken(t), nil
+}
+
+func (s *MemoryStore) GetArchiveTokenByHash(tokenHash string) (*ArchiveToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.archiveTokens {
+		if t.TokenHash == tokenHash {
+			return cloneArchiveToken(t), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListArchiveTokens(archiveID uint) ([]*ArchiveToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*ArchiveToken
+	for _, t := range s.archiveTokens {
+		if t.ArchiveID == archiveID {
+			out = append(out, cloneArchiveToken(t))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) RotateArchiveToken(id uint, tokenHash, hint string) (*ArchiveToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.archiveTokens[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t.TokenHash = tokenHash
+	t.Hint = hint
+	t.Version++
+	t.LoginCount = 0
+	return cloneArchiveToken(t), nil
+}
+
+func (s *MemoryStore) UpdateArchiveTokenAccess(id uint, expiresAt *time.Time, maxLogins int) (*ArchiveToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.archiveTokens[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t.ExpiresAt = expiresAt
+	t.MaxLogins = maxLogins
+	return cloneArchiveToken(t), nil
+}
+
+func (s *MemoryStore) RevokeArchiveToken(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.archiveTokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.RevokedAt == nil {
+		now := time.Now().UTC()
+		t.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *MemoryStore) RecordArchiveTokenLogin(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.archiveTokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if t.MaxLogins > 0 && t.LoginCount >= t.MaxLogins {
+		return ErrLimitReached
+	}
+	now := time.Now().UTC()
+	t.LoginCount++
+	t.LastUsedAt = &now
+	return nil
+}
+
+// ============ ARCHIVE EDITORS ============
+func (s *MemoryStore) AssignArchiveEditor(archiveID, userID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.archives[archiveID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.users[userID]; !ok {
+		return ErrNotFound
+	}
+	if s.archiveEditors[archiveID] == nil {
+		s.archiveEditors[archiveID] = make(map[uint]bool)
+	}
+	s.archiveEditors[archiveID][userID] = true
+	return nil
+}
+
+func (s *MemoryStore) UnassignArchiveEditor(archiveID, userID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.archiveEditors[archiveID][userID] {
+		return ErrNotFound
+	}
+	delete(s.archiveEditors[archiveID], userID)
+	return nil
+}
+
+func (s *MemoryStore) ListArchiveEditors(archiveID uint) ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*User
+	for uid := range s.archiveEditors[archiveID] {
+		if u, ok := s.users[uid]; ok {
+			out = append(out, cloneUser(u))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) ListEditorArchives(userID uint) ([]*Archive, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Archive
+	for aid, editors := range s.archiveEditors {
+		if a, ok := s.archives[aid]; ok && editors[userID] {
+			out = append(out, cloneArchive(a))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) IsArchiveEditor(archiveID, userID uint) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.archiveEditors[archiveID][userID], nil
+}
+
+// ============ MODELS ============
+func (s *MemoryStore) CreateModel(m *GLBModel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	m.ID = s.modelIDCounter
+	if m.ProcessingStatus == "" {
+		m.ProcessingStatus = ProcessingReady
+	}
+	m.CreatedAt = now
+	m.UpdatedAt = now
+	s.models[m.ID] = cloneModel(m)
+	s.modelIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetModelByID(id uint) (*GLBModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.models[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneModel(m), nil
+}
+
+func (s *MemoryStore) GetModelByFile(fileName string, archiveID uint) (*GLBModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, m := range s.models {
+		if m.FileName == fileName && m.ArchiveID == archiveID {
+			return cloneModel(m), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListModels(archiveID uint) ([]*GLBModel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*GLBModel
+	for _, m := range s.models {
+		if archiveID != 0 && m.ArchiveID != archiveID {
+			continue
+		}
+		out = append(out, cloneModel(m))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) CountModels(archiveID uint) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, m := range s.models {
+		if m.ArchiveID == archiveID {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) DeleteModel(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.models[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.models, id)
+	s.deleteModelJobs(id)
+	return nil
+}
+
+func (s *MemoryStore) SetModelMetadata(id uint, md *ModelMetadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.models[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Metadata = md
+	m.UpdatedAt = time.Now()
+	s.models[id] = cloneModel(m)
+	return nil
+}
+
+func (s *MemoryStore) SetModelThumbnail(id uint, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.models[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.ThumbnailURL = url
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStore) SetModelOptimized(id uint, url string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.models[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.OptimizedURL = url
+	m.OptimizedSize = size
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStore) SetModelLODs(id uint, lods []ModelLOD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.models[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.LODs = append([]ModelLOD(nil), lods...)
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *MemoryStore) SetModelProcessingStatus(id uint, status string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.models[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.ProcessingStatus = status
+	m.UpdatedAt = time.Now()
+	return nil
+}
+
+// ============ SESSIONS ============
+func (s *MemoryStore) CreateSession(sess *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[sess.ID]; ok {
+		return ErrConflict
+	}
+	sess.CreatedAt = time.Now().UTC()
+	c := *sess
+	s.sessions[sess.ID] = &c
+	return nil
+}
+
+func (s *MemoryStore) GetSession(id string) (*Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *sess
+	return &c, nil
+}
+
+func (s *MemoryStore) ExtendSession(id string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return ErrNotFound
+	}
+	sess.ExpiresAt = expiresAt
+	return nil
+}
+
+func (s *MemoryStore) RevokeSession(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[id]; ok && sess.RevokedAt == nil {
+		now := time.Now().UTC()
+		sess.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeUserSessions(userID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for _, sess := range s.sessions {
+		if sess.UserID == userID && sess.RevokedAt == nil {
+			sess.RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(t *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.refreshTokens[t.TokenHash]; ok {
+		return ErrConflict
+	}
+	t.CreatedAt = time.Now().UTC()
+	c := *t
+	s.refreshTokens[t.TokenHash] = &c
+	return nil
+}
+
+func (s *MemoryStore) GetRefreshToken(hash string) (*RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.refreshTokens[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *t
+	return &c, nil
+}
+
+func (s *MemoryStore) ConsumeRefreshToken(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.refreshTokens[hash]
+	if !ok || t.UsedAt != nil {
+		return ErrConflict
+	}
+	now := time.Now().UTC()
+	t.UsedAt = &now
+	return nil
+}
+
+// ============ API KEYS ============
+func (s *MemoryStore) CreateAPIKey(k *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[k.UserID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.archives[k.ArchiveID]; k.ArchiveID != 0 && !ok {
+		return ErrNotFound
+	}
+	for _, existing := range s.apiKeys {
+		if existing.KeyHash == k.KeyHash {
+			return ErrConflict
+		}
+	}
+	k.ID = s.apiKeyIDCounter
+	k.CreatedAt = time.Now().UTC()
+	stored := cloneAPIKey(k)
+	stored.Key = "" // only the hash is kept
+	s.apiKeys[k.ID] = stored
+	s.apiKeyIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKey(id uint) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneAPIKey(k), nil
+}
+
+func (s *MemoryStore) GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.apiKeys {
+		if k.KeyHash == keyHash {
+			return cloneAPIKey(k), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListAPIKeys(userID uint) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*APIKey
+	for _, k := range s.apiKeys {
+		if k.UserID == userID {
+			out = append(out, cloneAPIKey(k))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		k.RevokedAt = &now
+	}
+	return nil
+}
+
+func (s *MemoryStore) TouchAPIKey(id uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	t := at.UTC()
+	k.LastUsedAt = &t
+	return nil
+}
+
+// ============ UPLOADS ============
+func (s *MemoryStore) CreateUpload(u *Upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[u.UserID]; !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.archives[u.ArchiveID]; u.ArchiveID != 0 && !ok {
+		return ErrNotFound
+	}
+	if _, ok := s.uploads[u.ID]; ok {
+		return ErrConflict
+	}
+	u.CreatedAt = time.Now().UTC()
+	s.uploads[u.ID] = cloneUpload(u)
+	return nil
+}
+
+func (s *MemoryStore) GetUpload(id string) (*Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneUpload(u), nil
+}
+
+func (s *MemoryStore) SetUploadOffset(id string, offset int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Offset = offset
+	u.ExpiresAt = expiresAt.UTC()
+	return nil
+}
+
+func (s *MemoryStore) DeleteUpload(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *MemoryStore) ListExpiredUploads(now time.Time) ([]*Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Upload
+	for _, u := range s.uploads {
+		if u.ExpiresAt.Before(now) {
+			out = append(out, cloneUpload(u))
+		}
+	}
+	return out, nil
+}
+
+// ============ JOBS ============
+func (s *MemoryStore) CreateJob(j *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.models[j.ModelID]; !ok {
+		return ErrNotFound
+	}
+	for _, q := range s.jobs {
+		if q.ModelID == j.ModelID && q.Kind == j.Kind && q.Status == JobQueued {
+			return ErrConflict
+		}
+	}
+	now := time.Now().UTC()
+	if j.RunAt.IsZero() {
+		j.RunAt = now
+	}
+	j.ID = s.jobIDCounter
+	j.Status = JobQueued
+	j.Attempts = 0
+	j.LastError = ""
+	j.CreatedAt = now
+	j.UpdatedAt = now
+	s.jobs[j.ID] = cloneJob(j)
+	s.jobIDCounter++
+	return nil
+}
+
+func (s *MemoryStore) GetJob(id uint) (*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return cloneJob(j), nil
+}
+
+func (s *MemoryStore) ListModelJobs(modelID uint) ([]*Job, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Job
+	for _, j := range s.jobs {
+		if j.ModelID == modelID {
+			out = append(out, cloneJob(j))
+		}
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].ID < out[k].ID })
+	return out, nil
+}
+
+func (s *MemoryStore) ClaimJob(now time.Time) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var next *Job
+	for _, j := range s.jobs {
+		if j.Status != JobQueued || j.RunAt.After(now) {
+			continue
+		}
+		if next == nil || j.RunAt.Before(next.RunAt) || (j.RunAt.Equal(next.RunAt) && j.ID < next.ID) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, ErrNotFound
+	}
+	next.Status = JobRunning
+	next.Attempts++
+	next.UpdatedAt = now.UTC()
+	return cloneJob(next), nil
+}
+
+func (s *MemoryStore) FinishJob(id uint, status, lastError string, runAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if status == JobQueued {
+		for _, q := range s.jobs {
+			if q.ID != id && q.ModelID == j.ModelID && q.Kind == j.Kind && q.Status == JobQueued {
+				return ErrConflict
+			}
+		}
+	}
+	j.Status = status
+	j.LastError = lastError
+	j.RunAt = runAt.UTC()
+	j.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+func (s *MemoryStore) RequeueRunningJobs() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	// the job that stays per model and kind: the queued one, else the
+	// newest running one
+	keep := make(map[uint]map[string]*Job)
+	for _, j := range s.jobs {
+		if j.Status != JobQueued && j.Status != JobRunning {
+			continue
+		}
+		if keep[j.ModelID] == nil {
+			keep[j.ModelID] = make(map[string]*Job)
+		}
+		k := keep[j.ModelID][j.Kind]
+		if k == nil || (k.Status == JobRunning && (j.Status == JobQueued || j.ID > k.ID)) {
+			keep[j.ModelID][j.Kind] = j
+		}
+	}
+	n := 0
+	for _, j := range s.jobs {
+		if j.Status != JobRunning {
+			continue
+		}
+		j.UpdatedAt = now
+		if keep[j.ModelID][j.Kind] != j {
+			j.Status = JobFailed
+			j.LastError = "superseded by a newer job"
+			continue
+		}
+		j.Status = JobQueued
+		j.RunAt = now
+		n++
+	}
+	return n, nil
+}
+
+// deleteModelJobs drops the jobs of a removed model; callers hold the lock
+func (s *MemoryStore) deleteModelJobs(modelID uint) {
+	for id, j := range s.jobs {
+		if j.ModelID == modelID {
+			delete(s.jobs, id)
+		}
+	}
+}
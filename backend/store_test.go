@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// storeContract runs test against every Store implementation, each on a
+// fresh, empty store
+func storeContract(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		test(t, s)
+	})
+}
+
+func TestStoreUsers(t *testing.T) {
+	storeContract(t, func(t *testing.T, s Store) {
+		u := &User{Email: "a@test.com", PasswordHash: "x", Role: RoleUser}
+		if err := s.CreateUser(u); err != nil || u.ID == 0 {
+			t.Fatalf("create: %v, id %d", err, u.ID)
+		}
+		if err := s.CreateUser(&User{Email: "a@test.com", PasswordHash: "y", Role: RoleUser}); !errors.Is(err, ErrConflict) {
+			t.Fatalf("duplicate email: %v", err)
+		}
+		got, err := s.GetUserByEmail("a@test.com")
+		if err != nil || got.ID != u.ID {
+			t.Fatalf("by email: %v %+v", err, got)
+		}
+		if _, err := s.GetUserByID(u.ID + 100); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("missing user: %v", err)
+		}
+		got, err = s.UpdateUserRole(u.ID, RoleEditor)
+		if err != nil || got.Role != RoleEditor {
+			t.Fatalf("role: %v %+v", err, got)
+		}
+		if n, _ := s.CountEnabledUsers(RoleEditor); n != 1 {
+			t.Fatalf("%d enabled editors", n)
+		}
+		if _, err := s.SetUserDisabled(u.ID, true); err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := s.CountEnabledUsers(RoleEditor); n != 0 {
+			t.Fatalf("%d enabled editors after disable", n)
+		}
+		if err := s.DeleteUser(u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetUserByID(u.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleted user: %v", err)
+		}
+	})
+}
+
+func TestStoreModels(t *testing.T) {
+	storeContract(t, func(t *testing.T, s Store) {
+		a := &Archive{Name: "ARSIP_001"}
+		if err := s.CreateArchive(a); err != nil {
+			t.Fatal(err)
+		}
+		loose := &GLBModel{Name: "loose", FileName: "loose.glb", FileURL: "/uploads/loose.glb"}
+		inArchive := &GLBModel{Name: "in", FileName: "in.glb", FileURL: "/api/archives/ARSIP_001/files/in.glb", ArchiveID: a.ID}
+		for _, m := range []*GLBModel{loose, inArchive} {
+			if err := s.CreateModel(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		all, _ := s.ListModels(0)
+		only, _ := s.ListModels(a.ID)
+		if len(all) != 2 || len(only) != 1 || only[0].ID != inArchive.ID {
+			t.Fatalf("list: %d all, %d in archive", len(all), len(only))
+		}
+		if m, err := s.GetModelByFile("in.glb", a.ID); err != nil || m.ID != inArchive.ID {
+			t.Fatalf("by file: %v", err)
+		}
+		if _, err := s.GetModelByFile("in.glb", 0); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("by file outside archive: %v", err)
+		}
+		if err := s.DeleteArchive(a.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetModelByID(inArchive.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("archive model survived archive delete: %v", err)
+		}
+		if err := s.DeleteModel(loose.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteModel(loose.ID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("delete twice: %v", err)
+		}
+	})
+}
+
+func TestStoreModelMetadata(t *testing.T) {
+	storeContract(t, func(t *testing.T, s Store) {
+		m := &GLBModel{Name: "cube", FileName: "cube.glb"}
+		if err := s.CreateModel(m); err != nil {
+			t.Fatal(err)
+		}
+		md := &ModelMetadata{Triangles: 12, Vertices: 8, Meshes: 1, Extensions: []string{"KHR_texture_transform"},
+			BoundsMin: []float64{-1, -1, -1}, BoundsMax: []float64{1, 1, 1}, Generator: "test"}
+		if err := s.SetModelMetadata(m.ID, md); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetModelByID(m.ID)
+		if err != nil || !reflect.DeepEqual(got.Metadata, md) {
+			t.Fatalf("metadata %+v: %v", got.Metadata, err)
+		}
+		if err := s.SetModelMetadata(m.ID+1, md); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("metadata of a missing model: %v", err)
+		}
+	})
+}
+
+func TestStoreModelVariants(t *testing.T) {
+	storeContract(t, func(t *testing.T, s Store) {
+		m := &GLBModel{Name: "grid", FileName: "grid.glb"}
+		if err := s.CreateModel(m); err != nil {
+			t.Fatal(err)
+		}
+		lods := []ModelLOD{
+			{Level: 1, Ratio: 0.5, Triangles: 4000, FileURL: "/uploads/grid.lod1.glb?v=1", FileSize: 900},
+			{Level: 2, Ratio: 0.1, Triangles: 800, FileURL: "/uploads/grid.lod2.glb?v=1", FileSize: 200},
+		}
+		if err := s.SetModelLODs(m.ID, lods); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SetModelOptimized(m.ID, "/uploads/grid.optimized.glb?v=1", 1200); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetModelByID(m.ID)
+		if err != nil || !reflect.DeepEqual(got.LODs, lods) || got.OptimizedURL != "/uploads/grid.optimized.glb?v=1" || got.OptimizedSize != 1200 {
+			t.Fatalf("variants %+v %q %d: %v", got.LODs, got.OptimizedURL, got.OptimizedSize, err)
+		}
+
+		if err := s.SetModelLODs(m.ID, []ModelLOD{}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := s.GetModelByID(m.ID); len(got.LODs) != 0 {
+			t.Fatalf("lods after clearing %+v", got.LODs)
+		}
+		if err := s.SetModelLODs(m.ID+1, lods); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("lods of a missing model: %v", err)
+		}
+		if err := s.SetModelOptimized(m.ID+1, "", 0); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("variant of a missing model: %v", err)
+		}
+	})
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg" // baseColor textures
+	_ "image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The thumbnail renderer is a small software rasterizer: it draws the
+// triangles of the default scene with their base color (factor and PNG or
+// JPEG texture) under a fixed key light, seen from the front right. There is
+// no GPU, so no PBR, shadows or transparency; BLEND materials are drawn
+// opaque and MASK ones honour alphaCutoff. Primitives it cannot read, such
+// as Draco or quantized meshes, are left out.
+
+// thumbnailSupersample is the number of samples per pixel along each axis
+const thumbnailSupersample = 2
+
+// thumbnailFOV is the vertical field of view of the camera, in radians
+const thumbnailFOV = 35 * math.Pi / 180
+
+var errNothingToRender = errors.New("model has no triangles that can be rendered")
+
+type vec3 [3]float64
+
+func (a vec3) sub(b vec3) vec3      { return vec3{a[0] - b[0], a[1] - b[1], a[2] - b[2]} }
+func (a vec3) add(b vec3) vec3      { return vec3{a[0] + b[0], a[1] + b[1], a[2] + b[2]} }
+func (a vec3) scale(s float64) vec3 { return vec3{a[0] * s, a[1] * s, a[2] * s} }
+func (a vec3) dot(b vec3) float64   { return a[0]*b[0] + a[1]*b[1] + a[2]*b[2] }
+
+func (a vec3) cross(b vec3) vec3 {
+	return vec3{a[1]*b[2] - a[2]*b[1], a[2]*b[0] - a[0]*b[2], a[0]*b[1] - a[1]*b[0]}
+}
+
+func (a vec3) normalize() vec3 {
+	if l := math.Sqrt(a.dot(a)); l > 0 {
+		return a.scale(1 / l)
+	}
+	return a
+}
+
+// transformPoint applies the column-major matrix m to p
+func transformPoint(m [16]float64, p vec3) vec3 {
+	return vec3{
+		m[0]*p[0] + m[4]*p[1] + m[8]*p[2] + m[12],
+		m[1]*p[0] + m[5]*p[1] + m[9]*p[2] + m[13],
+		m[2]*p[0] + m[6]*p[1] + m[10]*p[2] + m[14],
+	}
+}
+
+// transformDir applies the rotation and scale of m to d; exact for normals
+// as long as the scale is uniform, which is good enough for shading
+func transformDir(m [16]float64, d vec3) vec3 {
+	return vec3{
+		m[0]*d[0] + m[4]*d[1] + m[8]*d[2],
+		m[1]*d[0] + m[5]*d[1] + m[9]*d[2],
+		m[2]*d[0] + m[6]*d[1] + m[10]*d[2],
+	}.normalize()
+}
+
+type rasterMaterial struct {
+	color   [4]float64 // linear baseColorFactor
+	texture image.Image
+	cutoff  float64 // alpha below this is discarded; -1 when not masked
+}
+
+type rasterVertex struct {
+	pos    vec3
+	normal vec3
+	uv     [2]float64
+}
+
+type rasterTriangle struct {
+	v          [3]rasterVertex
+	hasNormals bool
+	mat        *rasterMaterial
+}
+
+// sceneLoader feeds the world-space triangles of a glTF asset to draw
+type sceneLoader struct {
+	asset     *gltfAsset
+	materials map[int]*rasterMaterial
+	images    map[int]image.Image
+	draw      func(t *rasterTriangle)
+	drawn     int
+}
+
+var defaultRasterMaterial = &rasterMaterial{color: [4]float64{0.8, 0.8, 0.8, 1}, cutoff: -1}
+
+func (l *sceneLoader) material(i *int) *rasterMaterial {
+	doc := l.asset.Doc
+	if i == nil || *i < 0 || *i >= len(doc.Materials) {
+		return defaultRasterMaterial
+	}
+	if m, ok := l.materials[*i]; ok {
+		return m
+	}
+	src := doc.Materials[*i]
+	m := &rasterMaterial{color: [4]float64{1, 1, 1, 1}, cutoff: -1}
+	if pbr := src.PBRMetallicRoughness; pbr != nil {
+		if len(pbr.BaseColorFactor) == 4 {
+			copy(m.color[:], pbr.BaseColorFactor)
+		}
+		if t := pbr.BaseColorTexture; t != nil && t.TexCoord == 0 && t.Index >= 0 && t.Index < len(doc.Textures) {
+			if src := doc.Textures[t.Index].Source; src != nil {
+				m.texture = l.image(*src)
+			}
+		}
+	}
+	if src.AlphaMode == "MASK" {
+		m.cutoff = 0.5
+		if src.AlphaCutoff != nil {
+			m.cutoff = *src.AlphaCutoff
+		}
+	}
+	l.materials[*i] = m
+	return m
+}
+
+// image decodes image i, or returns nil for formats the standard library
+// cannot read (WebP, KTX2) so the base color factor is used alone
+func (l *sceneLoader) image(i int) image.Image {
+	doc := l.asset.Doc
+	if img, ok := l.images[i]; ok {
+		return img
+	}
+	var r io.Reader
+	if i >= 0 && i < len(doc.Images) {
+		src := doc.Images[i]
+		switch {
+		case strings.HasPrefix(src.URI, "data:"):
+			if data, _, err := decodeDataURI(src.URI); err == nil {
+				r = bytes.NewReader(data)
+			}
+		case src.URI != "" && l.asset.resolve != nil:
+			if f, err := l.asset.resolve(src.URI); err == nil {
+				r = f
+			}
+		case src.BufferView != nil && *src.BufferView >= 0 && *src.BufferView < len(doc.BufferViews):
+			bv := doc.BufferViews[*src.BufferView]
+			if bv.Buffer >= 0 && bv.Buffer < len(l.asset.Data) && l.asset.Data[bv.Buffer] != nil {
+				r = io.NewSectionReader(l.asset.Data[bv.Buffer], int64(bv.ByteOffset), int64(bv.ByteLength))
+			}
+		}
+	}
+	var img image.Image
+	if r != nil {
+		img, _, _ = image.Decode(r)
+	}
+	l.images[i] = img
+	return img
+}
+
+// addMesh draws the triangles of one instance of mesh i
+func (l *sceneLoader) addMesh(i int, world [16]float64) {
+	doc := l.asset.Doc
+	for _, p := range doc.Meshes[i].Primitives {
+		mode := 4
+		if p.Mode != nil {
+			mode = *p.Mode
+		}
+		pi, ok := p.Attributes["POSITION"]
+		if (mode != 4 && mode != 5 && mode != 6) || !ok || pi < 0 || pi >= len(doc.Accessors) {
+			continue
+		}
+		pos, err := l.asset.readFloats(pi)
+		if err != nil || doc.Accessors[pi].Type != "VEC3" {
+			continue
+		}
+		count := len(pos) / 3
+		var normals, uvs []float64
+		if ni, ok := p.Attributes["NORMAL"]; ok && ni >= 0 && ni < len(doc.Accessors) {
+			if n, err := l.asset.readFloats(ni); err == nil && len(n) == count*3 {
+				normals = n
+			}
+		}
+		if ti, ok := p.Attributes["TEXCOORD_0"]; ok && ti >= 0 && ti < len(doc.Accessors) {
+			if t, err := l.asset.readFloats(ti); err == nil && len(t) == count*2 {
+				uvs = t
+			}
+		}
+
+		var idx []uint32
+		if p.Indices != nil && *p.Indices >= 0 && *p.Indices < len(doc.Accessors) {
+			if idx, err = l.asset.readIndices(*p.Indices); err != nil {
+				continue
+			}
+		} else {
+			idx = make([]uint32, count)
+			for n := range idx {
+				idx[n] = uint32(n)
+			}
+		}
+
+		mat := l.material(p.Material)
+		vertex := func(n uint32) rasterVertex {
+			var v rasterVertex
+			v.pos = transformPoint(world, vec3{pos[n*3], pos[n*3+1], pos[n*3+2]})
+			if normals != nil {
+				v.normal = transformDir(world, vec3{normals[n*3], normals[n*3+1], normals[n*3+2]})
+			}
+			if uvs != nil {
+				v.uv = [2]float64{uvs[n*2], uvs[n*2+1]}
+			}
+			return v
+		}
+		t := rasterTriangle{hasNormals: normals != nil, mat: mat}
+		emit := func(a, b, c uint32) {
+			if int(a) >= count || int(b) >= count || int(c) >= count {
+				return
+			}
+			t.v = [3]rasterVertex{vertex(a), vertex(b), vertex(c)}
+			l.draw(&t)
+			l.drawn++
+		}
+		tris := triangleList(mode, idx)
+		for n := 0; n+2 < len(tris); n += 3 {
+			emit(tris[n], tris[n+1], tris[n+2])
+		}
+	}
+}
+
+// triangleList returns the corners of the triangles idx draws in a
+// triangle list (mode 4), strip (5) or fan (6), three per triangle and
+// wound the same way
+func triangleList(mode int, idx []uint32) []uint32 {
+	switch mode {
+	case 4:
+		return idx[:len(idx)/3*3]
+	case 5:
+		out := make([]uint32, 0, 3*max(len(idx)-2, 0))
+		for n := 0; n+2 < len(idx); n++ {
+			if n%2 == 0 {
+				out = append(out, idx[n], idx[n+1], idx[n+2])
+			} else {
+				out = append(out, idx[n+1], idx[n], idx[n+2])
+			}
+		}
+		return out
+	case 6:
+		out := make([]uint32, 0, 3*max(len(idx)-2, 0))
+		for n := 1; n+1 < len(idx); n++ {
+			out = append(out, idx[0], idx[n], idx[n+1])
+		}
+		return out
+	}
+	return nil
+}
+
+// renderThumbnail renders the model at filePath into a size x size image
+// with a transparent background. External URIs are resolved next to it.
+func renderThumbnail(filePath string, size int) (*image.NRGBA, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	files := newModelFiles(filepath.Dir(filePath), false)
+	defer files.Close()
+	asset, errs := openGLTF(f, info.Size(), strings.ToLower(filepath.Ext(filePath)), files.resolve)
+	if asset == nil {
+		return nil, fmt.Errorf("%s: %s", filePath, errs[0].Message)
+	}
+
+	// the camera fits the bounding box the accessors declare, so triangles
+	// can be drawn as they are read
+	md := modelMetadata(asset.Doc)
+	if md.BoundsMin == nil {
+		return nil, errNothingToRender
+	}
+	r := newRasterizer(size, vec3{md.BoundsMin[0], md.BoundsMin[1], md.BoundsMin[2]}, vec3{md.BoundsMax[0], md.BoundsMax[1], md.BoundsMax[2]})
+	l := &sceneLoader{
+		asset:     asset,
+		materials: make(map[int]*rasterMaterial),
+		images:    make(map[int]image.Image),
+		draw:      r.draw,
+	}
+	forEachMeshInstance(asset.Doc, l.addMesh)
+	if l.drawn == 0 {
+		return nil, errNothingToRender
+	}
+	return r.image(), nil
+}
+
+// rasterizer holds the camera and the supersampled frame being drawn
+type rasterizer struct {
+	size                    int
+	w                       int // frame width and height in samples
+	eye, forward, right, up vec3
+	key, toEye              vec3 // directions towards the lights
+	focal                   float64
+	depth                   []float64
+	colors                  []vec3
+	covered                 []bool
+}
+
+// newRasterizer sets up a camera that fits the box min-max
+func newRasterizer(size int, min, max vec3) *rasterizer {
+	center := min.add(max).scale(0.5)
+	radius := math.Sqrt(math.Max(max.sub(center).dot(max.sub(center)), 1e-12))
+
+	// look at the front (+Z) from the right and a little above
+	viewDir := vec3{0.6, 0.45, 1}.normalize()
+	r := &rasterizer{size: size, w: size * thumbnailSupersample, focal: 1 / math.Tan(thumbnailFOV/2)}
+	r.eye = center.add(viewDir.scale(radius / math.Sin(thumbnailFOV/2) * 1.02))
+	r.forward = center.sub(r.eye).normalize()
+	r.right = r.forward.cross(vec3{0, 1, 0}).normalize()
+	r.up = r.right.cross(r.forward)
+	r.key = r.right.scale(-0.4).add(r.up.scale(0.8)).sub(r.forward.scale(0.5)).normalize()
+	r.toEye = r.forward.scale(-1)
+
+	r.depth = make([]float64, r.w*r.w)
+	for i := range r.depth {
+		r.depth[i] = math.Inf(1)
+	}
+	r.colors = make([]vec3, r.w*r.w)
+	r.covered = make([]bool, r.w*r.w)
+	return r
+}
+
+// draw rasterizes one triangle with a depth test
+func (r *rasterizer) draw(t *rasterTriangle) {
+	var sx, sy, invz [3]float64
+	for i, v := range t.v {
+		d := v.pos.sub(r.eye)
+		z := d.dot(r.forward)
+		if z <= 1e-9 {
+			break
+		}
+		invz[i] = 1 / z
+		sx[i] = (d.dot(r.right)*r.focal*invz[i]*0.5 + 0.5) * float64(r.w)
+		sy[i] = (0.5 - d.dot(r.up)*r.focal*invz[i]*0.5) * float64(r.w)
+	}
+	if invz[0] == 0 || invz[1] == 0 || invz[2] == 0 {
+		return
+	}
+	area := (sx[1]-sx[0])*(sy[2]-sy[0]) - (sx[2]-sx[0])*(sy[1]-sy[0])
+	if math.Abs(area) < 1e-12 {
+		return
+	}
+	faceNormal := t.v[1].pos.sub(t.v[0].pos).cross(t.v[2].pos.sub(t.v[0].pos)).normalize()
+
+	x0 := int(math.Max(0, math.Floor(math.Min(sx[0], math.Min(sx[1], sx[2])))))
+	x1 := int(math.Min(float64(r.w-1), math.Ceil(math.Max(sx[0], math.Max(sx[1], sx[2])))))
+	y0 := int(math.Max(0, math.Floor(math.Min(sy[0], math.Min(sy[1], sy[2])))))
+	y1 := int(math.Min(float64(r.w-1), math.Ceil(math.Max(sy[0], math.Max(sy[1], sy[2])))))
+	for y := y0; y <= y1; y++ {
+		py := float64(y) + 0.5
+		for x := x0; x <= x1; x++ {
+			px := float64(x) + 0.5
+			// barycentric weights from the edge functions
+			b0 := ((sx[2]-sx[1])*(py-sy[1]) - (sy[2]-sy[1])*(px-sx[1])) / area
+			b1 := ((sx[0]-sx[2])*(py-sy[2]) - (sy[0]-sy[2])*(px-sx[2])) / area
+			b2 := 1 - b0 - b1
+			if b0 < 0 || b1 < 0 || b2 < 0 {
+				continue
+			}
+			// perspective-correct interpolation
+			p0, p1, p2 := b0*invz[0], b1*invz[1], b2*invz[2]
+			denom := p0 + p1 + p2
+			z := 1 / denom
+			i := y*r.w + x
+			if z >= r.depth[i] {
+				continue
+			}
+			p0, p1, p2 = p0/denom, p1/denom, p2/denom
+
+			base := t.mat.color
+			if t.mat.texture != nil {
+				u := p0*t.v[0].uv[0] + p1*t.v[1].uv[0] + p2*t.v[2].uv[0]
+				v := p0*t.v[0].uv[1] + p1*t.v[1].uv[1] + p2*t.v[2].uv[1]
+				texel := sampleTexture(t.mat.texture, u, v)
+				for c := 0; c < 4; c++ {
+					base[c] *= texel[c]
+				}
+			}
+			if t.mat.cutoff >= 0 && base[3] < t.mat.cutoff {
+				continue
+			}
+
+			n := faceNormal
+			if t.hasNormals {
+				n = t.v[0].normal.scale(p0).add(t.v[1].normal.scale(p1)).add(t.v[2].normal.scale(p2)).normalize()
+			}
+			if n.dot(r.toEye) < 0 {
+				n = n.scale(-1) // light back faces like front faces
+			}
+			light := 0.3 + 0.6*math.Max(0, n.dot(r.key)) + 0.25*math.Max(0, n.dot(r.toEye))
+
+			r.depth[i] = z
+			r.covered[i] = true
+			r.colors[i] = vec3{base[0] * light, base[1] * light, base[2] * light}
+		}
+	}
+}
+
+// sampleTexture returns the linear RGBA of img at (u, v) with repeat
+// wrapping and nearest filtering
+func sampleTexture(img image.Image, u, v float64) [4]float64 {
+	bnd := img.Bounds()
+	u -= math.Floor(u)
+	v -= math.Floor(v)
+	x := bnd.Min.X + int(u*float64(bnd.Dx()))
+	y := bnd.Min.Y + int(v*float64(bnd.Dy()))
+	if x >= bnd.Max.X {
+		x = bnd.Max.X - 1
+	}
+	if y >= bnd.Max.Y {
+		y = bnd.Max.Y - 1
+	}
+	c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	return [4]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B), float64(c.A) / 255}
+}
+
+func srgbToLinear(c uint8) float64 {
+	return math.Pow(float64(c)/255, 2.2)
+}
+
+func linearToSRGB(v float64) uint8 {
+	return uint8(math.Round(math.Pow(math.Min(math.Max(v, 0), 1), 1/2.2) * 255))
+}
+
+// image averages each block of supersamples into one pixel; the share of
+// covered samples becomes its alpha
+func (r *rasterizer) image() *image.NRGBA {
+	const s = thumbnailSupersample
+	size, w, colors, covered := r.size, r.w, r.colors, r.covered
+	out := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			var sum vec3
+			n := 0
+			for dy := 0; dy < s; dy++ {
+				for dx := 0; dx < s; dx++ {
+					i := (y*s+dy)*w + x*s + dx
+					if covered[i] {
+						sum = sum.add(colors[i])
+						n++
+					}
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			sum = sum.scale(1 / float64(n))
+			out.SetNRGBA(x, y, color.NRGBA{
+				R: linearToSRGB(sum[0]),
+				G: linearToSRGB(sum[1]),
+				B: linearToSRGB(sum[2]),
+				A: uint8(255 * n / (s * s)),
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// thumbnailName returns the file name of the preview of a model stored as
+// fileName: next to it, with the extension replaced. The same holds for
+// the file URL.
+func thumbnailName(fileName string) string {
+	return fileName[:len(fileName)-len(path.Ext(fileName))] + ".thumb.png"
+}
+
+// renderModelThumbnail renders the preview of model id next to its file
+// and records its URL; a version query makes browsers fetch a regenerated
+// preview
+func (s *Server) renderModelThumbnail(id uint) error {
+	m, err := s.store.GetModelByID(id)
+	if err != nil {
+		return err
+	}
+	baseDir := modelBaseDir(s.cfg, s.store, m)
+	img, err := renderThumbnail(filepath.Join(baseDir, filepath.FromSlash(m.FileName)), s.cfg.ThumbnailSize)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(baseDir, filepath.FromSlash(thumbnailName(m.FileName)))
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file private; the preview is served like the model
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := png.Encode(tmp, img); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	url := fmt.Sprintf("%s?v=%d", thumbnailName(m.FileURL), time.Now().Unix())
+	if err := s.store.SetModelThumbnail(id, url); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			// deleted while rendering
+			os.Remove(dst)
+		}
+		return err
+	}
+	return nil
+}
+
+// regenerateThumbnailHandler queues a new thumbnail for a model. Editors
+// may only do so for models in archives assigned to them.
+func (s *Server) regenerateThumbnailHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	m, err := s.store.GetModelByID(req.ID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": "Model not found"})
+		return
+	}
+	if !s.checkModelAccess(c, m) {
+		return
+	}
+	job, err := s.enqueueJob(m.ID, JobThumbnail)
+	if err != nil {
+		log.Printf("regenerateThumbnailHandler: queue job: %v", err)
+		c.JSON(500, gin.H{"error": "Error queueing thumbnail"})
+		return
+	}
+	c.JSON(202, gin.H{"message": "Thumbnail regeneration queued", "data": job})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestThumbnailName(t *testing.T) {
+	for name, want := range map[string]string{
+		"1700000000_chair.glb":                 "1700000000_chair.thumb.png",
+		"1700000000_house/house.gltf":          "1700000000_house/house.thumb.png",
+		"/api/archives/A/files/1_x.v2.glb":     "/api/archives/A/files/1_x.v2.thumb.png",
+		"/uploads/1700000000_dir.d/model.gltf": "/uploads/1700000000_dir.d/model.thumb.png",
+	} {
+		if got := thumbnailName(name); got != want {
+			t.Errorf("thumbnailName(%q) = %q", name, got)
+		}
+	}
+}
+
+func TestTriangleList(t *testing.T) {
+	idx := []uint32{0, 1, 2, 3, 4}
+	for mode, want := range map[int][]uint32{
+		4: {0, 1, 2},
+		5: {0, 1, 2, 2, 1, 3, 2, 3, 4},
+		6: {0, 1, 2, 0, 2, 3, 0, 3, 4},
+		0: nil,
+	} {
+		if got := triangleList(mode, idx); !reflect.DeepEqual(got, want) {
+			t.Errorf("mode %d: %v", mode, got)
+		}
+	}
+}
+
+func TestRenderThumbnail(t *testing.T) {
+	dir := t.TempDir()
+	img, err := renderThumbnail(writeTestFile(t, dir, "cube.glb", testGLB(t, testCube())), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 64 || img.Bounds().Dy() != 64 {
+		t.Fatalf("thumbnail of %v", img.Bounds())
+	}
+	// the cube fills the middle on a transparent background
+	if c := img.NRGBAAt(32, 32); c.A != 255 || c.R != c.G || c.G != c.B || c.R == 0 {
+		t.Fatalf("middle pixel %v, want opaque grey", c)
+	}
+	if c := img.NRGBAAt(0, 0); c.A != 0 {
+		t.Fatalf("corner pixel %v, want transparent", c)
+	}
+
+	// textures are sampled; the external files are resolved next to the model
+	gltf, bin, tex := texturedGLTF(t, "cube.bin", "textures/wall.png")
+	writeTestFile(t, dir, "cube.bin", bin)
+	writeTestFile(t, dir, "textures/wall.png", tex)
+	img, err = renderThumbnail(writeTestFile(t, dir, "cube.gltf", gltf), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.NRGBAAt(32, 32); c.A != 255 || c.R <= c.G || c.R <= c.B {
+		t.Fatalf("middle pixel %v, want the red texture", c)
+	}
+}
+
+// testPoints is a GLB of the corners of testCube as a point cloud
+func testPoints(t *testing.T) []byte {
+	t.Helper()
+	points := testCube()
+	points.indices = nil
+	doc, bin := testDoc(points)
+	mode := 0
+	doc.Meshes[0].Primitives[0].Mode = &mode
+	glb, err := encodeGLB(doc, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return glb
+}
+
+func TestRenderThumbnailOfNothing(t *testing.T) {
+	glb := testPoints(t)
+	if _, err := renderThumbnail(writeTestFile(t, t.TempDir(), "points.glb", glb), 64); !errors.Is(err, errNothingToRender) {
+		t.Fatalf("points rendered: %v", err)
+	}
+}
+
+func TestThumbnailJob(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.ThumbnailSize = 48 })
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	id := ts.uploadModel(admin, "cube.glb", testGLB(t, testCube()), nil)
+	ts.runJobs()
+
+	m, _ := ts.store.GetModelByID(id)
+	thumb, _, _ := strings.Cut(m.ThumbnailURL, "?v=")
+	if thumb != thumbnailName(m.FileURL) {
+		t.Fatalf("thumbnail_url %q", m.ThumbnailURL)
+	}
+	w := ts.do("GET", thumb, "", nil)
+	expectStatus(t, w, 200)
+	img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+	if err != nil || img.Bounds().Dx() != 48 {
+		t.Fatalf("served thumbnail: %v", err)
+	}
+
+	// regeneration is queued like the first render
+	expectStatus(t, ts.do("POST", "/api/models/thumbnail", admin, gin.H{"id": id}), 202)
+	if jobs, _ := ts.store.ListModelJobs(id); jobs[len(jobs)-1].Kind != JobThumbnail || jobs[len(jobs)-1].Status != JobQueued {
+		t.Fatalf("jobs %+v", jobs)
+	}
+	ts.runJobs()
+	expectStatus(t, ts.do("POST", "/api/models/thumbnail", admin, gin.H{"id": id + 100}), 404)
+	editor := ts.userToken("editor@test.com", RoleEditor)
+	expectStatus(t, ts.do("POST", "/api/models/thumbnail", editor, gin.H{"id": id}), 403)
+
+	// the preview goes with the model
+	path := filepath.Join(ts.cfg.UploadDir, thumbnailName(m.FileName))
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, ts.do("DELETE", "/api/models", admin, gin.H{"id": id}), 200)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("thumbnail left behind: %v", err)
+	}
+}
+
+func TestThumbnailJobWithoutTriangles(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	glb := testPoints(t)
+	id := ts.uploadModel(admin, "points.glb", glb, nil)
+	ts.runJobs()
+	m, _ := ts.store.GetModelByID(id)
+	if m.ThumbnailURL != "" || m.ProcessingStatus != ProcessingReady {
+		t.Fatalf("point cloud %+v", m)
+	}
+}
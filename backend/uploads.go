@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadOffsetHeader carries the number of bytes already staged, both in
+// append requests and in every answer about an upload
+const uploadOffsetHeader = "Upload-Offset"
+
+// Upload is a model file arriving in chunks. The client announces the file
+// with its size and SHA-256, appends chunks at Offset until it reaches Size,
+// then completes the upload, which creates the model like a plain upload.
+// The bytes are staged in UploadStagingDir/<id>.part.
+type Upload struct {
+	ID          string    `json:"id"`
+	UserID      uint      `json:"user_id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	ArchiveID   uint      `json:"archive_id,omitempty"`
+	FileName    string    `json:"file_name"` // original name of the file
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"` // lowercase hex
+	Offset      int64     `json:"offset"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// uploadLocks makes sure only one request at a time writes to an upload
+type uploadLocks struct {
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{busy: make(map[string]bool)}
+}
+
+// acquire claims id, reporting false if another request holds it
+func (l *uploadLocks) acquire(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	l.busy[id] = true
+	return true
+}
+
+func (l *uploadLocks) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.busy, id)
+}
+
+func (s *Server) stagingPath(id string) string {
+	return filepath.Join(s.cfg.UploadStagingDir, id+".part")
+}
+
+// sweepUploads discards expired uploads, staged files that no upload
+// refers to any more and multi-file models left half unpacked by a crash
+func (s *Server) sweepUploads() {
+	expired, err := s.store.ListExpiredUploads(time.Now())
+	if err != nil {
+		log.Printf("sweepUploads: list expired: %v", err)
+	}
+	for _, up := range expired {
+		if !s.uploads.acquire(up.ID) {
+			continue
+		}
+		if err := s.store.DeleteUpload(up.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("sweepUploads: delete %s: %v", up.ID, err)
+		} else if err := os.Remove(s.stagingPath(up.ID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove staged upload %s: %v", up.ID, err)
+		}
+		s.uploads.release(up.ID)
+	}
+
+	entries, err := os.ReadDir(s.cfg.UploadStagingDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "model-") {
+			if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > s.cfg.UploadExpiry.Duration {
+				os.RemoveAll(filepath.Join(s.cfg.UploadStagingDir, e.Name()))
+			}
+			continue
+		}
+		id, ok := strings.CutSuffix(e.Name(), ".part")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := s.store.GetUpload(id); errors.Is(err, ErrNotFound) {
+			if err := os.Remove(s.stagingPath(id)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to remove staged upload %s: %v", id, err)
+			}
+		}
+	}
+}
+
+// ownUpload fetches upload id of the caller; uploads of other users are
+// reported as missing
+func (s *Server) ownUpload(c *gin.Context, id string) (*Upload, bool) {
+	up, err := s.store.GetUpload(id)
+	if err != nil || up.UserID != c.GetUint("user_id") {
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			log.Printf("ownUpload: get %s: %v", id, err)
+		}
+		c.JSON(404, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	return up, true
+}
+
+// moveFile renames src to dst, copying when they are on different file
+// systems
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// fileSHA256 returns the lowercase hex SHA-256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ============ RESUMABLE UPLOAD HANDLERS ============
+// createUploadHandler announces a file. The target archive is checked now
+// and again on completion.
+func (s *Server) createUploadHandler(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name" binding:"required"`
+		Description string `json:"description"`
+		ArchiveID   uint   `json:"archive_id"`
+		FileName    string `json:"file_name" binding:"required"`
+		Size        int64  `json:"size" binding:"required,min=1"`
+		SHA256      string `json:"sha256" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request; name, file_name, size and sha256 are required"})
+		return
+	}
+	if req.Size > s.cfg.MaxResumableUploadSize {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("File exceeds the maximum upload size of %d bytes", s.cfg.MaxResumableUploadSize)})
+		return
+	}
+
+	fileName := filepath.Base(req.FileName)
+	fileExt := strings.ToLower(filepath.Ext(fileName))
+	if !modelExtension(fileExt) && fileExt != ".zip" {
+		c.JSON(400, gin.H{"error": uploadExtensionError})
+		return
+	}
+	sum := strings.ToLower(req.SHA256)
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		c.JSON(400, gin.H{"error": "sha256 must be the hex SHA-256 of the file"})
+		return
+	}
+
+	archiveIDStr := ""
+	if req.ArchiveID != 0 {
+		archiveIDStr = strconv.FormatUint(uint64(req.ArchiveID), 10)
+	}
+	_, arch, ok := s.uploadTarget(c, archiveIDStr)
+	if !ok {
+		return
+	}
+
+	s.sweepUploads()
+
+	id, err := generateRandomToken(16)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "Error creating upload"})
+		return
+	}
+	up := &Upload{
+		ID:          id,
+		UserID:      c.GetUint("user_id"),
+		Name:        req.Name,
+		Description: req.Description,
+		FileName:    fileName,
+		Size:        req.Size,
+		SHA256:      sum,
+		ExpiresAt:   time.Now().Add(s.cfg.UploadExpiry.Duration),
+	}
+	if arch != nil {
+		up.ArchiveID = arch.ID
+	}
+	if err := s.store.CreateUpload(up); err != nil {
+		log.Printf("createUploadHandler: create: %v", err)
+		c.JSON(500, gin.H{"error": "Error creating upload"})
+		return
+	}
+	f, err := os.OpenFile(s.stagingPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		log.Printf("createUploadHandler: create staging file: %v", err)
+		s.store.DeleteUpload(id)
+		c.JSON(500, gin.H{"error": "Error creating upload"})
+		return
+	}
+
+	c.Header(uploadOffsetHeader, "0")
+	c.Header("Location", "/api/uploads?id="+id)
+	c.JSON(201, gin.H{"message": "Upload created", "data": up})
+}
+
+// getUploadHandler reports how far an upload got, so a client can resume
+func (s *Server) getUploadHandler(c *gin.Context) {
+	up, ok := s.ownUpload(c, c.Query("id"))
+	if !ok {
+		return
+	}
+
+	c.Header(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+	c.Header("Cache-Control", "no-store")
+	c.JSON(200, gin.H{"message": "Upload retrieved", "data": up})
+}
+
+// appendUploadHandler writes the request body at Upload-Offset, which must
+// match what is already staged. Whatever arrives before a dropped
+// connection is kept, so the client resumes from the offset it gets back.
+func (s *Server) appendUploadHandler(c *gin.Context) {
+	id := c.Query("id")
+	if !s.uploads.acquire(id) {
+		c.JSON(409, gin.H{"error": "Another request is writing to this upload"})
+		return
+	}
+	defer s.uploads.release(id)
+	up, ok := s.ownUpload(c, id)
+	if !ok {
+		return
+	}
+
+	c.Header(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+	offset, err := strconv.ParseInt(c.GetHeader(uploadOffsetHeader), 10, 64)
+	if err != nil {
+		c.JSON(400, gin.H{"error": "Upload-Offset header is required"})
+		return
+	}
+	if offset != up.Offset {
+		c.JSON(409, gin.H{"error": "Upload-Offset does not match the staged size", "offset": up.Offset})
+		return
+	}
+
+	f, err := os.OpenFile(s.stagingPath(id), os.O_WRONLY, 0)
+	if err != nil {
+		log.Printf("appendUploadHandler: open %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Error writing upload"})
+		return
+	}
+	defer f.Close()
+	// drop bytes of an earlier write that never got recorded
+	if err := f.Truncate(up.Offset); err != nil {
+		log.Printf("appendUploadHandler: truncate %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Error writing upload"})
+		return
+	}
+	if _, err := f.Seek(up.Offset, io.SeekStart); err != nil {
+		log.Printf("appendUploadHandler: seek %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Error writing upload"})
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, up.Size-up.Offset)
+	n, copyErr := io.Copy(f, body)
+	var maxErr *http.MaxBytesError
+	if errors.As(copyErr, &maxErr) {
+		c.JSON(413, gin.H{"error": fmt.Sprintf("Chunk goes past the announced size of %d bytes", up.Size), "offset": up.Offset})
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("appendUploadHandler: sync %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Error writing upload"})
+		return
+	}
+
+	up.Offset += n
+	up.ExpiresAt = time.Now().Add(s.cfg.UploadExpiry.Duration)
+	if err := s.store.SetUploadOffset(id, up.Offset, up.ExpiresAt); err != nil {
+		log.Printf("appendUploadHandler: set offset %s: %v", id, err)
+		c.JSON(500, gin.H{"error": "Error writing upload"})
+		return
+	}
+	c.Header(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+	if copyErr != nil {
+		c.JSON(400, gin.H{"error": "Chunk was cut short; resume at the returned offset", "offset": up.Offset})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Chunk stored", "data": up})
+}
+
+// completeUploadHandler checks the staged file against the announced
+// SHA-256 and turns it into a model
+func (s *Server) completeUploadHandler(c *gin.Context) {
+	var req struct {
+		ID string `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !s.uploads.acquire(req.ID) {
+		c.JSON(409, gin.H{"error": "Another request is writing to this upload"})
+		return
+	}
+	defer s.uploads.release(req.ID)
+	up, ok := s.ownUpload(c, req.ID)
+	if !ok {
+		return
+	}
+	if up.Offset != up.Size {
+		c.Header(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+		c.JSON(409, gin.H{"error": "Upload is incomplete", "offset": up.Offset})
+		return
+	}
+
+	staged := s.stagingPath(up.ID)
+	sum, err := fileSHA256(staged)
+	if err != nil {
+		log.Printf("completeUploadHandler: hash %s: %v", up.ID, err)
+		c.JSON(500, gin.H{"error": "Error reading upload"})
+		return
+	}
+	if sum != up.SHA256 {
+		// there is no telling which chunk is bad, so the client starts over
+		if err := s.store.DeleteUpload(up.ID); err != nil {
+			log.Printf("completeUploadHandler: delete %s: %v", up.ID, err)
+		}
+		os.Remove(staged)
+		c.JSON(422, gin.H{"error": "Checksum mismatch; the upload was discarded"})
+		return
+	}
+	if ext := strings.ToLower(filepath.Ext(up.FileName)); ext == ".zip" || importFormat(ext) != "" {
+		s.completeStagedUpload(c, up)
+		return
+	}
+	f, err := os.Open(staged)
+	if err != nil {
+		log.Printf("completeUploadHandler: open %s: %v", up.ID, err)
+		c.JSON(500, gin.H{"error": "Error reading upload"})
+		return
+	}
+	valid := checkModelFile(c, f, up.Size, strings.ToLower(filepath.Ext(up.FileName)), nil)
+	f.Close()
+	if !valid {
+		// the bytes match what the client announced, so retrying cannot help
+		if err := s.store.DeleteUpload(up.ID); err != nil {
+			log.Printf("completeUploadHandler: delete %s: %v", up.ID, err)
+		}
+		os.Remove(staged)
+		return
+	}
+
+	archiveIDStr := ""
+	if up.ArchiveID != 0 {
+		archiveIDStr = strconv.FormatUint(uint64(up.ArchiveID), 10)
+	}
+	destDir, arch, ok := s.uploadTarget(c, archiveIDStr)
+	if !ok {
+		return
+	}
+
+	fileName := fmt.Sprintf("%d_%s", time.Now().Unix(), up.FileName)
+	filePath := filepath.Join(destDir, fileName)
+	if err := moveFile(staged, filePath); err != nil {
+		log.Printf("completeUploadHandler: move %s: %v", up.ID, err)
+		c.JSON(500, gin.H{"error": "Error saving file"})
+		return
+	}
+	if err := s.store.DeleteUpload(up.ID); err != nil {
+		log.Printf("completeUploadHandler: delete %s: %v", up.ID, err)
+	}
+
+	s.createUploadedModel(c, up.Name, up.Description, destDir, storedModel{fileName: fileName, size: up.Size}, arch)
+}
+
+// completeStagedUpload stores the model of a completed upload that needs a
+// directory of its own: a zip, which is unpacked, or a file to convert. A
+// zip or model that is rejected is discarded, as retrying the same bytes
+// cannot help.
+func (s *Server) completeStagedUpload(c *gin.Context, up *Upload) {
+	archiveIDStr := ""
+	if up.ArchiveID != 0 {
+		archiveIDStr = strconv.FormatUint(uint64(up.ArchiveID), 10)
+	}
+	destDir, arch, ok := s.uploadTarget(c, archiveIDStr)
+	if !ok {
+		return
+	}
+
+	staged := s.stagingPath(up.ID)
+	stored, ok := s.storeModelFiles(c, destDir, false, func(dir string) (string, error) {
+		if !strings.EqualFold(filepath.Ext(up.FileName), ".zip") {
+			// copied, so the upload can be completed again after a failure
+			return up.FileName, copyFile(staged, filepath.Join(dir, up.FileName))
+		}
+		f, err := os.Open(staged)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		return extractZip(f, up.Size, dir, s.cfg.MaxResumableUploadSize)
+	})
+	if !ok && c.Writer.Status() >= 500 {
+		return
+	}
+	if err := s.store.DeleteUpload(up.ID); err != nil {
+		log.Printf("completeStagedUpload: delete %s: %v", up.ID, err)
+	}
+	os.Remove(staged)
+	if ok {
+		s.createUploadedModel(c, up.Name, up.Description, destDir, stored, arch)
+	}
+}
+
+// cancelUploadHandler discards an upload and its staged bytes
+func (s *Server) cancelUploadHandler(c *gin.Context) {
+	var req struct {
+		ID string `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "Invalid request"})
+		return
+	}
+	if !s.uploads.acquire(req.ID) {
+		c.JSON(409, gin.H{"error": "Another request is writing to this upload"})
+		return
+	}
+	defer s.uploads.release(req.ID)
+	up, ok := s.ownUpload(c, req.ID)
+	if !ok {
+		return
+	}
+
+	if err := s.store.DeleteUpload(up.ID); err != nil {
+		log.Printf("cancelUploadHandler: delete %s: %v", up.ID, err)
+		c.JSON(500, gin.H{"error": "Error cancelling upload"})
+		return
+	}
+	if err := os.Remove(s.stagingPath(up.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove staged upload %s: %v", up.ID, err)
+	}
+
+	c.JSON(200, gin.H{"message": "Upload cancelled"})
+}
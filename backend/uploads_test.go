@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startUpload announces data as a resumable upload and returns its id
+func (ts *testServer) startUpload(token, fileName string, data []byte, sum string) string {
+	ts.t.Helper()
+	if sum == "" {
+		h := sha256.Sum256(data)
+		sum = hex.EncodeToString(h[:])
+	}
+	w := ts.do("POST", "/api/uploads", token, gin.H{"name": fileName, "file_name": fileName, "size": len(data), "sha256": sum})
+	expectStatus(ts.t, w, 201)
+	if w.Header().Get(uploadOffsetHeader) != "0" {
+		ts.t.Fatalf("new upload at offset %q", w.Header().Get(uploadOffsetHeader))
+	}
+	var resp struct {
+		Data Upload `json:"data"`
+	}
+	decodeJSON(ts.t, w, &resp)
+	return resp.Data.ID
+}
+
+// appendChunk sends chunk at offset and returns the response
+func (ts *testServer) appendChunk(token, id string, offset int, chunk []byte) int {
+	ts.t.Helper()
+	w := ts.do("PATCH", "/api/uploads?id="+id, token, chunk, uploadOffsetHeader, strconv.Itoa(offset))
+	if w.Code == 200 {
+		if got := w.Header().Get(uploadOffsetHeader); got != strconv.Itoa(offset+len(chunk)) {
+			ts.t.Fatalf("offset after chunk %q", got)
+		}
+	}
+	return w.Code
+}
+
+func TestResumableUpload(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	glb := testGLB(t, testCube())
+	half := len(glb) / 2
+	id := ts.startUpload(token, "cube.glb", glb, "")
+
+	if code := ts.appendChunk(token, id, 0, glb[:half]); code != 200 {
+		t.Fatalf("first chunk: %d", code)
+	}
+	expectStatus(t, ts.do("POST", "/api/uploads/complete", token, gin.H{"id": id}), 409)
+
+	// a client that lost track asks where to resume
+	w := ts.do("GET", "/api/uploads?id="+id, token, nil)
+	expectStatus(t, w, 200)
+	if w.Header().Get(uploadOffsetHeader) != strconv.Itoa(half) {
+		t.Fatalf("resume offset %q", w.Header().Get(uploadOffsetHeader))
+	}
+	if code := ts.appendChunk(token, id, 0, glb[:half]); code != 409 {
+		t.Fatalf("chunk at a stale offset: %d", code)
+	}
+	expectStatus(t, ts.do("PATCH", "/api/uploads?id="+id, token, glb[half:]), 400)
+	if code := ts.appendChunk(token, id, half, append(glb[half:], 0)); code != 413 {
+		t.Fatalf("chunk past the size: %d", code)
+	}
+	if code := ts.appendChunk(token, id, half, glb[half:]); code != 200 {
+		t.Fatalf("last chunk: %d", code)
+	}
+
+	w = ts.do("POST", "/api/uploads/complete", token, gin.H{"id": id})
+	expectStatus(t, w, 201)
+	var resp struct {
+		Data GLBModel `json:"data"`
+	}
+	decodeJSON(t, w, &resp)
+	m, err := ts.store.GetModelByID(resp.Data.ID)
+	if err != nil || m.FileSize != int64(len(glb)) {
+		t.Fatalf("model %+v: %v", m, err)
+	}
+	if _, err := os.Stat(ts.stagingPath(id)); !os.IsNotExist(err) {
+		t.Fatalf("staged file left behind: %v", err)
+	}
+	expectStatus(t, ts.do("GET", "/api/uploads?id="+id, token, nil), 404)
+}
+
+func TestResumableUploadChecksumMismatch(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	glb := testGLB(t, testCube())
+	other := sha256.Sum256([]byte("something else"))
+	id := ts.startUpload(token, "cube.glb", glb, hex.EncodeToString(other[:]))
+
+	if code := ts.appendChunk(token, id, 0, glb); code != 200 {
+		t.Fatalf("chunk: %d", code)
+	}
+	expectStatus(t, ts.do("POST", "/api/uploads/complete", token, gin.H{"id": id}), 422)
+	expectStatus(t, ts.do("GET", "/api/uploads?id="+id, token, nil), 404)
+	if models, _ := ts.store.ListModels(0); len(models) != 0 {
+		t.Fatalf("model created from a bad upload: %+v", models)
+	}
+}
+
+func TestResumableUploadRequests(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) { c.MaxResumableUploadSize = 1000 })
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	sum := hex.EncodeToString(make([]byte, sha256.Size))
+	for _, tc := range []struct {
+		req  gin.H
+		want int
+	}{
+		{gin.H{"name": "x", "file_name": "x.glb", "size": 1001, "sha256": sum}, 413},
+		{gin.H{"name": "x", "file_name": "x.exe", "size": 10, "sha256": sum}, 400},
+		{gin.H{"name": "x", "file_name": "x.glb", "size": 10, "sha256": "abc"}, 400},
+		{gin.H{"name": "x", "file_name": "x.glb", "sha256": sum}, 400},
+	} {
+		if w := ts.do("POST", "/api/uploads", token, tc.req); w.Code != tc.want {
+			t.Errorf("%v: %d %s, want %d", tc.req, w.Code, w.Body, tc.want)
+		}
+	}
+	viewer := ts.userToken("viewer@test.com", RoleUser)
+	expectStatus(t, ts.do("POST", "/api/uploads", viewer, gin.H{"name": "x", "file_name": "x.glb", "size": 10, "sha256": sum}), 403)
+}
+
+func TestResumableUploadBelongsToItsUser(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.userToken("admin@test.com", RoleAdmin)
+	other := ts.userToken("editor@test.com", RoleEditor)
+	glb := testGLB(t, testCube())
+	id := ts.startUpload(token, "cube.glb", glb, "")
+
+	expectStatus(t, ts.do("GET", "/api/uploads?id="+id, other, nil), 404)
+	if code := ts.appendChunk(other, id, 0, glb); code != 404 {
+		t.Fatalf("chunk from another user: %d", code)
+	}
+	expectStatus(t, ts.do("POST", "/api/uploads/complete", other, gin.H{"id": id}), 404)
+	expectStatus(t, ts.do("DELETE", "/api/uploads", other, gin.H{"id": id}), 404)
+
+	expectStatus(t, ts.do("DELETE", "/api/uploads", token, gin.H{"id": id}), 200)
+	expectStatus(t, ts.do("GET", "/api/uploads?id="+id, token, nil), 404)
+	if _, err := os.Stat(ts.stagingPath(id)); !os.IsNotExist(err) {
+		t.Fatalf("staged file left behind: %v", err)
+	}
+}
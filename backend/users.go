@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errLastAdmin = errors.New("cannot remove the last enabled admin")
+
+// bootstrapAdmin makes sure an enabled admin exists. Without one, the account
+// named by BOOTSTRAP_ADMIN_EMAIL is promoted (and re-enabled) or created;
+// if no password is configured for a new account a random one is generated
+// and logged once.
+func bootstrapAdmin(cfg Config, store Store) error {
+	n, err := store.CountEnabledUsers(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	if cfg.BootstrapAdminEmail == "" {
+		log.Printf("Warning: no admin account exists; set BOOTSTRAP_ADMIN_EMAIL (and optionally BOOTSTRAP_ADMIN_PASSWORD) and restart to create one")
+		return nil
+	}
+
+	existing, err := store.GetUserByEmail(cfg.BootstrapAdminEmail)
+	switch {
+	case err == nil:
+		if _, err := store.UpdateUserRole(existing.ID, RoleAdmin); err != nil {
+			return err
+		}
+		if _, err := store.SetUserDisabled(existing.ID, false); err != nil {
+			return err
+		}
+		log.Printf("Promoted %s to admin", existing.Email)
+		return nil
+	case !errors.Is(err, ErrNotFound):
+		return err
+	}
+
+	password := cfg.BootstrapAdminPassword
+	generated := password == ""
+	if generated {
+		if password, err = generateRandomToken(12); err != nil {
+			return err
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	if err := store.CreateUser(&User{Email: cfg.BootstrapAdminEmail, PasswordHash: string(hash), Role: RoleAdmin}); err != nil {
+		return fmt.Errorf("create admin %s: %w", cfg.BootstrapAdminEmail, err)
+	}
+	if generated {
+		log.Printf("Created admin %s with password %s (shown only once; change it after logging in)", cfg.BootstrapAdminEmail, password)
+	} else {
+		log.Printf("Created admin %s", cfg.BootstrapAdminEmail)
+	}
+	return nil
+}
+
+// checkNotLastAdmin fails if taking user out of the admin role (or
+// disabling it) would leave no enabled admin
+func (s *Server) checkNotLastAdmin(user *User) error {
+	if user.Role != RoleAdmin || user.DisabledAt != nil {
+		return nil
+	}
+	n, err := s.store.CountEnabledUsers(RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if n <= 1 {
+		return errLastAdmin
+	}
+	return nil
+}
+
+// ============ USER HANDLERS ============
+func (s *Server) listUsersHandler(c *gin.Context) {
+	users, err := s.store.ListUsers()
+	if err != nil {
+		log.Printf("listUsersHandler: list users: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to list users"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "Users retrieved", "data": users})
+}
+
+func (s *Server) createUserHandler(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required,email"`
+		Password string `json:"password" binding:"required,min=6"`
+		Role     string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	if req.Role == "" {
+		req.Role = RoleUser
+	}
+	if !validRole(req.Role) {
+		c.JSON(400, ErrorResponse{Error: "Unknown role"})
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(500, ErrorResponse{Error: "Error processing password"})
+		return
+	}
+	user := &User{Email: req.Email, PasswordHash: string(hash), Role: req.Role}
+	if err := s.store.CreateUser(user); err != nil {
+		if errors.Is(err, ErrConflict) {
+			c.JSON(409, ErrorResponse{Error: "Email already exists"})
+			return
+		}
+		log.Printf("createUserHandler: create user: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Error creating user"})
+		return
+	}
+
+	c.JSON(201, gin.H{"message": "User created", "data": user})
+}
+
+// updateUserHandler changes the role and/or disabled state of a user. Fields
+// left out are unchanged. Disabling signs the user out everywhere.
+func (s *Server) updateUserHandler(c *gin.Context) {
+	var req struct {
+		ID       uint    `json:"id" binding:"required"`
+		Role     *string `json:"role"`
+		Disabled *bool   `json:"disabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	if req.Role != nil && !validRole(*req.Role) {
+		c.JSON(400, ErrorResponse{Error: "Unknown role"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(req.ID)
+	if err != nil {
+		c.JSON(404, ErrorResponse{Error: "User not found"})
+		return
+	}
+	demote := req.Role != nil && *req.Role != user.Role
+	disable := req.Disabled != nil && *req.Disabled
+	if (demote || disable) && user.ID == c.GetUint("user_id") {
+		c.JSON(400, ErrorResponse{Error: "You cannot change your own role or disable your own account"})
+		return
+	}
+	if demote || disable {
+		if err := s.checkNotLastAdmin(user); err != nil {
+			if errors.Is(err, errLastAdmin) {
+				c.JSON(409, ErrorResponse{Error: "Cannot remove the last enabled admin"})
+				return
+			}
+			log.Printf("updateUserHandler: count admins: %v", err)
+			c.JSON(500, ErrorResponse{Error: "Failed to update user"})
+			return
+		}
+	}
+
+	if req.Role != nil {
+		if user, err = s.store.UpdateUserRole(user.ID, *req.Role); err != nil {
+			log.Printf("updateUserHandler: update role of %d: %v", req.ID, err)
+			c.JSON(500, ErrorResponse{Error: "Failed to update user"})
+			return
+		}
+	}
+	if req.Disabled != nil {
+		if user, err = s.store.SetUserDisabled(user.ID, *req.Disabled); err != nil {
+			log.Printf("updateUserHandler: set disabled of %d: %v", req.ID, err)
+			c.JSON(500, ErrorResponse{Error: "Failed to update user"})
+			return
+		}
+		if disable {
+			if err := s.store.RevokeUserSessions(user.ID); err != nil {
+				log.Printf("updateUserHandler: revoke sessions of %d: %v", req.ID, err)
+			}
+		}
+	}
+
+	c.JSON(200, gin.H{"message": "User updated", "data": user})
+}
+
+func (s *Server) deleteUserHandler(c *gin.Context) {
+	var req struct {
+		ID uint `json:"id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+	if req.ID == c.GetUint("user_id") {
+		c.JSON(400, ErrorResponse{Error: "You cannot delete your own account"})
+		return
+	}
+
+	user, err := s.store.GetUserByID(req.ID)
+	if err != nil {
+		c.JSON(404, ErrorResponse{Error: "User not found"})
+		return
+	}
+	if err := s.checkNotLastAdmin(user); err != nil {
+		if errors.Is(err, errLastAdmin) {
+			c.JSON(409, ErrorResponse{Error: "Cannot remove the last enabled admin"})
+			return
+		}
+		log.Printf("deleteUserHandler: count admins: %v", err)
+		c.JSON(500, ErrorResponse{Error: "Failed to delete user"})
+		return
+	}
+
+	if err := s.store.DeleteUser(user.ID); err != nil {
+		log.Printf("deleteUserHandler: delete %d: %v", req.ID, err)
+		c.JSON(500, ErrorResponse{Error: "Failed to delete user"})
+		return
+	}
+
+	c.JSON(200, gin.H{"message": "User deleted"})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestInitDataPrintsOnlyCreatedAccounts(t *testing.T) {
+	store := NewMemoryStore()
+	store.CreateUser(&User{Email: "editor@test.com", PasswordHash: "x", Role: RoleEditor})
+
+	var out bytes.Buffer
+	initData(store, &out)
+	if s := out.String(); !strings.Contains(s, "admin@test.com") || !strings.Contains(s, "user@test.com") || strings.Contains(s, "editor@test.com") {
+		t.Fatalf("first start printed %q", s)
+	}
+	if users, _ := store.ListUsers(); len(users) != 3 {
+		t.Fatalf("%d users after seeding", len(users))
+	}
+
+	out.Reset()
+	initData(store, &out)
+	if out.Len() != 0 {
+		t.Fatalf("second start printed %q", out.String())
+	}
+}
+
+func TestSeedTestUsersIsDevelopmentOnly(t *testing.T) {
+	t.Setenv("SEED_TEST_USERS", "true")
+	t.Setenv("BACKEND_ENV", "production")
+	t.Setenv("JWT_SECRET", strings.Repeat("s", 32))
+	if _, err := LoadConfig("", false); err == nil || !strings.Contains(err.Error(), "seed_test_users") {
+		t.Fatalf("seeding in production: %v", err)
+	}
+	t.Setenv("BACKEND_ENV", "development")
+	cfg, err := LoadConfig("", false)
+	if err != nil || !cfg.SeedTestUsers {
+		t.Fatalf("seeding in development: %v", err)
+	}
+	if DefaultConfig().SeedTestUsers {
+		t.Fatal("test accounts are seeded by default")
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	store := NewMemoryStore()
+	cfg := DefaultConfig()
+	if err := bootstrapAdmin(cfg, store); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := store.ListUsers(); len(users) != 0 {
+		t.Fatal("admin created without BOOTSTRAP_ADMIN_EMAIL")
+	}
+
+	existing := &User{Email: "boss@test.com", PasswordHash: "x", Role: RoleUser}
+	store.CreateUser(existing)
+	store.SetUserDisabled(existing.ID, true)
+	cfg.BootstrapAdminEmail = "boss@test.com"
+	if err := bootstrapAdmin(cfg, store); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := store.GetUserByID(existing.ID); u.Role != RoleAdmin || u.DisabledAt != nil {
+		t.Fatalf("bootstrap account %+v", u)
+	}
+
+	// with an admin in place nothing changes
+	cfg.BootstrapAdminEmail = "other@test.com"
+	bootstrapAdmin(cfg, store)
+	if _, err := store.GetUserByEmail("other@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second admin created: %v", err)
+	}
+}
+
+func TestUserManagement(t *testing.T) {
+	ts := newTestServer(t)
+	admin := ts.userToken("admin@test.com", RoleAdmin)
+	self, _ := ts.store.GetUserByEmail("admin@test.com")
+	user := ts.userToken("user@test.com", RoleUser)
+
+	expectStatus(t, ts.do("GET", "/api/users", user, nil), 403)
+	expectStatus(t, ts.do("POST", "/api/users", admin, gin.H{"email": "new@test.com", "password": "secret123", "role": "root"}), 400)
+	w := ts.do("POST", "/api/users", admin, gin.H{"email": "new@test.com", "password": "secret123", "role": RoleEditor})
+	expectStatus(t, w, 201)
+	var created struct {
+		Data User `json:"data"`
+	}
+	decodeJSON(t, w, &created)
+	expectStatus(t, ts.do("POST", "/api/users", admin, gin.H{"email": "new@test.com", "password": "secret123"}), 409)
+
+	newToken := ts.login("new@test.com", "secret123").Token
+	expectStatus(t, ts.do("PUT", "/api/users", admin, gin.H{"id": created.Data.ID, "role": RoleUser}), 200)
+	if u, _ := ts.store.GetUserByID(created.Data.ID); u.Role != RoleUser {
+		t.Fatalf("role %q", u.Role)
+	}
+
+	// disabling signs the user out and blocks login
+	expectStatus(t, ts.do("PUT", "/api/users", admin, gin.H{"id": created.Data.ID, "disabled": true}), 200)
+	expectStatus(t, ts.do("GET", "/api/user/profile", newToken, nil), 401)
+	expectStatus(t, ts.do("POST", "/api/auth/login", "", gin.H{"email": "new@test.com", "password": "secret123"}), 403)
+
+	expectStatus(t, ts.do("PUT", "/api/users", admin, gin.H{"id": self.ID, "role": RoleUser}), 400)
+	expectStatus(t, ts.do("DELETE", "/api/users", admin, gin.H{"id": self.ID}), 400)
+	expectStatus(t, ts.do("DELETE", "/api/users", admin, gin.H{"id": created.Data.ID}), 200)
+	expectStatus(t, ts.do("DELETE", "/api/users", admin, gin.H{"id": created.Data.ID}), 404)
+}
+
+func TestCheckNotLastAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	a := ts.addUser("a@test.com", "secret123", RoleAdmin)
+	if err := ts.checkNotLastAdmin(a); !errors.Is(err, errLastAdmin) {
+		t.Fatalf("only admin: %v", err)
+	}
+	b := ts.addUser("b@test.com", "secret123", RoleAdmin)
+	if err := ts.checkNotLastAdmin(a); err != nil {
+		t.Fatalf("two admins: %v", err)
+	}
+	ts.store.SetUserDisabled(b.ID, true)
+	if err := ts.checkNotLastAdmin(a); !errors.Is(err, errLastAdmin) {
+		t.Fatalf("other admin disabled: %v", err)
+	}
+	if err := ts.checkNotLastAdmin(&User{Role: RoleUser}); err != nil {
+		t.Fatalf("non-admin: %v", err)
+	}
+}
@@ -1,15 +1,51 @@
-import { getModels, listArchives, createArchive, deleteArchive } from './api.js';
+import { getModels, listArchives, createArchive, deleteArchive, createArchiveToken, rotateArchiveToken, revokeArchiveToken, authFetch, logoutUser, changePassword, listAPIKeys, createAPIKey, revokeAPIKey, uploadModelResumable, describeUploadError, loadThumbnails, regenerateThumbnail, optimizeModel, regenerateLODs, downloadFile } from './api.js';
+
+window.logout = async function() {
+    await logoutUser();
+    localStorage.clear();
+    window.location.href = './index.html';
+};
+
+// Change the password; the server signs out every other session
+window.changePassword = async function() {
+    const current = prompt('Password saat ini:');
+    if (!current) return;
+    const next = prompt('Password baru (minimal 6 karakter):');
+    if (!next) return;
+    if (prompt('Ulangi password baru:') !== next) {
+        alert('Password baru tidak sama');
+        return;
+    }
+    try {
+        await changePassword(current, next);
+        alert('Password berhasil diganti. Sesi di perangkat lain telah dikeluarkan.');
+    } catch (err) {
+        alert('Gagal mengganti password: ' + err.message);
+    }
+};
+
+// permissions granted to the logged in user's role, as returned by login
+function can(permission) {
+    const stored = localStorage.getItem('permissions');
+    // sessions from before permissions existed: admins could do everything
+    if (stored === null) return localStorage.getItem('role') === 'admin';
+    return JSON.parse(stored).includes(permission);
+}
 
 // Check authorization
 function checkAuth() {
     const token = localStorage.getItem('token');
-    const role = localStorage.getItem('role');
-    
-    if (!token || role !== 'admin') {
+
+    if (!token || !(can('models:upload') || can('archives:manage'))) {
         window.location.href = './index.html';
         return;
     }
 
+    // editors only upload into their archives
+    if (!can('archives:manage')) {
+        document.getElementById('createArchiveBtn').style.display = 'none';
+    }
+
     const user = JSON.parse(localStorage.getItem('user'));
     document.getElementById('userEmail').textContent = user.email;
 }
@@ -29,6 +65,57 @@ async function loadModels() {
     }
 }
 
+// models above these budgets tend to stutter or crash in mobile browsers
+const MOBILE_TRIANGLE_BUDGET = 500000;
+const MOBILE_TEXTURE_BUDGET = 16;
+
+function modelStats(model) {
+    const md = model.metadata;
+    if (!md) return '';
+    const heavy = md.triangles > MOBILE_TRIANGLE_BUDGET || md.textures > MOBILE_TEXTURE_BUDGET;
+    const ext = md.extensions.length ? ` | Ekstensi: ${md.extensions.join(', ')}` : '';
+    const lods = (model.lods || []).length ? ` | LOD: ${model.lods.map(l => l.triangles.toLocaleString()).join(' / ')}` : '';
+    return `
+            <p class="model-info">Segitiga: ${md.triangles.toLocaleString()} | Vertex: ${md.vertices.toLocaleString()} | Tekstur: ${md.textures} | Animasi: ${md.animations}${ext}${lods}</p>
+            ${heavy ? '<p class="model-info model-heavy">⚠ Terlalu berat untuk viewer mobile</p>' : ''}`;
+}
+
+const PROCESSING_LABELS = {
+    pending: '⏳ Menunggu diproses',
+    processing: '⚙ Sedang diproses',
+    failed: '✖ Pemrosesan gagal'
+};
+
+// sourceInfo links the uploaded file a converted model was made from
+function sourceInfo(model) {
+    if (!model.source_url) return '';
+    return `
+            <p class="model-info">Dikonversi dari ${model.source_format.toUpperCase()} | <a href="#" onclick="downloadSource('${model.source_url}'); return false;">Unduh file asli</a></p>`;
+}
+
+window.downloadSource = async function(url) {
+    try {
+        await downloadFile(url);
+    } catch (err) {
+        showMessage('Gagal mengunduh file asli: ' + err.message, 'error');
+    }
+};
+
+// uploadedMessage confirms an upload, listing what a conversion left out
+function uploadedMessage(result) {
+    const warnings = (result && result.data && result.data.warnings) || [];
+    if (warnings.length === 0) return 'Model uploaded successfully!';
+    return 'Model uploaded successfully, dengan catatan konversi:\n' + warnings.join('\n');
+}
+
+// processingInfo shows the post-upload job status until a model is ready
+function processingInfo(model) {
+    const label = PROCESSING_LABELS[model.processing_status];
+    if (!label) return '';
+    return `
+            <p class="model-info model-${model.processing_status}">${label}</p>`;
+}
+
 function displayModels(models) {
     const container = document.getElementById('modelsList');
     if (models.length === 0) {
@@ -38,27 +125,57 @@ function displayModels(models) {
 
     container.innerHTML = models.map(model => `
         <div class="model-card">
+            <img class="model-thumb" data-thumb-id="${model.id}" alt="">
             <h3>${model.name}</h3>
             <p>${model.description || 'No description'}</p>
             <p class="model-info">Upload: ${model.uploaded_by}</p>
-            <p class="model-info">Size: ${(model.file_size / 1024).toFixed(2)} KB</p>
+            <p class="model-info">Size: ${(model.file_size / 1024).toFixed(2)} KB${model.optimized_url ? ` (teroptimasi ${(model.optimized_size / 1024).toFixed(2)} KB)` : ''}</p>${sourceInfo(model)}${modelStats(model)}${processingInfo(model)}
             <button onclick="viewModel(${model.id})" class="btn btn-small">View</button>
-            <button onclick="deleteModel(${model.id})" class="btn btn-danger btn-small">Delete</button>
+            ${can('models:upload') ? `<button onclick="refreshThumbnail(${model.id})" class="btn btn-small">Thumbnail</button>` : ''}
+            ${can('models:upload') ? `<button onclick="refreshOptimized(${model.id})" class="btn btn-small">Optimasi</button>` : ''}
+            ${can('models:upload') ? `<button onclick="refreshLODs(${model.id})" class="btn btn-small">LOD</button>` : ''}
+            ${can('models:delete') ? `<button onclick="deleteModel(${model.id})" class="btn btn-danger btn-small">Delete</button>` : ''}
         </div>
     `).join('');
+    loadThumbnails(container, models);
 }
 
+window.refreshThumbnail = async function(id) {
+    try {
+        await regenerateThumbnail(id);
+        showMessage('Thumbnail sedang dibuat ulang dan akan muncul otomatis', 'success');
+    } catch (err) {
+        showMessage('Gagal membuat ulang thumbnail: ' + err.message, 'error');
+    }
+};
+
+window.refreshOptimized = async function(id) {
+    try {
+        await optimizeModel(id);
+        showMessage('Versi teroptimasi sedang dibuat; model yang sudah ringkas tetap memakai file asli', 'success');
+    } catch (err) {
+        showMessage('Gagal mengoptimasi model: ' + err.message, 'error');
+    }
+};
+
+window.refreshLODs = async function(id) {
+    try {
+        await regenerateLODs(id);
+        showMessage('LOD sedang dibuat ulang; model yang ringan tidak mendapat LOD', 'success');
+    } catch (err) {
+        showMessage('Gagal membuat LOD: ' + err.message, 'error');
+    }
+};
+
 window._deleteModelFn = async function(id) {
     if (!confirm('Delete model ini?')) return;
     console.log('Deleting model (fn) ->', id);
     try {
-        const token = localStorage.getItem('token');
         const controller = new AbortController();
         const timeoutId = setTimeout(() => controller.abort(), 15000);
-        const response = await fetch(`http://localhost:8080/api/models`, {
+        const response = await authFetch(`http://localhost:8080/api/models`, {
             method: 'DELETE',
             headers: {
-                'Authorization': `Bearer ${token}`,
                 'Content-Type': 'application/json'
             },
             body: JSON.stringify({ id: id }),
@@ -84,6 +201,9 @@ window._deleteModelFn = async function(id) {
     }
 };
 
+// files above this size are uploaded in resumable chunks
+const RESUMABLE_UPLOAD_THRESHOLD = 50 * 1024 * 1024;
+
 // Handle upload
 document.getElementById('uploadForm').addEventListener('submit', async (e) => {
     e.preventDefault();
@@ -91,30 +211,47 @@ document.getElementById('uploadForm').addEventListener('submit', async (e) => {
     const name = document.getElementById('modelName').value;
     const description = document.getElementById('modelDescription').value;
     const file = document.getElementById('modelFile').files[0];
+    const resources = Array.from(document.getElementById('modelResources').files);
+
+    // a .gltf with its resources goes in one request; zip them for large models
+    if (file && file.size > RESUMABLE_UPLOAD_THRESHOLD && resources.length === 0) {
+        const progress = document.getElementById('uploadProgress');
+        progress.value = 0;
+        progress.style.display = 'block';
+        try {
+            const archiveId = document.getElementById('archiveSelect').value || '';
+            const result = await uploadModelResumable(file, name, description, archiveId, (p) => { progress.value = p; });
+            showMessage(uploadedMessage(result), 'success');
+            document.getElementById('uploadForm').reset();
+            loadModels();
+        } catch (error) {
+            showMessage('Upload failed: ' + error.message, 'error');
+        } finally {
+            progress.style.display = 'none';
+        }
+        return;
+    }
 
     try {
-        const token = localStorage.getItem('token');
         const formData = new FormData();
         formData.append('file', file);
         formData.append('name', name);
         formData.append('description', description);
+        resources.forEach(r => formData.append('resources', r));
 
         const archiveId = document.getElementById('archiveSelect').value || '';
-        const response = await fetch('http://localhost:8080/api/models/upload', {
+        const response = await authFetch('http://localhost:8080/api/models/upload', {
             method: 'POST',
-            headers: {
-                'Authorization': `Bearer ${token}`
-            },
             body: (function(){ formData.append('archive_id', archiveId); return formData })()
         });
 
         if (response.ok) {
-            showMessage('Model uploaded successfully!', 'success');
+            showMessage(uploadedMessage(await response.json()), 'success');
             document.getElementById('uploadForm').reset();
             loadModels();
         } else {
             const error = await response.json();
-            showMessage('Upload failed: ' + error.error, 'error');
+            showMessage('Upload failed: ' + describeUploadError(error), 'error');
         }
     } catch (error) {
         showMessage('Upload error: ' + error.message, 'error');
@@ -134,8 +271,10 @@ async function loadArchives() {
 
 function displayArchives(arr) {
     const container = document.getElementById('archivesList');
+    const keyArchiveSelect = document.getElementById('apiKeyArchive');
+    keyArchiveSelect.innerHTML = '<option value="">(Semua)</option>';
     const select = document.getElementById('archiveSelect');
-    select.innerHTML = '<option value="">(None)</option>';
+    select.innerHTML = can('archives:manage') ? '<option value="">(None)</option>' : '';
     if (!arr || arr.length === 0) {
         container.innerHTML = '<p>Belum ada arsip</p>';
         return;
@@ -151,13 +290,36 @@ function displayArchives(arr) {
             <div class="archive-header">
                 <div>
                     <h3 style="margin:0">${a.name}</h3>
-                    <p style="margin:4px 0; color:var(--text-secondary)">TOKEN: <code>${a.token}</code></p>
                     <p style="margin:4px 0; color:var(--text-secondary)">Jumlah model: ${a.count}</p>
                 </div>
+                <button class="btn btn-secondary btn-small add-token-btn">Tambah Token</button>
             </div>
+            <div class="archive-tokens" style="margin-top:8px;"></div>
             <div class="archive-files" id="archive-files-${a.id}" style="display:none; margin-top:12px;"></div>
         `;
 
+        card.querySelector('.add-token-btn').addEventListener('click', async (e) => {
+            e.stopPropagation();
+            const name = prompt('Nama token (mis. "Klien A"):');
+            if (!name) return;
+            const expiresAt = prompt('Berlaku sampai (YYYY-MM-DD, kosongkan jika tanpa batas):') || '';
+            const maxLogins = parseInt(prompt('Batas login (0 = tanpa batas):') || '0', 10) || 0;
+            try {
+                const res = await createArchiveToken(a.id, name, expiresAt, maxLogins);
+                showSecretOnce(res.data.token);
+                showMessage('Token created', 'success');
+                loadArchives();
+            } catch (err) {
+                showMessage('Create token failed: ' + err.message, 'error');
+            }
+        });
+
+        if (can('archives:manage')) {
+            renderArchiveTokens(card.querySelector('.archive-tokens'), a.tokens || []);
+        } else {
+            card.querySelector('.add-token-btn').style.display = 'none';
+        }
+
         // make header clickable to toggle files
         const header = card.querySelector('.archive-header');
         header.style.cursor = 'pointer';
@@ -178,6 +340,76 @@ function displayArchives(arr) {
         opt.value = a.id;
         opt.textContent = a.name;
         select.appendChild(opt);
+        keyArchiveSelect.appendChild(opt.cloneNode(true));
+    });
+}
+
+// Token and API key secrets are only stored hashed, so this is the one chance to copy them
+function showSecretOnce(secret) {
+    prompt('Salin token ini sekarang. Token tidak akan ditampilkan lagi:', secret);
+}
+
+function renderArchiveTokens(container, tokens) {
+    if (tokens.length === 0) {
+        container.innerHTML = '<p style="margin:4px 0; color:var(--text-secondary)">Belum ada token</p>';
+        return;
+    }
+    tokens.forEach(t => {
+        const row = document.createElement('div');
+        row.style.display = 'flex';
+        row.style.justifyContent = 'space-between';
+        row.style.alignItems = 'center';
+        row.style.padding = '4px 0';
+
+        const info = document.createElement('div');
+        info.style.fontSize = '0.85rem';
+        info.style.color = 'var(--text-secondary)';
+        const status = t.revoked_at ? ' · DICABUT' : '';
+        info.innerHTML = `<strong>${t.name}</strong>: <code>…${t.token_hint}</code>${status}<br>
+            Berlaku sampai: ${t.expires_at ? new Date(t.expires_at).toLocaleString() : '-'} · Login: ${t.login_count}${t.max_logins ? ' / ' + t.max_logins : ''} · Terakhir dipakai: ${t.last_used_at ? new Date(t.last_used_at).toLocaleString() : '-'}`;
+        row.appendChild(info);
+
+        if (!t.revoked_at) {
+            const controls = document.createElement('div');
+            controls.style.display = 'flex';
+            controls.style.gap = '8px';
+
+            const rotateBtn = document.createElement('button');
+            rotateBtn.className = 'btn btn-secondary btn-small';
+            rotateBtn.textContent = 'Rotate';
+            rotateBtn.addEventListener('click', async (e) => {
+                e.stopPropagation();
+                if (!confirm('Rotate token? Token lama dan semua sesi viewer dari token ini akan langsung tidak berlaku.')) return;
+                try {
+                    const res = await rotateArchiveToken(t.id);
+                    showSecretOnce(res.data.token);
+                    showMessage('Token rotated', 'success');
+                    loadArchives();
+                } catch (err) {
+                    showMessage('Rotate failed: ' + err.message, 'error');
+                }
+            });
+
+            const revokeBtn = document.createElement('button');
+            revokeBtn.className = 'btn btn-danger btn-small';
+            revokeBtn.textContent = 'Cabut';
+            revokeBtn.addEventListener('click', async (e) => {
+                e.stopPropagation();
+                if (!confirm(`Cabut token "${t.name}"?`)) return;
+                try {
+                    await revokeArchiveToken(t.id);
+                    showMessage('Token revoked', 'success');
+                    loadArchives();
+                } catch (err) {
+                    showMessage('Revoke failed: ' + err.message, 'error');
+                }
+            });
+
+            controls.appendChild(rotateBtn);
+            controls.appendChild(revokeBtn);
+            row.appendChild(controls);
+        }
+        container.appendChild(row);
     });
 }
 
@@ -244,7 +476,7 @@ async function loadArchiveFiles(archiveId) {
             });
 
             controls.appendChild(viewBtn);
-            controls.appendChild(delBtn);
+            if (can('models:delete')) controls.appendChild(delBtn);
 
             row.appendChild(info);
             row.appendChild(controls);
@@ -281,7 +513,7 @@ async function loadArchiveFiles(archiveId) {
         });
 
         footer.appendChild(closeBtn);
-        footer.appendChild(delArchiveBtn);
+        if (can('archives:manage')) footer.appendChild(delArchiveBtn);
         filesContainer.appendChild(footer);
 
         currentOpenArchiveId = archiveId;
@@ -294,7 +526,8 @@ async function loadArchiveFiles(archiveId) {
 document.getElementById('createArchiveBtn').addEventListener('click', async () => {
     if (!confirm('Buat folder arsip baru?')) return;
     try {
-        await createArchive('');
+        const res = await createArchive('');
+        showSecretOnce(res.data.token);
         showMessage('Archive created', 'success');
         loadArchives();
         loadModels();
@@ -315,6 +548,89 @@ window._deleteArchive = async function(id) {
     }
 }
 
+// API keys act as the logged in user, limited to the chosen permissions
+function renderAPIKeyScopes() {
+    const container = document.getElementById('apiKeyScopes');
+    const perms = JSON.parse(localStorage.getItem('permissions') || '[]');
+    container.innerHTML = perms.map(p => `
+        <label style="display:inline-flex; gap:4px; margin-right:12px; font-weight:normal;">
+            <input type="checkbox" value="${p}" ${p === 'models:upload' ? 'checked' : ''}> ${p}
+        </label>
+    `).join('');
+}
+
+async function loadAPIKeys() {
+    const container = document.getElementById('apiKeysList');
+    try {
+        const res = await listAPIKeys();
+        if (res.data.length === 0) {
+            container.innerHTML = '<p style="color:var(--text-secondary)">Belum ada API key</p>';
+            return;
+        }
+        container.innerHTML = '';
+        res.data.forEach(k => {
+            const row = document.createElement('div');
+            row.style.display = 'flex';
+            row.style.justifyContent = 'space-between';
+            row.style.alignItems = 'center';
+            row.style.padding = '6px 0';
+
+            const info = document.createElement('div');
+            info.style.fontSize = '0.85rem';
+            info.style.color = 'var(--text-secondary)';
+            const status = k.revoked_at ? ' · DICABUT' : '';
+            info.innerHTML = `<strong>${k.name}</strong>: <code>…${k.key_hint}</code>${status}<br>
+                Izin: ${k.scopes.join(', ')}${k.archive_id ? ' · Arsip #' + k.archive_id : ''} · Berlaku sampai: ${k.expires_at ? new Date(k.expires_at).toLocaleString() : '-'} · Terakhir dipakai: ${k.last_used_at ? new Date(k.last_used_at).toLocaleString() : '-'}`;
+            row.appendChild(info);
+
+            if (!k.revoked_at) {
+                const revokeBtn = document.createElement('button');
+                revokeBtn.className = 'btn btn-danger btn-small';
+                revokeBtn.textContent = 'Cabut';
+                revokeBtn.addEventListener('click', async () => {
+                    if (!confirm(`Cabut API key "${k.name}"?`)) return;
+                    try {
+                        await revokeAPIKey(k.id);
+                        showMessage('API key revoked', 'success');
+                        loadAPIKeys();
+                    } catch (err) {
+                        showMessage('Revoke failed: ' + err.message, 'error');
+                    }
+                });
+                row.appendChild(revokeBtn);
+            }
+            container.appendChild(row);
+        });
+    } catch (err) {
+        console.error('Failed to load API keys', err);
+        container.innerHTML = '<p>Gagal memuat API key</p>';
+    }
+}
+
+document.getElementById('apiKeyForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    const scopes = [...document.querySelectorAll('#apiKeyScopes input:checked')].map(i => i.value);
+    if (scopes.length === 0) {
+        showMessage('Pilih minimal satu izin', 'error');
+        return;
+    }
+    try {
+        const res = await createAPIKey(
+            document.getElementById('apiKeyName').value,
+            scopes,
+            Number(document.getElementById('apiKeyArchive').value) || 0,
+            document.getElementById('apiKeyExpires').value
+        );
+        showSecretOnce(res.data.key);
+        showMessage('API key created', 'success');
+        e.target.reset();
+        renderAPIKeyScopes();
+        loadAPIKeys();
+    } catch (err) {
+        showMessage('Create API key failed: ' + err.message, 'error');
+    }
+});
+
 function showMessage(msg, type) {
     const messageDiv = document.getElementById('uploadMessage');
     messageDiv.textContent = msg;
@@ -329,4 +645,6 @@ function showMessage(msg, type) {
 checkAuth();
 loadModels();
 loadArchives();
+renderAPIKeyScopes();
+loadAPIKeys();
 setInterval(loadModels, 5000);
@@ -42,6 +42,9 @@ export async function loginUser(email, password) {
 
         const data = await response.json();
         
+        if (response.status === 429) {
+            throw new Error(`Terlalu banyak percobaan gagal, coba lagi dalam ${data.retry_after} detik`);
+        }
         if (!response.ok) {
             throw new Error(data.error || 'Login failed');
         }
@@ -54,6 +57,142 @@ export async function loginUser(email, password) {
     }
 }
 
+// SSO login through the configured OpenID Connect provider
+export const oidcLoginURL = `${API_URL}/auth/oidc/login`;
+
+export async function getOIDCConfig() {
+    try {
+        const response = await fetch(`${API_URL}/auth/oidc`);
+        if (!response.ok) return { enabled: false };
+        return await response.json();
+    } catch (e) {
+        return { enabled: false };
+    }
+}
+
+// Trade the one-time code from the SSO redirect for a session
+export async function exchangeOIDCCode(code) {
+    const response = await fetch(`${API_URL}/auth/oidc/exchange`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ code })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || 'SSO login failed');
+    }
+    return data;
+}
+
+// Exchange the stored refresh token for a new access/refresh pair.
+// Returns true when the session was renewed.
+let _refreshInFlight = null
+export async function refreshSession() {
+    const refreshToken = localStorage.getItem('refresh_token')
+    if (!refreshToken) return false
+    if (!_refreshInFlight) {
+        _refreshInFlight = (async () => {
+            try {
+                const res = await fetch(`${API_URL}/auth/refresh`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ refresh_token: refreshToken })
+                })
+                if (!res.ok) return false
+                const data = await res.json()
+                localStorage.setItem('token', data.token)
+                localStorage.setItem('refresh_token', data.refresh_token)
+                return true
+            } catch (e) {
+                console.error('[api] refresh failed', e)
+                return false
+            } finally {
+                _refreshInFlight = null
+            }
+        })()
+    }
+    return _refreshInFlight
+}
+
+// fetch with the stored access token; on 401 the session is refreshed once
+// and the request retried
+export async function authFetch(url, opts = {}) {
+    const withAuth = () => {
+        const headers = Object.assign({}, opts.headers)
+        const token = localStorage.getItem('token')
+        if (token) headers['Authorization'] = `Bearer ${token}`
+        return Object.assign({}, opts, { headers })
+    }
+    let res = await fetch(url, withAuth())
+    if (res.status === 401 && await refreshSession()) {
+        res = await fetch(url, withAuth())
+    }
+    return res
+}
+
+export function clearSession() {
+    localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
+    localStorage.removeItem('role')
+    localStorage.removeItem('user')
+    localStorage.removeItem('archive')
+}
+
+// Revoke the session on the server, then forget it locally
+export async function logoutUser() {
+    try {
+        if (localStorage.getItem('refresh_token')) {
+            await authFetch(`${API_URL}/auth/logout`, { method: 'POST' })
+        }
+    } catch (e) {
+        console.error('[api] logout request failed', e)
+    }
+    clearSession()
+}
+
+// Change the password of the logged in user. The server revokes every
+// session and returns a fresh one, which replaces the stored tokens.
+export async function changePassword(currentPassword, newPassword) {
+    const response = await authFetch(`${API_URL}/auth/password`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ current_password: currentPassword, new_password: newPassword })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || 'Failed to change password');
+    }
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refresh_token', data.refresh_token);
+    return data;
+}
+
+export async function requestPasswordReset(email) {
+    const response = await fetch(`${API_URL}/auth/password/forgot`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || 'Failed to request password reset');
+    }
+    return data;
+}
+
+export async function resetPassword(token, newPassword) {
+    const response = await fetch(`${API_URL}/auth/password/reset`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ token, new_password: newPassword })
+    });
+    const data = await response.json();
+    if (!response.ok) {
+        throw new Error(data.error || 'Failed to reset password');
+    }
+    return data;
+}
+
 function fetchWithTimeout(resource, options = {}) {
     const { timeout = 15000 } = options
     const controller = new AbortController()
@@ -66,7 +205,11 @@ function fetchWithTimeout(resource, options = {}) {
 async function doFetch(url, opts = {}) {
     console.log('[api] FETCH ->', url, opts && opts.method ? opts.method : 'GET')
     try {
-        const res = await fetchWithTimeout(url, opts)
+        let res = await fetchWithTimeout(url, opts)
+        if (res.status === 401 && opts.headers && opts.headers['Authorization'] && await refreshSession()) {
+            opts.headers['Authorization'] = `Bearer ${localStorage.getItem('token')}`
+            res = await fetchWithTimeout(url, opts)
+        }
         console.log('[api] RESPONSE <-', url, res && res.status)
         if (!res.ok) {
             const text = await res.text().catch(() => '')
@@ -75,10 +218,7 @@ async function doFetch(url, opts = {}) {
             if (res.status === 401) {
                 try {
                     console.warn('[api] Unauthorized - clearing local session')
-                    localStorage.removeItem('token')
-                    localStorage.removeItem('role')
-                    localStorage.removeItem('user')
-                    localStorage.removeItem('archive')
+                    clearSession()
                 } catch (e) {
                     console.error('[api] error clearing storage', e)
                 }
@@ -109,8 +249,86 @@ export async function getModels(archiveId) {
     return (data && data.data) || [];
 }
 
-export async function uploadModel(file, name, description) {
+// Thumbnails of archive models are served by the archive route, which needs
+// the Authorization header that an <img> cannot send; those are fetched and
+// shown through a blob URL. Fills every img[data-thumb-id] in container.
+export async function loadThumbnails(container, models) {
     const token = localStorage.getItem('token');
+    for (const img of container.querySelectorAll('img[data-thumb-id]')) {
+        const model = models.find(m => m.id === Number(img.dataset.thumbId));
+        if (!model || !model.thumbnail_url) continue;
+        const url = `http://localhost:8080${model.thumbnail_url}`;
+        if (!model.thumbnail_url.startsWith('/api/')) {
+            img.src = url;
+            continue;
+        }
+        try {
+            const resp = await fetch(url, { headers: token ? { Authorization: `Bearer ${token}` } : {} });
+            if (resp.ok) img.src = URL.createObjectURL(await resp.blob());
+        } catch (err) {
+            console.error('Error loading thumbnail', err);
+        }
+    }
+}
+
+// downloadFile saves a file the backend serves at path, like the source of a
+// converted model or an export. Archive files need the Authorization header
+// a plain link cannot send, so the file is fetched and saved through a blob
+// URL, under the name the server gives it if any.
+export async function downloadFile(path) {
+    const response = await authFetch(`http://localhost:8080${path}`);
+    if (!response.ok) {
+        const err = await response.json().catch(() => ({}));
+        throw new Error(err.error || 'Failed to download file');
+    }
+    const disposition = /filename="([^"]+)"/.exec(response.headers.get('Content-Disposition') || '');
+    const link = document.createElement('a');
+    link.href = URL.createObjectURL(await response.blob());
+    link.download = disposition ? disposition[1] : decodeURIComponent(path.split('?')[0].split('/').pop());
+    link.click();
+    setTimeout(() => URL.revokeObjectURL(link.href), 1000);
+}
+
+export async function regenerateThumbnail(id) {
+    const response = await authFetch(`${API_URL}/models/thumbnail`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to regenerate thumbnail');
+    }
+    return await response.json();
+}
+
+export async function optimizeModel(id) {
+    const response = await authFetch(`${API_URL}/models/optimize`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to queue optimization');
+    }
+    return await response.json();
+}
+
+export async function regenerateLODs(id) {
+    const response = await authFetch(`${API_URL}/models/lods`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to queue LOD generation');
+    }
+    return await response.json();
+}
+
+export async function uploadModel(file, name, description) {
     const formData = new FormData();
     formData.append('file', file);
     formData.append('name', name);
@@ -118,11 +336,8 @@ export async function uploadModel(file, name, description) {
     const archiveId = document.getElementById('archiveSelect') ? document.getElementById('archiveSelect').value : '';
     if (archiveId) formData.append('archive_id', archiveId);
 
-    const response = await fetch(`${API_URL}/models/upload`, {
+    const response = await authFetch(`${API_URL}/models/upload`, {
         method: 'POST',
-        headers: {
-            'Authorization': `Bearer ${token}`
-        },
         body: formData
     });
 
@@ -134,13 +349,98 @@ export async function uploadModel(file, name, description) {
     return await response.json();
 }
 
+// Large files go through the resumable upload API in chunks of this size
+const UPLOAD_CHUNK_SIZE = 8 * 1024 * 1024;
+const UPLOAD_RETRIES = 5;
+
+async function uploadError(response, fallback) {
+    const data = await response.json().catch(() => ({}));
+    return new Error(describeUploadError(data) || fallback);
+}
+
+// The error of a failed upload, with the first validation problems if the
+// server rejected the file content
+export function describeUploadError(data) {
+    const problems = (data.validation_errors || []).slice(0, 3)
+        .map(e => e.pointer ? `${e.pointer}: ${e.message}` : e.message);
+    return [data.error, ...problems].filter(Boolean).join('\n');
+}
+
+async function sha256Hex(file) {
+    // WebCrypto has no streaming digest, so the file is read in one go
+    const digest = await crypto.subtle.digest('SHA-256', await file.arrayBuffer());
+    return Array.from(new Uint8Array(digest)).map(b => b.toString(16).padStart(2, '0')).join('');
+}
+
+// Upload a file in chunks. An interrupted upload of the same file resumes
+// where it stopped, also after a page reload. onProgress gets the fraction
+// of bytes the server has.
+export async function uploadModelResumable(file, name, description, archiveId, onProgress = () => {}) {
+    const resumeKey = `upload:${file.name}:${file.size}:${file.lastModified}`;
+    let upload = null;
+
+    const savedId = localStorage.getItem(resumeKey);
+    if (savedId) {
+        const res = await authFetch(`${API_URL}/uploads?id=${encodeURIComponent(savedId)}`);
+        if (res.ok) upload = (await res.json()).data;
+        else localStorage.removeItem(resumeKey);
+    }
+    if (!upload) {
+        const body = { name, description, file_name: file.name, size: file.size, sha256: await sha256Hex(file) };
+        if (archiveId) body.archive_id = Number(archiveId);
+        const res = await authFetch(`${API_URL}/uploads`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw await uploadError(res, 'Upload failed');
+        upload = (await res.json()).data;
+        localStorage.setItem(resumeKey, upload.id);
+    }
+
+    let offset = upload.offset;
+    let failures = 0;
+    onProgress(offset / file.size);
+    while (offset < file.size) {
+        const chunk = file.slice(offset, offset + UPLOAD_CHUNK_SIZE);
+        let res;
+        try {
+            res = await authFetch(`${API_URL}/uploads?id=${encodeURIComponent(upload.id)}`, {
+                method: 'PATCH',
+                headers: { 'Content-Type': 'application/offset+octet-stream', 'Upload-Offset': String(offset) },
+                body: chunk
+            });
+        } catch (err) {
+            res = null; // network error; ask the server how far it got
+        }
+        if (res && res.ok) {
+            offset = Number(res.headers.get('Upload-Offset'));
+            failures = 0;
+            onProgress(offset / file.size);
+            continue;
+        }
+        if (res && res.status !== 409 && res.status < 500) {
+            throw await uploadError(res, 'Upload failed');
+        }
+        if (++failures > UPLOAD_RETRIES) throw new Error('Upload interrupted; try again to resume');
+        await new Promise(resolve => setTimeout(resolve, 1000 * 2 ** failures));
+        const status = await authFetch(`${API_URL}/uploads?id=${encodeURIComponent(upload.id)}`).catch(() => null);
+        if (status && status.ok) offset = (await status.json()).data.offset;
+    }
+
+    const res = await authFetch(`${API_URL}/uploads/complete`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id: upload.id })
+    });
+    if (res.status !== 409) localStorage.removeItem(resumeKey);
+    if (!res.ok) throw await uploadError(res, 'Upload failed');
+    return await res.json();
+}
+
 export async function createArchive(name) {
-    const token = localStorage.getItem('token');
-    const response = await fetch(`${API_URL}/archives`, {
+    const response = await authFetch(`${API_URL}/archives`, {
         method: 'POST',
-        headers: {
-            'Authorization': `Bearer ${token}`
-        },
         body: new URLSearchParams({ name: name || '' })
     });
     if (!response.ok) {
@@ -158,11 +458,9 @@ export async function listArchives() {
 }
 
 export async function deleteArchive(id) {
-    const token = localStorage.getItem('token');
-    const response = await fetch(`${API_URL}/archives`, {
+    const response = await authFetch(`${API_URL}/archives`, {
         method: 'DELETE',
         headers: {
-            'Authorization': `Bearer ${token}`,
             'Content-Type': 'application/json'
         },
         body: JSON.stringify({ id })
@@ -174,6 +472,81 @@ export async function deleteArchive(id) {
     return await response.json();
 }
 
+export async function createArchiveToken(archiveId, name, expiresAt, maxLogins) {
+    const response = await authFetch(`${API_URL}/archives/tokens`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ archive_id: archiveId, name, expires_at: expiresAt || '', max_logins: maxLogins || 0 })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to create token');
+    }
+    return await response.json();
+}
+
+export async function rotateArchiveToken(tokenId) {
+    const response = await authFetch(`${API_URL}/archives/tokens/rotate`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id: tokenId })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to rotate token');
+    }
+    return await response.json();
+}
+
+export async function revokeArchiveToken(tokenId) {
+    const response = await authFetch(`${API_URL}/archives/tokens`, {
+        method: 'DELETE',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id: tokenId })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to revoke token');
+    }
+    return await response.json();
+}
+
+// Personal API keys for scripts; the secret is only returned on creation
+export async function listAPIKeys() {
+    const response = await authFetch(`${API_URL}/keys`);
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to list API keys');
+    }
+    return await response.json();
+}
+
+export async function createAPIKey(name, scopes, archiveId, expiresAt) {
+    const response = await authFetch(`${API_URL}/keys`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ name, scopes, archive_id: archiveId || 0, expires_at: expiresAt || '' })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to create API key');
+    }
+    return await response.json();
+}
+
+export async function revokeAPIKey(id) {
+    const response = await authFetch(`${API_URL}/keys`, {
+        method: 'DELETE',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ id })
+    });
+    if (!response.ok) {
+        const err = await response.json();
+        throw new Error(err.error || 'Failed to revoke API key');
+    }
+    return await response.json();
+}
+
 export async function archiveLogin(tokenStr) {
     const response = await fetch(`${API_URL}/archives/login`, {
         method: 'POST',
@@ -182,18 +555,16 @@ export async function archiveLogin(tokenStr) {
     });
     if (!response.ok) {
         const err = await response.json();
+        if (response.status === 429) {
+            throw new Error(`Terlalu banyak percobaan gagal, coba lagi dalam ${err.retry_after} detik`);
+        }
         throw new Error(err.error || 'Login failed');
     }
     return await response.json();
 }
 
 export async function getUserProfile() {
-    const token = localStorage.getItem('token');
-    const response = await fetch(`${API_URL}/user/profile`, {
-        headers: {
-            'Authorization': `Bearer ${token}`
-        }
-    });
+    const response = await authFetch(`${API_URL}/user/profile`);
 
     if (!response.ok) {
         throw new Error('Failed to fetch user profile');
@@ -1,4 +1,4 @@
-import { loginUser, registerUser, archiveLogin } from './api.js';
+import { loginUser, registerUser, archiveLogin, requestPasswordReset, getOIDCConfig, exchangeOIDCCode, oidcLoginURL } from './api.js';
 
 window.toggleForm = function() {
     const loginForm = document.getElementById('loginForm');
@@ -17,6 +17,46 @@ function showMessage(msg, type) {
     }, 5000);
 }
 
+// Store the session from a login response and go to the page for the role
+function completeLogin(result) {
+    localStorage.setItem('token', result.token);
+    localStorage.setItem('refresh_token', result.refresh_token);
+    localStorage.setItem('user', JSON.stringify(result.user));
+    localStorage.setItem('role', result.role);
+    localStorage.setItem('permissions', JSON.stringify(result.permissions || []));
+
+    showMessage('Login berhasil!', 'success');
+
+    // Redirect based on role
+    setTimeout(() => {
+        if (result.role === 'admin' || result.role === 'editor') {
+            window.location.href = './admin.html';
+        } else {
+            window.location.href = './viewer.html';
+        }
+    }, 1000);
+}
+
+// The SSO callback sends the browser back here with ?oidc_code=... or ?oidc_error=...
+async function handleSSORedirect() {
+    const params = new URLSearchParams(window.location.search);
+    const code = params.get('oidc_code');
+    const error = params.get('oidc_error');
+    if (!code && !error) return false;
+    window.history.replaceState(null, '', window.location.pathname);
+    if (error) {
+        showMessage('Login SSO gagal: ' + error, 'error');
+        return false;
+    }
+    try {
+        completeLogin(await exchangeOIDCCode(code));
+        return true;
+    } catch (err) {
+        showMessage('Login SSO gagal: ' + err.message, 'error');
+        return false;
+    }
+}
+
 // Login form
 const loginForm = document.getElementById('form-login');
 if (loginForm) {
@@ -32,21 +72,7 @@ if (loginForm) {
         try {
             const result = await loginUser(email, password);
             console.log('Login successful:', result);
-            
-            localStorage.setItem('token', result.token);
-            localStorage.setItem('user', JSON.stringify(result.user));
-            localStorage.setItem('role', result.role);
-            
-            showMessage('Login berhasil!', 'success');
-            
-            // Redirect based on role
-            setTimeout(() => {
-                if (result.role === 'admin') {
-                    window.location.href = './admin.html';
-                } else {
-                    window.location.href = './viewer.html';
-                }
-            }, 1000);
+            completeLogin(result);
         } catch (error) {
             console.error('Login error:', error);
             showMessage('Login gagal: ' + error.message, 'error');
@@ -81,13 +107,49 @@ if (registerForm) {
     });
 }
 
+// Forgot password: swap the login form for the reset request form
+function showForgotForm(show) {
+    document.getElementById('loginForm').style.display = show ? 'none' : 'block';
+    document.getElementById('forgotForm').style.display = show ? 'block' : 'none';
+}
+
+const forgotLink = document.getElementById('forgotLink');
+if (forgotLink) {
+    forgotLink.addEventListener('click', (e) => { e.preventDefault(); showForgotForm(true); });
+    document.getElementById('backToLoginLink').addEventListener('click', (e) => { e.preventDefault(); showForgotForm(false); });
+}
+
+const forgotForm = document.getElementById('form-forgot');
+if (forgotForm) {
+    forgotForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+        const email = document.getElementById('forgot-email').value;
+        try {
+            await requestPasswordReset(email);
+            showMessage('Jika email terdaftar, link reset password telah dikirim.', 'success');
+            showForgotForm(false);
+        } catch (error) {
+            console.error('Forgot password error:', error);
+            showMessage('Gagal meminta reset password: ' + error.message, 'error');
+        }
+    });
+}
+
 // Check if already logged in
-window.addEventListener('DOMContentLoaded', () => {
+window.addEventListener('DOMContentLoaded', async () => {
     console.log('Page loaded');
+    if (await handleSSORedirect()) return;
+    const ssoBtn = document.getElementById('ssoLoginBtn');
+    getOIDCConfig().then(cfg => {
+        if (cfg.enabled) {
+            ssoBtn.href = oidcLoginURL;
+            ssoBtn.style.display = 'block';
+        }
+    });
     if (localStorage.getItem('token')) {
         console.log('Token found, redirecting...');
         const role = localStorage.getItem('role');
-        if (role === 'admin') {
+        if (role === 'admin' || role === 'editor') {
             window.location.href = './admin.html';
         } else {
             window.location.href = './viewer.html';
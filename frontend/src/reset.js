@@ -0,0 +1,35 @@
+import { resetPassword } from './api.js';
+
+function showMessage(msg, type) {
+    const messageDiv = document.getElementById('message');
+    messageDiv.textContent = msg;
+    messageDiv.className = `message ${type}`;
+    messageDiv.style.display = 'block';
+}
+
+// the token arrives as ?token=... in the link from the reset mail
+const token = new URLSearchParams(window.location.search).get('token');
+const form = document.getElementById('form-reset');
+
+if (!token) {
+    form.style.display = 'none';
+    showMessage('Link reset tidak valid. Minta link baru dari halaman login.', 'error');
+}
+
+form.addEventListener('submit', async (e) => {
+    e.preventDefault();
+    const password = document.getElementById('new-password').value;
+    if (password !== document.getElementById('confirm-password').value) {
+        showMessage('Password baru tidak sama', 'error');
+        return;
+    }
+    try {
+        await resetPassword(token, password);
+        form.style.display = 'none';
+        showMessage('Password berhasil direset. Mengalihkan ke halaman login...', 'success');
+        setTimeout(() => { window.location.href = './index.html'; }, 2000);
+    } catch (err) {
+        console.error('Reset password error:', err);
+        showMessage('Reset password gagal: ' + err.message, 'error');
+    }
+});
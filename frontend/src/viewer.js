@@ -1,7 +1,13 @@
 import * as THREE from 'three';
 import { GLTFLoader } from 'three/examples/jsm/loaders/GLTFLoader.js';
 import { OrbitControls } from 'three/examples/jsm/controls/OrbitControls.js';
-import { getModels } from './api.js';
+import { MeshoptDecoder } from 'three/examples/jsm/libs/meshopt_decoder.module.js';
+import { getModels, logoutUser, changePassword, loadThumbnails, downloadFile } from './api.js';
+
+window.logout = async function() {
+    await logoutUser();
+    window.location.href = './index.html';
+};
 
 let scene, camera, renderer, controls, currentModel;
 let models = [];
@@ -10,6 +16,24 @@ let isAnimating = false;
 let prevCameraPos = null;
 let prevTarget = null;
 
+// Change the password; the server signs out every other session
+window.changePassword = async function() {
+    const current = prompt('Password saat ini:');
+    if (!current) return;
+    const next = prompt('Password baru (minimal 6 karakter):');
+    if (!next) return;
+    if (prompt('Ulangi password baru:') !== next) {
+        alert('Password baru tidak sama');
+        return;
+    }
+    try {
+        await changePassword(current, next);
+        alert('Password berhasil diganti. Sesi di perangkat lain telah dikeluarkan.');
+    } catch (err) {
+        alert('Gagal mengganti password: ' + err.message);
+    }
+};
+
 // Check auth
 function checkAuth() {
     const token = localStorage.getItem('token');
@@ -30,6 +54,9 @@ function checkAuth() {
         const arch = JSON.parse(archStr);
         const el = document.getElementById('userEmail');
         if (el) el.textContent = arch.name || arch.token || 'Archive User';
+        // archive sessions have no password of their own
+        const pwBtn = document.getElementById('changePasswordBtn');
+        if (pwBtn) pwBtn.style.display = 'none';
     } else {
         // unknown role -> redirect
         window.location.href = './index.html';
@@ -275,10 +302,12 @@ function displayModelsList(modelsList) {
     const container = document.getElementById('modelList');
     container.innerHTML = modelsList.map(model => `
         <div class="model-item" onclick="selectModel(${model.id})">
+            <img class="model-thumb" data-thumb-id="${model.id}" alt="">
             <h4>${model.name}</h4>
-            <p>${(model.file_size / 1024).toFixed(2)} KB</p>
+            <p>${(modelFile(model).size / 1024).toFixed(2)} KB</p>
         </div>
     `).join('');
+    loadThumbnails(container, modelsList);
 }
 
 // Export selectModel for global use
@@ -290,98 +319,210 @@ window._selectModelFn = function(id) {
     }
 };
 
+// The optimized variant is a smaller GLB the server makes of some models;
+// models without one are shown from the original file
+const VARIANT_KEY = 'modelVariant';
+
+function modelFile(model) {
+    if (localStorage.getItem(VARIANT_KEY) === 'optimized' && model.optimized_url) {
+        return { url: model.optimized_url, size: model.optimized_size, optimized: true };
+    }
+    return { url: model.file_url, size: model.file_size, optimized: false };
+}
+
+function initVariantSelect() {
+    const select = document.getElementById('variantSelect');
+    select.value = localStorage.getItem(VARIANT_KEY) || 'original';
+    select.addEventListener('change', () => {
+        localStorage.setItem(VARIANT_KEY, select.value);
+        displayModelsList(models);
+        if (shownModel) loadModel(shownModel);
+    });
+}
+
+let shownModel = null;
+// loads of a model still running stop once another one is selected
+let loadSeq = 0;
+
+// Fetch a model file with the Authorization header (supports archive tokens)
+// and parse it with GLTFLoader
+async function fetchGLTF(fileUrl) {
+    const token = localStorage.getItem('token');
+    const headers = {};
+    if (token) headers['Authorization'] = `Bearer ${token}`;
+    const resp = await fetch(fileUrl, { headers });
+    if (!resp.ok) throw new Error('Failed to fetch model: ' + resp.statusText);
+    const arrayBuffer = await resp.arrayBuffer();
+    // buffers and textures of a multi-file .gltf sit next to it and
+    // need the same Authorization header
+    const loader = new GLTFLoader();
+    loader.setRequestHeader(headers);
+    // optimized variants and LODs store their geometry with EXT_meshopt_compression
+    loader.setMeshoptDecoder(MeshoptDecoder);
+    const resourcePath = fileUrl.slice(0, fileUrl.lastIndexOf('/') + 1);
+    return new Promise((resolve, reject) => loader.parse(arrayBuffer, resourcePath, resolve, reject));
+}
+
+function disposeModel(object) {
+    object.traverse((node) => {
+        if (!node.isMesh) return;
+        node.geometry.dispose();
+        const materials = Array.isArray(node.material) ? node.material : [node.material];
+        materials.forEach((m) => {
+            Object.values(m).forEach((v) => { if (v && v.isTexture) v.dispose(); });
+            m.dispose();
+        });
+    });
+}
+
+// Put a loaded scene in place of the shown one
+function showScene(object) {
+    if (currentModel) {
+        scene.remove(currentModel);
+        disposeModel(currentModel);
+    }
+    currentModel = object;
+
+    // Make sure model is visible
+    currentModel.traverse((node) => {
+        if (node.isMesh) {
+            node.castShadow = true;
+            node.receiveShadow = true;
+        }
+    });
+    scene.add(currentModel);
+}
+
+// Frame the shown model with the camera
+function fitCamera() {
+    const box = new THREE.Box3().setFromObject(currentModel);
+    const center = box.getCenter(new THREE.Vector3());
+    const size = box.getSize(new THREE.Vector3());
+
+    console.log('Model box:', { center, size });
+
+    const maxDim = Math.max(size.x, size.y, size.z);
+    const fov = camera.fov * (Math.PI / 180);
+    let cameraZ = Math.abs(maxDim / 2 / Math.tan(fov / 2));
+    cameraZ *= 1.5;
+
+    // adjust camera clipping planes to avoid near-plane clipping when zooming
+    // use a smaller near plane so users can zoom closer into components
+    camera.near = Math.max(0.0001, maxDim / 10000);
+    camera.far = Math.max(1000, cameraZ * 20);
+    camera.updateProjectionMatrix();
+
+    // position camera to frame the model
+    camera.position.copy(center);
+    camera.position.z += cameraZ;
+
+    // adjust controls distances to sensible ranges based on model size
+    // allow very close zooming by default; clamp to a small minimum
+    controls.target.copy(center);
+    controls.minDistance = Math.max(0.0001, maxDim * 0.001);
+    controls.maxDistance = Math.max(cameraZ * 2, maxDim * 50);
+    controls.screenSpacePanning = false;
+    controls.update();
+
+    console.log('Camera positioned at:', camera.position);
+}
+
+function showModelInfo(model, file, lod) {
+    document.getElementById('modelTitle').textContent = model.name;
+    document.getElementById('modelDesc').textContent = model.description || 'No description';
+    let sizeInfo = `${(file.size / 1024).toFixed(2)} KB`;
+    if (file.optimized) {
+        sizeInfo += ` (teroptimasi, asli ${(model.file_size / 1024).toFixed(2)} KB)`;
+    }
+    let info = `Uploaded by: ${model.uploaded_by} | Size: ${sizeInfo}`;
+    if (lod) {
+        info += ` | Pratinjau LOD ${lod.level} (${lod.triangles.toLocaleString()} segitiga), memuat detail penuh...`;
+    }
+    document.getElementById('modelInfo').textContent = info;
+    document.getElementById('info-panel').style.display = 'block';
+}
+
+// Download the shown model as STL, OBJ or PLY; the server converts and
+// caches it
+window.exportModel = async function() {
+    if (!shownModel) return;
+    const params = new URLSearchParams({
+        id: shownModel.id,
+        format: document.getElementById('exportFormat').value,
+        units: document.getElementById('exportUnits').value,
+        up: document.getElementById('exportUp').value
+    });
+    try {
+        await downloadFile(`/api/models/export?${params}`);
+    } catch (err) {
+        alert('Gagal mengekspor model: ' + err.message);
+    }
+};
+
+// Heavy models come with simplified levels of detail. The coarsest one is
+// shown first and replaced by finer ones, then by the full file, as they
+// arrive, so the viewer stays responsive while the model streams in.
 function loadModel(model) {
     console.log('Loading model:', model);
-    document.getElementById('loadingIndicator').style.display = 'block';
-    
-    const loader = new GLTFLoader();
-    
+    shownModel = model;
+    const seq = ++loadSeq;
+    const indicator = document.getElementById('loadingIndicator');
+    indicator.textContent = 'Loading model...';
+    indicator.style.display = 'block';
+
     // Remove existing model
     if (currentModel) {
         scene.remove(currentModel);
+        disposeModel(currentModel);
         currentModel = null;
     }
 
-    const fileUrl = `http://localhost:8080${model.file_url}`;
-    console.log('Requesting file from:', fileUrl);
+    const file = modelFile(model);
+    const steps = [...(model.lods || [])].reverse().map((lod) => ({ url: lod.file_url, lod }));
+    steps.push({ url: file.url, lod: null });
 
-    // Use fetch with Authorization header (supports archive tokens) then parse with GLTFLoader
     (async () => {
-        try {
-            const token = localStorage.getItem('token');
-            const headers = {};
-            if (token) headers['Authorization'] = `Bearer ${token}`;
-            const resp = await fetch(fileUrl, { headers });
-            if (!resp.ok) throw new Error('Failed to fetch model: ' + resp.statusText);
-            const arrayBuffer = await resp.arrayBuffer();
-            loader.parse(arrayBuffer, '', (gltf) => {
-                console.log('Model loaded successfully via fetch+parse:', gltf);
-                currentModel = gltf.scene;
-            
-            // Make sure model is visible
-            currentModel.traverse((node) => {
-                if (node.isMesh) {
-                    node.castShadow = true;
-                    node.receiveShadow = true;
-                    console.log('Mesh found:', node.name);
+        let fitted = false;
+        for (const step of steps) {
+            const fileUrl = `http://localhost:8080${step.url}`;
+            console.log('Requesting file from:', fileUrl);
+            let gltf;
+            try {
+                gltf = await fetchGLTF(fileUrl);
+            } catch (err) {
+                if (seq !== loadSeq) return;
+                if (step.lod) {
+                    // a missing preview only costs the quick first look
+                    console.warn(`Error loading LOD ${step.lod.level}:`, err);
+                    continue;
                 }
-            });
-            
-            scene.add(currentModel);
-            console.log('Model added to scene');
-
-            // Auto-fit camera
-            const box = new THREE.Box3().setFromObject(currentModel);
-            const center = box.getCenter(new THREE.Vector3());
-            const size = box.getSize(new THREE.Vector3());
-            
-            console.log('Model box:', { center, size });
-            
-            const maxDim = Math.max(size.x, size.y, size.z);
-            const fov = camera.fov * (Math.PI / 180);
-            let cameraZ = Math.abs(maxDim / 2 / Math.tan(fov / 2));
-            cameraZ *= 1.5;
-
-            // adjust camera clipping planes to avoid near-plane clipping when zooming
-            // use a smaller near plane so users can zoom closer into components
-            camera.near = Math.max(0.0001, maxDim / 10000);
-            camera.far = Math.max(1000, cameraZ * 20);
-            camera.updateProjectionMatrix();
-
-            // position camera to frame the model
-            camera.position.copy(center);
-            camera.position.z += cameraZ;
-
-            // adjust controls distances to sensible ranges based on model size
-            // allow very close zooming by default; clamp to a small minimum
-            controls.target.copy(center);
-            controls.minDistance = Math.max(0.0001, maxDim * 0.001);
-            controls.maxDistance = Math.max(cameraZ * 2, maxDim * 50);
-            controls.screenSpacePanning = false;
-            controls.update();
-
-            console.log('Camera positioned at:', camera.position);
+                console.error('Error loading model:', err);
+                indicator.textContent = 'Error loading model: ' + (err.message || err);
+                indicator.style.display = 'block';
+                return;
+            }
+            if (seq !== loadSeq) {
+                disposeModel(gltf.scene);
+                return;
+            }
 
-            // Update info
-            document.getElementById('modelTitle').textContent = model.name;
-            document.getElementById('modelDesc').textContent = model.description || 'No description';
-            document.getElementById('modelInfo').textContent = `Uploaded by: ${model.uploaded_by} | Size: ${(model.file_size / 1024).toFixed(2)} KB`;
-            document.getElementById('info-panel').style.display = 'block';
-            document.getElementById('loadingIndicator').style.display = 'none';
-            
-            console.log('Model rendering complete');
-            }, (error) => {
-                console.error('Error parsing model:', error);
-                document.getElementById('loadingIndicator').textContent = 'Error loading model: ' + (error.message || error);
-            });
-        } catch (err) {
-            console.error('Error loading model via fetch:', err);
-            document.getElementById('loadingIndicator').textContent = 'Error loading model: ' + err.message;
+            console.log('Model loaded successfully:', step.lod ? `LOD ${step.lod.level}` : 'full detail');
+            showScene(gltf.scene);
+            if (!fitted) {
+                // later levels share the bounds; refitting would undo the
+                // user's orbiting
+                fitCamera();
+                fitted = true;
+            }
+            showModelInfo(model, file, step.lod);
+            indicator.style.display = 'none';
         }
+        console.log('Model rendering complete');
     })();
 }
 
 // Initialize
 checkAuth();
 initThreeJS();
+initVariantSelect();
 loadModelsList();
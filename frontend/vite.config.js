@@ -17,7 +17,8 @@ export default defineConfig({
       input: {
         main: 'index.html',
         admin: 'admin.html',
-        viewer: 'viewer.html'
+        viewer: 'viewer.html',
+        reset: 'reset.html'
       }
     }
   }